@@ -0,0 +1,203 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// AuditLog records the routing changes, those requested through the API
+// are recorded by the handlers.
+type AuditLog interface {
+	Record(e router.AuditEntry) error
+	// Query returns the matching entries, the newest first
+	Query(q router.AuditQuery) ([]router.AuditEntry, error)
+}
+
+// defaultAuditLimit limits the entries returned by GetAudit without limit.
+const defaultAuditLimit = 100
+
+// SetAuditLog records all routing changes and enables GetAudit.
+func (s *Server) SetAuditLog(a AuditLog) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auditLog = a
+}
+
+type auditResp struct {
+	Time     string `json:"time"`
+	ClientIP string `json:"client_ip"`
+	User     string `json:"user,omitempty"`
+	Auth     string `json:"auth"`
+	Action   string `json:"action"`
+	MAC      string `json:"mac,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Name     string `json:"name,omitempty"`
+	Group    string `json:"group,omitempty"`
+	OldTable string `json:"old_table"`
+	NewTable string `json:"new_table"`
+	Until    string `json:"until,omitempty"`
+	Result   string `json:"result"`
+}
+
+func auditToResp(e router.AuditEntry) auditResp {
+	resp := auditResp{
+		Time:     e.Time.Format(time.RFC3339),
+		ClientIP: e.ClientIP,
+		User:     e.User,
+		Auth:     e.Auth,
+		Action:   e.Action,
+		MAC:      e.MAC,
+		IP:       e.IP,
+		Name:     e.Name,
+		Group:    e.Group,
+		OldTable: e.OldTable,
+		NewTable: e.NewTable,
+		Result:   e.Result,
+	}
+	if e.Until != nil {
+		resp.Until = e.Until.Format(time.RFC3339)
+	}
+	return resp
+}
+
+// hostAudit returns the entry of a change of the host using ip, described by the routes before.
+func hostAudit(before []router.Route, action string, ip string, table string) router.AuditEntry {
+	e := router.AuditEntry{Action: action, IP: ip, NewTable: table}
+	if route, found := routeByIP(before, ip); found {
+		e.MAC = route.Lease.MAC
+		e.Name = route.Lease.Name
+		e.OldTable = route.Table
+	}
+	return e
+}
+
+// groupAudit returns the entry of a change of the table of a group.
+func (s *Server) groupAudit(name string, table string) router.AuditEntry {
+	e := router.AuditEntry{Action: "group", Group: name, NewTable: table}
+	gs, _ := s.router.Groups()
+	for _, g := range gs {
+		if g.Name == name {
+			e.OldTable = g.Table
+		}
+	}
+	return e
+}
+
+// recordAudit records the changes requested by the client of r, err is their result.
+func (s *Server) recordAudit(r *http.Request, err error, entries ...router.AuditEntry) {
+	s.mu.RLock()
+	a := s.auditLog
+	s.mu.RUnlock()
+	if a == nil {
+		return
+	}
+	c := s.client(r)
+	if c.Auth == "" {
+		c.Auth = "self"
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	now := time.Now()
+	for _, e := range entries {
+		e.Time = now
+		e.ClientIP = c.IP
+		e.User = c.User
+		e.Auth = c.Auth
+		e.Result = result
+		if err := a.Record(e); err != nil {
+			log.Printf("Audit/Error: %s", err)
+		}
+	}
+}
+
+// isHost returns true if host is the MAC, an address or the name of the host of route.
+func isHost(route router.Route, host string) bool {
+	return strings.EqualFold(host, route.Lease.MAC) || host == route.IP || route.Lease.HasAddr(host) || host == route.Lease.Name
+}
+
+// GetAudit returns the recorded changes, the newest first, filtered by the query
+// parameters host (MAC, IP or name), user, since and until (RFC3339) and limit.
+// Unauthorized clients only get the changes of their own host.
+func (s *Server) GetAudit(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	s.mu.RLock()
+	a := s.auditLog
+	s.mu.RUnlock()
+	if a == nil {
+		sendError(w, http.StatusNotImplemented, "501", "Audit log not available")
+		return
+	}
+	params := r.URL.Query()
+	q := router.AuditQuery{
+		Host:  params.Get("host"),
+		User:  params.Get("user"),
+		Limit: defaultAuditLimit,
+	}
+	for _, p := range []struct {
+		name string
+		t    *time.Time
+	}{{"since", &q.Since}, {"until", &q.Until}} {
+		v := params.Get(p.name)
+		if v == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			sendError(w, http.StatusBadRequest, "400", "Invalid time")
+			return
+		}
+		*p.t = t
+	}
+	if v := params.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			sendError(w, http.StatusBadRequest, "400", "Invalid limit")
+			return
+		}
+		q.Limit = limit
+	}
+
+	if s.client(r).Auth == "" {
+		rs, err := s.router.Routes()
+		if err != nil {
+			sendError(w, http.StatusInternalServerError, "500", "Could not get routes")
+			return
+		}
+		route, found := routeByIP(rs, parseIP(r.RemoteAddr))
+		if !found || (q.Host != "" && !isHost(route, q.Host)) {
+			sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+			return
+		}
+		q.Host = route.Lease.MAC
+		if q.Host == "" {
+			q.Host = route.IP
+		}
+	}
+
+	entries, err := a.Query(q)
+	if err != nil {
+		log.Printf("GetAudit/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not read audit log")
+		return
+	}
+	resps := make([]auditResp, 0, len(entries))
+	for _, e := range entries {
+		resps = append(resps, auditToResp(e))
+	}
+	t := struct {
+		Data []auditResp `json:"data"`
+	}{
+		Data: resps,
+	}
+	if err := json.NewEncoder(w).Encode(&t); err != nil {
+		sendError(w, http.StatusInternalServerError, "500", "Could not read audit log")
+	}
+}
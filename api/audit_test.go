@@ -0,0 +1,153 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockAudit struct {
+	entries []router.AuditEntry
+	query   router.AuditQuery
+}
+
+func (m *mockAudit) Record(e router.AuditEntry) error {
+	m.entries = append(m.entries, e)
+	return nil
+}
+
+func (m *mockAudit) Query(q router.AuditQuery) ([]router.AuditEntry, error) {
+	m.query = q
+	return m.entries, nil
+}
+
+func TestAuditSetRoute(t *testing.T) {
+	assert := assert.New(t)
+	routes := []router.Route{
+		{IP: "127.0.0.1", Table: "table1", Lease: router.Host{MAC: "abc", IP: "127.0.0.1", Name: "pc1"}},
+	}
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return routes, nil
+		},
+		setRouteFn: func(ip, table string) error {
+			if ip != routes[0].IP {
+				return errors.New("rule failed")
+			}
+			routes[0].Table = table
+			return nil
+		},
+	}
+	audit := &mockAudit{}
+	server := NewServer(mock, NewTokenAuth("token"), testTables)
+	server.SetAuditLog(audit)
+	post := func(remote, token, body string) int {
+		req, err := http.NewRequest("POST", "http://127.0.0.1/api/routes", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.SetRoute(w, req)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusOK, post("127.0.0.1:6000", "", `{"data":{"ip":"127.0.0.1","table":"table2"}}`))
+	assert.Equal(http.StatusUnauthorized, post("127.0.0.2:6000", "", `{"data":{"ip":"127.0.0.1","table":"table3"}}`))
+	assert.Equal(http.StatusInternalServerError, post("127.0.0.2:6000", "token", `{"data":{"ip":"127.0.0.3","table":"table3"}}`))
+
+	if assert.Len(audit.entries, 2, "Unauthorized requests change nothing") {
+		e := audit.entries[0]
+		assert.False(e.Time.IsZero())
+		e.Time = time.Time{}
+		assert.Equal(router.AuditEntry{
+			ClientIP: "127.0.0.1",
+			Auth:     "self",
+			Action:   "set",
+			MAC:      "abc",
+			IP:       "127.0.0.1",
+			Name:     "pc1",
+			OldTable: "table1",
+			NewTable: "table2",
+			Result:   "ok",
+		}, e)
+		e = audit.entries[1]
+		assert.Equal("token", e.Auth)
+		assert.Equal("127.0.0.3", e.IP)
+		assert.Equal("", e.OldTable)
+		assert.Equal("rule failed", e.Result)
+	}
+}
+
+func TestGetAudit(t *testing.T) {
+	assert := assert.New(t)
+	until := time.Date(2026, 10, 16, 21, 0, 0, 0, time.UTC)
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return []router.Route{
+				{IP: "127.0.0.1", Table: "vpn", Lease: router.Host{MAC: "abc", IP: "127.0.0.1", Name: "pc1"}},
+			}, nil
+		},
+	}
+	audit := &mockAudit{entries: []router.AuditEntry{{
+		Time:     time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC),
+		ClientIP: "127.0.0.9",
+		User:     "admin",
+		Auth:     "basic",
+		Action:   "set",
+		MAC:      "abc",
+		IP:       "127.0.0.1",
+		Name:     "pc1",
+		NewTable: "vpn",
+		Until:    &until,
+		Result:   "ok",
+	}}}
+	server := NewServer(mock, NewTokenAuth("token"), testTables)
+	get := func(remote, token, query string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://127.0.0.1/api/audit?"+query, nil)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.GetAudit(w, req)
+		return w
+	}
+
+	assert.Equal(http.StatusNotImplemented, get("127.0.0.1:6000", "", "").Code)
+	server.SetAuditLog(audit)
+
+	w := get("127.0.0.1:6000", "", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"time":"2026-10-16T20:00:00Z","client_ip":"127.0.0.9","user":"admin","auth":"basic","action":"set","mac":"abc","ip":"127.0.0.1","name":"pc1","old_table":"","new_table":"vpn","until":"2026-10-16T21:00:00Z","result":"ok"}]}`,
+		strings.TrimSpace(w.Body.String()))
+	assert.Equal(router.AuditQuery{Host: "abc", Limit: defaultAuditLimit}, audit.query, "Own host only")
+
+	assert.Equal(http.StatusOK, get("127.0.0.1:6000", "", "host=pc1").Code)
+	assert.Equal(http.StatusUnauthorized, get("127.0.0.1:6000", "", "host=def").Code, "Other host")
+	assert.Equal(http.StatusUnauthorized, get("127.0.0.2:6000", "", "").Code, "Unknown host")
+
+	w = get("127.0.0.2:6000", "token", "host=def&user=admin&since=2026-10-16T00:00:00Z&limit=5")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(router.AuditQuery{
+		Host:  "def",
+		User:  "admin",
+		Since: time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC),
+		Limit: 5,
+	}, audit.query)
+
+	assert.Equal(http.StatusBadRequest, get("127.0.0.2:6000", "token", "until=yesterday").Code)
+	assert.Equal(http.StatusBadRequest, get("127.0.0.2:6000", "token", "limit=0").Code)
+}
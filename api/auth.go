@@ -1,6 +1,7 @@
 package api
 
 import (
+	"context"
 	"encoding/base64"
 	"net/http"
 	"strings"
@@ -85,6 +86,35 @@ func authHelper(token string) string {
 	return "Bearer " + base64.StdEncoding.EncodeToString([]byte(token))
 }
 
+// AnyAuth authorizes a request if any of its providers does.
+type AnyAuth []AuthProvider
+
+func (a AnyAuth) Auth(r *http.Request) bool {
+	for _, p := range a {
+		if p.Auth(r) {
+			return true
+		}
+	}
+	return false
+}
+
+type localKey struct{}
+
+// LocalHandler marks all requests as local, e.g. requests from a unix socket.
+func LocalHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), localKey{}, true)))
+	})
+}
+
+// LocalAuth authorizes all requests marked by LocalHandler.
+type LocalAuth struct{}
+
+func (LocalAuth) Auth(r *http.Request) bool {
+	local, _ := r.Context().Value(localKey{}).(bool)
+	return local
+}
+
 type IPAuth map[string]struct{}
 
 func NewIPAuth(ips ...string) IPAuth {
@@ -96,13 +126,38 @@ func NewIPAuth(ips ...string) IPAuth {
 }
 
 func (a IPAuth) Auth(r *http.Request) bool {
-	parts := strings.SplitN(r.RemoteAddr, ":", 2)
-	if len(parts) == 0 {
-		return false
-	}
-
-	if _, ok := a[parts[0]]; ok {
+	if _, ok := a[parseIP(r.RemoteAddr)]; ok {
 		return true
 	}
 	return false
 }
+
+// authName returns the name of the provider authorizing r, empty if none does.
+// Providers of an AnyAuth are named individually.
+func authName(p AuthProvider, r *http.Request) string {
+	if p == nil {
+		return ""
+	}
+	if anyAuth, ok := p.(AnyAuth); ok {
+		for _, sub := range anyAuth {
+			if name := authName(sub, r); name != "" {
+				return name
+			}
+		}
+		return ""
+	}
+	if !p.Auth(r) {
+		return ""
+	}
+	switch p.(type) {
+	case BasicAuth:
+		return "basic"
+	case *TokenAuth:
+		return "token"
+	case IPAuth:
+		return "ip"
+	case LocalAuth:
+		return "local"
+	}
+	return "other"
+}
@@ -3,6 +3,7 @@ package api
 import (
 	"encoding/base64"
 	"net/http"
+	"net/http/httptest"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -37,13 +38,42 @@ func TestBasicAuth(t *testing.T) {
 
 func TestIPAuth(t *testing.T) {
 	assert := assert.New(t)
-	var a AuthProvider = NewIPAuth("127.0.0.1", "127.0.1.1")
+	var a AuthProvider = NewIPAuth("127.0.0.1", "127.0.1.1", "::1")
 	assert.True(a.Auth(requestWithRemoteAddr("127.0.0.1")))
 	assert.True(a.Auth(requestWithRemoteAddr("127.0.1.1")))
 	assert.False(a.Auth(requestWithRemoteAddr("127.0.2.2")))
 	assert.False(a.Auth(requestWithRemoteAddr("192.168.0.1")))
 	assert.False(a.Auth(requestWithRemoteAddr("")))
+	assert.True(a.Auth(requestWithRemoteAddr("[::1]")))
+	assert.False(a.Auth(requestWithRemoteAddr("[::2]")))
 }
+func TestAnyAuth(t *testing.T) {
+	assert := assert.New(t)
+	var a AuthProvider = AnyAuth{NewTokenAuth("123"), NewIPAuth("127.0.0.1")}
+	assert.True(a.Auth(requestWithAuthHeader("Bearer", "123")))
+	assert.True(a.Auth(requestWithRemoteAddr("127.0.0.1")))
+	assert.False(a.Auth(requestWithAuthHeader("Bearer", "abc")))
+	assert.False(AnyAuth{}.Auth(requestWithRemoteAddr("127.0.0.1")))
+
+	assert.Equal("token", authName(a, requestWithAuthHeader("Bearer", "123")))
+	assert.Equal("ip", authName(a, requestWithRemoteAddr("127.0.0.1")))
+	assert.Equal("", authName(a, requestWithAuthHeader("Bearer", "abc")))
+	assert.Equal("basic", authName(NewBasicAuth(map[string]string{"user": "pass"}), requestWithAuthHeader("Basic", "user:pass")))
+}
+
+func TestLocalAuth(t *testing.T) {
+	assert := assert.New(t)
+	var a AuthProvider = LocalAuth{}
+	assert.False(a.Auth(requestWithRemoteAddr("127.0.0.1")))
+
+	var authd bool
+	h := LocalHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authd = a.Auth(r)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), requestWithRemoteAddr(""))
+	assert.True(authd)
+}
+
 func requestWithAuthHeader(method string, content string) *http.Request {
 	r, err := http.NewRequest("GET", "http://127.0.0.1", nil)
 	if err != nil {
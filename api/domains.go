@@ -0,0 +1,122 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/zenazn/goji/web"
+)
+
+// DomainPolicyProvider manages the tables traffic to domains is routed through.
+type DomainPolicyProvider interface {
+	DomainPolicies() []router.DomainPolicy
+	SetDomainPolicy(p router.DomainPolicy) error
+	DeleteDomainPolicy(domain string) error
+}
+
+// SetDomainPolicyProvider enables the domain policy handlers.
+func (s *Server) SetDomainPolicyProvider(p DomainPolicyProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.domain = p
+}
+
+type domainPolicyResp struct {
+	Domain string `json:"domain"`
+	Table  string `json:"table"`
+}
+
+// domainPolicies returns the provider, sending an error if there is none.
+func (s *Server) domainPolicies(w http.ResponseWriter) (DomainPolicyProvider, bool) {
+	s.mu.RLock()
+	p := s.domain
+	s.mu.RUnlock()
+	if p == nil {
+		sendError(w, http.StatusNotImplemented, "501", "Domain policies not supported")
+		return nil, false
+	}
+	return p, true
+}
+
+func (s *Server) GetDomainPolicies(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	p, ok := s.domainPolicies(w)
+	if !ok {
+		return
+	}
+	policies := p.DomainPolicies()
+	resps := make([]domainPolicyResp, 0, len(policies))
+	for _, dp := range policies {
+		resps = append(resps, domainPolicyResp{Domain: dp.Domain, Table: dp.Table})
+	}
+	t := struct {
+		Data []domainPolicyResp `json:"data"`
+	}{
+		Data: resps,
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+type domainPolicyReq struct {
+	Data struct {
+		Table string
+	} `json:"data"`
+}
+
+// SetDomainPolicy routes the domain named in the URL through a table.
+func (s *Server) SetDomainPolicy(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	p, ok := s.domainPolicies(w)
+	if !ok {
+		return
+	}
+	var req domainPolicyReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := p.SetDomainPolicy(router.DomainPolicy{Domain: c.URLParams["domain"], Table: req.Data.Table}); err != nil {
+		sendDomainPolicyError(w, err)
+		return
+	}
+	s.GetDomainPolicies(w, r)
+}
+
+func (s *Server) DeleteDomainPolicy(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	p, ok := s.domainPolicies(w)
+	if !ok {
+		return
+	}
+	if err := p.DeleteDomainPolicy(c.URLParams["domain"]); err != nil {
+		sendDomainPolicyError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendDomainPolicyError(w http.ResponseWriter, err error) {
+	switch err {
+	case router.ErrUnknownDomainPolicy:
+		sendError(w, http.StatusNotFound, "404", "Domain policy not found")
+	case router.ErrInvalidDomainPolicy:
+		sendError(w, http.StatusBadRequest, "400", "Invalid domain or table")
+	case router.ErrUnknownTable:
+		sendError(w, http.StatusBadRequest, "400", "Unknown table")
+	default:
+		log.Printf("DomainPolicy/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not process request")
+	}
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+type mockDomainPolicies struct {
+	policies []router.DomainPolicy
+	err      error
+}
+
+func (m *mockDomainPolicies) DomainPolicies() []router.DomainPolicy {
+	return m.policies
+}
+
+func (m *mockDomainPolicies) SetDomainPolicy(p router.DomainPolicy) error {
+	if m.err != nil {
+		return m.err
+	}
+	m.policies = append(m.policies, p)
+	return nil
+}
+
+func (m *mockDomainPolicies) DeleteDomainPolicy(domain string) error {
+	return m.err
+}
+
+func TestDomainPolicies(t *testing.T) {
+	assert := assert.New(t)
+	server := Server{auth: NewTokenAuth("token")}
+	request := func(method, token, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest(method, "http://127.0.0.1/api/domain-policies/example.com", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = "127.0.0.1:6000"
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		c := web.C{URLParams: map[string]string{"domain": "example.com"}}
+		switch method {
+		case "GET":
+			server.GetDomainPolicies(w, req)
+		case "PUT":
+			server.SetDomainPolicy(c, w, req)
+		case "DELETE":
+			server.DeleteDomainPolicy(c, w, req)
+		}
+		return w
+	}
+
+	w := request("GET", "", "")
+	assert.Equal(http.StatusNotImplemented, w.Code)
+
+	mock := &mockDomainPolicies{}
+	server.SetDomainPolicyProvider(mock)
+	w = request("GET", "", "")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[]}`, strings.TrimSpace(w.Body.String()))
+
+	w = request("PUT", "", `{"data":{"table":"vpn"}}`)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	w = request("PUT", "token", `{"data":{"table":"vpn"}}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"domain":"example.com","table":"vpn"}]}`, strings.TrimSpace(w.Body.String()))
+
+	mock.err = router.ErrUnknownTable
+	w = request("PUT", "token", `{"data":{"table":"x"}}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = request("DELETE", "", "")
+	assert.Equal(http.StatusUnauthorized, w.Code)
+	mock.err = router.ErrUnknownDomainPolicy
+	w = request("DELETE", "token", "")
+	assert.Equal(http.StatusNotFound, w.Code)
+	mock.err = nil
+	w = request("DELETE", "token", "")
+	assert.Equal(http.StatusNoContent, w.Code)
+}
@@ -0,0 +1,209 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// EventSource streams the events of the router.
+type EventSource interface {
+	Subscribe(buffer int) (<-chan router.Event, func())
+}
+
+// eventKeepalive is the interval of comments keeping idle streams open.
+var eventKeepalive = 30 * time.Second
+
+// SetEventSource enables GetEvents.
+func (s *Server) SetEventSource(es EventSource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.events = es
+}
+
+type eventHostResp struct {
+	IP       string   `json:"ip,omitempty"`
+	IP6      []string `json:"ip6,omitempty"`
+	Hostname string   `json:"hostname"`
+	MAC      string   `json:"mac"`
+}
+
+type routeChangeResp struct {
+	IP    string `json:"ip,omitempty"`
+	MAC   string `json:"mac,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Empty if the route was deleted
+	Table string `json:"table"`
+	Until string `json:"until,omitempty"`
+	By    string `json:"by,omitempty"`
+}
+
+type tableHealthResp struct {
+	Table    string `json:"table"`
+	Fallback string `json:"fallback,omitempty"`
+	Healthy  bool   `json:"healthy"`
+	Since    string `json:"since,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+type reconcileResp struct {
+	Time         string     `json:"time,omitempty"`
+	Added        []ruleResp `json:"added,omitempty"`
+	Moved        []ruleResp `json:"moved,omitempty"`
+	Removed      []ruleResp `json:"removed,omitempty"`
+	KillSwitches []string   `json:"killswitches,omitempty"`
+	Error        string     `json:"error,omitempty"`
+}
+
+type eventResp struct {
+	Type      string           `json:"type"`
+	Time      string           `json:"time"`
+	Host      *eventHostResp   `json:"host,omitempty"`
+	Route     *routeChangeResp `json:"route,omitempty"`
+	Health    *tableHealthResp `json:"health,omitempty"`
+	Reconcile *reconcileResp   `json:"reconcile,omitempty"`
+}
+
+func rulesToResp(rules []router.Rule) []ruleResp {
+	var resps []ruleResp
+	for _, r := range rules {
+		resps = append(resps, ruleResp{IP: r.IP, Table: r.Table})
+	}
+	return resps
+}
+
+func eventToResp(e router.Event) eventResp {
+	resp := eventResp{
+		Type: string(e.Type),
+		Time: e.Time.Format(time.RFC3339),
+	}
+	if h := e.Host; h != nil {
+		resp.Host = &eventHostResp{IP: h.IP, IP6: h.IP6, Hostname: h.Name, MAC: h.MAC}
+	}
+	if c := e.Route; c != nil {
+		resp.Route = &routeChangeResp{IP: c.IP, MAC: c.MAC, Group: c.Group, Table: c.Table, By: c.By}
+		if !c.Until.IsZero() {
+			resp.Route.Until = c.Until.Format(time.RFC3339)
+		}
+	}
+	if h := e.Health; h != nil {
+		resp.Health = &tableHealthResp{Table: h.Table, Fallback: h.Fallback, Healthy: h.Healthy}
+		if !h.Since.IsZero() {
+			resp.Health.Since = h.Since.Format(time.RFC3339)
+		}
+		if !h.Healthy {
+			resp.Health.Error = h.Err
+		}
+	}
+	if res := e.Reconcile; res != nil {
+		resp.Reconcile = reconcileToResp(*res)
+	}
+	return resp
+}
+
+func reconcileToResp(res router.ReconcileResult) *reconcileResp {
+	resp := &reconcileResp{
+		Added:        rulesToResp(res.Added),
+		Moved:        rulesToResp(res.Moved),
+		Removed:      rulesToResp(res.Removed),
+		KillSwitches: res.KillSwitches,
+	}
+	if res.Err != nil {
+		resp.Error = res.Err.Error()
+	}
+	return resp
+}
+
+// visibleRoute reports whether the change is shown to a client owning route,
+// unauthorized clients only see the changes of their own host.
+func visibleRoute(c *router.RouteChange, route router.Route) bool {
+	if c.MAC != "" && route.Lease.MAC != "" {
+		return strings.EqualFold(c.MAC, route.Lease.MAC)
+	}
+	return c.IP != "" && (c.IP == route.IP || route.Lease.HasAddr(c.IP))
+}
+
+// GetEvents streams the events of the router as server-sent events until the client disconnects.
+// The query parameter types limits the stream to a comma separated list of event types.
+// Unauthorized clients only get the route changes of their own host, without who made them.
+func (s *Server) GetEvents(w http.ResponseWriter, r *http.Request) {
+	s.mu.RLock()
+	es := s.events
+	s.mu.RUnlock()
+	if es == nil {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		sendError(w, http.StatusNotImplemented, "501", "Events not available")
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		w.Header().Set("Content-Type", "application/vnd.api+json")
+		sendError(w, http.StatusInternalServerError, "500", "Streaming not supported")
+		return
+	}
+	types := make(map[string]bool)
+	if q := r.URL.Query().Get("types"); q != "" {
+		for _, t := range strings.Split(q, ",") {
+			types[strings.TrimSpace(t)] = true
+		}
+	}
+
+	authorized := s.client(r).Auth != ""
+	var own router.Route
+	if !authorized {
+		rs, err := s.router.Routes()
+		if err != nil {
+			w.Header().Set("Content-Type", "application/vnd.api+json")
+			sendError(w, http.StatusInternalServerError, "500", "Could not get routes")
+			return
+		}
+		own, _ = routeByIP(rs, parseIP(r.RemoteAddr))
+	}
+
+	events, cancel := es.Subscribe(64)
+	defer cancel()
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			if len(types) > 0 && !types[string(e.Type)] {
+				continue
+			}
+			if !authorized && e.Route != nil {
+				if !visibleRoute(e.Route, own) {
+					continue
+				}
+				c := *e.Route
+				c.By = ""
+				e.Route = &c
+			}
+			data, err := json.Marshal(eventToResp(e))
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
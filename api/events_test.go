@@ -0,0 +1,194 @@
+package api
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+// readEvent reads the lines of the next event of an event stream.
+func readEvent(t *testing.T, r *bufio.Reader) []string {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			t.Fatalf("Error reading event: %s", err)
+		}
+		line = strings.TrimSuffix(line, "\n")
+		if line == "" {
+			return lines
+		}
+		lines = append(lines, line)
+	}
+}
+
+// getEvents opens the event stream at url with the token, if any.
+func getEvents(t *testing.T, url, token string) *http.Response {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", authHelper(token))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	return resp
+}
+
+func TestGetEvents(t *testing.T) {
+	assert := assert.New(t)
+	server := &Server{auth: NewTokenAuth("token")}
+	w := httptest.NewRecorder()
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/events", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	server.GetEvents(w, req)
+	assert.Equal(http.StatusNotImplemented, w.Code)
+
+	bus := router.NewEventBus()
+	server.SetEventSource(bus)
+	ts := httptest.NewServer(http.HandlerFunc(server.GetEvents))
+	defer ts.Close()
+	resp := getEvents(t, ts.URL+"?types=route-changed,reconciled", "token")
+	defer resp.Body.Close()
+	assert.Equal("text/event-stream", resp.Header.Get("Content-Type"))
+
+	// Subscribed before the headers are sent
+	now := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	bus.Publish(router.Event{Type: router.EventHostAdded, Time: now})
+	bus.Publish(router.Event{Type: router.EventRouteChanged, Time: now, Route: &router.RouteChange{
+		IP:    "127.0.0.1",
+		MAC:   "abc",
+		Table: "vpn",
+		Until: now.Add(time.Hour),
+		By:    "admin@127.0.0.2",
+	}})
+	bus.Publish(router.Event{Type: router.EventReconciled, Time: now, Reconcile: &router.ReconcileResult{
+		Added: []router.Rule{{IP: "127.0.0.1", Table: "vpn"}},
+	}})
+
+	r := bufio.NewReader(resp.Body)
+	assert.Equal([]string{
+		"event: route-changed",
+		`data: {"type":"route-changed","time":"2026-10-16T20:00:00Z","route":{"ip":"127.0.0.1","mac":"abc","table":"vpn","until":"2026-10-16T21:00:00Z","by":"admin@127.0.0.2"}}`,
+	}, readEvent(t, r))
+	assert.Equal([]string{
+		"event: reconciled",
+		`data: {"type":"reconciled","time":"2026-10-16T20:00:00Z","reconcile":{"added":[{"ip":"127.0.0.1","table":"vpn"}]}}`,
+	}, readEvent(t, r))
+}
+
+func TestGetEventsUnauthorized(t *testing.T) {
+	assert := assert.New(t)
+	bus := router.NewEventBus()
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return []router.Route{
+				{IP: "127.0.0.1", Table: "vpn", Lease: router.Host{MAC: "aa", IP: "127.0.0.1"}},
+				{IP: "127.0.0.2", Table: "vpn", Lease: router.Host{MAC: "bb", IP: "127.0.0.2"}},
+			}, nil
+		},
+	}
+	server := &Server{router: mock, auth: NewTokenAuth("token")}
+	server.SetEventSource(bus)
+	ts := httptest.NewServer(http.HandlerFunc(server.GetEvents))
+	defer ts.Close()
+	resp := getEvents(t, ts.URL+"?types=route-changed", "")
+	defer resp.Body.Close()
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	now := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	for _, c := range []router.RouteChange{
+		{IP: "127.0.0.2", MAC: "bb", Table: "null", By: "admin@127.0.0.3"},
+		{Group: "kids", Table: "null", By: "admin@127.0.0.3"},
+		{IP: "127.0.0.1", MAC: "AA", Table: "defgw", By: "admin@127.0.0.3"},
+	} {
+		c := c
+		bus.Publish(router.Event{Type: router.EventRouteChanged, Time: now, Route: &c})
+	}
+	assert.Equal([]string{
+		"event: route-changed",
+		`data: {"type":"route-changed","time":"2026-10-16T20:00:00Z","route":{"ip":"127.0.0.1","mac":"AA","table":"defgw"}}`,
+	}, readEvent(t, bufio.NewReader(resp.Body)), "Only the own host without the actor")
+}
+
+func TestGetEventsShutdown(t *testing.T) {
+	bus := router.NewEventBus()
+	server := &Server{auth: NewTokenAuth("token")}
+	server.SetEventSource(bus)
+	ts := httptest.NewServer(http.HandlerFunc(server.GetEvents))
+	resp := getEvents(t, ts.URL, "token")
+	defer resp.Body.Close()
+
+	bus.Close()
+	closed := make(chan struct{})
+	go func() {
+		// Waits for the open requests
+		ts.Close()
+		close(closed)
+	}()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Event stream kept the server open")
+	}
+}
+
+type actorRouter struct {
+	mockRouter
+	actor *string
+}
+
+func (r actorRouter) As(actor string) router.Router {
+	*r.actor = actor
+	return r.mockRouter
+}
+
+func TestRouteChangeActor(t *testing.T) {
+	assert := assert.New(t)
+	var actor string
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return []router.Route{{IP: "127.0.0.1", Table: "vpn"}}, nil
+		},
+		setRouteFn: func(ip, table string) error {
+			return nil
+		},
+	}
+	server := Server{
+		router: actorRouter{mock, &actor},
+		auth:   NewBasicAuth(map[string]string{"admin": "secret"}),
+		tables: testTables,
+	}
+	post := func(remote, user string) int {
+		req, err := http.NewRequest("POST", "http://127.0.0.1/api/routes", strings.NewReader(`{"data":{"ip":"127.0.0.1","table":"vpn"}}`))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = remote
+		if user != "" {
+			req.SetBasicAuth(user, "secret")
+		}
+		w := httptest.NewRecorder()
+		server.SetRoute(w, req)
+		return w.Code
+	}
+
+	assert.Equal(http.StatusOK, post("127.0.0.2:6000", "admin"))
+	assert.Equal("admin@127.0.0.2", actor)
+	assert.Equal(http.StatusOK, post("127.0.0.1:6000", ""))
+	assert.Equal("127.0.0.1", actor)
+	// Unverified users are not trusted
+	assert.Equal(http.StatusOK, post("127.0.0.1:6000", "mallory"))
+	assert.Equal("127.0.0.1", actor)
+}
@@ -0,0 +1,148 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/zenazn/goji/web"
+)
+
+type exceptionResp struct {
+	To    string `json:"to"`
+	Proto string `json:"proto,omitempty"`
+	Port  uint16 `json:"port,omitempty"`
+	Table string `json:"table"`
+	// Group the exception is inherited from, if any
+	Group string `json:"group,omitempty"`
+}
+
+func exceptionsToResp(exceptions []router.Rule, group string) []exceptionResp {
+	resps := make([]exceptionResp, 0, len(exceptions))
+	for _, e := range exceptions {
+		resps = append(resps, exceptionResp{
+			To:    e.To,
+			Proto: e.Proto,
+			Port:  e.Port,
+			Table: e.Table,
+			Group: group,
+		})
+	}
+	return resps
+}
+
+// routeExceptions returns the exceptions of a host followed by those of its
+// group it does not override.
+func routeExceptions(r router.Route) []exceptionResp {
+	if len(r.Exceptions) == 0 && len(r.GroupExceptions) == 0 {
+		return nil
+	}
+	resps := exceptionsToResp(r.Exceptions, "")
+	for _, e := range exceptionsToResp(r.GroupExceptions, r.Group) {
+		overridden := false
+		for _, own := range resps {
+			if own.To == e.To && own.Proto == e.Proto && own.Port == e.Port {
+				overridden = true
+				break
+			}
+		}
+		if !overridden {
+			resps = append(resps, e)
+		}
+	}
+	return resps
+}
+
+type exceptionsReq struct {
+	Data []struct {
+		To    string
+		Proto string
+		Port  uint16
+		Table string
+	} `json:"data"`
+}
+
+func (req exceptionsReq) rules() []router.Rule {
+	rules := make([]router.Rule, 0, len(req.Data))
+	for _, e := range req.Data {
+		rules = append(rules, router.Rule{To: e.To, Proto: e.Proto, Port: e.Port, Table: e.Table})
+	}
+	return rules
+}
+
+// SetExceptions replaces the exceptions of the host with the ip given in the URL.
+func (s *Server) SetExceptions(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	ip := c.URLParams["ip"]
+	if net.ParseIP(ip) == nil {
+		sendError(w, http.StatusBadRequest, "400", "Invalid IP")
+		return
+	}
+	// Auth if ip does not match
+	if ip != parseIP(r.RemoteAddr) && !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	var req exceptionsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+
+	if err := s.router.SetExceptions(ip, req.rules()); err != nil {
+		sendExceptionError(w, err)
+		return
+	}
+	rs, err := s.router.Routes()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "500", "Could not get routes")
+		return
+	}
+	route, found := routeByIP(rs, ip)
+	if !found {
+		sendError(w, http.StatusNotFound, "404", "Route not found")
+		return
+	}
+	sendRoute(w, route)
+}
+
+// SetGroupExceptions replaces the exceptions of the group named in the URL.
+func (s *Server) SetGroupExceptions(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	var req exceptionsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+
+	name := c.URLParams["name"]
+	if err := s.router.SetGroupExceptions(name, req.rules()); err != nil {
+		sendExceptionError(w, err)
+		return
+	}
+	s.sendGroup(w, name)
+}
+
+func sendExceptionError(w http.ResponseWriter, err error) {
+	switch err {
+	case router.ErrUnknownHost:
+		sendError(w, http.StatusNotFound, "404", "Host not found")
+	case router.ErrUnknownGroup:
+		sendError(w, http.StatusNotFound, "404", "Group not found")
+	case router.ErrInvalidException:
+		sendError(w, http.StatusBadRequest, "400", "Invalid exception")
+	case router.ErrNoExceptions:
+		sendError(w, http.StatusNotImplemented, "501", "Exceptions not supported")
+	default:
+		log.Printf("Exception/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not process request")
+	}
+}
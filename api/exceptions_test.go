@@ -0,0 +1,107 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+func TestRouteExceptions(t *testing.T) {
+	route := router.Route{
+		Group:           "kids",
+		Exceptions:      []router.Rule{{To: "10.0.0.0/8", Table: "defgw"}},
+		GroupExceptions: []router.Rule{{To: "10.0.0.0/8", Table: "vpn"}, {To: "192.168.0.0/16", Proto: "tcp", Port: 443, Table: "defgw"}},
+	}
+	assert.Equal(t, []exceptionResp{
+		{To: "10.0.0.0/8", Table: "defgw"},
+		{To: "192.168.0.0/16", Proto: "tcp", Port: 443, Table: "defgw", Group: "kids"},
+	}, routeExceptions(route))
+	assert.Nil(t, routeExceptions(router.Route{}))
+}
+
+func TestSetExceptions(t *testing.T) {
+	assert := assert.New(t)
+	var exceptions []router.Rule
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return []router.Route{
+				{IP: "127.0.0.1", Table: "vpn", Lease: router.Host{MAC: "abc", IP: "127.0.0.1", Name: "name"}, Exceptions: exceptions},
+			}, nil
+		},
+		exceptionsFn: func(ip string, e []router.Rule) error {
+			if ip != "127.0.0.1" {
+				return router.ErrUnknownHost
+			}
+			if len(e) > 0 && e[0].Table == "" {
+				return router.ErrInvalidException
+			}
+			exceptions = e
+			return nil
+		},
+	}
+	server := Server{
+		router: mock,
+		auth:   NewTokenAuth("token"),
+	}
+	put := func(ip, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "http://127.0.0.1/api/routes/"+ip+"/exceptions", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = "127.0.0.1:6000"
+		w := httptest.NewRecorder()
+		server.SetExceptions(web.C{URLParams: map[string]string{"ip": ip}}, w, req)
+		return w
+	}
+
+	w := put("127.0.0.1", `{"data":[{"to":"10.0.0.0/8","proto":"tcp","port":443,"table":"defgw"}]}`)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":{"ip":"127.0.0.1","table":"vpn","hostname":"name","mac":"abc","exceptions":[{"to":"10.0.0.0/8","proto":"tcp","port":443,"table":"defgw"}]}}`, strings.TrimSpace(w.Body.String()))
+
+	w = put("127.0.0.1", `{"data":[{"to":"10.0.0.0/8"}]}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	w = put("127.0.0.2", `{"data":[]}`)
+	assert.Equal(http.StatusUnauthorized, w.Code, "Exceptions of other hosts require auth")
+	w = put("invalid", `{"data":[]}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestSetGroupExceptions(t *testing.T) {
+	assert := assert.New(t)
+	mock := mockRouter{groups: []router.Group{
+		{Name: "kids", Table: "vpn", Exceptions: []router.Rule{{To: "10.0.0.0/8", Table: "defgw"}}},
+	}}
+	server := Server{
+		router: mock,
+		auth:   NewTokenAuth("token"),
+	}
+	put := func(token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "http://127.0.0.1/api/groups/kids/exceptions", strings.NewReader(`{"data":[{"to":"10.0.0.0/8","table":"defgw"}]}`))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = "127.0.0.1:6000"
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.SetGroupExceptions(web.C{URLParams: map[string]string{"name": "kids"}}, w, req)
+		return w
+	}
+
+	w := put("")
+	assert.Equal(http.StatusUnauthorized, w.Code, "Groups always require auth")
+	w = put("token")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":{"name":"kids","members":[],"table":"vpn","exceptions":[{"to":"10.0.0.0/8","table":"defgw"}]}}`, strings.TrimSpace(w.Body.String()))
+
+	mock.groupErr = router.ErrNoExceptions
+	server.router = mock
+	w = put("token")
+	assert.Equal(http.StatusNotImplemented, w.Code)
+}
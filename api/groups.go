@@ -0,0 +1,158 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/zenazn/goji/web"
+)
+
+type groupResp struct {
+	Name    string   `json:"name"`
+	Members []string `json:"members"`
+	Table   string   `json:"table"`
+	// Exceptions of all members
+	Exceptions []exceptionResp `json:"exceptions,omitempty"`
+}
+
+func groupToResp(g router.Group) groupResp {
+	members := g.MACs
+	if members == nil {
+		members = []string{}
+	}
+	return groupResp{
+		Name:    g.Name,
+		Members: members,
+		Table:   g.Table,
+
+		Exceptions: exceptionsToResp(g.Exceptions, ""),
+	}
+}
+
+func (s *Server) GetGroups(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	gs, err := s.router.Groups()
+	if err != nil {
+		log.Printf("GetGroups/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Unable to fetch groups")
+		return
+	}
+	resps := make([]groupResp, 0, len(gs))
+	for _, g := range gs {
+		resps = append(resps, groupToResp(g))
+	}
+	t := struct {
+		Data []groupResp `json:"data"`
+	}{
+		Data: resps,
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+type groupReq struct {
+	Data struct {
+		Members []string
+		Table   string
+	} `json:"data"`
+}
+
+// SetGroup creates or replaces the group named in the URL.
+func (s *Server) SetGroup(c web.C, w http.ResponseWriter, r *http.Request) {
+	w, done := countRouteRequest("group", w)
+	defer done()
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	var req groupReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+	if !s.checkTables(w, req.Data.Table) {
+		return
+	}
+
+	name := c.URLParams["name"]
+	entry := s.groupAudit(name, req.Data.Table)
+	err := s.routerFor(r).SetGroup(router.Group{
+		Name:  name,
+		MACs:  req.Data.Members,
+		Table: req.Data.Table,
+	})
+	if req.Data.Table != "" {
+		s.recordAudit(r, err, entry)
+	}
+	if err != nil {
+		sendGroupError(w, err)
+		return
+	}
+	s.sendGroup(w, name)
+}
+
+func (s *Server) DeleteGroup(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	if err := s.router.DeleteGroup(c.URLParams["name"]); err != nil {
+		sendGroupError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setGroupRoute handles a route change of a whole group, requested via SetRoute.
+func (s *Server) setGroupRoute(w http.ResponseWriter, r *http.Request, name, table string) {
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	entry := s.groupAudit(name, table)
+	err := s.routerFor(r).SetGroupRoute(name, table)
+	s.recordAudit(r, err, entry)
+	if err != nil {
+		sendGroupError(w, err)
+		return
+	}
+	s.sendGroup(w, name)
+}
+
+func (s *Server) sendGroup(w http.ResponseWriter, name string) {
+	gs, err := s.router.Groups()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "500", "Could not get groups")
+		return
+	}
+	for _, g := range gs {
+		if g.Name == name {
+			t := struct {
+				Data groupResp `json:"data"`
+			}{
+				Data: groupToResp(g),
+			}
+			json.NewEncoder(w).Encode(&t)
+			return
+		}
+	}
+	sendError(w, http.StatusNotFound, "404", "Group not found")
+}
+
+func sendGroupError(w http.ResponseWriter, err error) {
+	switch err {
+	case router.ErrUnknownGroup:
+		sendError(w, http.StatusNotFound, "404", "Group not found")
+	case router.ErrInvalidGroup:
+		sendError(w, http.StatusBadRequest, "400", "Invalid group name or member")
+	case router.ErrGroupMember:
+		sendError(w, http.StatusConflict, "409", "Device is member of another group")
+	default:
+		log.Printf("Group/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not process request")
+	}
+}
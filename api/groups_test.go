@@ -0,0 +1,133 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+func TestGetGroups(t *testing.T) {
+	assert := assert.New(t)
+	server := Server{
+		router: mockRouter{groups: []router.Group{
+			{Name: "kids", MACs: []string{"aa:bb:cc:dd:ee:01"}, Table: "vpn"},
+			{Name: "tv"},
+		}},
+		tables: testTables,
+	}
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/groups", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.GetGroups(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	const expected = `{"data":[{"name":"kids","members":["aa:bb:cc:dd:ee:01"],"table":"vpn"},{"name":"tv","members":[],"table":""}]}`
+	assert.Equal(expected, strings.TrimSpace(w.Body.String()))
+}
+
+func TestSetGroup(t *testing.T) {
+	assert := assert.New(t)
+	mock := mockRouter{groups: []router.Group{
+		{Name: "kids", MACs: []string{"aa:bb:cc:dd:ee:01"}, Table: "vpn"},
+	}}
+	server := Server{
+		router: mock,
+		auth:   NewTokenAuth("token"),
+		tables: testTables,
+	}
+	put := func(server *Server, token string) *httptest.ResponseRecorder {
+		const reqStr = `{"data":{"members":["aa:bb:cc:dd:ee:01"],"table":"vpn"}}`
+		req, err := http.NewRequest("PUT", "http://127.0.0.1/api/groups/kids", strings.NewReader(reqStr))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = "127.0.0.1:6000"
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.SetGroup(web.C{URLParams: map[string]string{"name": "kids"}}, w, req)
+		return w
+	}
+
+	w := put(&server, "")
+	assert.Equal(http.StatusUnauthorized, w.Code, "Groups always require auth")
+
+	w = put(&server, "token")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":{"name":"kids","members":["aa:bb:cc:dd:ee:01"],"table":"vpn"}}`, strings.TrimSpace(w.Body.String()))
+
+	server.tables = []TableDef{{Name: "defgw"}}
+	w = put(&server, "token")
+	assert.Equal(http.StatusBadRequest, w.Code, "Unknown table")
+	server.tables = testTables
+
+	mock.groupErr = router.ErrGroupMember
+	server.router = mock
+	w = put(&server, "token")
+	assert.Equal(http.StatusConflict, w.Code)
+
+	mock.groupErr = router.ErrInvalidGroup
+	server.router = mock
+	w = put(&server, "token")
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestDeleteGroup(t *testing.T) {
+	assert := assert.New(t)
+	server := Server{
+		router: mockRouter{groupErr: router.ErrUnknownGroup},
+		auth:   NewTokenAuth("token"),
+		tables: testTables,
+	}
+	req, err := http.NewRequest("DELETE", "http://127.0.0.1/api/groups/kids", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	req.Header.Set("Authorization", authHelper("token"))
+	w := httptest.NewRecorder()
+	server.DeleteGroup(web.C{URLParams: map[string]string{"name": "kids"}}, w, req)
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	server.router = mockRouter{}
+	w = httptest.NewRecorder()
+	server.DeleteGroup(web.C{URLParams: map[string]string{"name": "kids"}}, w, req)
+	assert.Equal(http.StatusNoContent, w.Code)
+}
+
+func TestSetRouteGroup(t *testing.T) {
+	assert := assert.New(t)
+	server := Server{
+		router: mockRouter{groups: []router.Group{
+			{Name: "kids", MACs: []string{"aa:bb:cc:dd:ee:01"}, Table: "vpn"},
+		}},
+		auth:   NewTokenAuth("token"),
+		tables: testTables,
+	}
+	const reqStr = `{"data":{"group":"kids","table":"vpn"}}`
+	req, err := http.NewRequest("POST", "http://127.0.0.1/api/routes", strings.NewReader(reqStr))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	req.RemoteAddr = "127.0.0.1:6000"
+	w := httptest.NewRecorder()
+	server.SetRoute(w, req)
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	req, err = http.NewRequest("POST", "http://127.0.0.1/api/routes", strings.NewReader(reqStr))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	req.Header.Set("Authorization", authHelper("token"))
+	w = httptest.NewRecorder()
+	server.SetRoute(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":{"name":"kids","members":["aa:bb:cc:dd:ee:01"],"table":"vpn"}}`, strings.TrimSpace(w.Body.String()))
+}
@@ -0,0 +1,57 @@
+package api
+
+import (
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// HealthProvider reports the health of tables with checks.
+type HealthProvider interface {
+	Health(table string) (router.TableHealth, bool)
+	// Active returns the table used instead of table
+	Active(table string) string
+}
+
+type healthResp struct {
+	Healthy bool   `json:"healthy"`
+	Since   string `json:"since,omitempty"`
+	Error   string `json:"error,omitempty"`
+	// Table used by the hosts of the table
+	Active string `json:"active"`
+}
+
+// SetHealthProvider adds the health of monitored tables to GetTables.
+func (s *Server) SetHealthProvider(h HealthProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.health = h
+}
+
+// tablesWithHealth returns a copy of tables with the health of all monitored tables.
+func tablesWithHealth(tables []TableDef, h HealthProvider) []TableDef {
+	if h == nil {
+		return tables
+	}
+	defs := make([]TableDef, len(tables))
+	for i, t := range tables {
+		defs[i] = t
+		th, ok := h.Health(t.Name)
+		if !ok {
+			continue
+		}
+		resp := &healthResp{
+			Healthy: th.Healthy,
+			Active:  h.Active(t.Name),
+		}
+		if !th.Since.IsZero() {
+			resp.Since = th.Since.Format(time.RFC3339)
+		}
+		if !th.Healthy {
+			resp.Error = th.Err
+		}
+		defs[i].Fallback = th.Fallback
+		defs[i].Health = resp
+	}
+	return defs
+}
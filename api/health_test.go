@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockHealth map[string]router.TableHealth
+
+func (m mockHealth) Health(table string) (router.TableHealth, bool) {
+	h, ok := m[table]
+	return h, ok
+}
+
+func (m mockHealth) Active(table string) string {
+	if h, ok := m[table]; ok && !h.Healthy {
+		return h.Fallback
+	}
+	return table
+}
+
+func TestGetTablesHealth(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth(), []TableDef{
+		{Name: "defgw", Text: "KabelD"},
+		{Name: "vpn", Text: "VPN"},
+	})
+	server.SetHealthProvider(mockHealth{
+		"vpn": {
+			Table:    "vpn",
+			Fallback: "defgw",
+			Since:    time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC),
+			Err:      "link tun0 is down",
+		},
+	})
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/tables", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.GetTables(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"name":"defgw","text":"KabelD"},`+
+		`{"name":"vpn","text":"VPN","fallback":"defgw","health":{"healthy":false,"since":"2026-10-16T20:00:00Z","error":"link tun0 is down","active":"defgw"}}]}`,
+		strings.TrimSpace(w.Body.String()))
+}
@@ -0,0 +1,47 @@
+package api
+
+import (
+	"log"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// KillSwitchProvider reports the kill switch of strict tables.
+type KillSwitchProvider interface {
+	KillSwitch(table string) (router.KillSwitchState, bool, error)
+}
+
+type killSwitchResp struct {
+	Installed bool `json:"installed"`
+	// The table has no route, its hosts are cut off
+	Blocking bool `json:"blocking"`
+}
+
+// SetKillSwitchProvider adds the kill switch of strict tables to GetTables.
+func (s *Server) SetKillSwitchProvider(k KillSwitchProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.strict = k
+}
+
+// tablesWithKillSwitch returns a copy of tables with the kill switch of all strict tables.
+func tablesWithKillSwitch(tables []TableDef, k KillSwitchProvider) []TableDef {
+	if k == nil {
+		return tables
+	}
+	defs := make([]TableDef, len(tables))
+	for i, t := range tables {
+		defs[i] = t
+		state, strict, err := k.KillSwitch(t.Name)
+		if err != nil {
+			log.Printf("GetTables/Error: %s", err)
+		}
+		if strict {
+			defs[i].KillSwitch = &killSwitchResp{
+				Installed: state.Installed,
+				Blocking:  state.Blocking,
+			}
+		}
+	}
+	return defs
+}
@@ -0,0 +1,38 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockKillSwitch map[string]router.KillSwitchState
+
+func (m mockKillSwitch) KillSwitch(table string) (router.KillSwitchState, bool, error) {
+	state, ok := m[table]
+	return state, ok, nil
+}
+
+func TestGetTablesKillSwitch(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth(), []TableDef{
+		{Name: "defgw", Text: "KabelD"},
+		{Name: "vpn", Text: "VPN"},
+	})
+	server.SetKillSwitchProvider(mockKillSwitch{"vpn": {Installed: true, Blocking: true}})
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/tables", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.GetTables(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"name":"defgw","text":"KabelD"},`+
+		`{"name":"vpn","text":"VPN","killswitch":{"installed":true,"blocking":true}}]}`,
+		strings.TrimSpace(w.Body.String()))
+}
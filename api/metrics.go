@@ -0,0 +1,152 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/blang/vpnrouter/metrics"
+)
+
+var (
+	routeRequests = metrics.Default.NewCounter("vpnrouter_route_requests_total",
+		"Requests changing routes by operation and outcome.", "op", "outcome")
+	authFailures = metrics.Default.NewCounter("vpnrouter_auth_failures_total",
+		"Failed authorizations by the provider of the credentials, none if missing.", "provider")
+)
+
+// statusRecorder remembers the status code written to a response.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(code int) {
+	if r.status == 0 {
+		r.status = code
+	}
+	r.ResponseWriter.WriteHeader(code)
+}
+
+func (r *statusRecorder) Write(b []byte) (int, error) {
+	if r.status == 0 {
+		r.status = http.StatusOK
+	}
+	return r.ResponseWriter.Write(b)
+}
+
+// countRouteRequest wraps w to remember the status and returns a func which
+// counts the request as op with its outcome, to be deferred by the handler.
+func countRouteRequest(op string, w http.ResponseWriter) (http.ResponseWriter, func()) {
+	rec := &statusRecorder{ResponseWriter: w}
+	return rec, func() { routeRequests.Inc(op, outcome(rec.status)) }
+}
+
+// outcome names the result of a request with the status code.
+func outcome(status int) string {
+	switch {
+	case status == http.StatusUnauthorized:
+		return "unauthorized"
+	case status == http.StatusNotFound:
+		return "not_found"
+	case status >= 200 && status < 300:
+		return "ok"
+	case status >= 400 && status < 500:
+		return "invalid"
+	}
+	return "error"
+}
+
+// authProvider names the provider checking the credentials of r.
+func authProvider(r *http.Request) string {
+	method := strings.SplitN(r.Header.Get("Authorization"), " ", 2)[0]
+	switch method {
+	case "":
+		return "none"
+	case "Basic":
+		return "basic"
+	case "Bearer":
+		return "token"
+	}
+	return "other"
+}
+
+// tableMetrics returns the hosts routed through each table, the health of
+// monitored tables and the traffic of their tunnels.
+func (s *Server) tableMetrics() []metrics.Metric {
+	hosts := metrics.NewGauge("vpnrouter_hosts", "Hosts routed through a table.", "table")
+	known := metrics.NewGauge("vpnrouter_known_hosts", "Hosts with a name from their lease or the static names.")
+	unknown := metrics.NewGauge("vpnrouter_unknown_hosts", "Hosts without a name.")
+	ms := []metrics.Metric{hosts, known, unknown}
+
+	s.mu.RLock()
+	tables, health, tunnels, ovpn := s.tables, s.health, s.tunnel, s.ovpn
+	s.mu.RUnlock()
+	for _, t := range tables {
+		hosts.Set(0, t.Name)
+	}
+	known.Set(0)
+	unknown.Set(0)
+	rs, err := s.router.Routes()
+	if err != nil {
+		log.Printf("Metrics/Error: %s", err)
+	}
+	for _, r := range rs {
+		hosts.Add(1, r.Table)
+		if r.Lease.Name != "" && r.Lease.Name != "*" {
+			known.Add(1)
+		} else {
+			unknown.Add(1)
+		}
+	}
+
+	if health != nil {
+		healthy := metrics.NewGauge("vpnrouter_table_healthy", "Health of monitored tables, 1 if healthy.", "table")
+		for _, t := range tables {
+			if th, ok := health.Health(t.Name); ok {
+				v := 0.0
+				if th.Healthy {
+					v = 1
+				}
+				healthy.Set(v, t.Name)
+			}
+		}
+		ms = append(ms, healthy)
+	}
+
+	rx := metrics.NewCounter("vpnrouter_tunnel_receive_bytes_total", "Bytes received by the tunnel of a table.", "table", "type")
+	tx := metrics.NewCounter("vpnrouter_tunnel_transmit_bytes_total", "Bytes sent by the tunnel of a table.", "table", "type")
+	if tunnels != nil {
+		for _, t := range tunnels.Tunnels() {
+			for _, p := range t.Device.Peers {
+				rx.Add(float64(p.RxBytes), t.Table, "wireguard")
+				tx.Add(float64(p.TxBytes), t.Table, "wireguard")
+			}
+		}
+	}
+	if ovpn != nil {
+		for _, t := range tables {
+			state, ok, err := ovpn.OpenVPNState(t.Name)
+			if !ok || err != nil {
+				continue
+			}
+			rx.Add(float64(state.RxBytes), t.Name, "openvpn")
+			tx.Add(float64(state.TxBytes), t.Name, "openvpn")
+		}
+	}
+	if tunnels != nil || ovpn != nil {
+		ms = append(ms, rx, tx)
+	}
+	return ms
+}
+
+// Metrics writes the metrics of vpnrouter in the text format of Prometheus.
+func (s *Server) Metrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	reg := metrics.NewRegistry()
+	reg.Register(metrics.Default)
+	reg.Register(s.tableMetrics()...)
+	if _, err := reg.WriteTo(w); err != nil {
+		log.Printf("Metrics/Error: %s", err)
+	}
+}
@@ -0,0 +1,93 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+func TestMetrics(t *testing.T) {
+	assert := assert.New(t)
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return []router.Route{
+				{IP: "127.0.0.1", Table: "vpn", Lease: router.Host{MAC: "a", IP: "127.0.0.1", Name: "pc1"}},
+				{IP: "127.0.0.2", Table: "vpn", Lease: router.Host{MAC: "b", IP: "127.0.0.2", Name: "*"}},
+				{IP: "127.0.0.3", Table: "null", Lease: router.Host{MAC: "c", IP: "127.0.0.3", Name: "pc3"}},
+			}, nil
+		},
+		setRouteFn: func(ip, table string) error {
+			return nil
+		},
+		deleteRouteFn: func(ip string) error {
+			return nil
+		},
+	}
+	server := NewServer(mock, NewTokenAuth("token"), []TableDef{{Name: "null"}, {Name: "vpn"}, {Name: "defgw"}})
+	server.SetHealthProvider(mockHealth{"vpn": {Table: "vpn", Healthy: false}})
+	server.SetTunnelProvider(mockTunnels{{
+		WireGuardTunnel: router.WireGuardTunnel{Table: "vpn", Interface: "wg0"},
+		Device: router.WireGuardDevice{Peers: []router.WireGuardPeerState{
+			{RxBytes: 10, TxBytes: 20},
+			{RxBytes: 1, TxBytes: 2},
+		}},
+	}})
+
+	ok := routeRequests.Value("set", "ok")
+	unauthorized := routeRequests.Value("set", "unauthorized")
+	deleted := routeRequests.Value("delete", "ok")
+	token := authFailures.Value("token")
+	post := func(remote, token string) {
+		req, err := http.NewRequest("POST", "http://127.0.0.1/api/routes", strings.NewReader(`{"data":{"ip":"127.0.0.1","table":"vpn"}}`))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		server.SetRoute(httptest.NewRecorder(), req)
+	}
+	post("127.0.0.1:6000", "")
+	post("127.0.0.2:6000", "wrong")
+	assert.Equal(ok+1, routeRequests.Value("set", "ok"))
+	assert.Equal(unauthorized+1, routeRequests.Value("set", "unauthorized"))
+	assert.Equal(token+1, authFailures.Value("token"))
+
+	del, err := http.NewRequest("DELETE", "http://127.0.0.1/api/routes/127.0.0.1", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	del.RemoteAddr = "127.0.0.1:6000"
+	server.DeleteRoute(web.C{URLParams: map[string]string{"ip": "127.0.0.1"}}, httptest.NewRecorder(), del)
+	assert.Equal(deleted+1, routeRequests.Value("delete", "ok"))
+
+	req, err := http.NewRequest("GET", "http://127.0.0.1/metrics", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.Metrics(w, req)
+	assert.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	for _, line := range []string{
+		`vpnrouter_hosts{table="defgw"} 0`,
+		`vpnrouter_hosts{table="null"} 1`,
+		`vpnrouter_hosts{table="vpn"} 2`,
+		`vpnrouter_known_hosts 2`,
+		`vpnrouter_unknown_hosts 1`,
+		`vpnrouter_table_healthy{table="vpn"} 0`,
+		`vpnrouter_tunnel_receive_bytes_total{table="vpn",type="wireguard"} 11`,
+		`vpnrouter_tunnel_transmit_bytes_total{table="vpn",type="wireguard"} 22`,
+		`# TYPE vpnrouter_route_requests_total counter`,
+		`# TYPE vpnrouter_ip_rule_duration_seconds histogram`,
+		`# TYPE vpnrouter_persistence_write_failures_total counter`,
+	} {
+		assert.Contains(body, line+"\n")
+	}
+}
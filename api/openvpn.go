@@ -0,0 +1,93 @@
+package api
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/zenazn/goji/web"
+)
+
+// OpenVPNProvider reports and restarts the OpenVPN tunnels of tables.
+type OpenVPNProvider interface {
+	OpenVPNState(table string) (router.OpenVPNState, bool, error)
+	RestartOpenVPN(table string) error
+}
+
+type openVPNResp struct {
+	State    string `json:"state,omitempty"`
+	Since    string `json:"since,omitempty"`
+	LocalIP  string `json:"local_ip,omitempty"`
+	RemoteIP string `json:"remote_ip,omitempty"`
+	RxBytes  uint64 `json:"rx_bytes"`
+	TxBytes  uint64 `json:"tx_bytes"`
+	// The management interface is unreachable
+	Error string `json:"error,omitempty"`
+}
+
+// SetOpenVPNProvider adds the tunnel state to GetTables and enables RestartTable.
+func (s *Server) SetOpenVPNProvider(p OpenVPNProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ovpn = p
+}
+
+// tablesWithOpenVPN returns a copy of tables with the state of all OpenVPN tunnels.
+func tablesWithOpenVPN(tables []TableDef, p OpenVPNProvider) []TableDef {
+	if p == nil {
+		return tables
+	}
+	defs := make([]TableDef, len(tables))
+	for i, t := range tables {
+		defs[i] = t
+		state, ok, err := p.OpenVPNState(t.Name)
+		if !ok {
+			continue
+		}
+		if err != nil {
+			log.Printf("GetTables/Error: %s", err)
+			defs[i].OpenVPN = &openVPNResp{Error: err.Error()}
+			continue
+		}
+		resp := &openVPNResp{
+			State:    state.State,
+			LocalIP:  state.LocalIP,
+			RemoteIP: state.RemoteIP,
+			RxBytes:  state.RxBytes,
+			TxBytes:  state.TxBytes,
+		}
+		if !state.Since.IsZero() {
+			resp.Since = state.Since.Format(time.RFC3339)
+		}
+		defs[i].OpenVPN = resp
+	}
+	return defs
+}
+
+// RestartTable restarts the OpenVPN tunnel of the table named in the URL.
+func (s *Server) RestartTable(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	s.mu.RLock()
+	p := s.ovpn
+	s.mu.RUnlock()
+	if p == nil {
+		sendError(w, http.StatusNotFound, "404", "Table has no tunnel")
+		return
+	}
+	err := p.RestartOpenVPN(c.URLParams["name"])
+	if err == router.ErrNoOpenVPN {
+		sendError(w, http.StatusNotFound, "404", "Table has no tunnel")
+		return
+	}
+	if err != nil {
+		log.Printf("RestartTable/Error: %s", err)
+		sendError(w, http.StatusBadGateway, "502", "Could not restart tunnel")
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,82 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+type mockOpenVPN struct {
+	states    map[string]router.OpenVPNState
+	restarted []string
+}
+
+func (m *mockOpenVPN) OpenVPNState(table string) (router.OpenVPNState, bool, error) {
+	if table == "down" {
+		return router.OpenVPNState{}, true, errors.New("connection refused")
+	}
+	state, ok := m.states[table]
+	return state, ok, nil
+}
+
+func (m *mockOpenVPN) RestartOpenVPN(table string) error {
+	if _, ok := m.states[table]; !ok {
+		return router.ErrNoOpenVPN
+	}
+	m.restarted = append(m.restarted, table)
+	return nil
+}
+
+func TestGetTablesOpenVPN(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth(), []TableDef{
+		{Name: "defgw", Text: "KabelD"},
+		{Name: "vpn", Text: "VPN"},
+		{Name: "down", Text: "Down"},
+	})
+	server.SetOpenVPNProvider(&mockOpenVPN{states: map[string]router.OpenVPNState{
+		"vpn": {State: "CONNECTED", Since: time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC), LocalIP: "10.8.0.6", RemoteIP: "192.0.2.1", RxBytes: 1, TxBytes: 2},
+	}})
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/tables", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.GetTables(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"name":"defgw","text":"KabelD"},`+
+		`{"name":"vpn","text":"VPN","openvpn":{"state":"CONNECTED","since":"2026-10-18T12:00:00Z","local_ip":"10.8.0.6","remote_ip":"192.0.2.1","rx_bytes":1,"tx_bytes":2}},`+
+		`{"name":"down","text":"Down","openvpn":{"rx_bytes":0,"tx_bytes":0,"error":"connection refused"}}]}`,
+		strings.TrimSpace(w.Body.String()))
+}
+
+func TestRestartTable(t *testing.T) {
+	assert := assert.New(t)
+	mock := &mockOpenVPN{states: map[string]router.OpenVPNState{"vpn": {}}}
+	server := NewServer(mockRouter{}, NewTokenAuth("token"), nil)
+	server.SetOpenVPNProvider(mock)
+	post := func(table, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://127.0.0.1/api/tables/"+table+"/restart", nil)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.RestartTable(web.C{URLParams: map[string]string{"name": table}}, w, req)
+		return w
+	}
+	assert.Equal(http.StatusUnauthorized, post("vpn", "").Code)
+	assert.Equal(http.StatusNotFound, post("defgw", "token").Code)
+	assert.Equal(http.StatusNoContent, post("vpn", "token").Code)
+	assert.Equal([]string{"vpn"}, mock.restarted)
+}
@@ -0,0 +1,126 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// RuleLister lists the rules of the kernel.
+type RuleLister interface {
+	// Rules returns the host rules owned by vpnrouter
+	Rules() ([]router.Rule, error)
+	// Exceptions returns the exception rules owned by vpnrouter
+	Exceptions() ([]router.Rule, error)
+	ForeignRules() ([]router.ForeignRule, error)
+}
+
+// ReconcileStatusProvider reports the last sync of the rules with the hosts.
+type ReconcileStatusProvider interface {
+	LastResult() router.ReconcileResult
+}
+
+// SetRuleLister enables GetRules.
+func (s *Server) SetRuleLister(l RuleLister) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.rules = l
+}
+
+// SetReconcileStatusProvider adds the last reconcile run to GetRules.
+func (s *Server) SetReconcileStatusProvider(p ReconcileStatusProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.reconcile = p
+}
+
+type ruleResp struct {
+	IP    string `json:"ip"`
+	Table string `json:"table"`
+}
+
+type exceptionRuleResp struct {
+	IP    string `json:"ip"`
+	To    string `json:"to"`
+	Proto string `json:"proto,omitempty"`
+	Port  uint16 `json:"port,omitempty"`
+	Table string `json:"table"`
+}
+
+type foreignRuleResp struct {
+	Priority uint32 `json:"priority"`
+	Rule     string `json:"rule"`
+	IPv6     bool   `json:"ipv6,omitempty"`
+}
+
+// GetRules returns the host and exception rules owned by vpnrouter and all
+// other rules separately, along with the drift fixed by the last reconcile run if any.
+func (s *Server) GetRules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	s.mu.RLock()
+	l := s.rules
+	rp := s.reconcile
+	s.mu.RUnlock()
+	if l == nil {
+		sendError(w, http.StatusNotImplemented, "501", "Rules not available")
+		return
+	}
+	rules, err := l.Rules()
+	if err != nil {
+		log.Printf("GetRules/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Unable to fetch rules")
+		return
+	}
+	exceptions, err := l.Exceptions()
+	if err != nil {
+		log.Printf("GetRules/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Unable to fetch rules")
+		return
+	}
+	foreign, err := l.ForeignRules()
+	if err != nil {
+		log.Printf("GetRules/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Unable to fetch rules")
+		return
+	}
+	t := struct {
+		Data struct {
+			Managed    []ruleResp          `json:"managed"`
+			Exceptions []exceptionRuleResp `json:"exceptions"`
+			Foreign    []foreignRuleResp   `json:"foreign"`
+			Reconcile  *reconcileResp      `json:"reconcile,omitempty"`
+		} `json:"data"`
+	}{}
+	t.Data.Managed = make([]ruleResp, 0, len(rules))
+	for _, rule := range rules {
+		t.Data.Managed = append(t.Data.Managed, ruleResp{IP: rule.IP, Table: rule.Table})
+	}
+	t.Data.Exceptions = make([]exceptionRuleResp, 0, len(exceptions))
+	for _, rule := range exceptions {
+		t.Data.Exceptions = append(t.Data.Exceptions, exceptionRuleResp{
+			IP:    rule.IP,
+			To:    rule.To,
+			Proto: rule.Proto,
+			Port:  rule.Port,
+			Table: rule.Table,
+		})
+	}
+	t.Data.Foreign = make([]foreignRuleResp, 0, len(foreign))
+	for _, rule := range foreign {
+		t.Data.Foreign = append(t.Data.Foreign, foreignRuleResp{
+			Priority: rule.Priority,
+			Rule:     rule.Spec,
+			IPv6:     rule.IPv6,
+		})
+	}
+	if rp != nil {
+		if res := rp.LastResult(); !res.Time.IsZero() {
+			t.Data.Reconcile = reconcileToResp(res)
+			t.Data.Reconcile.Time = res.Time.Format(time.RFC3339)
+		}
+	}
+	json.NewEncoder(w).Encode(t)
+}
@@ -0,0 +1,81 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockRuleLister struct {
+	rules      []router.Rule
+	exceptions []router.Rule
+	foreign    []router.ForeignRule
+}
+
+func (m mockRuleLister) Rules() ([]router.Rule, error) {
+	return m.rules, nil
+}
+
+func (m mockRuleLister) Exceptions() ([]router.Rule, error) {
+	return m.exceptions, nil
+}
+
+func (m mockRuleLister) ForeignRules() ([]router.ForeignRule, error) {
+	return m.foreign, nil
+}
+
+type mockReconcileStatus router.ReconcileResult
+
+func (m mockReconcileStatus) LastResult() router.ReconcileResult {
+	return router.ReconcileResult(m)
+}
+
+func TestGetRules(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth(), nil)
+	get := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://127.0.0.1/api/rules", nil)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		server.GetRules(w, req)
+		return w
+	}
+	assert.Equal(http.StatusNotImplemented, get().Code)
+
+	server.SetRuleLister(mockRuleLister{
+		rules: []router.Rule{{IP: "10.0.0.1", Table: "vpn"}},
+		exceptions: []router.Rule{
+			{IP: "10.0.0.1", Table: "defgw", To: "192.168.0.0/16"},
+			{IP: "10.0.0.1", Table: "null", To: "8.8.8.8/32", Proto: "udp", Port: 53},
+		},
+		foreign: []router.ForeignRule{
+			{Priority: 0, Spec: "from all lookup local"},
+			{Priority: 32766, Spec: "from all lookup main", IPv6: true},
+		},
+	})
+	w := get()
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":{"managed":[{"ip":"10.0.0.1","table":"vpn"}],"exceptions":[`+
+		`{"ip":"10.0.0.1","to":"192.168.0.0/16","table":"defgw"},{"ip":"10.0.0.1","to":"8.8.8.8/32","proto":"udp","port":53,"table":"null"}],"foreign":[`+
+		`{"priority":0,"rule":"from all lookup local"},{"priority":32766,"rule":"from all lookup main","ipv6":true}]}}`,
+		strings.TrimSpace(w.Body.String()))
+
+	server.SetRuleLister(mockRuleLister{})
+	server.SetReconcileStatusProvider(mockReconcileStatus{})
+	assert.Equal(`{"data":{"managed":[],"exceptions":[],"foreign":[]}}`, strings.TrimSpace(get().Body.String()), "Not reconciled yet")
+	server.SetReconcileStatusProvider(mockReconcileStatus{
+		Time:  time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC),
+		Moved: []router.Rule{{IP: "10.0.0.2", Table: "vpn"}},
+		Err:   errors.New("no such table"),
+	})
+	assert.Equal(`{"data":{"managed":[],"exceptions":[],"foreign":[],"reconcile":{"time":"2026-10-18T12:00:00Z",`+
+		`"moved":[{"ip":"10.0.0.2","table":"vpn"}],"error":"no such table"}}}`, strings.TrimSpace(get().Body.String()))
+}
@@ -0,0 +1,182 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/zenazn/goji/web"
+)
+
+type nextResp struct {
+	Time  string `json:"time"`
+	Table string `json:"table"`
+}
+
+func nextToResp(c router.ScheduledChange) *nextResp {
+	return &nextResp{
+		Time:  c.Time.Format(time.RFC3339),
+		Table: c.Table,
+	}
+}
+
+type scheduleResp struct {
+	Name  string    `json:"name"`
+	MAC   string    `json:"mac,omitempty"`
+	Group string    `json:"group,omitempty"`
+	Days  []string  `json:"days"`
+	Start string    `json:"start"`
+	End   string    `json:"end"`
+	Table string    `json:"table"`
+	Else  string    `json:"else"`
+	Next  *nextResp `json:"next,omitempty"`
+}
+
+func scheduleToResp(s router.Schedule, now time.Time) scheduleResp {
+	days := make([]string, 0, len(s.Days))
+	for _, d := range s.Days {
+		days = append(days, router.WeekdayName(d))
+	}
+	resp := scheduleResp{
+		Name:  s.Name,
+		MAC:   s.MAC,
+		Group: s.Group,
+		Days:  days,
+		Start: s.Start.String(),
+		End:   s.End.String(),
+		Table: s.Table,
+		Else:  s.Else,
+	}
+	if next, ok := s.Next(now); ok {
+		resp.Next = nextToResp(next)
+	}
+	return resp
+}
+
+func (s *Server) GetSchedules(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	scheds, err := s.router.Schedules()
+	if err != nil {
+		log.Printf("GetSchedules/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Unable to fetch schedules")
+		return
+	}
+	now := time.Now()
+	resps := make([]scheduleResp, 0, len(scheds))
+	for _, sched := range scheds {
+		resps = append(resps, scheduleToResp(sched, now))
+	}
+	t := struct {
+		Data []scheduleResp `json:"data"`
+	}{
+		Data: resps,
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+type scheduleReq struct {
+	Data struct {
+		MAC   string
+		Group string
+		Days  []string
+		Start string
+		End   string
+		Table string
+		Else  string
+	} `json:"data"`
+}
+
+func parseScheduleReq(name string, req scheduleReq) (router.Schedule, bool) {
+	sched := router.Schedule{
+		Name:  name,
+		MAC:   req.Data.MAC,
+		Group: req.Data.Group,
+		Table: req.Data.Table,
+		Else:  req.Data.Else,
+	}
+	for _, d := range req.Data.Days {
+		day, err := router.ParseWeekday(d)
+		if err != nil {
+			return sched, false
+		}
+		sched.Days = append(sched.Days, day)
+	}
+	var err, err2 error
+	sched.Start, err = router.ParseClock(req.Data.Start)
+	sched.End, err2 = router.ParseClock(req.Data.End)
+	return sched, err == nil && err2 == nil
+}
+
+// SetSchedule creates or replaces the schedule named in the URL.
+func (s *Server) SetSchedule(c web.C, w http.ResponseWriter, r *http.Request) {
+	w, done := countRouteRequest("schedule", w)
+	defer done()
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	var req scheduleReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+
+	sched, ok := parseScheduleReq(c.URLParams["name"], req)
+	if !ok {
+		sendError(w, http.StatusBadRequest, "400", "Invalid schedule")
+		return
+	}
+	if !s.checkTables(w, sched.Table, sched.Else) {
+		return
+	}
+	if err := s.router.SetSchedule(sched); err != nil {
+		sendScheduleError(w, err)
+		return
+	}
+	scheds, err := s.router.Schedules()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "500", "Could not get schedules")
+		return
+	}
+	for _, saved := range scheds {
+		if saved.Name == sched.Name {
+			t := struct {
+				Data scheduleResp `json:"data"`
+			}{
+				Data: scheduleToResp(saved, time.Now()),
+			}
+			json.NewEncoder(w).Encode(&t)
+			return
+		}
+	}
+	sendError(w, http.StatusNotFound, "404", "Schedule not found")
+}
+
+func (s *Server) DeleteSchedule(c web.C, w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	if err := s.router.DeleteSchedule(c.URLParams["name"]); err != nil {
+		sendScheduleError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func sendScheduleError(w http.ResponseWriter, err error) {
+	switch err {
+	case router.ErrUnknownSchedule:
+		sendError(w, http.StatusNotFound, "404", "Schedule not found")
+	case router.ErrInvalidSchedule:
+		sendError(w, http.StatusBadRequest, "400", "Invalid schedule")
+	default:
+		log.Printf("Schedule/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not process request")
+	}
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
+)
+
+func TestGetSchedules(t *testing.T) {
+	assert := assert.New(t)
+	server := Server{
+		router: mockRouter{schedules: []router.Schedule{
+			{Name: "bed", MAC: "aa:bb:cc:dd:ee:01", Days: []time.Weekday{time.Sunday, time.Monday}, Start: 22 * 60, End: 7 * 60, Table: "null", Else: "defgw"},
+		}},
+		tables: testTables,
+	}
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/schedules", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.GetSchedules(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	body := w.Body.String()
+	assert.Contains(body, `{"name":"bed","mac":"aa:bb:cc:dd:ee:01","days":["sun","mon"],"start":"22:00","end":"07:00","table":"null","else":"defgw","next":{"time":`)
+}
+
+func TestSetSchedule(t *testing.T) {
+	assert := assert.New(t)
+	mock := mockRouter{schedules: []router.Schedule{
+		{Name: "bed", Group: "kids", Start: 22 * 60, End: 7 * 60, Table: "null"},
+	}}
+	server := &Server{
+		router: mock,
+		auth:   NewTokenAuth("token"),
+		tables: testTables,
+	}
+	put := func(reqStr, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("PUT", "http://127.0.0.1/api/schedules/bed", strings.NewReader(reqStr))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.SetSchedule(web.C{URLParams: map[string]string{"name": "bed"}}, w, req)
+		return w
+	}
+
+	const valid = `{"data":{"group":"kids","start":"22:00","end":"07:00","table":"null"}}`
+	w := put(valid, "")
+	assert.Equal(http.StatusUnauthorized, w.Code)
+
+	w = put(`{"data":{"group":"kids","days":["someday"],"start":"22:00","end":"07:00","table":"null"}}`, "token")
+	assert.Equal(http.StatusBadRequest, w.Code, "Invalid day")
+	w = put(`{"data":{"group":"kids","start":"25:00","end":"07:00","table":"null"}}`, "token")
+	assert.Equal(http.StatusBadRequest, w.Code, "Invalid time")
+
+	w = put(`{"data":{"group":"kids","start":"22:00","end":"07:00","table":"nope"}}`, "token")
+	assert.Equal(http.StatusBadRequest, w.Code, "Unknown table")
+	w = put(`{"data":{"group":"kids","start":"22:00","end":"07:00","table":"null","else":"nope"}}`, "token")
+	assert.Equal(http.StatusBadRequest, w.Code, "Unknown else table")
+
+	w = put(valid, "token")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Body.String(), `{"data":{"name":"bed","group":"kids","days":[],"start":"22:00","end":"07:00","table":"null","else":"","next":`)
+
+	mock.scheduleErr = router.ErrInvalidSchedule
+	server.router = mock
+	w = put(valid, "token")
+	assert.Equal(http.StatusBadRequest, w.Code)
+}
+
+func TestRoutesNext(t *testing.T) {
+	next := router.ScheduledChange{Time: time.Date(2026, 10, 18, 22, 0, 0, 0, time.UTC), Table: "null"}
+	resp := routeToRespRoute(router.Route{IP: "127.0.0.1", Table: "defgw", Next: &next})
+	assert.Equal(t, &nextResp{Time: "2026-10-18T22:00:00Z", Table: "null"}, resp.Next)
+}
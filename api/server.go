@@ -3,11 +3,14 @@ package api
 import (
 	"encoding/json"
 	"log"
+	"net"
 	"net/http"
 	"sort"
-	"strings"
+	"sync"
+	"time"
 
 	"github.com/blang/vpnrouter/router"
+	"github.com/zenazn/goji/web"
 )
 
 func NewServer(router router.Router, auth AuthProvider, tables []TableDef) *Server {
@@ -20,20 +23,61 @@ func NewServer(router router.Router, auth AuthProvider, tables []TableDef) *Serv
 
 type Server struct {
 	router router.Router
+	mu     sync.RWMutex
 	auth   AuthProvider
 	tables []TableDef
+	health HealthProvider
+	strict KillSwitchProvider
+	rules  RuleLister
+	status TableStatusProvider
+	tunnel TunnelProvider
+	ovpn   OpenVPNProvider
+	domain DomainPolicyProvider
+	events EventSource
+	state  StateProvider
+
+	auditLog  AuditLog
+	reconcile ReconcileStatusProvider
+}
+
+// Reload replaces the auth provider and tables of a running server.
+func (s *Server) Reload(auth AuthProvider, tables []TableDef) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.auth = auth
+	s.tables = tables
 }
 
 type TableDef struct {
-	Name string `json:"name"`
-	Text string `json:"text"`
+	Name        string `json:"name"`
+	Text        string `json:"text"`
+	Description string `json:"description,omitempty"`
+	ID          uint32 `json:"id,omitempty"`
+	Icon        string `json:"icon,omitempty"`
+	// Set for tables with health checks
+	Fallback string      `json:"fallback,omitempty"`
+	Health   *healthResp `json:"health,omitempty"`
+	// Set for strict tables
+	KillSwitch *killSwitchResp `json:"killswitch,omitempty"`
+	// Routes found in the table
+	Status *tableStatusResp `json:"status,omitempty"`
+	// Set for tables with an OpenVPN tunnel
+	OpenVPN *openVPNResp `json:"openvpn,omitempty"`
 }
 
 type routesResp struct {
-	IP       string `json:"ip"`
-	Table    string `json:"table"`
-	Hostname string `json:"hostname"`
-	MAC      string `json:"mac"`
+	IP       string    `json:"ip"`
+	IP6      []string  `json:"ip6,omitempty"`
+	Table    string    `json:"table"`
+	Hostname string    `json:"hostname"`
+	MAC      string    `json:"mac"`
+	Group    string    `json:"group,omitempty"`
+	Next     *nextResp `json:"next,omitempty"`
+	// Expiry of a temporary table and the seconds remaining
+	Expires   string `json:"expires,omitempty"`
+	Remaining int64  `json:"remaining,omitempty"`
+	// Exceptions of the host and those inherited from its group
+	Exceptions []exceptionResp `json:"exceptions,omitempty"`
 }
 
 type ByHostname []routesResp
@@ -43,20 +87,37 @@ func (a ByHostname) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
 func (a ByHostname) Less(i, j int) bool { return a[i].Hostname > a[j].Hostname }
 
 func parseIP(addr string) string {
-	parts := strings.SplitN(addr, ":", 2)
-	if len(parts) == 0 {
-		return ""
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
 	}
-	return parts[0]
+	return host
 }
 
 func routeToRespRoute(r router.Route) routesResp {
-	return routesResp{
+	var next *nextResp
+	if r.Next != nil {
+		next = nextToResp(*r.Next)
+	}
+	resp := routesResp{
 		IP:       r.IP,
+		IP6:      r.Lease.IP6,
 		Table:    r.Table,
 		Hostname: r.Lease.Name,
 		MAC:      r.Lease.MAC,
+		Group:    r.Group,
+		Next:     next,
+
+		Exceptions: routeExceptions(r),
+	}
+	if !r.Expires.IsZero() {
+		resp.Expires = r.Expires.Format(time.RFC3339)
+		resp.Remaining = int64(r.Expires.Sub(time.Now()).Seconds() + 0.5)
+		if resp.Remaining < 1 {
+			resp.Remaining = 1
+		}
 	}
+	return resp
 }
 
 func (s *Server) GetRoutes(w http.ResponseWriter, r *http.Request) {
@@ -89,10 +150,14 @@ func (s *Server) GetRoutes(w http.ResponseWriter, r *http.Request) {
 
 func (s *Server) GetTables(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/vnd.api+json")
+	// Providers may be slow, they are queried without holding the lock
+	s.mu.RLock()
+	tables, health, strict, status, ovpn := s.tables, s.health, s.strict, s.status, s.ovpn
+	s.mu.RUnlock()
 	resp := struct {
 		Data []TableDef `json:"data"`
 	}{
-		Data: s.tables,
+		Data: tablesWithOpenVPN(tablesWithStatus(tablesWithKillSwitch(tablesWithHealth(tables, health), strict), status), ovpn),
 	}
 	err := json.NewEncoder(w).Encode(resp)
 	if err != nil {
@@ -104,10 +169,62 @@ type setReq struct {
 	Data struct {
 		IP    string
 		Table string
+		// Set the table of all members of a group instead
+		Group string
+		// Revert to the previous table after a duration like "90m" or at an RFC3339 time
+		Duration string
+		Until    string
 	} `json:"data"`
 }
 
+// parseUntil returns the expiry of a temporary route request, zero if the route is permanent.
+func parseUntil(duration, until string, now time.Time) (time.Time, bool) {
+	switch {
+	case duration != "" && until != "":
+		return time.Time{}, false
+	case duration != "":
+		d, err := time.ParseDuration(duration)
+		if err != nil || d <= 0 {
+			return time.Time{}, false
+		}
+		return now.Add(d), true
+	case until != "":
+		t, err := time.Parse(time.RFC3339, until)
+		if err != nil || !t.After(now) {
+			return time.Time{}, false
+		}
+		return t, true
+	}
+	return time.Time{}, true
+}
+
+// tableExists returns true if name is a configured table.
+func (s *Server) tableExists(name string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tables {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// checkTables sends an error for the first of tables which is not configured
+// and returns false. Empty names are left to the caller.
+func (s *Server) checkTables(w http.ResponseWriter, tables ...string) bool {
+	for _, t := range tables {
+		if t != "" && !s.tableExists(t) {
+			sendError(w, http.StatusBadRequest, "400", "Unknown table "+t)
+			return false
+		}
+	}
+	return true
+}
+
 func (s *Server) SetRoute(w http.ResponseWriter, r *http.Request) {
+	w, done := countRouteRequest("set", w)
+	defer done()
 	w.Header().Set("Content-Type", "application/vnd.api+json")
 	ip := parseIP(r.RemoteAddr)
 	dec := json.NewDecoder(r.Body)
@@ -120,15 +237,40 @@ func (s *Server) SetRoute(w http.ResponseWriter, r *http.Request) {
 	defer r.Body.Close()
 
 	changeReq := req.Data
+	until, ok := parseUntil(changeReq.Duration, changeReq.Until, time.Now())
+	if !ok || (!until.IsZero() && changeReq.Group != "") {
+		sendError(w, http.StatusBadRequest, "400", "Invalid duration or expiry")
+		return
+	}
+	if !s.checkTables(w, changeReq.Table) {
+		return
+	}
+	if changeReq.Group != "" {
+		s.setGroupRoute(w, r, changeReq.Group, changeReq.Table)
+		return
+	}
 	// Auth if ip does not match
-	if changeReq.IP != ip {
-		authd := s.auth.Auth(r)
-		if !authd {
-			sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
-			return
-		}
+	if changeReq.IP != ip && !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	before, _ := s.router.Routes()
+	entry := hostAudit(before, "set", changeReq.IP, changeReq.Table)
+	if until.IsZero() {
+		err = s.routerFor(r).SetRoute(changeReq.IP, changeReq.Table)
+	} else {
+		entry.Until = &until
+		err = s.routerFor(r).SetTemporaryRoute(changeReq.IP, changeReq.Table, until)
+	}
+	s.recordAudit(r, err, entry)
+	if err == router.ErrUnknownHost {
+		sendError(w, http.StatusNotFound, "404", "Host not found")
+		return
+	}
+	if err == router.ErrNoTemporary {
+		sendError(w, http.StatusBadRequest, "400", "Temporary routes not supported")
+		return
 	}
-	err = s.router.SetRoute(changeReq.IP, changeReq.Table)
 	if err != nil {
 		sendError(w, http.StatusInternalServerError, "500", "Could not process request")
 		return
@@ -147,9 +289,206 @@ func (s *Server) SetRoute(w http.ResponseWriter, r *http.Request) {
 	sendRoute(w, route)
 }
 
+// DeleteRoute resets the route of the host with the ip given in the URL,
+// the kernel routes the host by its main table afterwards.
+func (s *Server) DeleteRoute(c web.C, w http.ResponseWriter, r *http.Request) {
+	w, done := countRouteRequest("delete", w)
+	defer done()
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	ip := c.URLParams["ip"]
+	if net.ParseIP(ip) == nil {
+		sendError(w, http.StatusBadRequest, "400", "Invalid IP")
+		return
+	}
+	// Auth if ip does not match
+	if ip != parseIP(r.RemoteAddr) && !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	before, _ := s.router.Routes()
+	err := s.routerFor(r).DeleteRoute(ip)
+	s.recordAudit(r, err, hostAudit(before, "delete", ip, ""))
+	if err == router.ErrUnknownHost {
+		sendError(w, http.StatusNotFound, "404", "Host not found")
+		return
+	}
+	if err != nil {
+		log.Printf("DeleteRoute/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not process request")
+		return
+	}
+	rs, err := s.router.Routes()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "500", "Could not get routes")
+		return
+	}
+	route, found := routeByIP(rs, ip)
+	if !found {
+		sendError(w, http.StatusNotFound, "404", "Route not found")
+		return
+	}
+
+	sendRoute(w, route)
+}
+
+type batchReq struct {
+	Data []struct {
+		IP    string
+		Table string
+	} `json:"data"`
+}
+
+type batchResult struct {
+	IP      string      `json:"ip"`
+	Table   string      `json:"table"`
+	Applied bool        `json:"applied"`
+	Error   string      `json:"error,omitempty"`
+	Route   *routesResp `json:"route,omitempty"`
+}
+
+// SetRoutes applies many changes at once, either all or none of them.
+// A change with an empty table resets the route of the host.
+func (s *Server) SetRoutes(w http.ResponseWriter, r *http.Request) {
+	w, done := countRouteRequest("batch", w)
+	defer done()
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	ip := parseIP(r.RemoteAddr)
+	var req batchReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Data) == 0 {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+
+	results := make([]batchResult, len(req.Data))
+	changes := make([]router.Rule, len(req.Data))
+	authRequired, invalid := false, ""
+	for i, c := range req.Data {
+		results[i] = batchResult{IP: c.IP, Table: c.Table}
+		changes[i] = router.Rule{IP: c.IP, Table: c.Table}
+		if net.ParseIP(c.IP) == nil {
+			results[i].Error = "Invalid IP"
+			invalid = results[i].Error
+		} else if c.Table != "" && !s.tableExists(c.Table) {
+			results[i].Error = "Unknown table"
+			invalid = results[i].Error
+		}
+		// Auth if any ip does not match
+		if c.IP != ip {
+			authRequired = true
+		}
+	}
+	if authRequired && !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	if invalid != "" {
+		sendBatch(w, http.StatusBadRequest, results, JSONError{Code: "400", Title: invalid})
+		return
+	}
+
+	before, _ := s.router.Routes()
+	entries := make([]router.AuditEntry, len(changes))
+	for i, c := range changes {
+		entries[i] = hostAudit(before, "batch", c.IP, c.Table)
+	}
+	err := s.routerFor(r).SetRoutes(changes)
+	s.recordAudit(r, err, entries...)
+	if be, ok := err.(*router.BatchError); ok && be.Err == router.ErrUnknownHost {
+		results[be.Index].Error = "Host not found"
+		sendBatch(w, http.StatusNotFound, results, JSONError{Code: "404", Title: "Host not found"})
+		return
+	} else if ok {
+		log.Printf("SetRoutes/Error: %s", err)
+		results[be.Index].Error = "Could not apply change"
+	}
+	if err != nil {
+		sendBatch(w, http.StatusInternalServerError, results, JSONError{Code: "500", Title: "Could not process request"})
+		return
+	}
+
+	rs, err := s.router.Routes()
+	if err != nil {
+		sendError(w, http.StatusInternalServerError, "500", "Could not get routes")
+		return
+	}
+	for i := range results {
+		results[i].Applied = true
+		if route, found := routeByIP(rs, results[i].IP); found {
+			resp := routeToRespRoute(route)
+			results[i].Route = &resp
+		}
+	}
+	sendBatch(w, http.StatusOK, results)
+}
+
+func sendBatch(w http.ResponseWriter, httpCode int, results []batchResult, errs ...JSONError) {
+	t := struct {
+		Data   []batchResult `json:"data"`
+		Errors []JSONError   `json:"errors,omitempty"`
+	}{
+		Data:   results,
+		Errors: errs,
+	}
+	w.WriteHeader(httpCode)
+	json.NewEncoder(w).Encode(&t)
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if !s.auth.Auth(r) {
+		authFailures.Inc(authProvider(r))
+		return false
+	}
+	return true
+}
+
+// ActorRouter is implemented by routers attributing their changes to someone.
+type ActorRouter interface {
+	As(actor string) router.Router
+}
+
+// routerFor returns the router making changes on behalf of the client of r:
+// the authorized user of basic auth or the IP of the client.
+func (s *Server) routerFor(r *http.Request) router.Router {
+	a, ok := s.router.(ActorRouter)
+	if !ok {
+		return s.router
+	}
+	return a.As(s.client(r).actor())
+}
+
+// requestClient describes the client sending a request.
+type requestClient struct {
+	IP string
+	// User of basic auth, only set if authorized by it
+	User string
+	// Provider authorizing the request, empty if unauthorized
+	Auth string
+}
+
+func (c requestClient) actor() string {
+	if c.User != "" {
+		return c.User + "@" + c.IP
+	}
+	return c.IP
+}
+
+func (s *Server) client(r *http.Request) requestClient {
+	s.mu.RLock()
+	auth := s.auth
+	s.mu.RUnlock()
+	c := requestClient{IP: parseIP(r.RemoteAddr), Auth: authName(auth, r)}
+	if c.Auth == "basic" {
+		c.User, _, _ = r.BasicAuth()
+	}
+	return c
+}
+
 func routeByIP(rs []router.Route, ip string) (router.Route, bool) {
 	for _, r := range rs {
-		if r.IP == ip {
+		if r.IP == ip || r.Lease.HasAddr(ip) {
 			return r, true
 		}
 	}
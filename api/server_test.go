@@ -6,14 +6,29 @@ import (
 	"net/http/httptest"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/blang/vpnrouter/router"
 	"github.com/stretchr/testify/assert"
+	"github.com/zenazn/goji/web"
 )
 
 type mockRouter struct {
-	routesFn   func() ([]router.Route, error)
-	setRouteFn func(ip, table string) error
+	routesFn      func() ([]router.Route, error)
+	setRouteFn    func(ip, table string) error
+	deleteRouteFn func(ip string) error
+	setRoutesFn   func(changes []router.Rule) error
+	setTempFn     func(ip, table string, until time.Time) error
+	groups        []router.Group
+	groupErr      error
+	schedules     []router.Schedule
+	scheduleErr   error
+	exceptionsFn  func(ip string, exceptions []router.Rule) error
+}
+
+var testTables = []TableDef{
+	{Name: "table1"}, {Name: "table2"}, {Name: "table3"},
+	{Name: "vpn"}, {Name: "null"}, {Name: "defgw"}, {Name: "fail"},
 }
 
 func (r mockRouter) Routes() ([]router.Route, error) {
@@ -24,6 +39,54 @@ func (r mockRouter) SetRoute(ip, table string) error {
 	return r.setRouteFn(ip, table)
 }
 
+func (r mockRouter) SetTemporaryRoute(ip, table string, until time.Time) error {
+	return r.setTempFn(ip, table, until)
+}
+
+func (r mockRouter) DeleteRoute(ip string) error {
+	return r.deleteRouteFn(ip)
+}
+
+func (r mockRouter) SetRoutes(changes []router.Rule) error {
+	return r.setRoutesFn(changes)
+}
+
+func (r mockRouter) Groups() ([]router.Group, error) {
+	return r.groups, nil
+}
+
+func (r mockRouter) SetGroup(g router.Group) error {
+	return r.groupErr
+}
+
+func (r mockRouter) DeleteGroup(name string) error {
+	return r.groupErr
+}
+
+func (r mockRouter) SetGroupRoute(name, table string) error {
+	return r.groupErr
+}
+
+func (r mockRouter) Schedules() ([]router.Schedule, error) {
+	return r.schedules, nil
+}
+
+func (r mockRouter) SetSchedule(s router.Schedule) error {
+	return r.scheduleErr
+}
+
+func (r mockRouter) DeleteSchedule(name string) error {
+	return r.scheduleErr
+}
+
+func (r mockRouter) SetExceptions(ip string, exceptions []router.Rule) error {
+	return r.exceptionsFn(ip, exceptions)
+}
+
+func (r mockRouter) SetGroupExceptions(name string, exceptions []router.Rule) error {
+	return r.groupErr
+}
+
 func TestRoutes(t *testing.T) {
 	assert := assert.New(t)
 	mock := mockRouter{
@@ -36,6 +99,7 @@ func TestRoutes(t *testing.T) {
 
 	server := Server{
 		router: mock,
+		tables: testTables,
 	}
 	req, err := http.NewRequest("GET", "http://127.0.0.1", nil)
 	if err != nil {
@@ -74,6 +138,7 @@ func TestSetRoute(t *testing.T) {
 	server := Server{
 		router: mock,
 		auth:   NewTokenAuth(),
+		tables: testTables,
 	}
 	const reqStr = `{"data":{"ip":"127.0.0.1","table":"table2"}}`
 	req, err := http.NewRequest("POST", "http://127.0.0.1", strings.NewReader(reqStr))
@@ -110,6 +175,7 @@ func TestSetRouteAuthorizedSameIP(t *testing.T) {
 	server := Server{
 		router: mock,
 		auth:   NewTokenAuth(""),
+		tables: testTables,
 	}
 	const reqStr = `{"data":{"ip":"127.0.0.1","table":"table2"}}`
 	req, err := http.NewRequest("POST", "http://127.0.0.1", strings.NewReader(reqStr))
@@ -124,6 +190,16 @@ func TestSetRouteAuthorizedSameIP(t *testing.T) {
 	assert.Equal(http.StatusOK, w.Code, "Invalid status code")
 	assert.Equal("table2", mock_routes[0].Table)
 	assert.Equal(`{"data":{"ip":"127.0.0.1","table":"table2","hostname":"name","mac":"abc"}}`, strings.TrimSpace(w.Body.String()))
+
+	req, err = http.NewRequest("POST", "http://127.0.0.1", strings.NewReader(`{"data":{"ip":"127.0.0.1","table":"nope"}}`))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	req.RemoteAddr = "127.0.0.1:6000"
+	w = httptest.NewRecorder()
+	server.SetRoute(w, req)
+	assert.Equal(http.StatusBadRequest, w.Code, "Unknown table")
+	assert.Equal("table2", mock_routes[0].Table)
 }
 
 func TestSetRouteAuthorized(t *testing.T) {
@@ -148,6 +224,7 @@ func TestSetRouteAuthorized(t *testing.T) {
 	server := Server{
 		router: mock,
 		auth:   NewTokenAuth("token"),
+		tables: testTables,
 	}
 	const reqStr = `{"data":{"ip":"127.0.0.1","table":"table2"}}`
 	req, err := http.NewRequest("POST", "http://127.0.0.1", strings.NewReader(reqStr))
@@ -166,11 +243,202 @@ func TestSetRouteAuthorized(t *testing.T) {
 	assert.Equal(`{"data":{"ip":"127.0.0.1","table":"table2","hostname":"name","mac":"abc"}}`, strings.TrimSpace(w.Body.String()))
 }
 
+func TestSetTemporaryRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	mock_routes := []router.Route{
+		{IP: "127.0.0.1", Table: "table1", Lease: router.Host{MAC: "abc", IP: "127.0.0.1", Name: "name"}},
+	}
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return mock_routes, nil
+		},
+		setTempFn: func(ip, table string, until time.Time) error {
+			if ip != mock_routes[0].IP {
+				return router.ErrUnknownHost
+			}
+			mock_routes[0].Table = table
+			mock_routes[0].Expires = until
+			return nil
+		},
+	}
+	server := Server{
+		router: mock,
+		auth:   NewTokenAuth(""),
+		tables: testTables,
+	}
+	post := func(reqStr string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://127.0.0.1", strings.NewReader(reqStr))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = "127.0.0.1:6000"
+		w := httptest.NewRecorder()
+		server.SetRoute(w, req)
+		return w
+	}
+
+	w := post(`{"data":{"ip":"127.0.0.1","table":"table2","duration":"90m"}}`)
+	assert.Equal(http.StatusOK, w.Code, "Invalid status code")
+	assert.Equal("table2", mock_routes[0].Table)
+	assert.WithinDuration(time.Now().Add(90*time.Minute), mock_routes[0].Expires, time.Minute)
+	assert.Contains(w.Body.String(), `"remaining":5400`)
+
+	until := time.Now().Add(time.Hour).Truncate(time.Second)
+	w = post(`{"data":{"ip":"127.0.0.1","table":"table3","until":"` + until.Format(time.RFC3339) + `"}}`)
+	assert.Equal(http.StatusOK, w.Code, "Invalid status code")
+	assert.True(until.Equal(mock_routes[0].Expires), "Expiry")
+	assert.Contains(w.Body.String(), `"expires":"`+until.Format(time.RFC3339)+`"`)
+
+	for _, reqStr := range []string{
+		`{"data":{"ip":"127.0.0.1","table":"table2","duration":"-5m"}}`,
+		`{"data":{"ip":"127.0.0.1","table":"table2","duration":"soon"}}`,
+		`{"data":{"ip":"127.0.0.1","table":"table2","until":"2001-01-01T00:00:00Z"}}`,
+		`{"data":{"ip":"127.0.0.1","table":"table2","duration":"5m","until":"2101-01-01T00:00:00Z"}}`,
+		`{"data":{"group":"kids","table":"table2","duration":"5m"}}`,
+	} {
+		w = post(reqStr)
+		assert.Equal(http.StatusBadRequest, w.Code, reqStr)
+	}
+}
+
+func TestDeleteRoute(t *testing.T) {
+	assert := assert.New(t)
+
+	mock_routes := []router.Route{
+		{IP: "127.0.0.1", Table: "table1", Lease: router.Host{MAC: "abc", IP: "127.0.0.1", Name: "name"}},
+	}
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return mock_routes, nil
+		},
+		deleteRouteFn: func(ip string) error {
+			if ip == mock_routes[0].IP {
+				mock_routes[0].Table = router.DefaultTable
+				return nil
+			}
+			return router.ErrUnknownHost
+		},
+	}
+
+	server := Server{
+		router: mock,
+		auth:   NewTokenAuth("token"),
+		tables: testTables,
+	}
+	del := func(ip, remote, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("DELETE", "http://127.0.0.1/api/routes/"+ip, nil)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.DeleteRoute(web.C{URLParams: map[string]string{"ip": ip}}, w, req)
+		return w
+	}
+
+	w := del("127.0.0.1", "127.0.0.2:6000", "")
+	assert.Equal(http.StatusUnauthorized, w.Code, "Other IP without auth")
+	assert.Equal("table1", mock_routes[0].Table)
+
+	w = del("invalid", "127.0.0.2:6000", "token")
+	assert.Equal(http.StatusBadRequest, w.Code)
+
+	w = del("127.0.0.3", "127.0.0.2:6000", "token")
+	assert.Equal(http.StatusNotFound, w.Code)
+
+	w = del("127.0.0.1", "127.0.0.1:6000", "")
+	assert.Equal(http.StatusOK, w.Code, "Same IP")
+	assert.Equal(`{"data":{"ip":"127.0.0.1","table":"null","hostname":"name","mac":"abc"}}`, strings.TrimSpace(w.Body.String()))
+}
+
+func TestSetRoutes(t *testing.T) {
+	assert := assert.New(t)
+
+	mock_routes := []router.Route{
+		{IP: "127.0.0.1", Table: "table1", Lease: router.Host{MAC: "abc", IP: "127.0.0.1", Name: "name"}},
+		{IP: "127.0.0.2", Table: "table1", Lease: router.Host{MAC: "def", IP: "127.0.0.2", IP6: []string{"::2"}, Name: "name2"}},
+	}
+	mock := mockRouter{
+		routesFn: func() ([]router.Route, error) {
+			return mock_routes, nil
+		},
+		setRoutesFn: func(changes []router.Rule) error {
+			for i, c := range changes {
+				if _, found := routeByIP(mock_routes, c.IP); !found {
+					return &router.BatchError{Index: i, Err: router.ErrUnknownHost}
+				}
+				if c.Table == "fail" {
+					return &router.BatchError{Index: i, Err: errors.New("failed")}
+				}
+			}
+			for _, c := range changes {
+				for i := range mock_routes {
+					if mock_routes[i].IP == c.IP || mock_routes[i].Lease.HasAddr(c.IP) {
+						mock_routes[i].Table = c.Table
+					}
+				}
+			}
+			return nil
+		},
+	}
+
+	server := Server{
+		router: mock,
+		auth:   NewTokenAuth("token"),
+		tables: testTables,
+	}
+	batch := func(reqStr, remote, token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://127.0.0.1/api/routes:batch", strings.NewReader(reqStr))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = remote
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.SetRoutes(w, req)
+		return w
+	}
+
+	w := batch(`{"data":[{"ip":"127.0.0.1","table":"table2"},{"ip":"127.0.0.2","table":"table2"}]}`, "127.0.0.1:6000", "")
+	assert.Equal(http.StatusUnauthorized, w.Code, "Other IP without auth")
+
+	w = batch(`{"data":[]}`, "127.0.0.1:6000", "token")
+	assert.Equal(http.StatusBadRequest, w.Code, "Empty batch")
+
+	w = batch(`{"data":[{"ip":"127.0.0.1","table":"table2"},{"ip":"invalid","table":"table2"}]}`, "127.0.0.1:6000", "token")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(`{"data":[{"ip":"127.0.0.1","table":"table2","applied":false},{"ip":"invalid","table":"table2","applied":false,"error":"Invalid IP"}],"errors":[{"code":"400","title":"Invalid IP"}]}`, strings.TrimSpace(w.Body.String()))
+
+	w = batch(`{"data":[{"ip":"127.0.0.1","table":"table2"},{"ip":"127.0.0.2","table":"nope"}]}`, "127.0.0.1:6000", "token")
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Equal(`{"data":[{"ip":"127.0.0.1","table":"table2","applied":false},{"ip":"127.0.0.2","table":"nope","applied":false,"error":"Unknown table"}],"errors":[{"code":"400","title":"Unknown table"}]}`, strings.TrimSpace(w.Body.String()))
+
+	w = batch(`{"data":[{"ip":"127.0.0.1","table":"table2"},{"ip":"127.0.0.3","table":"table2"}]}`, "127.0.0.1:6000", "token")
+	assert.Equal(http.StatusNotFound, w.Code)
+	assert.Equal(`{"data":[{"ip":"127.0.0.1","table":"table2","applied":false},{"ip":"127.0.0.3","table":"table2","applied":false,"error":"Host not found"}],"errors":[{"code":"404","title":"Host not found"}]}`, strings.TrimSpace(w.Body.String()))
+
+	w = batch(`{"data":[{"ip":"127.0.0.1","table":"fail"}]}`, "127.0.0.1:6000", "")
+	assert.Equal(http.StatusInternalServerError, w.Code)
+	assert.Equal("table1", mock_routes[0].Table)
+
+	w = batch(`{"data":[{"ip":"127.0.0.1","table":"table2"},{"ip":"::2","table":"table2"}]}`, "127.0.0.5:6000", "token")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"ip":"127.0.0.1","table":"table2","applied":true,"route":{"ip":"127.0.0.1","table":"table2","hostname":"name","mac":"abc"}},{"ip":"::2","table":"table2","applied":true,"route":{"ip":"127.0.0.2","ip6":["::2"],"table":"table2","hostname":"name2","mac":"def"}}]}`, strings.TrimSpace(w.Body.String()))
+}
+
 func TestParseIP(t *testing.T) {
 	assert := assert.New(t)
 
 	assert.Equal("127.0.0.1", parseIP("127.0.0.1:1000"))
 	assert.Equal("192.168.0.1", parseIP("192.168.0.1:4567"))
+	assert.Equal("2001:db8::1", parseIP("[2001:db8::1]:4567"))
+	assert.Equal("::1", parseIP("[::1]:4567"))
 }
 
 func TestRoutesError(t *testing.T) {
@@ -183,6 +451,7 @@ func TestRoutesError(t *testing.T) {
 
 	server := Server{
 		router: mock,
+		tables: testTables,
 	}
 	req, err := http.NewRequest("GET", "http://127.0.0.1", nil)
 	if err != nil {
@@ -0,0 +1,168 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// StateProvider exports and restores the routing state.
+type StateProvider interface {
+	// State returns the current state without tables
+	State() (router.State, error)
+	Restore(s router.State) error
+}
+
+// SetStateProvider enables Export and Import.
+func (s *Server) SetStateProvider(p StateProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.state = p
+}
+
+// currentState returns the state including the configured tables.
+func (s *Server) currentState(p StateProvider) (router.State, error) {
+	state, err := p.State()
+	if err != nil {
+		return state, err
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	for _, t := range s.tables {
+		state.Tables = append(state.Tables, router.StateTable{Name: t.Name, Text: t.Text})
+	}
+	return state, nil
+}
+
+// Export returns the routing state as versioned JSON document, accepted by Import.
+func (s *Server) Export(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	s.mu.RLock()
+	p := s.state
+	s.mu.RUnlock()
+	if p == nil {
+		sendError(w, http.StatusNotImplemented, "501", "Export not available")
+		return
+	}
+	state, err := s.currentState(p)
+	if err != nil {
+		log.Printf("Export/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not export state")
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="vpnrouter-%s.json"`, state.Time.Format("20060102")))
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(&state)
+}
+
+type importResp struct {
+	DryRun  bool                 `json:"dry_run"`
+	Changes []router.StateChange `json:"changes"`
+}
+
+// Import replaces the names, routes, groups and schedules by those of the
+// posted document and returns the changes. Nothing is changed with the query
+// parameter dry_run=true. All tables used by the document must be configured.
+func (s *Server) Import(w http.ResponseWriter, r *http.Request) {
+	w, done := countRouteRequest("import", w)
+	defer done()
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	if !s.authorized(r) {
+		sendError(w, http.StatusUnauthorized, "401", "Invalid authorization")
+		return
+	}
+	s.mu.RLock()
+	p := s.state
+	s.mu.RUnlock()
+	if p == nil {
+		sendError(w, http.StatusNotImplemented, "501", "Import not available")
+		return
+	}
+	dryRun := false
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		if dryRun, err = strconv.ParseBool(v); err != nil {
+			sendError(w, http.StatusBadRequest, "400", "Invalid dry_run")
+			return
+		}
+	}
+	var state router.State
+	if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+		sendError(w, http.StatusBadRequest, "400", "Unable to process request")
+		return
+	}
+	defer r.Body.Close()
+	state, err := router.NormalizeState(state)
+	if err != nil {
+		sendError(w, http.StatusBadRequest, "400", err.Error())
+		return
+	}
+	var unknown []string
+	for _, t := range state.UsedTables() {
+		if !s.tableExists(t) {
+			unknown = append(unknown, t)
+		}
+	}
+	if len(unknown) > 0 {
+		sendError(w, http.StatusBadRequest, "400", "Unknown tables: "+strings.Join(unknown, ", "))
+		return
+	}
+
+	current, err := p.State()
+	if err != nil {
+		log.Printf("Import/Error: %s", err)
+		sendError(w, http.StatusInternalServerError, "500", "Could not get current state")
+		return
+	}
+	changes := router.DiffState(current, state)
+	if !dryRun {
+		err := p.Restore(state)
+		s.recordAudit(r, err, importAudit(current, state)...)
+		if err != nil {
+			log.Printf("Import/Error: %s", err)
+			sendError(w, http.StatusInternalServerError, "500", "Could not import state")
+			return
+		}
+	}
+	if changes == nil {
+		changes = []router.StateChange{}
+	}
+	t := struct {
+		Data importResp `json:"data"`
+	}{
+		Data: importResp{DryRun: dryRun, Changes: changes},
+	}
+	json.NewEncoder(w).Encode(&t)
+}
+
+// importAudit returns the entries of the route changes made by importing s.
+func importAudit(current, s router.State) []router.AuditEntry {
+	old := make(map[string]string)
+	for _, rt := range current.Routes {
+		old[rt.MAC] = rt.Table
+	}
+	var entries []router.AuditEntry
+	for _, rt := range s.Routes {
+		if old[rt.MAC] != rt.Table {
+			entries = append(entries, router.AuditEntry{Action: "import", MAC: rt.MAC, OldTable: old[rt.MAC], NewTable: rt.Table, Until: rt.Expires})
+		}
+		delete(old, rt.MAC)
+	}
+	for _, rt := range current.Routes {
+		if _, ok := old[rt.MAC]; ok {
+			entries = append(entries, router.AuditEntry{Action: "import", MAC: rt.MAC, OldTable: rt.Table})
+		}
+	}
+	return entries
+}
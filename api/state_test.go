@@ -0,0 +1,121 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockState struct {
+	state    router.State
+	restored []router.State
+}
+
+func (m *mockState) State() (router.State, error) {
+	return m.state, nil
+}
+
+func (m *mockState) Restore(s router.State) error {
+	m.restored = append(m.restored, s)
+	m.state = s
+	return nil
+}
+
+func TestExport(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth("token"), []TableDef{{Name: "vpn", Text: "VPN"}})
+	get := func(token string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://127.0.0.1/api/export", nil)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.Export(w, req)
+		return w
+	}
+	assert.Equal(http.StatusNotImplemented, get("token").Code)
+	server.SetStateProvider(&mockState{state: router.State{
+		Version: router.StateVersion,
+		Routes:  []router.StateRoute{{MAC: "aa:bb:cc:dd:ee:01", Table: "vpn"}},
+	}})
+	assert.Equal(http.StatusUnauthorized, get("").Code)
+
+	w := get("token")
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Contains(w.Header().Get("Content-Disposition"), "attachment")
+	var s router.State
+	assert.Nil(json.NewDecoder(w.Body).Decode(&s))
+	assert.Equal([]router.StateTable{{Name: "vpn", Text: "VPN"}}, s.Tables)
+	assert.Equal("vpn", s.Routes[0].Table)
+}
+
+func TestImport(t *testing.T) {
+	assert := assert.New(t)
+	current := router.State{
+		Version: router.StateVersion,
+		Routes: []router.StateRoute{
+			{MAC: "aa:bb:cc:dd:ee:01", Table: "vpn"},
+			{MAC: "aa:bb:cc:dd:ee:02", Table: "defgw"},
+		},
+	}
+	state := &mockState{state: current}
+	audit := &mockAudit{}
+	server := NewServer(mockRouter{}, NewTokenAuth("token"), []TableDef{{Name: "vpn"}, {Name: "defgw"}})
+	server.SetStateProvider(state)
+	server.SetAuditLog(audit)
+	post := func(token, query, body string) *httptest.ResponseRecorder {
+		req, err := http.NewRequest("POST", "http://127.0.0.1/api/import"+query, strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		req.RemoteAddr = "127.0.0.1:6000"
+		if token != "" {
+			req.Header.Set("Authorization", authHelper(token))
+		}
+		w := httptest.NewRecorder()
+		server.Import(w, req)
+		return w
+	}
+	doc := `{"version":1,"routes":[{"mac":"AA:BB:CC:DD:EE:01","table":"defgw"}],"groups":[{"name":"kids","macs":[],"table":"vpn"}]}`
+
+	assert.Equal(http.StatusUnauthorized, post("", "", doc).Code)
+	assert.Equal(http.StatusBadRequest, post("token", "", `{"version":2}`).Code)
+	assert.Equal(http.StatusBadRequest, post("token", "?dry_run=maybe", doc).Code)
+	w := post("token", "", `{"version":1,"routes":[{"mac":"aa:bb:cc:dd:ee:01","table":"tor"}]}`)
+	assert.Equal(http.StatusBadRequest, w.Code)
+	assert.Contains(w.Body.String(), "Unknown tables: tor")
+
+	w = post("token", "?dry_run=true", doc)
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":{"dry_run":true,"changes":[`+
+		`{"kind":"route","key":"aa:bb:cc:dd:ee:01","old":"vpn","new":"defgw"},`+
+		`{"kind":"route","key":"aa:bb:cc:dd:ee:02","old":"defgw"},`+
+		`{"kind":"group","key":"kids","new":"vpn []"}]}}`, strings.TrimSpace(w.Body.String()))
+	assert.Nil(state.restored)
+	assert.Nil(audit.entries)
+
+	w = post("token", "", doc)
+	assert.Equal(http.StatusOK, w.Code)
+	if assert.Len(state.restored, 1) {
+		assert.Equal([]router.StateRoute{{MAC: "aa:bb:cc:dd:ee:01", Table: "defgw"}}, state.restored[0].Routes)
+	}
+	if assert.Len(audit.entries, 2) {
+		assert.Equal("import", audit.entries[0].Action)
+		assert.Equal("vpn", audit.entries[0].OldTable)
+		assert.Equal("defgw", audit.entries[0].NewTable)
+		assert.Equal("aa:bb:cc:dd:ee:02", audit.entries[1].MAC)
+		assert.Equal("", audit.entries[1].NewTable)
+		assert.Equal("token", audit.entries[1].Auth)
+	}
+
+	w = post("token", "", doc)
+	assert.Equal(`{"data":{"dry_run":false,"changes":[]}}`, strings.TrimSpace(w.Body.String()))
+}
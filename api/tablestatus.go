@@ -0,0 +1,50 @@
+package api
+
+import (
+	"log"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// TableStatusProvider inspects the routes of tables.
+type TableStatusProvider interface {
+	TableStatus(table string) (router.TableStatus, error)
+}
+
+type tableStatusResp struct {
+	Populated bool `json:"populated"`
+	Usable    bool `json:"usable"`
+	// The default route is installed by vpnrouter
+	Managed bool   `json:"managed"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SetTableStatusProvider adds the state of the routes of all tables to GetTables.
+func (s *Server) SetTableStatusProvider(p TableStatusProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.status = p
+}
+
+// tablesWithStatus returns a copy of tables with the state of their routes.
+func tablesWithStatus(tables []TableDef, p TableStatusProvider) []TableDef {
+	if p == nil {
+		return tables
+	}
+	defs := make([]TableDef, len(tables))
+	for i, t := range tables {
+		defs[i] = t
+		status, err := p.TableStatus(t.Name)
+		if err != nil {
+			log.Printf("GetTables/Error: %s", err)
+			continue
+		}
+		defs[i].Status = &tableStatusResp{
+			Populated: status.Populated,
+			Usable:    status.Usable,
+			Managed:   status.Managed,
+			Error:     status.Err,
+		}
+	}
+	return defs
+}
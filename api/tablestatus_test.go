@@ -0,0 +1,46 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTableStatus map[string]router.TableStatus
+
+func (m mockTableStatus) TableStatus(table string) (router.TableStatus, error) {
+	status, ok := m[table]
+	if !ok {
+		return router.TableStatus{}, router.ErrUnknownTable
+	}
+	return status, nil
+}
+
+func TestGetTablesStatus(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth(), []TableDef{
+		{Name: "null", Text: "Gesperrt"},
+		{Name: "defgw", Text: "KabelD"},
+		{Name: "vpn", Text: "VPN"},
+	})
+	server.SetTableStatusProvider(mockTableStatus{
+		"defgw": {Populated: true, Usable: true},
+		"vpn":   {Managed: true, Err: "netlink route of table vpn: no such device"},
+	})
+	req, err := http.NewRequest("GET", "http://127.0.0.1/api/tables", nil)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	w := httptest.NewRecorder()
+	server.GetTables(w, req)
+
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"name":"null","text":"Gesperrt"},`+
+		`{"name":"defgw","text":"KabelD","status":{"populated":true,"usable":true,"managed":false}},`+
+		`{"name":"vpn","text":"VPN","status":{"populated":false,"usable":false,"managed":true,"error":"netlink route of table vpn: no such device"}}]}`,
+		strings.TrimSpace(w.Body.String()))
+}
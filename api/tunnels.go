@@ -0,0 +1,96 @@
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+)
+
+// TunnelProvider reports the state of the WireGuard tunnels of tables.
+type TunnelProvider interface {
+	Tunnels() []router.WireGuardTunnelState
+}
+
+// SetTunnelProvider enables GetTunnels.
+func (s *Server) SetTunnelProvider(p TunnelProvider) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tunnel = p
+}
+
+type tunnelResp struct {
+	Table      string `json:"table"`
+	Interface  string `json:"interface"`
+	PublicKey  string `json:"public_key,omitempty"`
+	ListenPort int    `json:"listen_port,omitempty"`
+	// Any peer had a recent handshake
+	Alive bool             `json:"alive"`
+	Error string           `json:"error,omitempty"`
+	Peers []tunnelPeerResp `json:"peers"`
+}
+
+type tunnelPeerResp struct {
+	PublicKey     string `json:"public_key"`
+	Endpoint      string `json:"endpoint,omitempty"`
+	LastHandshake string `json:"last_handshake,omitempty"`
+	// Seconds since the last handshake, omitted without handshake
+	HandshakeAge *int64 `json:"handshake_age,omitempty"`
+	Alive        bool   `json:"alive"`
+	RxBytes      uint64 `json:"rx_bytes"`
+	TxBytes      uint64 `json:"tx_bytes"`
+}
+
+func tunnelToResp(t router.WireGuardTunnelState, now time.Time) tunnelResp {
+	resp := tunnelResp{
+		Table:      t.Table,
+		Interface:  t.Interface,
+		ListenPort: t.Device.ListenPort,
+		Error:      t.Err,
+		Peers:      make([]tunnelPeerResp, 0, len(t.Device.Peers)),
+	}
+	if !t.Device.PublicKey.IsZero() {
+		resp.PublicKey = t.Device.PublicKey.String()
+	}
+	for _, p := range t.Device.Peers {
+		peer := tunnelPeerResp{
+			PublicKey: p.PublicKey.String(),
+			Endpoint:  p.Endpoint,
+			Alive:     p.Alive(now),
+			RxBytes:   p.RxBytes,
+			TxBytes:   p.TxBytes,
+		}
+		if !p.LastHandshake.IsZero() {
+			peer.LastHandshake = p.LastHandshake.Format(time.RFC3339)
+			age := int64(now.Sub(p.LastHandshake).Seconds())
+			peer.HandshakeAge = &age
+		}
+		resp.Alive = resp.Alive || peer.Alive
+		resp.Peers = append(resp.Peers, peer)
+	}
+	return resp
+}
+
+// GetTunnels returns the WireGuard tunnels with the handshakes and transfer of their peers.
+func (s *Server) GetTunnels(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/vnd.api+json")
+	s.mu.RLock()
+	p := s.tunnel
+	s.mu.RUnlock()
+	if p == nil {
+		sendError(w, http.StatusNotImplemented, "501", "Tunnels not available")
+		return
+	}
+	now := time.Now()
+	states := p.Tunnels()
+	resp := struct {
+		Data []tunnelResp `json:"data"`
+	}{
+		Data: make([]tunnelResp, 0, len(states)),
+	}
+	for _, t := range states {
+		resp.Data = append(resp.Data, tunnelToResp(t, now))
+	}
+	json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/blang/vpnrouter/router"
+	"github.com/stretchr/testify/assert"
+)
+
+type mockTunnels []router.WireGuardTunnelState
+
+func (m mockTunnels) Tunnels() []router.WireGuardTunnelState {
+	return m
+}
+
+func TestTunnelToResp(t *testing.T) {
+	assert := assert.New(t)
+	key, _ := router.ParseWireGuardKey("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	handshake := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	state := router.WireGuardTunnelState{
+		WireGuardTunnel: router.WireGuardTunnel{Table: "vpn", Interface: "wg0"},
+		Device: router.WireGuardDevice{
+			ListenPort: 51820,
+			Peers: []router.WireGuardPeerState{
+				{PublicKey: key, Endpoint: "192.0.2.1:51820", LastHandshake: handshake, RxBytes: 10, TxBytes: 20},
+			},
+		},
+	}
+	resp := tunnelToResp(state, handshake.Add(90*time.Second))
+	assert.True(resp.Alive)
+	assert.Equal(int64(90), *resp.Peers[0].HandshakeAge)
+	assert.Equal("2026-10-18T12:00:00Z", resp.Peers[0].LastHandshake)
+	assert.Equal(uint64(20), resp.Peers[0].TxBytes)
+
+	resp = tunnelToResp(state, handshake.Add(time.Hour))
+	assert.False(resp.Alive, "Handshake too old")
+	assert.False(resp.Peers[0].Alive)
+}
+
+func TestGetTunnels(t *testing.T) {
+	assert := assert.New(t)
+	server := NewServer(mockRouter{}, NewTokenAuth(), nil)
+	get := func() *httptest.ResponseRecorder {
+		req, err := http.NewRequest("GET", "http://127.0.0.1/api/tunnels", nil)
+		if err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		w := httptest.NewRecorder()
+		server.GetTunnels(w, req)
+		return w
+	}
+	assert.Equal(http.StatusNotImplemented, get().Code)
+
+	key, _ := router.ParseWireGuardKey("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	server.SetTunnelProvider(mockTunnels{
+		{
+			WireGuardTunnel: router.WireGuardTunnel{Table: "vpn", Interface: "wg0"},
+			Device:          router.WireGuardDevice{Peers: []router.WireGuardPeerState{{PublicKey: key}}},
+		},
+		{
+			WireGuardTunnel: router.WireGuardTunnel{Table: "vpn2", Interface: "wg1"},
+			Err:             "wireguard wg1: no such file or directory",
+		},
+	})
+	w := get()
+	assert.Equal(http.StatusOK, w.Code)
+	assert.Equal(`{"data":[{"table":"vpn","interface":"wg0","alive":false,"peers":[`+
+		`{"public_key":"xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=","alive":false,"rx_bytes":0,"tx_bytes":0}]},`+
+		`{"table":"vpn2","interface":"wg1","alive":false,"error":"wireguard wg1: no such file or directory","peers":[]}]}`,
+		strings.TrimSpace(w.Body.String()))
+}
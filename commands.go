@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/blang/vpnrouter/api"
+	"github.com/blang/vpnrouter/config"
+	"github.com/blang/vpnrouter/router"
+)
+
+// commands talk to the running vpnrouter given by the config.
+var commands = map[string]func(c *apiClient, args []string) error{
+	"export": exportCommand,
+	"import": importCommand,
+}
+
+// runCommand runs the command named by args[0].
+func runCommand(cfg *config.Config, args []string) error {
+	cmd, ok := commands[args[0]]
+	if !ok {
+		var names []string
+		for name := range commands {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("unknown command, use one of %s", strings.Join(names, ", "))
+	}
+	c, err := newAPIClient(cfg)
+	if err != nil {
+		return err
+	}
+	return cmd(c, args[1:])
+}
+
+// exportCommand writes the routing state to a file or stdout.
+func exportCommand(c *apiClient, args []string) error {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	out := fs.String("o", "", "Output file, stdout if empty")
+	fs.Parse(args)
+	resp, err := c.do("GET", "/api/export", nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if *out == "" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*out, data, 0600)
+}
+
+// importCommand restores the routing state of a file or stdin and prints the changes.
+func importCommand(c *apiClient, args []string) error {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only show the changes")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: vpnrouter import [-dry-run] <file|->\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return errors.New("missing file")
+	}
+	in := os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+	resp, err := c.do("POST", fmt.Sprintf("/api/import?dry_run=%t", *dryRun), in)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var t struct {
+		Data struct {
+			DryRun  bool                 `json:"dry_run"`
+			Changes []router.StateChange `json:"changes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil {
+		return err
+	}
+	for _, change := range t.Data.Changes {
+		fmt.Println(change)
+	}
+	switch {
+	case len(t.Data.Changes) == 0:
+		fmt.Println("No changes")
+	case t.Data.DryRun:
+		fmt.Println("Dry run, nothing changed")
+	}
+	return nil
+}
+
+// apiClient sends authorized requests to the API of a running vpnrouter.
+type apiClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// newAPIClient connects to the unix socket of cfg if set, otherwise to its listen address.
+// The first configured token is sent if any.
+func newAPIClient(cfg *config.Config) (*apiClient, error) {
+	c := &apiClient{http: &http.Client{Timeout: time.Minute}}
+	if len(cfg.Auth.Tokens) > 0 {
+		c.token = cfg.Auth.Tokens[0]
+	}
+	if cfg.Socket != "" {
+		c.base = "http://vpnrouter"
+		c.http.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", cfg.Socket)
+			},
+		}
+		return c, nil
+	}
+	if cfg.TLS.Enabled() {
+		return nil, errors.New("commands need the socket if TLS is enabled")
+	}
+	host, port, err := net.SplitHostPort(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	if ip := net.ParseIP(host); host == "" || (ip != nil && ip.IsUnspecified()) {
+		host = "127.0.0.1"
+	}
+	c.base = "http://" + net.JoinHostPort(host, port)
+	return c, nil
+}
+
+// do sends a request and returns the response of a successful one.
+func (c *apiClient) do(method, path string, body io.Reader) (*http.Response, error) {
+	req, err := http.NewRequest(method, c.base+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+base64.StdEncoding.EncodeToString([]byte(c.token)))
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 300 {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var t struct {
+		Errors []api.JSONError `json:"errors"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&t); err != nil || len(t.Errors) == 0 {
+		return nil, errors.New(resp.Status)
+	}
+	return nil, fmt.Errorf("%s: %s", resp.Status, t.Errors[0].Title)
+}
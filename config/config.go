@@ -0,0 +1,430 @@
+// Package config reads the TOML configuration of vpnrouter.
+package config
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Config describes a vpnrouter instance.
+type Config struct {
+	// TCP listen address of the HTTP(S) server
+	Listen string `toml:"listen"`
+	// Optional unix socket for local tooling, requests on it are authorized
+	Socket string `toml:"socket"`
+	TLS    TLS    `toml:"tls"`
+
+	WebDir         string `toml:"web_dir"`
+	LeaseFile      string `toml:"lease_file"`
+	ARPFile        string `toml:"arp_file"`
+	NameFile       string `toml:"name_file"`
+	StoreFile      string `toml:"store_file"`
+	DBFile         string `toml:"db_file"`
+	GroupsFile     string `toml:"groups_file"`
+	SchedulesFile  string `toml:"schedules_file"`
+	ExceptionsFile string `toml:"exceptions_file"`
+	DomainsFile    string `toml:"domains_file"`
+	AuditFile      string `toml:"audit_file"`
+	RTTablesFile   string `toml:"rt_tables_file"`
+
+	// Ethernet devices to get hosts from
+	Devices []string `toml:"devices"`
+
+	IPv6         bool     `toml:"ipv6"`
+	Netlink      bool     `toml:"netlink"`
+	Debug        bool     `toml:"debug"`
+	SyncInterval Duration `toml:"sync_interval"`
+
+	Auth     Auth     `toml:"auth"`
+	Health   Health   `toml:"health"`
+	Rules    Rules    `toml:"rules"`
+	NFTables NFTables `toml:"nftables"`
+	Domains  Domains  `toml:"domains"`
+	Audit    Audit    `toml:"audit"`
+	Tables   []Table  `toml:"table"`
+	// Table shown for hosts without a rule, "null" if empty. Display only,
+	// the kernel routes such hosts by its main table.
+	DisplayTable string `toml:"display_table"`
+}
+
+// TLS enables HTTPS on the listen address.
+type TLS struct {
+	CertFile string `toml:"cert_file"`
+	KeyFile  string `toml:"key_file"`
+	// Generate a self-signed certificate, saved to cert_file and key_file if given
+	SelfSigned bool `toml:"self_signed"`
+	// Address of a plain HTTP listener redirecting to HTTPS
+	Redirect string `toml:"redirect"`
+}
+
+// Enabled returns true if HTTPS is configured.
+func (t TLS) Enabled() bool {
+	return t.SelfSigned || t.CertFile != ""
+}
+
+// Table describes a routing table selectable by the user.
+type Table struct {
+	Name        string `toml:"name"`
+	Label       string `toml:"label"`
+	Description string `toml:"description"`
+	// Kernel table id, only needed if the name is not in rt_tables
+	ID   uint32 `toml:"id"`
+	Icon string `toml:"icon"`
+	// Table used for its hosts while the checks fail
+	Fallback string `toml:"fallback"`
+	Check    Check  `toml:"check"`
+	// Block the hosts of the table if it has no route, instead of
+	// letting the kernel fall through to the main table
+	Strict bool `toml:"strict"`
+	// Default route installed by vpnrouter, the table is added to rt_tables
+	Route   Route   `toml:"route"`
+	OpenVPN OpenVPN `toml:"openvpn"`
+}
+
+// OpenVPN describes the management interface of the OpenVPN instance of a table.
+type OpenVPN struct {
+	// host:port or the path of a unix socket
+	Management string `toml:"management"`
+	Password   string `toml:"password"`
+}
+
+// Route describes the default route of a managed table.
+type Route struct {
+	Gateway string `toml:"gateway"`
+	Device  string `toml:"device"`
+	// WireGuard interface, routed without gateway
+	WireGuard string `toml:"wireguard"`
+	// Config file of the WireGuard interface, which is then created and
+	// configured by vpnrouter
+	WireGuardConfig string `toml:"wireguard_config"`
+}
+
+// Enabled returns true if the table is managed.
+func (r Route) Enabled() bool {
+	return r != Route{}
+}
+
+// Check describes the health checks of a table, all given checks must succeed.
+type Check struct {
+	// Interface which must be up, probes are bound to it
+	Interface string `toml:"interface"`
+	// Address answering ICMP echo requests
+	Ping string `toml:"ping"`
+	// Address accepting TCP connections, like "10.8.0.1:53"
+	TCP string `toml:"tcp"`
+}
+
+// Enabled returns true if any check is configured.
+func (c Check) Enabled() bool {
+	return c != Check{}
+}
+
+// Rules configures the ip rules owned by vpnrouter. Rules outside of the
+// priority range or without the protocol are never read or changed.
+type Rules struct {
+	PriorityMin uint32 `toml:"priority_min"`
+	PriorityMax uint32 `toml:"priority_max"`
+	// Protocol tagging the rules, 0 relies on the priority range alone
+	Protocol uint8 `toml:"protocol"`
+}
+
+// NFTables routes hosts by marking their traffic with nftables, each table
+// then has a single fwmark rule instead of a rule per host.
+type NFTables struct {
+	Enabled bool `toml:"enabled"`
+	// Table of the inet family owned by vpnrouter
+	Table string `toml:"table"`
+	// Match hosts by "ip" or by "mac"
+	Match string `toml:"match"`
+}
+
+// Domains routes the traffic to domains through tables. dnsmasq adds the
+// addresses it resolves for the domains to a set of each table.
+type Domains struct {
+	Enabled bool `toml:"enabled"`
+	// Sets filled by dnsmasq, "nftset" or "ipset"
+	Backend string `toml:"backend"`
+	// Config file of dnsmasq written by vpnrouter
+	DNSMasqConfig string `toml:"dnsmasq_config"`
+	// Command run after the config changed
+	ReloadCommand string `toml:"reload_command"`
+}
+
+// Audit configures the audit log of routing changes.
+type Audit struct {
+	// Entries kept in the store, the oldest are deleted first
+	MaxEntries int `toml:"max_entries"`
+}
+
+// Health configures the probing of tables with checks.
+type Health struct {
+	Interval Duration `toml:"interval"`
+	Timeout  Duration `toml:"timeout"`
+	// Consecutive failed probes until a table is down, as many successful ones bring it up
+	Failures int `toml:"failures"`
+}
+
+// Auth configures the auth backends. A request is authorized if any backend accepts it.
+type Auth struct {
+	AdminIPs []string          `toml:"admin_ips"`
+	Tokens   []string          `toml:"tokens"`
+	Users    map[string]string `toml:"users"`
+}
+
+// Duration is a time.Duration read from strings like "30s".
+type Duration struct {
+	time.Duration
+}
+
+func (d *Duration) UnmarshalText(text []byte) error {
+	var err error
+	d.Duration, err = time.ParseDuration(string(text))
+	return err
+}
+
+func (d Duration) MarshalText() ([]byte, error) {
+	return []byte(d.String()), nil
+}
+
+// Default returns the configuration used without a config file.
+func Default() *Config {
+	c := &Config{}
+	c.setDefaults()
+	return c
+}
+
+func (c *Config) setDefaults() {
+	if c.Listen == "" {
+		c.Listen = ":8080"
+	}
+	if c.WebDir == "" {
+		c.WebDir = "./web"
+	}
+	if c.LeaseFile == "" {
+		c.LeaseFile = "/var/lib/misc/dnsmasq.leases"
+	}
+	if c.ARPFile == "" {
+		c.ARPFile = "/proc/net/arp"
+	}
+	if c.NameFile == "" {
+		c.NameFile = "./names.txt"
+	}
+	if c.StoreFile == "" {
+		c.StoreFile = "./vpnrouter.db"
+	}
+	if c.DBFile == "" {
+		c.DBFile = "./db.txt"
+	}
+	if c.GroupsFile == "" {
+		c.GroupsFile = "./groups.txt"
+	}
+	if c.SchedulesFile == "" {
+		c.SchedulesFile = "./schedules.txt"
+	}
+	if c.ExceptionsFile == "" {
+		c.ExceptionsFile = "./exceptions.txt"
+	}
+	if c.DomainsFile == "" {
+		c.DomainsFile = "./domains.txt"
+	}
+	if c.AuditFile == "" {
+		c.AuditFile = "./audit.log"
+	}
+	if c.Audit.MaxEntries == 0 {
+		c.Audit.MaxEntries = 100000
+	}
+	if c.RTTablesFile == "" {
+		c.RTTablesFile = "/etc/iproute2/rt_tables"
+	}
+	if c.Devices == nil {
+		c.Devices = []string{"eth0", "eth1"}
+	}
+	if c.SyncInterval.Duration == 0 {
+		c.SyncInterval.Duration = 30 * time.Second
+	}
+	if c.Rules.PriorityMin == 0 && c.Rules.PriorityMax == 0 {
+		c.Rules.PriorityMin, c.Rules.PriorityMax = 10000, 10999
+		if c.Rules.Protocol == 0 {
+			c.Rules.Protocol = 86
+		}
+	}
+	if c.NFTables.Table == "" {
+		c.NFTables.Table = "vpnrouter"
+	}
+	if c.NFTables.Match == "" {
+		c.NFTables.Match = "ip"
+	}
+	if c.Domains.Backend == "" {
+		c.Domains.Backend = "nftset"
+	}
+	if c.Domains.DNSMasqConfig == "" {
+		c.Domains.DNSMasqConfig = "/etc/dnsmasq.d/vpnrouter.conf"
+	}
+	if c.Domains.ReloadCommand == "" {
+		c.Domains.ReloadCommand = "systemctl restart dnsmasq"
+	}
+	if c.Health.Interval.Duration == 0 {
+		c.Health.Interval.Duration = 10 * time.Second
+	}
+	if c.Health.Timeout.Duration == 0 {
+		c.Health.Timeout.Duration = 2 * time.Second
+	}
+	if c.Health.Failures == 0 {
+		c.Health.Failures = 3
+	}
+	if c.Auth.AdminIPs == nil && c.Auth.Tokens == nil && c.Auth.Users == nil {
+		c.Auth.AdminIPs = []string{"127.0.0.1"}
+	}
+	if c.Tables == nil {
+		c.Tables = []Table{
+			{Name: "null", Label: "Gesperrt"},
+			{Name: "defgw", Label: "KabelD"},
+		}
+	}
+}
+
+// Load reads a config file, missing values are set to their defaults.
+func Load(file string) (*Config, error) {
+	c := &Config{}
+	md, err := toml.DecodeFile(file, c)
+	if err != nil {
+		return nil, err
+	}
+	if undecoded := md.Undecoded(); len(undecoded) > 0 {
+		return nil, fmt.Errorf("unknown config keys: %v", undecoded)
+	}
+	c.setDefaults()
+	return c, nil
+}
+
+// Validate checks the config for consistency and the existence of all files.
+func (c *Config) Validate() error {
+	if len(c.Tables) == 0 {
+		return errors.New("no tables given")
+	}
+	names := make(map[string]Table)
+	for i, t := range c.Tables {
+		if t.Name == "" || strings.ContainsAny(t.Name, " \t") {
+			return fmt.Errorf("table %d: invalid name %q", i+1, t.Name)
+		}
+		if _, ok := names[t.Name]; ok {
+			return fmt.Errorf("table %s: defined twice", t.Name)
+		}
+		names[t.Name] = t
+	}
+	for _, t := range c.Tables {
+		if err := t.validateCheck(names); err != nil {
+			return fmt.Errorf("table %s: %s", t.Name, err)
+		}
+		if err := t.Route.validate(); err != nil {
+			return fmt.Errorf("table %s: route: %s", t.Name, err)
+		}
+		if t.OpenVPN.Password != "" && t.OpenVPN.Management == "" {
+			return fmt.Errorf("table %s: openvpn: password without management", t.Name)
+		}
+	}
+	// 32766 is the rule of the main table
+	if c.Rules.PriorityMin == 0 || c.Rules.PriorityMin > c.Rules.PriorityMax || c.Rules.PriorityMax >= 32766 {
+		return errors.New("rules: priorities must be in 1-32765 with priority_min <= priority_max")
+	}
+	if c.NFTables.Match != "ip" && c.NFTables.Match != "mac" {
+		return fmt.Errorf("nftables: match must be ip or mac, not %q", c.NFTables.Match)
+	}
+	if c.NFTables.Table == "" || strings.ContainsAny(c.NFTables.Table, " \t{};") {
+		return fmt.Errorf("nftables: invalid table %q", c.NFTables.Table)
+	}
+	if c.Domains.Backend != "nftset" && c.Domains.Backend != "ipset" {
+		return fmt.Errorf("domains: backend must be nftset or ipset, not %q", c.Domains.Backend)
+	}
+	if c.Audit.MaxEntries < 0 {
+		return errors.New("audit: max_entries must not be negative")
+	}
+	if c.Health.Interval.Duration <= 0 || c.Health.Timeout.Duration <= 0 || c.Health.Failures <= 0 {
+		return errors.New("health: interval, timeout and failures must be positive")
+	}
+	if _, ok := names[c.DisplayTable]; c.DisplayTable != "" && !ok {
+		return fmt.Errorf("display table %s is not defined", c.DisplayTable)
+	}
+	if len(c.Devices) == 0 {
+		return errors.New("no devices given")
+	}
+	if c.SyncInterval.Duration <= 0 {
+		return errors.New("sync interval must be positive")
+	}
+	if (c.TLS.CertFile == "") != (c.TLS.KeyFile == "") {
+		return errors.New("tls: cert_file and key_file must be given together")
+	}
+	if c.TLS.Redirect != "" && !c.TLS.Enabled() {
+		return errors.New("tls: redirect requires a certificate")
+	}
+
+	fi, err := os.Stat(c.WebDir)
+	if err != nil {
+		return fmt.Errorf("invalid web dir: %s", err)
+	}
+	if !fi.IsDir() {
+		return fmt.Errorf("web dir %s is not a directory", c.WebDir)
+	}
+	files := map[string]string{
+		"lease": c.LeaseFile,
+		"arp":   c.ARPFile,
+		"name":  c.NameFile,
+	}
+	// Rules are installed by table id
+	if c.Netlink || c.NFTables.Enabled || c.Domains.Enabled {
+		files["rt_tables"] = c.RTTablesFile
+	}
+	for kind, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			return fmt.Errorf("error opening %s file: %s", kind, err)
+		}
+		f.Close()
+	}
+	// no need to check db file for existence
+	return nil
+}
+
+func (r Route) validate() error {
+	if r.WireGuard != "" && (r.Gateway != "" || r.Device != "") {
+		return errors.New("wireguard excludes gateway and device")
+	}
+	if r.WireGuardConfig != "" && r.WireGuard == "" {
+		return errors.New("wireguard_config without wireguard interface")
+	}
+	if r.Gateway != "" && net.ParseIP(r.Gateway) == nil {
+		return fmt.Errorf("invalid gateway %s", r.Gateway)
+	}
+	return nil
+}
+
+func (t Table) validateCheck(names map[string]Table) error {
+	if t.Fallback != "" {
+		fallback, ok := names[t.Fallback]
+		if !ok || t.Fallback == t.Name {
+			return fmt.Errorf("invalid fallback %s", t.Fallback)
+		}
+		if !t.Check.Enabled() {
+			return errors.New("fallback without check")
+		}
+		// Failover would move the hosts to a table leaking their traffic
+		if t.Strict && !fallback.Strict {
+			return fmt.Errorf("strict table with non-strict fallback %s", t.Fallback)
+		}
+	}
+	if t.Check.Ping != "" && net.ParseIP(t.Check.Ping) == nil {
+		return fmt.Errorf("invalid ping address %s", t.Check.Ping)
+	}
+	if t.Check.TCP != "" {
+		if _, _, err := net.SplitHostPort(t.Check.TCP); err != nil {
+			return fmt.Errorf("invalid tcp address %s", t.Check.TCP)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,202 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTempFile(t *testing.T, s string) string {
+	f, err := ioutil.TempFile("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	return f.Name()
+}
+
+const fixture_config = `
+listen = ":8080"
+devices = ["br0"]
+sync_interval = "1m"
+
+[auth]
+tokens = ["secret"]
+
+[[table]]
+name = "vpn"
+label = "VPN"
+id = 100
+icon = "lock"
+
+[table.route]
+wireguard = "wg0"
+`
+
+func TestLoad(t *testing.T) {
+	assert := assert.New(t)
+	file := writeTempFile(t, fixture_config)
+	defer os.Remove(file)
+
+	c, err := Load(file)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(":8080", c.Listen)
+	assert.Equal([]string{"br0"}, c.Devices)
+	assert.Equal(time.Minute, c.SyncInterval.Duration)
+	assert.Equal([]string{"secret"}, c.Auth.Tokens)
+	assert.Nil(c.Auth.AdminIPs, "No default admin IPs if any auth is configured")
+	assert.Equal([]Table{{Name: "vpn", Label: "VPN", ID: 100, Icon: "lock", Route: Route{WireGuard: "wg0"}}}, c.Tables)
+
+	// Defaults
+	assert.Equal("./vpnrouter.db", c.StoreFile)
+	assert.Equal("./db.txt", c.DBFile)
+	assert.Equal("./groups.txt", c.GroupsFile)
+	assert.Equal("./schedules.txt", c.SchedulesFile)
+	assert.Equal("./exceptions.txt", c.ExceptionsFile)
+	assert.Equal("./domains.txt", c.DomainsFile)
+	assert.Equal("./audit.log", c.AuditFile)
+	assert.Equal(Audit{MaxEntries: 100000}, c.Audit)
+	assert.Equal("/proc/net/arp", c.ARPFile)
+	assert.Equal(10*time.Second, c.Health.Interval.Duration)
+	assert.Equal(3, c.Health.Failures)
+	assert.Equal(Rules{PriorityMin: 10000, PriorityMax: 10999, Protocol: 86}, c.Rules)
+	assert.Equal(NFTables{Table: "vpnrouter", Match: "ip"}, c.NFTables)
+	assert.Equal(Domains{Backend: "nftset", DNSMasqConfig: "/etc/dnsmasq.d/vpnrouter.conf", ReloadCommand: "systemctl restart dnsmasq"}, c.Domains)
+}
+
+func TestLoadExample(t *testing.T) {
+	c, err := Load("../example_config.toml")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(t, 3, len(c.Tables))
+}
+
+func TestLoadUnknownKey(t *testing.T) {
+	file := writeTempFile(t, "unknown = 1\n")
+	defer os.Remove(file)
+
+	if _, err := Load(file); err == nil {
+		t.Error("Expected error for unknown key")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := writeTempFile(t, "")
+	defer os.Remove(file)
+
+	valid := func() *Config {
+		c := Default()
+		c.WebDir = dir
+		c.LeaseFile = file
+		c.ARPFile = file
+		c.NameFile = file
+		return c
+	}
+	c := valid()
+	assert.Nil(c.Validate())
+
+	c.Tables = append(c.Tables, Table{Name: "null"})
+	assert.NotNil(c.Validate(), "Duplicate table")
+	c.Tables = []Table{{Name: "a b"}}
+	assert.NotNil(c.Validate(), "Invalid table name")
+	c.Tables = nil
+	assert.NotNil(c.Validate(), "No tables")
+
+	c = valid()
+	c.DisplayTable = "defgw"
+	assert.Nil(c.Validate())
+	c.DisplayTable = "vpn"
+	assert.NotNil(c.Validate(), "Unknown display table")
+
+	c = valid()
+	c.Tables = append(c.Tables, Table{Name: "vpn", Fallback: "defgw", Check: Check{Interface: "tun0", Ping: "10.8.0.1", TCP: "10.8.0.1:53"}})
+	assert.Nil(c.Validate())
+	c.Tables[2].Check.Ping = "tun0"
+	assert.NotNil(c.Validate(), "Invalid ping address")
+	c.Tables[2].Check = Check{TCP: "10.8.0.1"}
+	assert.NotNil(c.Validate(), "TCP address without port")
+	c.Tables[2].Check = Check{}
+	assert.NotNil(c.Validate(), "Fallback without check")
+	c.Tables[2].Check = Check{Interface: "tun0"}
+	c.Tables[2].Fallback = "vpn2"
+	assert.NotNil(c.Validate(), "Unknown fallback")
+	c.Tables[2].Fallback = "vpn"
+	assert.NotNil(c.Validate(), "Fallback to itself")
+	c.Tables[2] = Table{Name: "vpn", Strict: true}
+	assert.Nil(c.Validate(), "Strict table without checks")
+	c.Tables[2] = Table{Name: "vpn", Strict: true, Fallback: "defgw", Check: Check{Interface: "tun0"}}
+	assert.NotNil(c.Validate(), "Strict table with non-strict fallback")
+	c.Tables[1].Strict = true
+	assert.Nil(c.Validate(), "Strict table with strict fallback")
+	c = valid()
+	c.Tables[0].Route = Route{Gateway: "192.168.1.1", Device: "eth2"}
+	assert.Nil(c.Validate())
+	c.Tables[0].Route = Route{Gateway: "gw"}
+	assert.NotNil(c.Validate(), "Invalid gateway")
+	c.Tables[0].Route = Route{WireGuard: "wg0", Device: "eth2"}
+	assert.NotNil(c.Validate(), "WireGuard with device")
+	c.Tables[0].Route = Route{WireGuardConfig: "/etc/wireguard/wg0.conf"}
+	assert.NotNil(c.Validate(), "WireGuard config without interface")
+	c.Tables[0].Route = Route{}
+	c.Tables[0].OpenVPN = OpenVPN{Password: "secret"}
+	assert.NotNil(c.Validate(), "OpenVPN password without management")
+
+	c = valid()
+	c.Rules.PriorityMax = 32766
+	assert.NotNil(c.Validate(), "Range covers main table")
+	c.Rules = Rules{PriorityMin: 200, PriorityMax: 100}
+	assert.NotNil(c.Validate(), "Empty range")
+	c.Rules = Rules{PriorityMin: 100, PriorityMax: 100}
+	assert.Nil(c.Validate(), "Untagged single priority")
+
+	c = valid()
+	c.NFTables.Match = "hostname"
+	assert.NotNil(c.Validate(), "Unknown match")
+	c = valid()
+	c.NFTables.Table = "vpn router"
+	assert.NotNil(c.Validate(), "Invalid nftables table")
+	c = valid()
+	c.NFTables.Enabled = true
+	c.RTTablesFile = dir + "/rt_tables"
+	assert.NotNil(c.Validate(), "Missing rt_tables")
+
+	c = valid()
+	c.Domains.Backend = "dnsmasq"
+	assert.NotNil(c.Validate(), "Unknown domain backend")
+	c = valid()
+	c.Domains.Enabled = true
+	c.RTTablesFile = dir + "/rt_tables"
+	assert.NotNil(c.Validate(), "Missing rt_tables")
+
+	c = valid()
+	c.Health.Failures = -1
+	assert.NotNil(c.Validate(), "Negative failures")
+
+	c = valid()
+	c.WebDir = file
+	assert.NotNil(c.Validate(), "Web dir is no directory")
+
+	c = valid()
+	c.TLS.CertFile = "cert.pem"
+	assert.NotNil(c.Validate(), "Key file missing")
+	c = valid()
+	c.TLS.Redirect = ":80"
+	assert.NotNil(c.Validate(), "Redirect without TLS")
+	c.TLS.SelfSigned = true
+	assert.Nil(c.Validate())
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/blang/vpnrouter/api"
+	"github.com/blang/vpnrouter/config"
+	"github.com/blang/vpnrouter/router"
+)
+
+// Flags override the values of the config file if given
+var (
+	flagConfig         = flag.String("config", "", "Config file, reloaded on SIGHUP")
+	flagListen         = flag.String("listen", ":8080", "Listen addr")
+	flagSocket         = flag.String("socket", "", "Additional unix socket for local tooling")
+	flagTLSCert        = flag.String("tls-cert", "", "TLS certificate file")
+	flagTLSKey         = flag.String("tls-key", "", "TLS key file")
+	flagSelfSigned     = flag.Bool("tls-self-signed", false, "Generate a self-signed certificate, saved to -tls-cert and -tls-key if given")
+	flagTLSRedirect    = flag.String("tls-redirect", "", "Listen addr of a HTTP to HTTPS redirect")
+	flagWebDir         = flag.String("web", "./web", "Path to static files")
+	flagLeaseFile      = flag.String("lease-file", "/var/lib/misc/dnsmasq.leases", "Lease file")
+	flagARPFile        = flag.String("arp-file", "/proc/net/arp", "ARP file")
+	flagNameFile       = flag.String("name-file", "./names.txt", "Static MAC to name mapping")
+	flagStoreFile      = flag.String("store-file", "./vpnrouter.db", "Database of routes, groups, schedules, exceptions, domain policies and the audit log")
+	flagDBFile         = flag.String("db-file", "./db.txt", "Database file of older versions, imported into the store")
+	flagGroupsFile     = flag.String("groups-file", "./groups.txt", "Device groups file of older versions, imported into the store")
+	flagSchedulesFile  = flag.String("schedules-file", "./schedules.txt", "Routing schedules file of older versions, imported into the store")
+	flagExceptionsFile = flag.String("exceptions-file", "./exceptions.txt", "Split tunnelling exceptions file of older versions, imported into the store")
+	flagDomainsFile    = flag.String("domains-file", "./domains.txt", "Domain policies file of older versions, imported into the store")
+	flagAuditFile      = flag.String("audit-file", "./audit.log", "Audit log of older versions, imported into the store")
+	flagDevices        = flag.String("devices", "eth0,eth1", "Ethernet devices to get hosts from")
+	flagAdminIPs       = flag.String("admin-ips", "127.0.0.1", "Admin IPs comma separated")
+	flagTables         = flag.String("tables", "null=Gesperrt,defgw=KabelD", "Routing tables comma separated")
+	flagDisplayTable   = flag.String("display-table", "null", "Table shown for hosts without a rule, display only")
+	flagDebug          = flag.Bool("debug", false, "Enable mock rules")
+	flagNetlink        = flag.Bool("netlink", false, "Manage rules via netlink instead of the ip command")
+	flagRTTables       = flag.String("rt-tables", "/etc/iproute2/rt_tables", "Routing table names file used with -netlink")
+	flagIPv6           = flag.Bool("ipv6", false, "Also route IPv6 neighbours and leases")
+	flagSyncInterval   = flag.Duration("sync-interval", 30*time.Second, "Interval to reconcile rules with hosts")
+)
+
+// loadConfig reads the config file if given, applies the flags set on the
+// command line and validates the result.
+func loadConfig() (*config.Config, error) {
+	c := config.Default()
+	if *flagConfig != "" {
+		var err error
+		c, err = config.Load(*flagConfig)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err := applyFlags(c); err != nil {
+		return nil, err
+	}
+	return c, c.Validate()
+}
+
+func applyFlags(c *config.Config) error {
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "bind":
+			// Registered by goji, whose listener is not used
+			err = errors.New("flag -bind is not supported, use -listen")
+		case "listen":
+			c.Listen = f.Value.String()
+		case "socket":
+			c.Socket = *flagSocket
+		case "tls-cert":
+			c.TLS.CertFile = *flagTLSCert
+		case "tls-key":
+			c.TLS.KeyFile = *flagTLSKey
+		case "tls-self-signed":
+			c.TLS.SelfSigned = *flagSelfSigned
+		case "tls-redirect":
+			c.TLS.Redirect = *flagTLSRedirect
+		case "web":
+			c.WebDir = *flagWebDir
+		case "lease-file":
+			c.LeaseFile = *flagLeaseFile
+		case "arp-file":
+			c.ARPFile = *flagARPFile
+		case "name-file":
+			c.NameFile = *flagNameFile
+		case "store-file":
+			c.StoreFile = *flagStoreFile
+		case "db-file":
+			c.DBFile = *flagDBFile
+		case "groups-file":
+			c.GroupsFile = *flagGroupsFile
+		case "schedules-file":
+			c.SchedulesFile = *flagSchedulesFile
+		case "exceptions-file":
+			c.ExceptionsFile = *flagExceptionsFile
+		case "domains-file":
+			c.DomainsFile = *flagDomainsFile
+		case "audit-file":
+			c.AuditFile = *flagAuditFile
+		case "devices":
+			c.Devices = splitList(*flagDevices)
+		case "admin-ips":
+			c.Auth.AdminIPs = splitList(*flagAdminIPs)
+		case "tables":
+			c.Tables = parseTables(*flagTables)
+		case "display-table":
+			c.DisplayTable = *flagDisplayTable
+		case "debug":
+			c.Debug = *flagDebug
+		case "netlink":
+			c.Netlink = *flagNetlink
+		case "rt-tables":
+			c.RTTablesFile = *flagRTTables
+		case "ipv6":
+			c.IPv6 = *flagIPv6
+		case "sync-interval":
+			c.SyncInterval.Duration = *flagSyncInterval
+		}
+	})
+	return err
+}
+
+func splitList(s string) []string {
+	var l []string
+	for _, e := range strings.Split(s, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			l = append(l, e)
+		}
+	}
+	return l
+}
+
+// parseTables parses table definitions like "null=Gesperrt,defgw=KabelD"
+func parseTables(s string) []config.Table {
+	var tables []config.Table
+	for _, t := range splitList(s) {
+		nameTitle := strings.SplitN(t, "=", 2)
+		if len(nameTitle) != 2 {
+			log.Printf("Ignore invalid table definition: %s", t)
+			continue
+		}
+		tables = append(tables, config.Table{
+			Name:  nameTitle[0],
+			Label: nameTitle[1],
+		})
+	}
+	return tables
+}
+
+func apiTables(tables []config.Table) []api.TableDef {
+	defs := make([]api.TableDef, 0, len(tables))
+	for _, t := range tables {
+		defs = append(defs, api.TableDef{
+			Name:        t.Name,
+			Text:        t.Label,
+			Description: t.Description,
+			ID:          t.ID,
+			Icon:        t.Icon,
+		})
+	}
+	return defs
+}
+
+func tableNames(tables []config.Table) []string {
+	var names []string
+	for _, t := range tables {
+		names = append(names, t.Name)
+	}
+	return names
+}
+
+func strictTables(tables []config.Table) []string {
+	var strict []string
+	for _, t := range tables {
+		if t.Strict {
+			strict = append(strict, t.Name)
+		}
+	}
+	return strict
+}
+
+// tableChecks returns the health checks of all tables with checks.
+func tableChecks(tables []config.Table) []router.TableCheck {
+	var checks []router.TableCheck
+	for _, t := range tables {
+		c := t.Check
+		if !c.Enabled() {
+			continue
+		}
+		tc := router.TableCheck{Table: t.Name, Fallback: t.Fallback}
+		if c.Interface != "" {
+			tc.Checks = append(tc.Checks, router.LinkCheck{Interface: c.Interface})
+		}
+		if c.Ping != "" {
+			tc.Checks = append(tc.Checks, router.PingCheck{Addr: c.Ping, Interface: c.Interface})
+		}
+		if c.TCP != "" {
+			tc.Checks = append(tc.Checks, router.TCPCheck{Addr: c.TCP, Interface: c.Interface})
+		}
+		checks = append(checks, tc)
+	}
+	return checks
+}
+
+// tableRoutes returns the default routes of all managed tables.
+func tableRoutes(tables []config.Table) []router.TableRoute {
+	var routes []router.TableRoute
+	for _, t := range tables {
+		r := t.Route
+		if !r.Enabled() {
+			continue
+		}
+		tr := router.TableRoute{Table: t.Name, Gateway: r.Gateway, Device: r.Device}
+		if r.WireGuard != "" {
+			tr.Device = r.WireGuard
+		}
+		routes = append(routes, tr)
+	}
+	return routes
+}
+
+// loadRouteTables adds the managed tables to the rt_tables file and reads it,
+// the ids given in the config take precedence. The file is optional unless
+// rules are installed by table id.
+func loadRouteTables(c *config.Config) (*router.RouteTables, error) {
+	if !c.Debug {
+		for _, t := range c.Tables {
+			if !t.Route.Enabled() {
+				continue
+			}
+			if _, err := router.AddRouteTable(c.RTTablesFile, t.Name, t.ID); err != nil {
+				return nil, err
+			}
+		}
+	}
+	rtTables, err := router.ReadRouteTables(c.RTTablesFile)
+	if os.IsNotExist(err) && !c.Netlink && !c.NFTables.Enabled && !c.Domains.Enabled {
+		rtTables, err = router.NewRouteTables(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range c.Tables {
+		if t.ID != 0 {
+			rtTables.Add(t.Name, t.ID)
+		}
+	}
+	return rtTables, nil
+}
+
+// wireGuardTunnels returns the tunnels of all tables with a WireGuard config.
+func wireGuardTunnels(tables []config.Table) []router.WireGuardTunnel {
+	var tunnels []router.WireGuardTunnel
+	for _, t := range tables {
+		if t.Route.WireGuardConfig == "" {
+			continue
+		}
+		tunnels = append(tunnels, router.WireGuardTunnel{
+			Table:      t.Name,
+			Interface:  t.Route.WireGuard,
+			ConfigFile: t.Route.WireGuardConfig,
+		})
+	}
+	return tunnels
+}
+
+// openVPNTunnels returns the management interfaces of all tables with OpenVPN.
+func openVPNTunnels(tables []config.Table) router.OpenVPNTunnels {
+	tunnels := make(router.OpenVPNTunnels)
+	for _, t := range tables {
+		if t.OpenVPN.Management != "" {
+			tunnels[t.Name] = router.NewOpenVPNManagement(t.OpenVPN.Management, t.OpenVPN.Password)
+		}
+	}
+	return tunnels
+}
+
+func apiAuth(c config.Auth) api.AuthProvider {
+	// Requests from the unix socket are always authorized
+	auth := api.AnyAuth{api.LocalAuth{}}
+	if len(c.AdminIPs) > 0 {
+		auth = append(auth, api.NewIPAuth(c.AdminIPs...))
+	}
+	if len(c.Tokens) > 0 {
+		auth = append(auth, api.NewTokenAuth(c.Tokens...))
+	}
+	if len(c.Users) > 0 {
+		auth = append(auth, api.NewBasicAuth(c.Users))
+	}
+	return auth
+}
+
+// restartRequired lists the changed settings which are only applied on startup.
+func restartRequired(old, c *config.Config) []string {
+	var changed []string
+	check := func(name string, differs bool) {
+		if differs {
+			changed = append(changed, name)
+		}
+	}
+	check("listen", old.Listen != c.Listen)
+	check("socket", old.Socket != c.Socket)
+	check("tls", old.TLS != c.TLS)
+	check("web_dir", old.WebDir != c.WebDir)
+	check("lease_file", old.LeaseFile != c.LeaseFile)
+	check("arp_file", old.ARPFile != c.ARPFile)
+	check("name_file", old.NameFile != c.NameFile)
+	check("store_file", old.StoreFile != c.StoreFile)
+	check("db_file", old.DBFile != c.DBFile)
+	check("groups_file", old.GroupsFile != c.GroupsFile)
+	check("schedules_file", old.SchedulesFile != c.SchedulesFile)
+	check("exceptions_file", old.ExceptionsFile != c.ExceptionsFile)
+	check("domains_file", old.DomainsFile != c.DomainsFile)
+	check("audit_file", old.AuditFile != c.AuditFile)
+	check("rt_tables_file", old.RTTablesFile != c.RTTablesFile)
+	check("ipv6", old.IPv6 != c.IPv6)
+	check("netlink", old.Netlink != c.Netlink)
+	check("debug", old.Debug != c.Debug)
+	check("sync_interval", old.SyncInterval != c.SyncInterval)
+	check("display_table", old.DisplayTable != c.DisplayTable)
+	check("table ids", tableIDs(old.Tables) != tableIDs(c.Tables))
+	check("health", old.Health != c.Health)
+	check("rules", old.Rules != c.Rules)
+	check("nftables", old.NFTables != c.NFTables)
+	check("domains", old.Domains != c.Domains)
+	check("audit", old.Audit != c.Audit)
+	check("strict tables", fmt.Sprint(strictTables(old.Tables)) != fmt.Sprint(strictTables(c.Tables)))
+	check("table routes", fmt.Sprint(tableRoutes(old.Tables)) != fmt.Sprint(tableRoutes(c.Tables)))
+	check("wireguard tunnels", fmt.Sprint(wireGuardTunnels(old.Tables)) != fmt.Sprint(wireGuardTunnels(c.Tables)))
+	check("table checks", fmt.Sprint(tableChecks(old.Tables)) != fmt.Sprint(tableChecks(c.Tables)))
+	return changed
+}
+
+func tableIDs(tables []config.Table) string {
+	var ids []string
+	for _, t := range tables {
+		if t.ID != 0 {
+			ids = append(ids, fmt.Sprintf("%s=%d", t.Name, t.ID))
+		}
+	}
+	return strings.Join(ids, ",")
+}
@@ -5,138 +5,334 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/blang/vpnrouter/api"
 	"github.com/blang/vpnrouter/router"
 	"github.com/zenazn/goji"
+	"github.com/zenazn/goji/graceful"
 	"github.com/zenazn/goji/web"
 	"github.com/zenazn/goji/web/middleware"
 )
 
-var (
-	//flagListen    = flag.String("listen", ":8080", "Listen addr")
-	flagWebDir    = flag.String("web", "./web", "Path to static files")
-	flagLeaseFile = flag.String("lease-file", "/var/lib/misc/dnsmasq.leases", "Lease file")
-	flagARPFile   = flag.String("arp-file", "/proc/net/arp", "ARP file")
-	flagNameFile  = flag.String("name-file", "./names.txt", "Static MAC to name mapping")
-	flagDBFile    = flag.String("db-file", "./db.txt", "Database file")
-	flagDevices   = flag.String("devices", "eth0,eth1", "Ethernet devices to get hosts from")
-	flagAdminIPs  = flag.String("admin-ips", "127.0.0.1", "Admin IPs comma separated")
-	flagTables    = flag.String("tables", "null=Gesperrt,defgw=KabelD", "Routing tables comma separated")
-	flagDebug     = flag.Bool("debug", false, "Enable mock rules")
-)
-
-var (
-	tables    []api.TableDef
-	adminIPs  []string
-	devices   []string
-	leaseFile string
-	nameFile  string
-	arpFile   string
-	dbFile    string
-	listen    string
-	webDir    string
-)
-
-func prepareFlags() {
+func main() {
 	flag.Parse()
-
-	// prepare tables
-	tableParts := strings.Split(*flagTables, ",")
-	if len(tableParts) == 0 {
-		log.Fatal("No tables given")
-	}
-	for _, t := range tableParts {
-		tp := strings.TrimSpace(t)
-		nameTitle := strings.SplitN(tp, "=", 2)
-		if len(nameTitle) != 2 {
-			log.Printf("Ignore invalid table definition: %s", tp)
-			continue
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatalf("Invalid config: %s", err)
+	}
+	// Commands like export talk to the running instance
+	if flag.NArg() > 0 {
+		if err := runCommand(cfg, flag.Args()); err != nil {
+			log.Fatalf("%s: %s", flag.Arg(0), err)
 		}
-		tables = append(tables, api.TableDef{
-			Name: nameTitle[0],
-			Text: nameTitle[1],
-		})
+		return
 	}
 
-	ips := strings.Split(*flagAdminIPs, ",")
-	for _, ip := range ips {
-		ip = strings.TrimSpace(ip)
-		adminIPs = append(adminIPs, ip)
+	// Routes, groups, schedules, domain policies and the audit log,
+	// the files of older versions are imported on first start
+	store, err := router.OpenBoltStore(cfg.StoreFile)
+	if err != nil {
+		log.Fatalf("Error opening store: %s", err)
 	}
+	defer store.Close()
 
-	devs := strings.Split(*flagDevices, ",")
-	for _, dev := range devs {
-		dev = strings.TrimSpace(dev)
-		devices = append(devices, dev)
+	// Record who changed which route, clients of the API as well as
+	// schedules, expiry, failover and reconciler
+	audit := router.NewStoreAuditLog(store)
+	audit.MaxEntries = cfg.Audit.MaxEntries
+	if err := audit.Import(router.NewAuditLog(cfg.AuditFile)); err != nil {
+		log.Printf("Audit/Error: %s", err)
 	}
 
-	fi, err := os.Stat(*flagWebDir)
+	ipRoute2 := router.NewIPRoute2RuleProvider()
+	ipRoute2.IPv6 = cfg.IPv6
+	prios := router.PriorityRange{Min: cfg.Rules.PriorityMin, Max: cfg.Rules.PriorityMax}
+	ipRoute2.Priorities = prios
+	ipRoute2.Protocol = cfg.Rules.Protocol
+	var ruleProv router.RuleProvider = ipRoute2
+	var killSwitch router.KillSwitchProvider = ipRoute2
+	var exceptions router.ExceptionRuleProvider = ipRoute2
+	// Host rules of older versions are untagged and outside the range
+	var legacy router.LegacyRuleProvider = ipRoute2
+	rtTables, err := loadRouteTables(cfg)
 	if err != nil {
-		log.Fatalf("Invalid webdir: %s", err)
+		log.Fatalf("Error reading routing tables: %s", err)
 	}
-	if !fi.IsDir() {
-		log.Fatalf("Webdir is not a directory")
+	if cfg.Netlink {
+		nl := router.NewNetlinkRuleProvider(rtTables)
+		nl.IPv6 = cfg.IPv6
+		nl.Priorities = prios
+		nl.Protocol = cfg.Rules.Protocol
+		ruleProv = nl
+		killSwitch = nl
+		exceptions = nl
+		legacy = nl
 	}
-	webDir = *flagWebDir
-
-	// check lease file
-	f, err := os.Open(*flagLeaseFile)
-	if err != nil {
-		log.Fatalf("Error opening lease file: %s", err)
+	// Mark the traffic of hosts instead, the kill switch stays with the rules above
+	var nft *router.NFTRuleProvider
+	if cfg.NFTables.Enabled {
+		nft = router.NewNFTRuleProvider(rtTables)
+		nft.IPv6 = cfg.IPv6
+		nft.Priorities = prios
+		nft.Protocol = cfg.Rules.Protocol
+		nft.Table = cfg.NFTables.Table
+		ruleProv = nft
+		exceptions = nft
+	}
+	if cfg.Debug {
+		ruleProv = make(router.DummyRuleProvider)
+		killSwitch = make(router.DummyKillSwitch)
+		exceptions = make(router.DummyExceptions)
+		legacy = nil
 	}
-	f.Close()
-	leaseFile = *flagLeaseFile
 
-	// check arp file
-	f, err = os.Open(*flagARPFile)
-	if err != nil {
-		log.Fatalf("Error opening arp file: %s", err)
+	kernel := ruleProv
+
+	// Bring up WireGuard tunnels before the routes over them
+	var wireGuard router.WireGuardClient = router.NewNetlinkWireGuard()
+	if cfg.Debug {
+		wireGuard = make(router.DummyWireGuard)
+	}
+	tunnels := router.NewWireGuardManager(wireGuard, wireGuardTunnels(cfg.Tables))
+	if err := tunnels.Sync(); err != nil {
+		log.Printf("WireGuard/Error: %s", err)
 	}
-	f.Close()
-	arpFile = *flagARPFile
+	go tunnels.Run(cfg.SyncInterval.Duration, nil)
 
-	// check name file
-	f, err = os.Open(*flagNameFile)
-	if err != nil {
-		log.Fatalf("Error opening name file: %s", err)
+	// Install the default routes of managed tables, restored whenever their interfaces return
+	var tableMgr *router.TableManager
+	if !cfg.Debug {
+		tableMgr = router.NewTableManager(rtTables, tableRoutes(cfg.Tables))
+		tableMgr.IPv6 = cfg.IPv6
+		if err := tableMgr.Sync(); err != nil {
+			log.Printf("Tables/Error: %s", err)
+		}
+		if err := tableMgr.Watch(); err != nil {
+			log.Printf("Error watching links: %s", err)
+		}
+		go tableMgr.Run(cfg.SyncInterval.Duration, nil)
 	}
-	f.Close()
-	nameFile = *flagNameFile
 
-	// no need to check dbFile for existence
-	dbFile = *flagDBFile
-}
+	// Install the kill switch of strict tables before their first host
+	strict := router.NewStrictRuleProvider(ruleProv, killSwitch, strictTables(cfg.Tables))
+	strict.SetExceptionProvider(exceptions)
+	ruleProv = strict
 
-func main() {
-	prepareFlags()
+	// Changes of hosts, routes and tables are published to the clients of the event stream
+	events := router.NewEventBus()
 
-	var ruleProv router.RuleProvider = router.NewIPRoute2RuleProvider()
-	if *flagDebug {
-		ruleProv = make(router.DummyRuleProvider)
+	// Move hosts to the fallback of tables failing their checks
+	health := router.NewHealthMonitor(tableChecks(cfg.Tables))
+	health.SetEventBus(events)
+	health.Timeout = cfg.Health.Timeout.Duration
+	health.Failures = cfg.Health.Failures
+	failover := router.NewFailoverRuleProvider(ruleProv, health)
+	failover.SetExceptionProvider(strict)
+	failover.SetAuditLog(audit)
+	health.OnChange(failover.Update)
+	go health.Run(cfg.Health.Interval.Duration, nil)
+	ruleProv = failover
+
+	// Route the traffic to domains through the sets dnsmasq fills
+	var domains *router.DomainRouter
+	if cfg.Domains.Enabled {
+		domains = router.NewDomainRouter(rtTables, cfg.DomainsFile)
+		domains.SetStore(store)
+		domains.Backend = cfg.Domains.Backend
+		domains.IPv6 = cfg.IPv6
+		domains.Priorities = prios
+		domains.Protocol = cfg.Rules.Protocol
+		domains.NFTTable = cfg.NFTables.Table
+		domains.ConfigFile = cfg.Domains.DNSMasqConfig
+		domains.Reload = strings.Fields(cfg.Domains.ReloadCommand)
+		if cfg.Debug {
+			domains.ConfigFile = ""
+			domains.SetDryRun()
+		}
+		domains.SetStrict(strict)
+		domains.SetHealthMonitor(health)
+		health.OnChange(domains.Update)
+		if err := domains.Init(); err != nil {
+			log.Printf("Domains/Error: %s", err)
+		}
+	}
+
+	dnsmasq := router.NewDNSMasqLeaseProvider(cfg.LeaseFile)
+	dnsmasq.SetEventBus(events)
+	log.Printf("Devices: %s", cfg.Devices)
+	arp := router.NewARPProvider(cfg.Devices, cfg.ARPFile)
+	staticNameProv := router.NewStaticNameProvider(cfg.NameFile)
+	hostprov := router.HostMerger{First: arp, Backup: dnsmasq, StaticName: staticNameProv}
+	var neighbors *router.IPv6NeighProvider
+	if cfg.IPv6 {
+		neighbors = router.NewIPv6NeighProvider(cfg.Devices)
+		hostprov.Neighbors = neighbors
+	}
+	hosts := router.NewHostWatcher(hostprov, events)
+
+	if nft != nil && !cfg.Debug {
+		if cfg.NFTables.Match == "mac" {
+			nft.SetHostProvider(hosts)
+		}
+		if err := nft.Init(); err != nil {
+			log.Printf("NFTables/Error: %s", err)
+		}
 	}
 
 	// Add persistence layer
-	persistence := router.NewRulePersistence(ruleProv, dbFile)
-	persistence.Init()
+	persistence := router.NewRulePersistence(ruleProv, hosts, cfg.DBFile)
+	persistence.SetStore(store)
+	persistence.SetGroupFile(cfg.GroupsFile)
+	persistence.SetScheduleFile(cfg.SchedulesFile)
+	persistence.SetExceptionFile(cfg.ExceptionsFile)
+	persistence.SetExceptionProvider(failover)
+	persistence.SetEventBus(events)
+	persistence.SetAuditLog(audit)
+	if legacy != nil {
+		persistence.SetLegacyRuleProvider(legacy, tableNames(cfg.Tables))
+	}
+	if err := persistence.Init(); err != nil {
+		log.Printf("Error loading database: %s", err)
+	}
+
+	// Keep rules in sync with changing hosts
+	reconciler := router.NewReconciler(hosts, persistence, ruleProv)
+	reconciler.SetStrict(strict)
+	reconciler.SetEventBus(events)
+	// procfs sends no inotify events, changes of the ARP table are picked up by the interval
+	if err := reconciler.Watch(cfg.LeaseFile, cfg.NameFile); err != nil {
+		log.Printf("Error watching host files: %s", err)
+	}
+	go reconciler.Run(cfg.SyncInterval.Duration, nil)
 	ruleProv = persistence
 
-	dnsmasq := router.NewDNSMasqLeaseProvider(leaseFile)
-	log.Printf("Devices: %s", devices)
-	arp := router.NewARPProvider(devices, arpFile)
-	staticNameProv := router.NewStaticNameProvider(nameFile)
-	hostprov := router.HostMerger{arp, dnsmasq, staticNameProv}
-	r := router.NewVPNRouter(hostprov, ruleProv)
-	server := api.NewServer(r, api.NewIPAuth(adminIPs...), tables)
+	scheduler := router.NewScheduler(persistence, hosts)
+	scheduler.SetEventBus(events)
+	go scheduler.Run(time.Minute, nil)
+
+	r := router.NewVPNRouter(hosts, ruleProv)
+	r.SetEventBus(events)
+	r.SetGroupProvider(persistence)
+	r.SetScheduler(scheduler)
+	r.SetExceptionPolicy(persistence)
+	if cfg.DisplayTable != "" {
+		r.SetDisplayTable(cfg.DisplayTable)
+	}
+	// Revert temporary routes when they expire
+	go r.RunExpiry(nil)
+	server := api.NewServer(r, apiAuth(cfg.Auth), apiTables(cfg.Tables))
+	server.SetHealthProvider(health)
+	server.SetKillSwitchProvider(strict)
+	if tableMgr != nil {
+		server.SetTableStatusProvider(tableMgr)
+	}
+	server.SetTunnelProvider(tunnels)
+	// Management interfaces answer slowly or not at all, their state is polled
+	ovpn := router.NewOpenVPNMonitor(openVPNTunnels(cfg.Tables))
+	go ovpn.Run(cfg.Health.Interval.Duration, nil)
+	server.SetOpenVPNProvider(ovpn)
+	if rl, ok := kernel.(api.RuleLister); ok {
+		if domains != nil {
+			rl = domainRuleLister{rl, domains}
+		}
+		server.SetRuleLister(rl)
+	}
+	server.SetReconcileStatusProvider(reconciler)
+	if domains != nil {
+		server.SetDomainPolicyProvider(domains)
+	}
+	server.SetEventSource(events)
+	server.SetAuditLog(audit)
+	stateMgr := router.NewStateManager(persistence, staticNameProv)
+	if domains != nil {
+		stateMgr.SetDomainRouter(domains)
+	}
+	server.SetStateProvider(stateMgr)
+
+	// Reload config on SIGHUP, cfg stays the config of the running settings
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			c, err := loadConfig()
+			if err != nil {
+				log.Printf("Reload/Error: %s", err)
+				continue
+			}
+			if changed := restartRequired(cfg, c); len(changed) > 0 {
+				log.Printf("Reload: Changes of %s require a restart", strings.Join(changed, ", "))
+			}
+			server.Reload(apiAuth(c.Auth), apiTables(c.Tables))
+			ovpn.SetTunnels(openVPNTunnels(c.Tables))
+			go ovpn.Poll()
+			arp.SetDevices(c.Devices)
+			if neighbors != nil {
+				neighbors.SetDevices(c.Devices)
+			}
+			log.Printf("Reloaded config")
+		}
+	}()
+
 	apiMux := web.New()
 	apiMux.Use(middleware.SubRouter)
 	goji.Handle("/api/*", apiMux)
+	apiMux.Get("/events", server.GetEvents)
+	apiMux.Get("/audit", server.GetAudit)
+	apiMux.Get("/export", server.Export)
+	apiMux.Post("/import", server.Import)
 	apiMux.Get("/tables", server.GetTables)
+	apiMux.Post("/tables/:name/restart", server.RestartTable)
 	apiMux.Get("/routes", server.GetRoutes)
 	apiMux.Post("/routes", server.SetRoute)
+	// Not a string pattern, goji would read :batch as parameter
+	apiMux.Post(regexp.MustCompile(`^/routes:batch$`), server.SetRoutes)
+	apiMux.Delete("/routes/:ip", server.DeleteRoute)
+	apiMux.Put("/routes/:ip/exceptions", server.SetExceptions)
+	apiMux.Get("/rules", server.GetRules)
+	apiMux.Get("/tunnels", server.GetTunnels)
+	apiMux.Get("/groups", server.GetGroups)
+	apiMux.Put("/groups/:name", server.SetGroup)
+	apiMux.Delete("/groups/:name", server.DeleteGroup)
+	apiMux.Put("/groups/:name/exceptions", server.SetGroupExceptions)
+	apiMux.Get("/schedules", server.GetSchedules)
+	apiMux.Put("/schedules/:name", server.SetSchedule)
+	apiMux.Delete("/schedules/:name", server.DeleteSchedule)
+	apiMux.Get("/domain-policies", server.GetDomainPolicies)
+	apiMux.Put("/domain-policies/:domain", server.SetDomainPolicy)
+	apiMux.Delete("/domain-policies/:domain", server.DeleteDomainPolicy)
 
-	goji.Get("/*", http.FileServer(http.Dir(webDir)))
+	goji.Get("/metrics", server.Metrics)
+	goji.Get("/*", http.FileServer(http.Dir(cfg.WebDir)))
+
+	goji.DefaultMux.Compile()
+	// Event streams stay open until the client leaves, end them on shutdown
+	graceful.PreHook(events.Close)
+	if err := serve(cfg, goji.DefaultMux); err != nil {
+		log.Fatalf("Error serving: %s", err)
+	}
+}
 
-	goji.Serve()
+// domainRuleLister leaves the fwmark rules of domain policies out of the foreign rules.
+type domainRuleLister struct {
+	api.RuleLister
+	domains *router.DomainRouter
+}
+
+func (l domainRuleLister) ForeignRules() ([]router.ForeignRule, error) {
+	rules, err := l.RuleLister.ForeignRules()
+	if err != nil {
+		return nil, err
+	}
+	var foreign []router.ForeignRule
+	for _, r := range rules {
+		if !l.domains.Owns(r) {
+			foreign = append(foreign, r)
+		}
+	}
+	return foreign, nil
 }
@@ -0,0 +1,324 @@
+// Package metrics writes counters, gauges and histograms in the text format of Prometheus.
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Metric is a family of series sharing a name and label names.
+type Metric interface {
+	WriteTo(w io.Writer) (int64, error)
+}
+
+// Registry collects the metrics written by WriteTo.
+type Registry struct {
+	mu      sync.Mutex
+	metrics []Metric
+}
+
+// Default is the registry of the metrics updated by the packages of vpnrouter.
+var Default = NewRegistry()
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+// Register adds metrics to the registry, they are written in the order of registration.
+func (r *Registry) Register(ms ...Metric) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.metrics = append(r.metrics, ms...)
+}
+
+// NewCounter returns a registered counter.
+func (r *Registry) NewCounter(name, help string, labels ...string) *Counter {
+	c := NewCounter(name, help, labels...)
+	r.Register(c)
+	return c
+}
+
+// NewHistogram returns a registered histogram.
+func (r *Registry) NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	h := NewHistogram(name, help, buckets, labels...)
+	r.Register(h)
+	return h
+}
+
+// WriteTo writes all registered metrics.
+func (r *Registry) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	ms := append([]Metric(nil), r.metrics...)
+	r.mu.Unlock()
+	var total int64
+	for _, m := range ms {
+		n, err := m.WriteTo(w)
+		total += n
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// family holds the series of a metric by their label values.
+type family struct {
+	name   string
+	help   string
+	typ    string
+	labels []string
+
+	mu     sync.Mutex
+	series map[string][]string // key to label values
+}
+
+func newFamily(name, help, typ string, labels []string) family {
+	return family{
+		name:   name,
+		help:   help,
+		typ:    typ,
+		labels: labels,
+		series: make(map[string][]string),
+	}
+}
+
+// key returns the key of the series with the label values, adding it if missing.
+// Must be called with mu held.
+func (f *family) key(values []string) string {
+	if len(values) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s has %d labels, got %d values", f.name, len(f.labels), len(values)))
+	}
+	k := strings.Join(values, "\xff")
+	if _, ok := f.series[k]; !ok {
+		f.series[k] = append([]string(nil), values...)
+	}
+	return k
+}
+
+// keys returns the keys of all series sorted by their label values.
+func (f *family) keys() []string {
+	keys := make([]string, 0, len(f.series))
+	for k := range f.series {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *family) header(w io.Writer) (int, error) {
+	return fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, f.typ)
+}
+
+// sample writes a line of the series with key, extra is appended to its labels.
+func (f *family) sample(w io.Writer, suffix string, key string, extra []string, v float64) (int, error) {
+	values := f.series[key]
+	var pairs []string
+	for i, l := range f.labels {
+		pairs = append(pairs, l+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	labels := ""
+	if len(pairs) > 0 {
+		labels = "{" + strings.Join(pairs, ",") + "}"
+	}
+	return fmt.Fprintf(w, "%s%s%s %s\n", f.name, suffix, labels, formatFloat(v))
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Counter is a family of values which only increase.
+type Counter struct {
+	family
+	values map[string]float64
+}
+
+func NewCounter(name, help string, labels ...string) *Counter {
+	return &Counter{
+		family: newFamily(name, help, "counter", labels),
+		values: make(map[string]float64),
+	}
+}
+
+// Inc adds 1 to the series with the label values.
+func (c *Counter) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+// Add adds v to the series with the label values.
+func (c *Counter) Add(v float64, values ...string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[c.key(values)] += v
+}
+
+// Value returns the value of the series with the label values.
+func (c *Counter) Value(values ...string) float64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[strings.Join(values, "\xff")]
+}
+
+func (c *Counter) WriteTo(w io.Writer) (int64, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return writeValues(w, &c.family, c.values)
+}
+
+// Gauge is a family of values which may go up and down,
+// usually created while writing the metrics.
+type Gauge struct {
+	family
+	values map[string]float64
+}
+
+func NewGauge(name, help string, labels ...string) *Gauge {
+	return &Gauge{
+		family: newFamily(name, help, "gauge", labels),
+		values: make(map[string]float64),
+	}
+}
+
+// Set sets the series with the label values to v.
+func (g *Gauge) Set(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(values)] = v
+}
+
+// Add adds v to the series with the label values.
+func (g *Gauge) Add(v float64, values ...string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.values[g.key(values)] += v
+}
+
+func (g *Gauge) WriteTo(w io.Writer) (int64, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return writeValues(w, &g.family, g.values)
+}
+
+func writeValues(w io.Writer, f *family, values map[string]float64) (int64, error) {
+	n, err := f.header(w)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	for _, k := range f.keys() {
+		n, err := f.sample(w, "", k, nil, values[k])
+		total += int64(n)
+		if err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
+
+// DurationBuckets are the upper bounds in seconds used for the duration of commands.
+var DurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+// Histogram counts observations in buckets.
+type Histogram struct {
+	family
+	buckets []float64
+	values  map[string]*histogram
+}
+
+// NewHistogram counts observations in buckets given by their sorted upper bounds.
+func NewHistogram(name, help string, buckets []float64, labels ...string) *Histogram {
+	return &Histogram{
+		family:  newFamily(name, help, "histogram", labels),
+		buckets: buckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+// Observe adds v to the series with the label values.
+func (h *Histogram) Observe(v float64, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	k := h.key(values)
+	s, ok := h.values[k]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[k] = s
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		s.counts[i]++
+	}
+	s.count++
+	s.sum += v
+}
+
+// Count returns the number of observations of the series with the label values.
+func (h *Histogram) Count(values ...string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if s, ok := h.values[strings.Join(values, "\xff")]; ok {
+		return s.count
+	}
+	return 0
+}
+
+func (h *Histogram) WriteTo(w io.Writer) (int64, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, err := h.header(w)
+	total := int64(n)
+	if err != nil {
+		return total, err
+	}
+	write := func(suffix, key string, extra []string, v float64) error {
+		n, err := h.sample(w, suffix, key, extra, v)
+		total += int64(n)
+		return err
+	}
+	for _, k := range h.keys() {
+		s := h.values[k]
+		var cumulative uint64
+		for i, b := range h.buckets {
+			cumulative += s.counts[i]
+			if err := write("_bucket", k, []string{"le", formatFloat(b)}, float64(cumulative)); err != nil {
+				return total, err
+			}
+		}
+		if err := write("_bucket", k, []string{"le", "+Inf"}, float64(s.count)); err != nil {
+			return total, err
+		}
+		if err := write("_sum", k, nil, s.sum); err != nil {
+			return total, err
+		}
+		if err := write("_count", k, nil, float64(s.count)); err != nil {
+			return total, err
+		}
+	}
+	return total, nil
+}
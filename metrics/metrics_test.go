@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegistry(t *testing.T) {
+	assert := assert.New(t)
+	r := NewRegistry()
+	c := r.NewCounter("requests_total", "Requests by outcome", "outcome")
+	h := r.NewHistogram("cmd_duration_seconds", "Duration of commands", []float64{0.1, 1}, "op")
+	g := NewGauge("hosts", "Hosts with \\ and\nnewline", "table")
+	r.Register(g)
+
+	c.Inc("ok")
+	c.Inc("ok")
+	c.Add(3, `bad "quoted"`)
+	h.Observe(0.05, "add")
+	h.Observe(0.5, "add")
+	h.Observe(2, "add")
+	g.Set(4, "vpn")
+	g.Add(1, "defgw")
+
+	assert.Equal(float64(2), c.Value("ok"))
+	assert.Equal(uint64(3), h.Count("add"))
+	assert.Equal(uint64(0), h.Count("del"))
+
+	var buf bytes.Buffer
+	if _, err := r.WriteTo(&buf); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(`# HELP requests_total Requests by outcome
+# TYPE requests_total counter
+requests_total{outcome="bad \"quoted\""} 3
+requests_total{outcome="ok"} 2
+# HELP cmd_duration_seconds Duration of commands
+# TYPE cmd_duration_seconds histogram
+cmd_duration_seconds_bucket{op="add",le="0.1"} 1
+cmd_duration_seconds_bucket{op="add",le="1"} 2
+cmd_duration_seconds_bucket{op="add",le="+Inf"} 3
+cmd_duration_seconds_sum{op="add"} 2.55
+cmd_duration_seconds_count{op="add"} 3
+# HELP hosts Hosts with \\ and\nnewline
+# TYPE hosts gauge
+hosts{table="defgw"} 1
+hosts{table="vpn"} 4
+`, buf.String())
+}
+
+func TestLabelCount(t *testing.T) {
+	c := NewCounter("c", "Counter", "a", "b")
+	assert.Panics(t, func() { c.Inc("only a") })
+}
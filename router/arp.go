@@ -5,24 +5,55 @@ import (
 	"io"
 	"os"
 	"strings"
+	"sync"
 )
 
-type ARPProvider struct {
-	devs    map[string]struct{}
-	arpFile string
+// deviceSet holds the selected devices, which may be changed at runtime.
+type deviceSet struct {
+	mu sync.RWMutex
+	m  map[string]struct{}
 }
 
-func NewARPProvider(devices []string, arpFile string) *ARPProvider {
+func newDeviceSet(devices []string) *deviceSet {
+	s := &deviceSet{}
+	s.Set(devices)
+	return s
+}
+
+func (s *deviceSet) Set(devices []string) {
 	m := make(map[string]struct{})
 	for _, dev := range devices {
 		m[dev] = struct{}{}
 	}
+	s.mu.Lock()
+	s.m = m
+	s.mu.Unlock()
+}
+
+func (s *deviceSet) Contains(dev string) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.m[dev]
+	return ok
+}
+
+type ARPProvider struct {
+	devs    *deviceSet
+	arpFile string
+}
+
+func NewARPProvider(devices []string, arpFile string) *ARPProvider {
 	return &ARPProvider{
-		devs:    m,
+		devs:    newDeviceSet(devices),
 		arpFile: arpFile,
 	}
 }
 
+// SetDevices replaces the devices to get hosts from.
+func (p *ARPProvider) SetDevices(devices []string) {
+	p.devs.Set(devices)
+}
+
 func (p *ARPProvider) Hosts() ([]Host, error) {
 	f, err := os.Open(p.arpFile)
 	if err != nil {
@@ -48,7 +79,7 @@ func (p *ARPProvider) Hosts() ([]Host, error) {
 			continue
 		}
 		// Only selected devices
-		if _, ok := p.devs[parts[5]]; !ok {
+		if !p.devs.Contains(parts[5]) {
 			continue
 		}
 		ls = append(ls, Host{
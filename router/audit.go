@@ -0,0 +1,321 @@
+package router
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AuditEntry records a routing change requested by a client or made by
+// vpnrouter itself.
+type AuditEntry struct {
+	Time     time.Time `json:"time"`
+	ClientIP string    `json:"client_ip"`
+	// Authenticated user of basic auth, if any, or the part of vpnrouter
+	// making the change like "schedule:night", "expiry", "failover" or "reconcile"
+	User string `json:"user,omitempty"`
+	// Auth provider allowing the change, "self" for a host changing its own
+	// route and "system" for changes made by vpnrouter itself
+	Auth string `json:"auth"`
+	// Kind of the change: set, delete, batch, group, import, schedule,
+	// expiry, failover or reconcile
+	Action string `json:"action"`
+	// Target host or group
+	MAC   string `json:"mac,omitempty"`
+	IP    string `json:"ip,omitempty"`
+	Name  string `json:"name,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Tables before and after, empty without a rule
+	OldTable string `json:"old_table"`
+	NewTable string `json:"new_table"`
+	// Expiry of a temporary table
+	Until *time.Time `json:"until,omitempty"`
+	// "ok" or the error of the change
+	Result string `json:"result"`
+}
+
+// AuditRecorder records audit entries.
+type AuditRecorder interface {
+	Record(e AuditEntry) error
+}
+
+// recordSystem records the changes made by actor, a part of vpnrouter, with err as their result.
+// Nothing is recorded without a.
+func recordSystem(a AuditRecorder, actor string, err error, entries ...AuditEntry) {
+	if a == nil {
+		return
+	}
+	result := "ok"
+	if err != nil {
+		result = err.Error()
+	}
+	now := time.Now()
+	for _, e := range entries {
+		e.Time = now
+		e.User = actor
+		e.Auth = "system"
+		e.Result = result
+		if err := a.Record(e); err != nil {
+			log.Printf("Audit/Error: %s", err)
+		}
+	}
+}
+
+// AuditQuery filters audit entries, empty fields match all entries.
+type AuditQuery struct {
+	// MAC, IP or name of the target host
+	Host  string
+	User  string
+	Since time.Time
+	Until time.Time
+	// Maximum number of entries, the newest are kept
+	Limit int
+}
+
+func (q AuditQuery) matches(e AuditEntry) bool {
+	if q.Host != "" && !strings.EqualFold(q.Host, e.MAC) && q.Host != e.IP && q.Host != e.Name {
+		return false
+	}
+	if q.User != "" && q.User != e.User {
+		return false
+	}
+	if !q.Since.IsZero() && e.Time.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && e.Time.After(q.Until) {
+		return false
+	}
+	return true
+}
+
+// AuditLog appends entries to a JSON lines file. The file is rotated to
+// file.1 when it exceeds MaxSize bytes, keeping Keep rotated files.
+type AuditLog struct {
+	MaxSize int64
+	Keep    int
+
+	file string
+	mu   sync.Mutex
+}
+
+func NewAuditLog(file string) *AuditLog {
+	return &AuditLog{
+		MaxSize: 10 << 20,
+		Keep:    5,
+		file:    file,
+	}
+}
+
+// Record appends e, the time is set if missing.
+func (a *AuditLog) Record(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	line, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if fi, err := os.Stat(a.file); err == nil && fi.Size() > 0 && fi.Size()+int64(len(line)) > a.MaxSize {
+		if err := a.rotate(); err != nil {
+			return err
+		}
+	}
+	f, err := os.OpenFile(a.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// rotated returns the name of the n-th rotated file, the file itself for 0.
+func (a *AuditLog) rotated(n int) string {
+	if n == 0 {
+		return a.file
+	}
+	return fmt.Sprintf("%s.%d", a.file, n)
+}
+
+func (a *AuditLog) rotate() error {
+	if a.Keep <= 0 {
+		return os.Remove(a.file)
+	}
+	if err := os.Remove(a.rotated(a.Keep)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	for n := a.Keep - 1; n >= 0; n-- {
+		if err := os.Rename(a.rotated(n), a.rotated(n+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the entries matching q of all files, the newest first.
+func (a *AuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var entries []AuditEntry
+	for n := 0; n <= a.Keep; n++ {
+		found, err := a.read(a.rotated(n), q)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, found...)
+		if q.Limit > 0 && len(entries) >= q.Limit {
+			return entries[:q.Limit], nil
+		}
+	}
+	return entries, nil
+}
+
+// read returns the entries of file matching q, the newest first. A missing file is no error.
+func (a *AuditLog) read(file string, q AuditQuery) ([]AuditEntry, error) {
+	f, err := os.Open(file)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []AuditEntry
+	sc := bufio.NewScanner(f)
+	sc.Buffer(make([]byte, 64*1024), 1024*1024)
+	for sc.Scan() {
+		var e AuditEntry
+		if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+			log.Printf("Audit: Skip invalid entry in %s: %s", file, err)
+			continue
+		}
+		if q.matches(e) {
+			entries = append(entries, e)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(entries)-1; i < j; i, j = i+1, j-1 {
+		entries[i], entries[j] = entries[j], entries[i]
+	}
+	return entries, nil
+}
+
+// StoreAuditLog keeps the entries in a Store, the oldest are deleted
+// beyond MaxEntries.
+type StoreAuditLog struct {
+	MaxEntries int
+
+	store Store
+}
+
+func NewStoreAuditLog(s Store) *StoreAuditLog {
+	return &StoreAuditLog{
+		MaxEntries: 100000,
+		store:      s,
+	}
+}
+
+// auditKey orders the entries by their sequence number.
+func auditKey(seq uint64) string {
+	return fmt.Sprintf("%016x", seq)
+}
+
+// Record appends e, the time is set if missing.
+func (a *StoreAuditLog) Record(e AuditEntry) error {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	return updateStore("audit", a.store, func(tx StoreTx) error {
+		return a.put(tx, e)
+	})
+}
+
+func (a *StoreAuditLog) put(tx StoreTx, e AuditEntry) error {
+	seq, err := tx.NextSequence(storeAudit)
+	if err != nil {
+		return err
+	}
+	if err := tx.Put(storeAudit, auditKey(seq), e); err != nil {
+		return err
+	}
+	if a.MaxEntries <= 0 || seq <= uint64(a.MaxEntries) {
+		return nil
+	}
+	oldest := auditKey(seq - uint64(a.MaxEntries) + 1)
+	var expired []string
+	err = tx.ForEach(storeAudit, func(key string, data []byte) error {
+		if key >= oldest {
+			return errStopIteration
+		}
+		expired = append(expired, key)
+		return nil
+	})
+	if err != nil && err != errStopIteration {
+		return err
+	}
+	for _, key := range expired {
+		if err := tx.Delete(storeAudit, key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query returns the entries matching q, the newest first.
+func (a *StoreAuditLog) Query(q AuditQuery) ([]AuditEntry, error) {
+	var entries []AuditEntry
+	err := a.store.View(func(tx StoreTx) error {
+		return tx.ForEachReverse(storeAudit, func(key string, data []byte) error {
+			var e AuditEntry
+			if err := json.Unmarshal(data, &e); err != nil {
+				log.Printf("Audit: Skip invalid entry %s: %s", key, err)
+				return nil
+			}
+			if !q.matches(e) {
+				return nil
+			}
+			entries = append(entries, e)
+			if q.Limit > 0 && len(entries) >= q.Limit {
+				return errStopIteration
+			}
+			return nil
+		})
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	return entries, nil
+}
+
+// Import copies the entries of the file log of an older version once.
+func (a *StoreAuditLog) Import(legacy *AuditLog) error {
+	done, err := imported(a.store, "audit")
+	if err != nil || done {
+		return err
+	}
+	entries, err := legacy.Query(AuditQuery{})
+	if err != nil {
+		return err
+	}
+	return updateStore("import", a.store, func(tx StoreTx) error {
+		for i := len(entries) - 1; i >= 0; i-- {
+			if err := a.put(tx, entries[i]); err != nil {
+				return err
+			}
+		}
+		return markImported(tx, "audit", legacy.file)
+	})
+}
@@ -0,0 +1,152 @@
+package router
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "audit.log")
+	a := NewAuditLog(file)
+	// Two entries per file
+	a.MaxSize = 500
+	a.Keep = 1
+
+	t1 := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	entries := []AuditEntry{
+		{Time: t1, ClientIP: "10.0.0.1", Auth: "self", Action: "set", MAC: "aa:bb", IP: "10.0.0.1", Name: "pc1", NewTable: "vpn", Result: "ok"},
+		{Time: t1.Add(time.Minute), ClientIP: "10.0.0.9", User: "admin", Auth: "basic", Action: "set", MAC: "cc:dd", IP: "10.0.0.2", Name: "pc2", OldTable: "vpn", NewTable: "defgw", Result: "ok"},
+		{Time: t1.Add(2 * time.Minute), ClientIP: "10.0.0.9", User: "admin", Auth: "basic", Action: "delete", MAC: "aa:bb", IP: "10.0.0.1", Name: "pc1", OldTable: "vpn", Result: "ok"},
+		{Time: t1.Add(3 * time.Minute), ClientIP: "10.0.0.1", Auth: "self", Action: "set", MAC: "aa:bb", IP: "10.0.0.1", Name: "pc1", NewTable: "x", Result: "unknown table"},
+		{Time: t1.Add(4 * time.Minute), ClientIP: "10.0.0.9", Auth: "token", Action: "group", Group: "kids", NewTable: "null", Result: "ok"},
+	}
+	for _, e := range entries {
+		if err := a.Record(e); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	_, err = os.Stat(file + ".2")
+	assert.True(os.IsNotExist(err), "Only one rotated file kept")
+
+	// The first two entries were rotated away
+	all, err := a.Query(AuditQuery{})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal([]AuditEntry{entries[4], entries[3], entries[2]}, all, "Newest first")
+
+	found, err := a.Query(AuditQuery{Host: "AA:BB"})
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal([]AuditEntry{entries[3], entries[2]}, found)
+
+	found, _ = a.Query(AuditQuery{User: "admin", Until: t1.Add(150 * time.Second)})
+	assert.Equal([]AuditEntry{entries[2]}, found)
+
+	found, _ = a.Query(AuditQuery{Host: "10.0.0.1", Since: t1.Add(3 * time.Minute)})
+	assert.Equal([]AuditEntry{entries[3]}, found)
+
+	found, _ = a.Query(AuditQuery{Limit: 2})
+	assert.Equal([]AuditEntry{entries[4], entries[3]}, found)
+}
+
+func TestStoreAuditLog(t *testing.T) {
+	assert := assert.New(t)
+	store, file, cleanup := tempStore(t)
+	defer cleanup()
+	t1 := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	legacy := NewAuditLog(filepath.Join(filepath.Dir(file), "audit.log"))
+	old := AuditEntry{Time: t1, ClientIP: "10.0.0.1", Auth: "self", Action: "set", MAC: "aa:bb", IP: "10.0.0.1", NewTable: "vpn", Result: "ok"}
+	legacy.Record(old)
+
+	a := NewStoreAuditLog(store)
+	a.MaxEntries = 3
+	assert.Nil(a.Import(legacy))
+	all, err := a.Query(AuditQuery{})
+	assert.Nil(err)
+	assert.Equal([]AuditEntry{old}, all)
+	legacy.Record(AuditEntry{Time: t1, Action: "set", Result: "ok"})
+	assert.Nil(a.Import(legacy), "Imported once")
+
+	var entries []AuditEntry
+	for i := 1; i <= 3; i++ {
+		e := AuditEntry{Time: t1.Add(time.Duration(i) * time.Minute), ClientIP: "10.0.0.9", User: "admin", Auth: "basic", Action: "set", MAC: "cc:dd", NewTable: "defgw", Result: "ok"}
+		if err := a.Record(e); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+		entries = append(entries, e)
+	}
+	all, err = a.Query(AuditQuery{})
+	assert.Nil(err)
+	assert.Equal([]AuditEntry{entries[2], entries[1], entries[0]}, all, "Newest first, the imported entry was deleted")
+
+	found, _ := a.Query(AuditQuery{Host: "CC:DD", Since: t1.Add(90 * time.Second), Limit: 1})
+	assert.Equal([]AuditEntry{entries[2]}, found)
+	found, _ = a.Query(AuditQuery{Host: "aa:bb"})
+	assert.Nil(found)
+}
+
+// memoryAudit keeps the recorded entries without their time.
+type memoryAudit []AuditEntry
+
+func (a *memoryAudit) Record(e AuditEntry) error {
+	e.Time = time.Time{}
+	*a = append(*a, e)
+	return nil
+}
+
+func TestSystemAudit(t *testing.T) {
+	assert := assert.New(t)
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	const mac = "aa:bb:cc:dd:ee:01"
+	hosts := mockHostProvider{{IP: "1", MAC: mac}}
+	kernel := DummyRuleProvider{}
+	vpn := &probeResult{}
+	m := NewHealthMonitor([]TableCheck{{Table: "vpn", Fallback: "defgw", Checks: []Check{vpn}}})
+	m.Failures = 1
+	f := NewFailoverRuleProvider(kernel, m)
+	m.OnChange(f.Update)
+	rp := NewRulePersistence(f, hosts, "")
+	rp.SetStore(store)
+	audit := &memoryAudit{}
+	f.SetAuditLog(audit)
+	rp.SetAuditLog(audit)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+
+	assert.NoError(rp.Set("1", "vpn"))
+	assert.NoError(rp.SetUntil("1", "null", time.Now().Add(-time.Minute)))
+	assert.Empty(*audit, "Changes of the API are recorded by the API")
+	_, err := rp.Expire(time.Now())
+	assert.NoError(err)
+	vpn.err = errors.New("down")
+	m.Probe()
+	assert.NoError(rp.SetSchedule(Schedule{Name: "day", MAC: mac, Start: 0, End: 24*60 - 1, Table: "null"}))
+	s := NewScheduler(rp, hosts)
+	s.now = func() time.Time { return time.Date(2026, 10, 19, 10, 0, 0, 0, time.Local) }
+	s.Apply()
+	kernel["1"] = "defgw"
+	NewReconciler(hosts, rp, kernel).Reconcile()
+
+	assert.Equal([]AuditEntry{
+		{User: "expiry", Auth: "system", Action: "expiry", MAC: mac, IP: "1", OldTable: "null", NewTable: "vpn", Result: "ok"},
+		{User: "failover", Auth: "system", Action: "failover", IP: "1", OldTable: "vpn", NewTable: "defgw", Result: "ok"},
+		{User: "schedule:day", Auth: "system", Action: "schedule", MAC: mac, OldTable: "vpn", NewTable: "null", Result: "ok"},
+		{User: "reconcile", Auth: "system", Action: "reconcile", IP: "1", NewTable: "null", Result: "ok"},
+	}, []AuditEntry(*audit))
+}
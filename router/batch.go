@@ -0,0 +1,113 @@
+package router
+
+import (
+	"fmt"
+	"log"
+)
+
+// BatchRuleProvider applies many rule changes at once.
+type BatchRuleProvider interface {
+	// SetBatch applies all changes or none of them.
+	// A change with an empty table deletes the rule of its IP.
+	SetBatch(changes []Rule) error
+}
+
+// BatchError is returned if a batch could not be applied,
+// none of its changes are in effect.
+type BatchError struct {
+	// Index of the failed change
+	Index int
+	Err   error
+}
+
+func (e *BatchError) Error() string {
+	return fmt.Sprintf("change %d: %s", e.Index+1, e.Err)
+}
+
+// SetBatch applies all changes or none of them using the batch support of rp.
+// Without it, changes are set one by one and rolled back on failure.
+func SetBatch(rp RuleProvider, changes []Rule) error {
+	if bp, ok := rp.(BatchRuleProvider); ok {
+		return bp.SetBatch(changes)
+	}
+	rules, err := rp.Rules()
+	if err != nil {
+		return err
+	}
+	old := ruleMap(rules)
+	for i, c := range changes {
+		if err := setOrDelete(rp, c); err != nil {
+			// The failed change might be half applied as well
+			for j := i; j >= 0; j-- {
+				ip := changes[j].IP
+				if err := setOrDelete(rp, Rule{IP: ip, Table: old[ip].Table}); err != nil {
+					log.Printf("SetBatch/Error: Could not roll back %s: %s", ip, err)
+				}
+			}
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return nil
+}
+
+func setOrDelete(rp RuleProvider, r Rule) error {
+	if r.Table == "" {
+		return rp.Delete(r.IP)
+	}
+	return rp.Set(r.IP, r.Table)
+}
+
+// ruleOp adds or deletes a single rule as part of a batch.
+type ruleOp struct {
+	del   bool
+	ip    string
+	table string
+	// Index of the change requiring the op
+	change int
+}
+
+func (o ruleOp) inverse() ruleOp {
+	o.del = !o.del
+	return o
+}
+
+// planBatch returns the ops turning rules into rules with all changes applied.
+func planBatch(rules []Rule, changes []Rule) []ruleOp {
+	current := ruleMap(rules)
+	var ops []ruleOp
+	for i, c := range changes {
+		old, found := current[c.IP]
+		if found && old.Table == c.Table {
+			continue
+		}
+		if found {
+			ops = append(ops, ruleOp{del: true, ip: c.IP, table: old.Table, change: i})
+			delete(current, c.IP)
+		}
+		if c.Table != "" {
+			ops = append(ops, ruleOp{ip: c.IP, table: c.Table, change: i})
+			current[c.IP] = c
+		}
+	}
+	return ops
+}
+
+// applyOps applies ops in order, on failure the applied ops are reverted.
+func applyOps(ops []ruleOp, apply func(ruleOp) error) error {
+	for i, op := range ops {
+		if err := apply(op); err != nil {
+			revertOps(ops[:i], apply)
+			return &BatchError{Index: op.change, Err: err}
+		}
+	}
+	return nil
+}
+
+// revertOps applies the inverse ops of applied in reverse order.
+func revertOps(applied []ruleOp, apply func(ruleOp) error) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		if err := apply(applied[i].inverse()); err != nil {
+			log.Printf("SetBatch/Error: Could not roll back %s: %s", applied[i].ip, err)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPlanBatch(t *testing.T) {
+	rules := []Rule{{IP: "1", Table: "vpn"}, {IP: "2", Table: "defgw"}}
+	ops := planBatch(rules, []Rule{
+		{IP: "1", Table: "defgw"},
+		{IP: "2", Table: "defgw"},
+		{IP: "3", Table: "vpn"},
+		{IP: "1", Table: ""},
+	})
+	assert.Equal(t, []ruleOp{
+		{del: true, ip: "1", table: "vpn", change: 0},
+		{ip: "1", table: "defgw", change: 0},
+		{ip: "3", table: "vpn", change: 2},
+		{del: true, ip: "1", table: "defgw", change: 3},
+	}, ops)
+}
+
+// failingRuleProvider fails to set the table "fail"
+type failingRuleProvider struct {
+	DummyRuleProvider
+}
+
+func (p failingRuleProvider) Set(ip, table string) error {
+	if table == "fail" {
+		return errors.New("failed")
+	}
+	return p.DummyRuleProvider.Set(ip, table)
+}
+
+func TestSetBatchFallback(t *testing.T) {
+	assert := assert.New(t)
+	p := failingRuleProvider{DummyRuleProvider{"1": "vpn", "2": "defgw"}}
+
+	err := SetBatch(p, []Rule{{IP: "1", Table: "defgw"}, {IP: "2", Table: ""}, {IP: "3", Table: "fail"}})
+	if be, ok := err.(*BatchError); assert.True(ok) {
+		assert.Equal(2, be.Index)
+	}
+	assert.Equal(DummyRuleProvider{"1": "vpn", "2": "defgw"}, p.DummyRuleProvider, "Rolled back")
+
+	assert.Nil(SetBatch(p, []Rule{{IP: "1", Table: "defgw"}, {IP: "2", Table: ""}, {IP: "3", Table: "vpn"}}))
+	assert.Equal(DummyRuleProvider{"1": "defgw", "3": "vpn"}, p.DummyRuleProvider)
+}
@@ -0,0 +1,545 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+var (
+	ErrUnknownDomainPolicy = errors.New("unknown domain policy")
+	ErrInvalidDomainPolicy = errors.New("invalid domain policy")
+	ErrNoDomainPolicies    = errors.New("domain policies not supported")
+)
+
+// Backends filling the sets of domain policies, named after the dnsmasq options
+const (
+	DomainNFTSet = "nftset"
+	DomainIPSet  = "ipset"
+)
+
+// DomainMarkBit is set in the marks of domain policies, the other bits are
+// the id of the table. It keeps them apart from the marks of NFTRuleProvider.
+const DomainMarkBit = 0x10000000
+
+// iptables chain of the mangle table marking the traffic to the ipsets
+const domainChain = "VPNROUTER_DOMAINS"
+
+// DomainPolicy routes the traffic of all hosts to a domain and its
+// subdomains through a table.
+type DomainPolicy struct {
+	Domain string
+	Table  string
+}
+
+var domainRe = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)*[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+// normalizeDomainPolicy validates p and returns it with a lower case domain
+// without trailing dot.
+func normalizeDomainPolicy(p DomainPolicy) (DomainPolicy, error) {
+	p.Domain = strings.TrimSuffix(strings.ToLower(p.Domain), ".")
+	if len(p.Domain) > 253 || !domainRe.MatchString(p.Domain) || p.Table == "" || strings.ContainsAny(p.Table, " \t") {
+		return p, ErrInvalidDomainPolicy
+	}
+	return p, nil
+}
+
+// DomainRouter routes the traffic to domains through tables. dnsmasq adds
+// the addresses it resolves for a domain to a set of the table, whose members
+// are marked and routed by a "fwmark <mark> lookup <id>" rule. The generated
+// dnsmasq config only changes with the domains, failover just moves the marks.
+type DomainRouter struct {
+	// Backend is DomainNFTSet or DomainIPSet
+	Backend string
+	// IPv6 also fills and marks IPv6 sets
+	IPv6 bool
+	// The fwmark rules get the domain priority and are tagged with Protocol
+	Priorities PriorityRange
+	Protocol   uint8
+	// Table of the inet family holding the nftsets
+	NFTTable string
+	// dnsmasq config file written with the nftset or ipset options, none if empty
+	ConfigFile string
+	// Command making dnsmasq read ConfigFile, run whenever it changes
+	Reload []string
+
+	tables *RouteTables
+	file   string
+	store  Store
+	health *HealthMonitor
+	strict *StrictRuleProvider
+	// run executes a command with stdin and returns its output, replaced by tests
+	run func(stdin string, name string, args ...string) (string, error)
+
+	mu       sync.Mutex
+	policies map[string]DomainPolicy
+}
+
+// NewDomainRouter saves the policies to file and maps their tables to ids with tables.
+func NewDomainRouter(tables *RouteTables, file string) *DomainRouter {
+	return &DomainRouter{
+		Backend:    DomainNFTSet,
+		Priorities: DefaultPriorities,
+		Protocol:   DefaultRuleProtocol,
+		NFTTable:   DefaultNFTTable,
+		tables:     tables,
+		file:       file,
+		run:        runCmd,
+		policies:   make(map[string]DomainPolicy),
+	}
+}
+
+// SetHealthMonitor routes the domains of failing tables through their fallback.
+// Update must be called whenever the health changes.
+func (d *DomainRouter) SetHealthMonitor(h *HealthMonitor) {
+	d.health = h
+}
+
+// SetStrict installs the kill switch of strict tables before routing domains through them.
+func (d *DomainRouter) SetStrict(s *StrictRuleProvider) {
+	d.strict = s
+}
+
+// SetDryRun logs the commands instead of running them, for debug mode.
+func (d *DomainRouter) SetDryRun() {
+	d.run = func(stdin string, name string, args ...string) (string, error) {
+		log.Printf("Domains: Run %s %s", name, strings.Join(args, " "))
+		return "", nil
+	}
+}
+
+// SetStore saves the policies to s instead of the file, must be called before Init.
+// The file is imported once into a store which has never seen it.
+func (d *DomainRouter) SetStore(s Store) {
+	d.store = s
+}
+
+// Init reads the saved policies and applies them.
+func (d *DomainRouter) Init() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	read := d.read
+	if d.store != nil {
+		read = d.loadStore
+	}
+	if err := read(); err != nil {
+		return err
+	}
+	return d.apply()
+}
+
+// Update applies the policies again, e.g. after the health of a table changed.
+func (d *DomainRouter) Update() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.apply(); err != nil {
+		log.Printf("Domains/Error: %s", err)
+	}
+}
+
+// read reads the policy file, a missing file is no error.
+func (d *DomainRouter) read() error {
+	f, err := os.Open(d.file)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	// skip first line
+	br.ReadString('\n')
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		parts := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if len(parts) != 2 {
+			continue
+		}
+		p, err := normalizeDomainPolicy(DomainPolicy{Domain: parts[0], Table: parts[1]})
+		if err != nil {
+			log.Printf("Domains: Drop invalid policy of %s: %s", parts[0], err)
+			continue
+		}
+		d.policies[p.Domain] = p
+	}
+	return nil
+}
+
+// loadStore reads the policies of the store, the file is imported if the store never saw it.
+func (d *DomainRouter) loadStore() error {
+	done, err := imported(d.store, "domains")
+	if err != nil {
+		return err
+	}
+	if !done {
+		if err := d.read(); err != nil {
+			return err
+		}
+		return updateStore("import", d.store, func(tx StoreTx) error {
+			if err := d.putPolicies(tx); err != nil {
+				return err
+			}
+			return markImported(tx, "domains", d.file)
+		})
+	}
+	return d.store.View(func(tx StoreTx) error {
+		return tx.ForEach(storeDomains, func(domain string, data []byte) error {
+			var table string
+			if err := json.Unmarshal(data, &table); err != nil {
+				return err
+			}
+			p, err := normalizeDomainPolicy(DomainPolicy{Domain: domain, Table: table})
+			if err != nil {
+				log.Printf("Domains: Drop invalid policy of %s: %s", domain, err)
+				return nil
+			}
+			d.policies[p.Domain] = p
+			return nil
+		})
+	})
+}
+
+// putPolicies replaces the policies of the store, saved as domain to table.
+func (d *DomainRouter) putPolicies(tx StoreTx) error {
+	if err := tx.Clear(storeDomains); err != nil {
+		return err
+	}
+	for _, p := range d.policies {
+		if err := tx.Put(storeDomains, p.Domain, p.Table); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (d *DomainRouter) save() error {
+	if d.store != nil {
+		return updateStore("domains", d.store, d.putPolicies)
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Domain\tTable\n")
+	for _, p := range d.sortedPolicies() {
+		fmt.Fprintf(&buf, "%s\t%s\n", p.Domain, p.Table)
+	}
+	return writeFile("domains", d.file, buf.Bytes())
+}
+
+func (d *DomainRouter) sortedPolicies() []DomainPolicy {
+	policies := make([]DomainPolicy, 0, len(d.policies))
+	for _, p := range d.policies {
+		policies = append(policies, p)
+	}
+	sort.Sort(policiesByDomain(policies))
+	return policies
+}
+
+type policiesByDomain []DomainPolicy
+
+func (a policiesByDomain) Len() int           { return len(a) }
+func (a policiesByDomain) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a policiesByDomain) Less(i, j int) bool { return a[i].Domain < a[j].Domain }
+
+// DomainPolicies returns all policies sorted by domain.
+func (d *DomainRouter) DomainPolicies() []DomainPolicy {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.sortedPolicies()
+}
+
+// SetDomainPolicy creates or replaces the policy of a domain.
+func (d *DomainRouter) SetDomainPolicy(p DomainPolicy) error {
+	p, err := normalizeDomainPolicy(p)
+	if err != nil {
+		return err
+	}
+	if _, ok := d.tables.ID(p.Table); !ok {
+		return ErrUnknownTable
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.policies[p.Domain] = p
+	if err := d.save(); err != nil {
+		return err
+	}
+	return d.apply()
+}
+
+func (d *DomainRouter) DeleteDomainPolicy(domain string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if _, ok := d.policies[domain]; !ok {
+		return ErrUnknownDomainPolicy
+	}
+	delete(d.policies, domain)
+	if err := d.save(); err != nil {
+		return err
+	}
+	return d.apply()
+}
+
+// state returns the policies as part of a State.
+func (d *DomainRouter) state() []StateDomain {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return stateDomains(d.policies)
+}
+
+// restore replaces all policies with those of a normalized State.
+func (d *DomainRouter) restore(sds []StateDomain) error {
+	policies := make(map[string]DomainPolicy)
+	for _, sd := range sds {
+		if _, ok := d.tables.ID(sd.Table); !ok {
+			return ErrUnknownTable
+		}
+		policies[sd.Domain] = DomainPolicy{Domain: sd.Domain, Table: sd.Table}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.policies = policies
+	if err := d.save(); err != nil {
+		return err
+	}
+	return d.apply()
+}
+
+// setName returns the name of the set of table for family 4 or 6.
+func setName(table string, family int) string {
+	return fmt.Sprintf("vpnr%d_%s", family, table)
+}
+
+// apply installs the sets, marks and fwmark rules of all tables with
+// policies and updates the dnsmasq config.
+func (d *DomainRouter) apply() error {
+	var tables []string
+	marks := make(map[string]uint32) // requested table to mark
+	for _, p := range d.policies {
+		if _, ok := marks[p.Table]; ok {
+			continue
+		}
+		active := p.Table
+		if d.health != nil {
+			active = d.health.Active(p.Table)
+		}
+		id, ok := d.tables.ID(active)
+		if !ok || id&DomainMarkBit != 0 {
+			return ErrUnknownTable
+		}
+		if d.strict != nil {
+			if err := d.strict.ensure(active); err != nil {
+				return err
+			}
+		}
+		tables = append(tables, p.Table)
+		marks[p.Table] = id | DomainMarkBit
+	}
+	sort.Strings(tables)
+
+	var err error
+	if d.Backend == DomainIPSet {
+		err = d.applyIPSets(tables, marks)
+	} else {
+		_, err = d.run(d.nftScript(tables, marks), "nft", "-f", "-")
+	}
+	if err != nil {
+		return err
+	}
+	if err := d.syncMarkRules(marks); err != nil {
+		return err
+	}
+	return d.writeConfig()
+}
+
+func (d *DomainRouter) families() []int {
+	if d.IPv6 {
+		return []int{4, 6}
+	}
+	return []int{4}
+}
+
+// nftScript declares the sets of tables and recreates the chain marking their members.
+// The chain runs right after the one of NFTRuleProvider, so domains take precedence.
+func (d *DomainRouter) nftScript(tables []string, marks map[string]uint32) string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "add table inet %s\n", d.NFTTable)
+	for _, t := range tables {
+		for _, family := range d.families() {
+			fmt.Fprintf(&buf, "add set inet %s %s { type ipv%d_addr; }\n", d.NFTTable, setName(t, family), family)
+		}
+	}
+	fmt.Fprintf(&buf, "add chain inet %s domains { type filter hook prerouting priority -149; policy accept; }\n", d.NFTTable)
+	fmt.Fprintf(&buf, "flush chain inet %s domains\n", d.NFTTable)
+	for _, t := range tables {
+		for _, family := range d.families() {
+			ip := "ip"
+			if family == 6 {
+				ip = "ip6"
+			}
+			fmt.Fprintf(&buf, "add rule inet %s domains %s daddr @%s meta mark set %#x\n", d.NFTTable, ip, setName(t, family), marks[t])
+		}
+	}
+	return buf.String()
+}
+
+// applyIPSets creates the ipsets of tables and recreates the iptables chain marking their members.
+func (d *DomainRouter) applyIPSets(tables []string, marks map[string]uint32) error {
+	for _, family := range d.families() {
+		iptables, inet := "iptables", "inet"
+		if family == 6 {
+			iptables, inet = "ip6tables", "inet6"
+		}
+		for _, t := range tables {
+			if _, err := d.run("", "ipset", "create", "-exist", setName(t, family), "hash:ip", "family", inet); err != nil {
+				return err
+			}
+		}
+		// Creating an existing chain fails, flushing it afterwards does not
+		d.run("", iptables, "-t", "mangle", "-N", domainChain)
+		if _, err := d.run("", iptables, "-t", "mangle", "-F", domainChain); err != nil {
+			return err
+		}
+		if _, err := d.run("", iptables, "-t", "mangle", "-C", "PREROUTING", "-j", domainChain); err != nil {
+			if _, err := d.run("", iptables, "-t", "mangle", "-A", "PREROUTING", "-j", domainChain); err != nil {
+				return err
+			}
+		}
+		for _, t := range tables {
+			mark := fmt.Sprintf("%#x", marks[t])
+			if _, err := d.run("", iptables, "-t", "mangle", "-A", domainChain,
+				"-m", "set", "--match-set", setName(t, family), "dst", "-j", "MARK", "--set-mark", mark); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Owns returns true if f is a fwmark rule of the domain policies.
+func (d *DomainRouter) Owns(f ForeignRule) bool {
+	_, ok := d.markRule(f)
+	return ok
+}
+
+// markRule returns the mark of a fwmark rule of the domain policies.
+func (d *DomainRouter) markRule(f ForeignRule) (uint32, bool) {
+	parts := strings.Fields(f.Spec)
+	tag := []string{}
+	if d.Protocol != 0 {
+		tag = []string{"proto", strconv.Itoa(int(d.Protocol))}
+	}
+	if f.Priority != d.Priorities.Domain() || len(parts) != 6+len(tag) ||
+		parts[0] != "from" || parts[1] != "all" || parts[2] != "fwmark" || parts[4] != "lookup" ||
+		strings.Join(parts[6:], " ") != strings.Join(tag, " ") {
+		return 0, false
+	}
+	mark, err := strconv.ParseUint(parts[3], 0, 32)
+	if err != nil || mark&DomainMarkBit == 0 {
+		return 0, false
+	}
+	return uint32(mark), true
+}
+
+// syncMarkRules installs a fwmark rule for each mark and removes those of other marks.
+func (d *DomainRouter) syncMarkRules(marks map[string]uint32) error {
+	want := make(map[uint32]bool)
+	var sorted []int
+	for _, mark := range marks {
+		if !want[mark] {
+			sorted = append(sorted, int(mark))
+		}
+		want[mark] = true
+	}
+	sort.Ints(sorted)
+	tag := ruleTag(d.Priorities.Domain(), d.Protocol)
+	for _, family := range d.families() {
+		fam := "-" + strconv.Itoa(family)
+		out, err := d.run("", "ip", fam, "rule", "show")
+		if err != nil {
+			return err
+		}
+		_, foreign := parseRuleLines(out, d.Priorities, d.Protocol, family == 6)
+		installed := make(map[uint32]bool)
+		for _, f := range foreign {
+			mark, ok := d.markRule(f)
+			if !ok {
+				continue
+			}
+			if want[mark] && !installed[mark] {
+				installed[mark] = true
+				continue
+			}
+			args := append([]string{fam, "rule", "del", "fwmark", fmt.Sprintf("%#x", mark)}, tag...)
+			if _, err := d.run("", "ip", args...); err != nil {
+				return err
+			}
+		}
+		for _, m := range sorted {
+			mark := uint32(m)
+			if installed[mark] {
+				continue
+			}
+			id := strconv.FormatUint(uint64(mark&^DomainMarkBit), 10)
+			args := append([]string{fam, "rule", "add", "fwmark", fmt.Sprintf("%#x", mark), "table", id}, tag...)
+			if _, err := d.run("", "ip", args...); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// dnsmasqConfig returns the nftset or ipset options of all policies.
+func (d *DomainRouter) dnsmasqConfig() string {
+	var buf bytes.Buffer
+	buf.WriteString("# Generated by vpnrouter, changes are overwritten\n")
+	for _, p := range d.sortedPolicies() {
+		var sets []string
+		for _, family := range d.families() {
+			if d.Backend == DomainIPSet {
+				sets = append(sets, setName(p.Table, family))
+			} else {
+				sets = append(sets, fmt.Sprintf("%d#inet#%s#%s", family, d.NFTTable, setName(p.Table, family)))
+			}
+		}
+		fmt.Fprintf(&buf, "%s=/%s/%s\n", d.Backend, p.Domain, strings.Join(sets, ","))
+	}
+	return buf.String()
+}
+
+// writeConfig writes the dnsmasq config and runs the reload command if it changed.
+func (d *DomainRouter) writeConfig() error {
+	if d.ConfigFile == "" {
+		return nil
+	}
+	conf := d.dnsmasqConfig()
+	if old, err := ioutil.ReadFile(d.ConfigFile); err == nil && string(old) == conf {
+		return nil
+	}
+	if err := ioutil.WriteFile(d.ConfigFile, []byte(conf), 0644); err != nil {
+		return err
+	}
+	if len(d.Reload) == 0 {
+		return nil
+	}
+	log.Printf("Domains: Reloading dnsmasq")
+	_, err := d.run("", d.Reload[0], d.Reload[1:]...)
+	return err
+}
@@ -0,0 +1,168 @@
+package router
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fixture_domain_rules = `
+0:	from all lookup local
+10997:	from all fwmark 0x10000064 lookup vpn proto 86
+10997:	from all fwmark 0x10000066 lookup 102 proto 86
+10997:	from all fwmark 0x66 lookup 102 proto 86
+32766:	from all lookup main
+`
+
+func newTestDomainRouter(t *testing.T, f *fakeCmds) (*DomainRouter, string) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	rt := NewRouteTables()
+	rt.Add("vpn", 100)
+	rt.Add("defgw", 101)
+	d := NewDomainRouter(rt, filepath.Join(dir, "domains.txt"))
+	d.ConfigFile = filepath.Join(dir, "vpnrouter.conf")
+	d.Reload = []string{"systemctl", "restart", "dnsmasq"}
+	d.run = f.run
+	return d, dir
+}
+
+func TestNormalizeDomainPolicy(t *testing.T) {
+	assert := assert.New(t)
+	p, err := normalizeDomainPolicy(DomainPolicy{Domain: "Example.COM.", Table: "vpn"})
+	assert.Nil(err)
+	assert.Equal(DomainPolicy{Domain: "example.com", Table: "vpn"}, p)
+	for _, p := range []DomainPolicy{
+		{Domain: "", Table: "vpn"},
+		{Domain: "-example.com", Table: "vpn"},
+		{Domain: "exa mple.com", Table: "vpn"},
+		{Domain: "example..com", Table: "vpn"},
+		{Domain: "example.com/", Table: "vpn"},
+		{Domain: "example.com"},
+	} {
+		_, err := normalizeDomainPolicy(p)
+		assert.Equal(ErrInvalidDomainPolicy, err, "%v", p)
+	}
+}
+
+func TestDomainRouter(t *testing.T) {
+	assert := assert.New(t)
+	f := &fakeCmds{rules: fixture_domain_rules}
+	d, dir := newTestDomainRouter(t, f)
+	defer os.RemoveAll(dir)
+
+	assert.Nil(d.Init())
+	assert.Equal([]string{"add table inet vpnrouter\n" +
+		"add chain inet vpnrouter domains { type filter hook prerouting priority -149; policy accept; }\n" +
+		"flush chain inet vpnrouter domains\n"}, f.scripts)
+	assert.Equal([]string{
+		"-4 rule del fwmark 0x10000064 pref 10997 protocol 86",
+		"-4 rule del fwmark 0x10000066 pref 10997 protocol 86",
+		"restart dnsmasq",
+	}, f.ipCmds, "Rules of tables without policies are removed")
+
+	f.scripts, f.ipCmds = nil, nil
+	assert.Equal(ErrUnknownTable, d.SetDomainPolicy(DomainPolicy{Domain: "example.com", Table: "x"}))
+	assert.Equal(ErrInvalidDomainPolicy, d.SetDomainPolicy(DomainPolicy{Domain: "example com", Table: "vpn"}))
+	assert.Nil(d.SetDomainPolicy(DomainPolicy{Domain: "Example.com", Table: "vpn"}))
+	assert.Nil(d.SetDomainPolicy(DomainPolicy{Domain: "stream.example", Table: "defgw"}))
+	assert.Equal("add table inet vpnrouter\n"+
+		"add set inet vpnrouter vpnr4_defgw { type ipv4_addr; }\n"+
+		"add set inet vpnrouter vpnr4_vpn { type ipv4_addr; }\n"+
+		"add chain inet vpnrouter domains { type filter hook prerouting priority -149; policy accept; }\n"+
+		"flush chain inet vpnrouter domains\n"+
+		"add rule inet vpnrouter domains ip daddr @vpnr4_defgw meta mark set 0x10000065\n"+
+		"add rule inet vpnrouter domains ip daddr @vpnr4_vpn meta mark set 0x10000064\n", f.scripts[1])
+	// The fixture still has the rule of vpn
+	assert.Equal([]string{
+		"-4 rule del fwmark 0x10000066 pref 10997 protocol 86",
+		"restart dnsmasq",
+		"-4 rule del fwmark 0x10000066 pref 10997 protocol 86",
+		"-4 rule add fwmark 0x10000065 table 101 pref 10997 protocol 86",
+		"restart dnsmasq",
+	}, f.ipCmds)
+	conf, _ := ioutil.ReadFile(d.ConfigFile)
+	assert.Equal("# Generated by vpnrouter, changes are overwritten\n"+
+		"nftset=/example.com/4#inet#vpnrouter#vpnr4_vpn\n"+
+		"nftset=/stream.example/4#inet#vpnrouter#vpnr4_defgw\n", string(conf))
+
+	// dnsmasq is only reloaded if its config changes
+	f.ipCmds = nil
+	d.Update()
+	assert.NotContains(f.ipCmds, "restart dnsmasq")
+
+	// Reload from file
+	d2, dir2 := newTestDomainRouter(t, f)
+	defer os.RemoveAll(dir2)
+	d2.file = d.file
+	assert.Nil(d2.Init())
+	assert.Equal(d.DomainPolicies(), d2.DomainPolicies())
+
+	assert.Equal(ErrUnknownDomainPolicy, d.DeleteDomainPolicy("other.example"))
+	assert.Nil(d.DeleteDomainPolicy("example.com."))
+	assert.Equal([]DomainPolicy{{Domain: "stream.example", Table: "defgw"}}, d.DomainPolicies())
+
+	assert.True(d.Owns(ForeignRule{Priority: 10997, Spec: "from all fwmark 0x10000064 lookup vpn proto 86"}))
+	assert.False(d.Owns(ForeignRule{Priority: 10997, Spec: "from all fwmark 0x66 lookup 102 proto 86"}))
+	assert.False(d.Owns(ForeignRule{Priority: 10999, Spec: "from all fwmark 0x10000064 lookup vpn proto 86"}))
+}
+
+func TestDomainRouterFailover(t *testing.T) {
+	vpn := &probeResult{err: errors.New("down")}
+	m := NewHealthMonitor([]TableCheck{{Table: "vpn", Fallback: "defgw", Checks: []Check{vpn}}})
+	m.Failures = 1
+	m.Probe()
+
+	f := &fakeCmds{}
+	d, dir := newTestDomainRouter(t, f)
+	defer os.RemoveAll(dir)
+	d.SetHealthMonitor(m)
+	assert.Nil(t, d.SetDomainPolicy(DomainPolicy{Domain: "example.com", Table: "vpn"}))
+	assert.Contains(t, f.scripts[0], "ip daddr @vpnr4_vpn meta mark set 0x10000065")
+	conf, _ := ioutil.ReadFile(d.ConfigFile)
+	assert.Contains(t, string(conf), "vpnr4_vpn", "Sets keep the requested table")
+}
+
+func TestDomainRouterIPSet(t *testing.T) {
+	assert := assert.New(t)
+	f := &fakeCmds{}
+	d, dir := newTestDomainRouter(t, f)
+	defer os.RemoveAll(dir)
+	d.Backend = DomainIPSet
+	d.IPv6 = true
+	d.Reload = nil
+	assert.Nil(d.SetDomainPolicy(DomainPolicy{Domain: "example.com", Table: "vpn"}))
+	conf, _ := ioutil.ReadFile(d.ConfigFile)
+	assert.Equal("# Generated by vpnrouter, changes are overwritten\nipset=/example.com/vpnr4_vpn,vpnr6_vpn\n", string(conf))
+	assert.Contains(f.ipCmds, "create -exist vpnr6_vpn hash:ip family inet6")
+	assert.Contains(f.ipCmds, "-t mangle -A VPNROUTER_DOMAINS -m set --match-set vpnr4_vpn dst -j MARK --set-mark 0x10000064")
+	assert.Contains(f.ipCmds, "-6 rule add fwmark 0x10000064 table 100 pref 10997 protocol 86")
+	assert.Nil(f.scripts)
+}
+
+func TestDomainRouterStore(t *testing.T) {
+	assert := assert.New(t)
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	f := &fakeCmds{}
+	d, dir := newTestDomainRouter(t, f)
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(d.file, []byte("Domain\tTable\nexample.com\tvpn\n"), 0644)
+	d.SetStore(store)
+	assert.Nil(d.Init())
+	assert.Equal([]DomainPolicy{{Domain: "example.com", Table: "vpn"}}, d.DomainPolicies(), "File imported")
+	assert.Nil(d.SetDomainPolicy(DomainPolicy{Domain: "stream.example", Table: "defgw"}))
+	os.Remove(d.file)
+
+	d2, dir2 := newTestDomainRouter(t, f)
+	defer os.RemoveAll(dir2)
+	d2.SetStore(store)
+	assert.Nil(d2.Init())
+	assert.Equal(d.DomainPolicies(), d2.DomainPolicies())
+}
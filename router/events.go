@@ -0,0 +1,112 @@
+package router
+
+import (
+	"sync"
+	"time"
+)
+
+// EventType names the kind of an Event.
+type EventType string
+
+const (
+	// A host appeared in or disappeared from the hosts
+	EventHostAdded   EventType = "host-added"
+	EventHostRemoved EventType = "host-removed"
+	// The DHCP lease of a host was extended
+	EventLeaseRenewed EventType = "lease-renewed"
+	// The table of a host or group was changed
+	EventRouteChanged EventType = "route-changed"
+	// A monitored table went down or recovered
+	EventHealthChanged EventType = "health-changed"
+	// The reconciler compared the rules with the policy
+	EventReconciled EventType = "reconciled"
+)
+
+// RouteChange describes a changed table of a host or group.
+type RouteChange struct {
+	IP    string
+	MAC   string
+	Group string
+	// New table, empty if the route was deleted
+	Table string
+	// Expiry of a temporary table, zero if permanent
+	Until time.Time
+	// Who made the change, e.g. a client of the API, a schedule or the expiry
+	By string
+}
+
+// Event is published on the EventBus, only the field matching Type is set.
+type Event struct {
+	Type      EventType
+	Time      time.Time
+	Host      *Host
+	Route     *RouteChange
+	Health    *TableHealth
+	Reconcile *ReconcileResult
+}
+
+// EventBus distributes events to all subscribers.
+// Publishing never blocks, events are dropped for subscribers not keeping up.
+type EventBus struct {
+	mu     sync.Mutex
+	subs   map[chan Event]struct{}
+	closed bool
+}
+
+func NewEventBus() *EventBus {
+	return &EventBus{
+		subs: make(map[chan Event]struct{}),
+	}
+}
+
+// Publish sends e to all subscribers, the time is set if missing.
+// Publishing to a nil bus does nothing, so publishers work without one.
+func (b *EventBus) Publish(e Event) {
+	if b == nil {
+		return
+	}
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Subscribe returns a channel receiving all events published from now on,
+// buffering up to buffer events. cancel unsubscribes and closes the channel.
+// The channel of a closed bus is closed right away.
+func (b *EventBus) Subscribe(buffer int) (events <-chan Event, cancel func()) {
+	ch := make(chan Event, buffer)
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	b.subs[ch] = struct{}{}
+	return ch, func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		if _, ok := b.subs[ch]; ok {
+			delete(b.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// Close closes the channels of all subscribers, ending their streams on shutdown.
+func (b *EventBus) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		delete(b.subs, ch)
+		close(ch)
+	}
+	b.closed = true
+}
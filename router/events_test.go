@@ -0,0 +1,145 @@
+package router
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// drain returns the events buffered in ch.
+func drain(ch <-chan Event) []Event {
+	var events []Event
+	for {
+		select {
+		case e := <-ch:
+			events = append(events, e)
+		default:
+			return events
+		}
+	}
+}
+
+func TestEventBus(t *testing.T) {
+	assert := assert.New(t)
+	b := NewEventBus()
+	ch1, cancel1 := b.Subscribe(1)
+	ch2, cancel2 := b.Subscribe(2)
+	defer cancel2()
+
+	b.Publish(Event{Type: EventHostAdded})
+	// Dropped for the full subscriber
+	b.Publish(Event{Type: EventHostRemoved})
+
+	es := drain(ch1)
+	if assert.Len(es, 1) {
+		assert.Equal(EventHostAdded, es[0].Type)
+		assert.False(es[0].Time.IsZero(), "Time is set")
+	}
+	es = drain(ch2)
+	if assert.Len(es, 2) {
+		assert.Equal(EventHostRemoved, es[1].Type)
+	}
+
+	cancel1()
+	cancel1()
+	_, open := <-ch1
+	assert.False(open, "Closed on cancel")
+	b.Publish(Event{Type: EventReconciled})
+	assert.Len(drain(ch2), 1)
+
+	b.Close()
+	_, open = <-ch2
+	assert.False(open, "Closed with the bus")
+	cancel2()
+	ch3, cancel3 := b.Subscribe(1)
+	defer cancel3()
+	_, open = <-ch3
+	assert.False(open, "Closed if subscribed after close")
+	b.Publish(Event{Type: EventReconciled})
+
+	// Publishers without a bus
+	var nb *EventBus
+	nb.Publish(Event{Type: EventReconciled})
+}
+
+func TestVPNRouterEvents(t *testing.T) {
+	assert := assert.New(t)
+	m := mock{
+		rules: []Rule{{IP: "127.0.0.1", Table: "table1"}},
+		leases: []Host{
+			{MAC: "abc", IP: "127.0.0.1", Name: "pc1"},
+		},
+	}
+	b := NewEventBus()
+	ch, cancel := b.Subscribe(10)
+	defer cancel()
+	r := NewVPNRouter(m, &m)
+	r.SetEventBus(b)
+
+	if err := r.As("admin@10.0.0.1").SetRoute("127.0.0.1", "table2"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(ErrUnknownHost, r.SetRoute("127.0.0.9", "table2"))
+	if err := r.DeleteRoute("127.0.0.1"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	es := drain(ch)
+	if assert.Len(es, 2) {
+		assert.Equal(EventRouteChanged, es[0].Type)
+		assert.Equal(&RouteChange{IP: "127.0.0.1", MAC: "abc", Table: "table2", By: "admin@10.0.0.1"}, es[0].Route)
+		assert.Equal(&RouteChange{IP: "127.0.0.1", MAC: "abc"}, es[1].Route, "No actor")
+	}
+}
+
+func TestRulePersistenceExpiryEvents(t *testing.T) {
+	assert := assert.New(t)
+	file := tempDB(t, "MAC\tIP\tTable\n")
+	defer os.Remove(file)
+	hosts := mockHostProvider{{IP: "1", MAC: "a"}}
+	rp := NewRulePersistence(DummyRuleProvider{}, hosts, file)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	b := NewEventBus()
+	ch, cancel := b.Subscribe(10)
+	defer cancel()
+	rp.SetEventBus(b)
+
+	t1 := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	if err := rp.SetUntil("1", "vpn", t1); err != nil {
+		t.Fatalf("Error on set: %s", err)
+	}
+	if _, err := rp.Expire(t1); err != nil {
+		t.Fatalf("Error on expire: %s", err)
+	}
+	es := drain(ch)
+	if assert.Len(es, 1) {
+		assert.Equal(&RouteChange{IP: "1", MAC: "a", By: "expiry"}, es[0].Route)
+	}
+}
+
+func TestHealthMonitorEvents(t *testing.T) {
+	assert := assert.New(t)
+	vpn := &probeResult{err: errors.New("timeout")}
+	m := NewHealthMonitor([]TableCheck{
+		{Table: "vpn", Fallback: "defgw", Checks: []Check{vpn}},
+	})
+	m.Failures = 1
+	b := NewEventBus()
+	ch, cancel := b.Subscribe(10)
+	defer cancel()
+	m.SetEventBus(b)
+
+	m.Probe()
+	m.Probe()
+	es := drain(ch)
+	if assert.Len(es, 1, "Only changes are published") {
+		assert.Equal(EventHealthChanged, es[0].Type)
+		assert.Equal("vpn", es[0].Health.Table)
+		assert.False(es[0].Health.Healthy)
+		assert.Equal("timeout", es[0].Health.Err)
+	}
+}
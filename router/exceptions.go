@@ -0,0 +1,483 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var (
+	ErrNoExceptions     = errors.New("exceptions not supported")
+	ErrInvalidException = errors.New("invalid exception")
+)
+
+// ExceptionRuleProvider manages exceptions, rules for the traffic of an IP to
+// a destination which precede its host rule. They split the traffic of a host
+// between its table and those of its exceptions.
+type ExceptionRuleProvider interface {
+	Exceptions() ([]Rule, error)
+	// SetException adds the exception or moves it to the table of r
+	SetException(r Rule) error
+	// DeleteException removes the exception matching r in any table, if any
+	DeleteException(r Rule) error
+}
+
+// ExceptionPolicy saves the exceptions of hosts and groups. Saved exceptions
+// have no IP, they apply to all addresses of a host of the family of their
+// destination.
+type ExceptionPolicy interface {
+	// HostExceptions returns the own exceptions of a host by MAC and
+	// those of its group
+	HostExceptions(mac string) (own []Rule, group []Rule)
+	// SetHostExceptions replaces the exceptions of the host currently using ip
+	SetHostExceptions(ip string, exceptions []Rule) error
+	// SetGroupExceptions replaces the exceptions of all members of a group
+	SetGroupExceptions(name string, exceptions []Rule) error
+}
+
+// NormalizeException validates the destination, protocol, port and table of
+// an exception and returns it with its prefix in canonical form.
+func NormalizeException(r Rule) (Rule, error) {
+	if r.To == "" {
+		return r, ErrInvalidException
+	}
+	_, n, err := net.ParseCIDR(hostPrefix(r.To))
+	if err != nil {
+		return r, ErrInvalidException
+	}
+	r.To = n.String()
+	r.Proto = strings.ToLower(r.Proto)
+	switch r.Proto {
+	case "", "tcp", "udp":
+	default:
+		return r, ErrInvalidException
+	}
+	if (r.Port != 0 && r.Proto == "") || r.Table == "" || strings.ContainsAny(r.Table, " \t") {
+		return r, ErrInvalidException
+	}
+	return r, nil
+}
+
+// normalizeExceptions validates exceptions, drops their IPs and returns them
+// sorted. Exceptions of the same destination, protocol and port are merged.
+func normalizeExceptions(exceptions []Rule) ([]Rule, error) {
+	m := make(map[string]Rule)
+	for _, e := range exceptions {
+		e, err := NormalizeException(e)
+		if err != nil {
+			return nil, err
+		}
+		e.IP = ""
+		m[exceptionKey(e)] = e
+	}
+	rules := make([]Rule, 0, len(m))
+	for _, e := range m {
+		rules = append(rules, e)
+	}
+	sortExceptions(rules)
+	return rules, nil
+}
+
+// exceptionKey identifies an exception regardless of its table.
+func exceptionKey(r Rule) string {
+	return fmt.Sprintf("%s %s %s %d", r.IP, r.To, r.Proto, r.Port)
+}
+
+// sameFamily returns true if ip and prefix are of the same address family.
+func sameFamily(ip, prefix string) bool {
+	return strings.Contains(ip, ":") == strings.Contains(prefix, ":")
+}
+
+// splitExceptions splits rules into host rules and sorted exceptions.
+func splitExceptions(rules []Rule) (hosts []Rule, exceptions []Rule) {
+	for _, r := range rules {
+		if r.To != "" {
+			exceptions = append(exceptions, r)
+		} else {
+			hosts = append(hosts, r)
+		}
+	}
+	sortExceptions(exceptions)
+	return hosts, exceptions
+}
+
+func findException(rules []Rule, r Rule) (Rule, bool) {
+	key := exceptionKey(r)
+	for _, e := range rules {
+		if exceptionKey(e) == key {
+			return e, true
+		}
+	}
+	return Rule{}, false
+}
+
+// sortExceptions orders exceptions by IP, destination, protocol and port.
+func sortExceptions(rules []Rule) {
+	sort.Sort(exceptionsByKey(rules))
+}
+
+type exceptionsByKey []Rule
+
+func (a exceptionsByKey) Len() int      { return len(a) }
+func (a exceptionsByKey) Swap(i, j int) { a[i], a[j] = a[j], a[i] }
+func (a exceptionsByKey) Less(i, j int) bool {
+	if a[i].IP != a[j].IP {
+		return a[i].IP < a[j].IP
+	}
+	if a[i].To != a[j].To {
+		return a[i].To < a[j].To
+	}
+	if a[i].Proto != a[j].Proto {
+		return a[i].Proto < a[j].Proto
+	}
+	return a[i].Port < a[j].Port
+}
+
+// exceptionSpec returns the selector and table of an exception as arguments of ip rule.
+func exceptionSpec(r Rule) []string {
+	args := []string{"from", r.IP, "to", r.To}
+	if r.Proto != "" {
+		args = append(args, "ipproto", r.Proto)
+	}
+	if r.Port != 0 {
+		args = append(args, "dport", strconv.Itoa(int(r.Port)))
+	}
+	return append(args, "table", r.Table)
+}
+
+// ruleTag returns the priority and protocol arguments of ip rule.
+func ruleTag(prio uint32, proto uint8) []string {
+	args := []string{"pref", strconv.FormatUint(uint64(prio), 10)}
+	if proto != 0 {
+		args = append(args, "protocol", strconv.Itoa(int(proto)))
+	}
+	return args
+}
+
+// setIPException adds r with the ip command run, replacing the exception of
+// the same key in current.
+func setIPException(run func(string, string, ...string) (string, error), current []Rule, r Rule, tag []string) error {
+	if old, ok := findException(current, r); ok {
+		if old.Table == r.Table {
+			return nil
+		}
+		if _, err := run("", "ip", ipFamilyArgs(old.IP, append(append([]string{"rule", "del"}, exceptionSpec(old)...), tag...))...); err != nil {
+			return err
+		}
+	}
+	_, err := run("", "ip", ipFamilyArgs(r.IP, append(append([]string{"rule", "add"}, exceptionSpec(r)...), tag...))...)
+	return err
+}
+
+// deleteIPException deletes the exception of the key of r in current, if any.
+func deleteIPException(run func(string, string, ...string) (string, error), current []Rule, r Rule, tag []string) error {
+	old, ok := findException(current, r)
+	if !ok {
+		return nil
+	}
+	_, err := run("", "ip", ipFamilyArgs(old.IP, append(append([]string{"rule", "del"}, exceptionSpec(old)...), tag...))...)
+	return err
+}
+
+// ipFamilyArgs prepends the family option of addr to args of the ip command.
+func ipFamilyArgs(addr string, args []string) []string {
+	if strings.Contains(addr, ":") {
+		return append([]string{"-6"}, args...)
+	}
+	return append([]string{"-4"}, args...)
+}
+
+// planExceptions returns the changes turning current into desired, removed
+// holds the exceptions of current missing in desired.
+func planExceptions(current, desired []Rule) (added, moved, removed []Rule) {
+	want := make(map[string]Rule)
+	for _, r := range desired {
+		want[exceptionKey(r)] = r
+	}
+	have := make(map[string]Rule)
+	for _, r := range current {
+		have[exceptionKey(r)] = r
+		if _, ok := want[exceptionKey(r)]; !ok {
+			removed = append(removed, r)
+		}
+	}
+	for _, r := range desired {
+		old, ok := have[exceptionKey(r)]
+		switch {
+		case !ok:
+			added = append(added, r)
+		case old.Table != r.Table:
+			moved = append(moved, r)
+		}
+	}
+	sortExceptions(added)
+	sortExceptions(moved)
+	sortExceptions(removed)
+	return added, moved, removed
+}
+
+// syncExceptions applies the changes turning the exceptions of ep into desired.
+// Returns the exceptions added, moved and removed until the first error.
+func syncExceptions(ep ExceptionRuleProvider, desired []Rule) (added, moved, removed []Rule, err error) {
+	current, err := ep.Exceptions()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	a, m, rm := planExceptions(current, desired)
+	for _, r := range rm {
+		if err := ep.DeleteException(r); err != nil {
+			return added, moved, removed, err
+		}
+		removed = append(removed, r)
+	}
+	for _, r := range a {
+		if err := ep.SetException(r); err != nil {
+			return added, moved, removed, err
+		}
+		added = append(added, r)
+	}
+	for _, r := range m {
+		if err := ep.SetException(r); err != nil {
+			return added, moved, removed, err
+		}
+		moved = append(moved, r)
+	}
+	return added, moved, removed, nil
+}
+
+// DummyExceptions remembers exceptions by their key.
+type DummyExceptions map[string]Rule
+
+func (d DummyExceptions) Exceptions() ([]Rule, error) {
+	var rules []Rule
+	for _, r := range d {
+		rules = append(rules, r)
+	}
+	sortExceptions(rules)
+	return rules, nil
+}
+
+func (d DummyExceptions) SetException(r Rule) error {
+	d[exceptionKey(r)] = r
+	return nil
+}
+
+func (d DummyExceptions) DeleteException(r Rule) error {
+	delete(d, exceptionKey(r))
+	return nil
+}
+
+// SetExceptionFile sets the file exceptions are saved to, must be called before Init.
+func (r *RulePersistence) SetExceptionFile(file string) {
+	r.exceptionFile = file
+}
+
+// SetExceptionProvider sets the provider the saved exceptions are applied to,
+// must be called before Init.
+func (r *RulePersistence) SetExceptionProvider(ep ExceptionRuleProvider) {
+	r.exceptions = ep
+}
+
+// readExceptions reads the exception file, a missing file is no error.
+func (r *RulePersistence) readExceptions() error {
+	if r.exceptionFile == "" {
+		return nil
+	}
+	f, err := os.Open(r.exceptionFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	// skip first line
+	br.ReadString('\n')
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		parts := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if len(parts) != 6 {
+			continue
+		}
+		port, err := strconv.ParseUint(parts[4], 10, 16)
+		if err != nil {
+			log.Printf("Persistence: Drop invalid exception of %s: %s", parts[1], err)
+			continue
+		}
+		e, err := NormalizeException(Rule{To: parts[2], Proto: parts[3], Port: uint16(port), Table: parts[5]})
+		if err != nil {
+			log.Printf("Persistence: Drop invalid exception of %s: %s", parts[1], err)
+			continue
+		}
+		switch parts[0] {
+		case "host":
+			r.hostExceptions[parts[1]] = append(r.hostExceptions[parts[1]], e)
+		case "group":
+			r.groupExceptions[parts[1]] = append(r.groupExceptions[parts[1]], e)
+		}
+	}
+	return nil
+}
+
+func (r *RulePersistence) saveExceptions() error {
+	if r.store != nil {
+		return updateStore("exceptions", r.store, r.putExceptions)
+	}
+	if r.exceptionFile == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Type\tOwner\tTo\tProto\tPort\tTable\n")
+	for _, typ := range []string{"host", "group"} {
+		m := r.hostExceptions
+		if typ == "group" {
+			m = r.groupExceptions
+		}
+		owners := make([]string, 0, len(m))
+		for owner := range m {
+			owners = append(owners, owner)
+		}
+		sort.Strings(owners)
+		for _, owner := range owners {
+			for _, e := range m[owner] {
+				fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%d\t%s\n", typ, owner, e.To, e.Proto, e.Port, e.Table)
+			}
+		}
+	}
+	return writeFile("exceptions", r.exceptionFile, buf.Bytes())
+}
+
+// HostExceptions returns the exceptions of the host and its group.
+func (r *RulePersistence) HostExceptions(mac string) (own []Rule, group []Rule) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	own = r.hostExceptions[mac]
+	if g, member := groupByMAC(r.groups, mac); member {
+		group = r.groupExceptions[g.Name]
+	}
+	return own, group
+}
+
+// SetHostExceptions saves the exceptions for the host currently using ip
+// and applies them to all its addresses. No exceptions delete them.
+func (r *RulePersistence) SetHostExceptions(ip string, exceptions []Rule) error {
+	exceptions, err := normalizeExceptions(exceptions)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exceptions == nil {
+		return ErrNoExceptions
+	}
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	h, found := hostByIP(hosts, ip)
+	if !found || h.MAC == "" {
+		return ErrUnknownHost
+	}
+	if len(exceptions) == 0 {
+		delete(r.hostExceptions, h.MAC)
+	} else {
+		r.hostExceptions[h.MAC] = exceptions
+	}
+	if err := r.saveExceptions(); err != nil {
+		return err
+	}
+	return r.applyExceptions(hosts)
+}
+
+// SetGroupExceptions saves the exceptions of a group and applies them to all
+// online members. Exceptions of a member override those of the group.
+func (r *RulePersistence) SetGroupExceptions(name string, exceptions []Rule) error {
+	exceptions, err := normalizeExceptions(exceptions)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.exceptions == nil {
+		return ErrNoExceptions
+	}
+	if _, ok := r.groups[name]; !ok {
+		return ErrUnknownGroup
+	}
+	if len(exceptions) == 0 {
+		delete(r.groupExceptions, name)
+	} else {
+		r.groupExceptions[name] = exceptions
+	}
+	if err := r.saveExceptions(); err != nil {
+		return err
+	}
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	return r.applyExceptions(hosts)
+}
+
+// desiredExceptions expands the saved exceptions to the addresses of the hosts.
+func (r *RulePersistence) desiredExceptions(hosts []Host) []Rule {
+	var desired []Rule
+	for _, h := range hosts {
+		if h.MAC == "" {
+			continue
+		}
+		merged := make(map[string]Rule)
+		if g, member := groupByMAC(r.groups, h.MAC); member {
+			for _, e := range r.groupExceptions[g.Name] {
+				merged[exceptionKey(e)] = e
+			}
+		}
+		for _, e := range r.hostExceptions[h.MAC] {
+			merged[exceptionKey(e)] = e
+		}
+		for _, e := range merged {
+			for _, addr := range h.Addrs() {
+				if sameFamily(addr, e.To) {
+					e.IP = addr
+					desired = append(desired, e)
+				}
+			}
+		}
+	}
+	sortExceptions(desired)
+	return desired
+}
+
+// applyExceptions syncs the exceptions of the provider with the saved
+// exceptions of the hosts, exceptions of other IPs are removed.
+func (r *RulePersistence) applyExceptions(hosts []Host) error {
+	if r.exceptions == nil {
+		return nil
+	}
+	_, _, _, err := syncExceptions(r.exceptions, r.desiredExceptions(hosts))
+	return err
+}
+
+// syncExceptions applies the saved exceptions to the hosts, see applyExceptions.
+// The caller holds r.mu.
+func (r *RulePersistence) syncExceptions(hosts []Host) (added, moved, removed []Rule, err error) {
+	if r.exceptions == nil {
+		return nil, nil, nil, nil
+	}
+	return syncExceptions(r.exceptions, r.desiredExceptions(hosts))
+}
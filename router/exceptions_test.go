@@ -0,0 +1,127 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeException(t *testing.T) {
+	assert := assert.New(t)
+	e, err := NormalizeException(Rule{To: "10.1.2.3/8", Proto: "TCP", Port: 443, Table: "defgw"})
+	assert.Nil(err)
+	assert.Equal(Rule{To: "10.0.0.0/8", Proto: "tcp", Port: 443, Table: "defgw"}, e)
+	e, err = NormalizeException(Rule{To: "2001:db8::1", Table: "defgw"})
+	assert.Nil(err)
+	assert.Equal("2001:db8::1/128", e.To)
+
+	for _, r := range []Rule{
+		{Table: "defgw"},
+		{To: "host", Table: "defgw"},
+		{To: "10.0.0.0/8", Proto: "icmp", Table: "defgw"},
+		{To: "10.0.0.0/8", Port: 53, Table: "defgw"},
+		{To: "10.0.0.0/8"},
+		{To: "10.0.0.0/8", Table: "a b"},
+	} {
+		_, err := NormalizeException(r)
+		assert.Equal(ErrInvalidException, err, "%v", r)
+	}
+}
+
+func TestPlanExceptions(t *testing.T) {
+	current := []Rule{
+		{IP: "10.0.0.1", To: "10.0.0.0/8", Table: "defgw"},
+		{IP: "10.0.0.1", To: "192.168.0.0/16", Table: "defgw"},
+		{IP: "10.0.0.2", To: "10.0.0.0/8", Table: "defgw"},
+	}
+	desired := []Rule{
+		{IP: "10.0.0.1", To: "10.0.0.0/8", Table: "defgw"},
+		{IP: "10.0.0.1", To: "192.168.0.0/16", Table: "vpn"},
+		{IP: "10.0.0.1", To: "192.168.0.0/16", Proto: "udp", Port: 53, Table: "defgw"},
+	}
+	added, moved, removed := planExceptions(current, desired)
+	assert.Equal(t, []Rule{desired[2]}, added)
+	assert.Equal(t, []Rule{desired[1]}, moved)
+	assert.Equal(t, []Rule{current[2]}, removed)
+}
+
+func TestPersistExceptions(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "db.txt")
+	groupFile := filepath.Join(dir, "groups.txt")
+	exceptionFile := filepath.Join(dir, "exceptions.txt")
+	ioutil.WriteFile(dbFile, []byte("MAC\tIP\tTable\n"), 0644)
+
+	const macA, macB = "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"
+	hosts := mockHostProvider{
+		{IP: "10.0.0.1", IP6: []string{"2001:db8::1"}, MAC: macA},
+		{IP: "10.0.0.2", MAC: macB},
+	}
+	newPersistence := func(ep ExceptionRuleProvider) *RulePersistence {
+		rp := NewRulePersistence(make(DummyRuleProvider), hosts, dbFile)
+		rp.SetGroupFile(groupFile)
+		rp.SetExceptionFile(exceptionFile)
+		rp.SetExceptionProvider(ep)
+		if err := rp.Init(); err != nil {
+			t.Fatalf("Error on init: %s", err)
+		}
+		return rp
+	}
+	kernel := make(DummyExceptions)
+	rp := newPersistence(kernel)
+
+	assert.Equal(ErrUnknownHost, rp.SetHostExceptions("10.0.0.9", []Rule{{To: "10.0.0.0/8", Table: "defgw"}}))
+	assert.Equal(ErrInvalidException, rp.SetHostExceptions("10.0.0.1", []Rule{{To: "10.0.0.0/8"}}))
+	assert.Nil(rp.SetHostExceptions("10.0.0.1", []Rule{
+		{To: "2001:db8:1::/48", Table: "defgw"},
+		{To: "10.0.0.0/8", Table: "defgw"},
+	}))
+	exceptions, _ := kernel.Exceptions()
+	assert.Equal([]Rule{
+		{IP: "10.0.0.1", To: "10.0.0.0/8", Table: "defgw"},
+		{IP: "2001:db8::1", To: "2001:db8:1::/48", Table: "defgw"},
+	}, exceptions, "Exceptions apply to the addresses of their family")
+
+	// Group exceptions are overridden by those of a member
+	assert.Nil(rp.SetGroup(Group{Name: "kids", MACs: []string{macA, macB}}))
+	assert.Equal(ErrUnknownGroup, rp.SetGroupExceptions("tv", nil))
+	assert.Nil(rp.SetGroupExceptions("kids", []Rule{{To: "10.0.0.0/8", Table: "vpn"}}))
+	exceptions, _ = kernel.Exceptions()
+	assert.Equal([]Rule{
+		{IP: "10.0.0.1", To: "10.0.0.0/8", Table: "defgw"},
+		{IP: "10.0.0.2", To: "10.0.0.0/8", Table: "vpn"},
+		{IP: "2001:db8::1", To: "2001:db8:1::/48", Table: "defgw"},
+	}, exceptions)
+	own, group := rp.HostExceptions(macA)
+	assert.Equal([]Rule{{To: "10.0.0.0/8", Table: "defgw"}, {To: "2001:db8:1::/48", Table: "defgw"}}, own)
+	assert.Equal([]Rule{{To: "10.0.0.0/8", Table: "vpn"}}, group)
+	assert.Equal([]Rule{{To: "10.0.0.0/8", Table: "vpn"}}, rp.Groups()[0].Exceptions)
+
+	// Reload from files, stale exceptions are removed
+	kernel2 := make(DummyExceptions)
+	kernel2.SetException(Rule{IP: "10.0.0.3", To: "10.0.0.0/8", Table: "vpn"})
+	rp2 := newPersistence(kernel2)
+	assert.Equal(kernel, kernel2)
+	assert.Equal(rp.Groups(), rp2.Groups())
+
+	// Deleting the group deletes its exceptions
+	assert.Nil(rp.DeleteGroup("kids"))
+	assert.Nil(rp.SetHostExceptions("10.0.0.1", nil))
+	assert.Equal(DummyExceptions{}, kernel)
+	rp3 := newPersistence(make(DummyExceptions))
+	own, group = rp3.HostExceptions(macA)
+	assert.Nil(own)
+	assert.Nil(group)
+
+	// Without a provider
+	rp.SetExceptionProvider(nil)
+	assert.Equal(ErrNoExceptions, rp.SetHostExceptions("10.0.0.1", nil))
+}
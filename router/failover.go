@@ -0,0 +1,236 @@
+package router
+
+import (
+	"log"
+	"sync"
+)
+
+// FailoverRuleProvider applies the active table of the health monitor instead of
+// the requested one. Rules reports the requested tables, so the layers above
+// never see a fallback and keep their rules while a table is down.
+// The requested tables are kept in memory only, the provider must be
+// wrapped by a RulePersistence which saves them and applies them again
+// through Set on Init, so a restart during a failover doesn't keep hosts
+// on the fallback.
+type FailoverRuleProvider struct {
+	base       RuleProvider
+	health     *HealthMonitor
+	exceptions ExceptionRuleProvider
+
+	mu sync.Mutex
+	// Requested table of all IPs redirected to a fallback
+	requested map[string]string
+	// Requested table of all exceptions redirected to a fallback, by key
+	requestedExceptions map[string]string
+
+	audit AuditRecorder
+}
+
+func NewFailoverRuleProvider(base RuleProvider, health *HealthMonitor) *FailoverRuleProvider {
+	return &FailoverRuleProvider{
+		base:                base,
+		health:              health,
+		requested:           make(map[string]string),
+		requestedExceptions: make(map[string]string),
+	}
+}
+
+// SetAuditLog records the rules moved on health changes, must be called before Update.
+func (f *FailoverRuleProvider) SetAuditLog(a AuditRecorder) {
+	f.audit = a
+}
+
+// SetExceptionProvider passes exceptions to ep, they fail over like host rules.
+func (f *FailoverRuleProvider) SetExceptionProvider(ep ExceptionRuleProvider) {
+	f.exceptions = ep
+}
+
+func (f *FailoverRuleProvider) Rules() ([]Rule, error) {
+	rules, err := f.base.Rules()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, rule := range rules {
+		if table, ok := f.requested[rule.IP]; ok {
+			rules[i].Table = table
+		}
+	}
+	return rules, nil
+}
+
+func (f *FailoverRuleProvider) Set(ip string, table string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := f.health.Active(table)
+	if err := f.base.Set(ip, active); err != nil {
+		return err
+	}
+	f.record(ip, table, active)
+	return nil
+}
+
+func (f *FailoverRuleProvider) Delete(ip string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.base.Delete(ip); err != nil {
+		return err
+	}
+	delete(f.requested, ip)
+	return nil
+}
+
+func (f *FailoverRuleProvider) SetBatch(changes []Rule) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := make([]Rule, len(changes))
+	for i, c := range changes {
+		active[i] = c
+		if c.Table != "" {
+			active[i].Table = f.health.Active(c.Table)
+		}
+	}
+	if err := SetBatch(f.base, active); err != nil {
+		return err
+	}
+	for i, c := range changes {
+		f.record(c.IP, c.Table, active[i].Table)
+	}
+	return nil
+}
+
+func (f *FailoverRuleProvider) record(ip, table, active string) {
+	if table != active {
+		f.requested[ip] = table
+	} else {
+		delete(f.requested, ip)
+	}
+}
+
+func (f *FailoverRuleProvider) Exceptions() ([]Rule, error) {
+	if f.exceptions == nil {
+		return nil, ErrNoExceptions
+	}
+	rules, err := f.exceptions.Exceptions()
+	if err != nil {
+		return nil, err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, rule := range rules {
+		if table, ok := f.requestedExceptions[exceptionKey(rule)]; ok {
+			rules[i].Table = table
+		}
+	}
+	return rules, nil
+}
+
+func (f *FailoverRuleProvider) SetException(r Rule) error {
+	if f.exceptions == nil {
+		return ErrNoExceptions
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	active := r
+	active.Table = f.health.Active(r.Table)
+	if err := f.exceptions.SetException(active); err != nil {
+		return err
+	}
+	f.recordException(r, active.Table)
+	return nil
+}
+
+func (f *FailoverRuleProvider) DeleteException(r Rule) error {
+	if f.exceptions == nil {
+		return ErrNoExceptions
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if err := f.exceptions.DeleteException(r); err != nil {
+		return err
+	}
+	delete(f.requestedExceptions, exceptionKey(r))
+	return nil
+}
+
+func (f *FailoverRuleProvider) recordException(r Rule, active string) {
+	if r.Table != active {
+		f.requestedExceptions[exceptionKey(r)] = r.Table
+	} else {
+		delete(f.requestedExceptions, exceptionKey(r))
+	}
+}
+
+// Update moves all rules and exceptions to the currently active tables,
+// called whenever the health of a table changes.
+func (f *FailoverRuleProvider) Update() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.updateExceptions()
+	rules, err := f.base.Rules()
+	if err != nil {
+		log.Printf("Failover/Error: %s", err)
+		return
+	}
+	var changes, requested []Rule
+	var entries []AuditEntry
+	for _, rule := range rules {
+		table := rule.Table
+		if req, ok := f.requested[rule.IP]; ok {
+			table = req
+		}
+		if active := f.health.Active(table); active != rule.Table {
+			changes = append(changes, Rule{IP: rule.IP, Table: active})
+			requested = append(requested, Rule{IP: rule.IP, Table: table})
+			entries = append(entries, AuditEntry{Action: "failover", IP: rule.IP, OldTable: rule.Table, NewTable: active})
+		}
+	}
+	if len(changes) == 0 {
+		return
+	}
+	err = SetBatch(f.base, changes)
+	recordSystem(f.audit, "failover", err, entries...)
+	if err != nil {
+		log.Printf("Failover/Error: %s", err)
+		return
+	}
+	for i, c := range changes {
+		f.record(c.IP, requested[i].Table, c.Table)
+	}
+	ruleChanges.Inc("failover")
+	log.Printf("Failover: Moved %v", changes)
+}
+
+// updateExceptions moves the exceptions to the currently active tables.
+func (f *FailoverRuleProvider) updateExceptions() {
+	if f.exceptions == nil {
+		return
+	}
+	rules, err := f.exceptions.Exceptions()
+	if err != nil {
+		log.Printf("Failover/Error: %s", err)
+		return
+	}
+	var moved []Rule
+	for _, rule := range rules {
+		requested := rule
+		if table, ok := f.requestedExceptions[exceptionKey(rule)]; ok {
+			requested.Table = table
+		}
+		active := f.health.Active(requested.Table)
+		if active == rule.Table {
+			continue
+		}
+		rule.Table = active
+		if err := f.exceptions.SetException(rule); err != nil {
+			log.Printf("Failover/Error: %s", err)
+			continue
+		}
+		f.recordException(requested, active)
+		moved = append(moved, rule)
+	}
+	if len(moved) > 0 {
+		log.Printf("Failover: Moved exceptions %v", moved)
+	}
+}
@@ -0,0 +1,130 @@
+package router
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestFailoverRuleProvider(t *testing.T) {
+	vpn := &probeResult{}
+	m := NewHealthMonitor([]TableCheck{{Table: "vpn", Fallback: "defgw", Checks: []Check{vpn}}})
+	m.Failures = 1
+	kernel := DummyRuleProvider{}
+	f := NewFailoverRuleProvider(kernel, m)
+	m.OnChange(f.Update)
+
+	if err := f.SetBatch([]Rule{{IP: "1", Table: "vpn"}, {IP: "2", Table: "null"}}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	vpn.err = errors.New("down")
+	m.Probe()
+	if exp := (DummyRuleProvider{"1": "defgw", "2": "null"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules after failover: %v", kernel)
+	}
+	rules, err := f.Rules()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if exp := []Rule{{IP: "1", Table: "vpn"}, {IP: "2", Table: "null"}}; !reflect.DeepEqual(sortedRules(rules), exp) {
+		t.Errorf("Requested tables not reported: %v", rules)
+	}
+
+	// New rules are redirected as well
+	if err := f.Set("3", "vpn"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := f.Set("1", "null"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if exp := (DummyRuleProvider{"1": "null", "2": "null", "3": "defgw"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules: %v", kernel)
+	}
+
+	vpn.err = nil
+	m.Probe()
+	if exp := (DummyRuleProvider{"1": "null", "2": "null", "3": "vpn"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules after recovery: %v", kernel)
+	}
+	if len(f.requested) != 0 {
+		t.Errorf("Redirects left: %v", f.requested)
+	}
+}
+
+func TestFailoverExceptions(t *testing.T) {
+	vpn := &probeResult{}
+	m := NewHealthMonitor([]TableCheck{{Table: "vpn", Fallback: "defgw", Checks: []Check{vpn}}})
+	m.Failures = 1
+	kernel := DummyExceptions{}
+	f := NewFailoverRuleProvider(DummyRuleProvider{}, m)
+	f.SetExceptionProvider(kernel)
+	m.OnChange(f.Update)
+
+	e := Rule{IP: "1", To: "10.0.0.0/8", Table: "vpn"}
+	if err := f.SetException(e); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	vpn.err = errors.New("down")
+	m.Probe()
+	if table := kernel[exceptionKey(e)].Table; table != "defgw" {
+		t.Errorf("Invalid table after failover: %s", table)
+	}
+	exceptions, err := f.Exceptions()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if exp := []Rule{e}; !reflect.DeepEqual(exceptions, exp) {
+		t.Errorf("Requested table not reported: %v", exceptions)
+	}
+
+	vpn.err = nil
+	m.Probe()
+	if table := kernel[exceptionKey(e)].Table; table != "vpn" {
+		t.Errorf("Invalid table after recovery: %s", table)
+	}
+	if len(f.requestedExceptions) != 0 {
+		t.Errorf("Redirects left: %v", f.requestedExceptions)
+	}
+}
+
+func TestFailoverRestart(t *testing.T) {
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	hosts := mockHostProvider{{IP: "10.0.0.1", MAC: "aa:bb:cc:dd:ee:01"}}
+	vpn := &probeResult{}
+	kernel := DummyRuleProvider{}
+	start := func() (*HealthMonitor, *RulePersistence) {
+		m := NewHealthMonitor([]TableCheck{{Table: "vpn", Fallback: "defgw", Checks: []Check{vpn}}})
+		m.Failures = 1
+		f := NewFailoverRuleProvider(kernel, m)
+		m.OnChange(f.Update)
+		rp := NewRulePersistence(f, hosts, "")
+		rp.SetStore(store)
+		if err := rp.Init(); err != nil {
+			t.Fatalf("Error on init: %s", err)
+		}
+		return m, rp
+	}
+
+	m, rp := start()
+	if err := rp.Set("10.0.0.1", "vpn"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	vpn.err = errors.New("down")
+	m.Probe()
+	if exp := (DummyRuleProvider{"10.0.0.1": "defgw"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules after failover: %v", kernel)
+	}
+
+	// Restart while the table is down, the saved table is requested again
+	m, _ = start()
+	m.Probe()
+	if exp := (DummyRuleProvider{"10.0.0.1": "defgw"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules after restart: %v", kernel)
+	}
+	vpn.err = nil
+	m.Probe()
+	if exp := (DummyRuleProvider{"10.0.0.1": "vpn"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Requested table not restored after restart: %v", kernel)
+	}
+}
@@ -0,0 +1,285 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	ErrUnknownGroup = errors.New("unknown group")
+	ErrInvalidGroup = errors.New("invalid group name or member")
+	ErrGroupMember  = errors.New("device is member of another group")
+	ErrNoGroups     = errors.New("groups not supported")
+)
+
+// Group is a named set of devices which share a table.
+type Group struct {
+	Name string
+	MACs []string
+	// Table of all members, empty if not set
+	Table string
+	// Exceptions of all members, set by SetGroupExceptions
+	Exceptions []Rule
+}
+
+// GroupProvider manages groups of devices.
+type GroupProvider interface {
+	Groups() []Group
+	// SetGroup creates or replaces a group, its members get the table of the group.
+	// The table of an existing group is kept if g.Table is empty.
+	SetGroup(g Group) error
+	// DeleteGroup removes a group, its members keep their table
+	DeleteGroup(name string) error
+	// SetGroupTable sets the table of all members, an empty table deletes their rules
+	SetGroupTable(name string, table string) error
+}
+
+var groupNameRe = regexp.MustCompile(`^[A-Za-z0-9_.-]+$`)
+
+// normalizeGroup validates g and returns it with sorted, lower case MACs.
+func normalizeGroup(g Group) (Group, error) {
+	if !groupNameRe.MatchString(g.Name) || strings.ContainsAny(g.Table, " \t") {
+		return g, ErrInvalidGroup
+	}
+	var macs []string
+	for _, m := range g.MACs {
+		hw, err := net.ParseMAC(m)
+		if err != nil {
+			return g, ErrInvalidGroup
+		}
+		macs = appendMissing(macs, hw.String())
+	}
+	sort.Strings(macs)
+	g.MACs = macs
+	return g, nil
+}
+
+func groupByMAC(groups map[string]Group, mac string) (Group, bool) {
+	for _, g := range groups {
+		for _, m := range g.MACs {
+			if m == mac {
+				return g, true
+			}
+		}
+	}
+	return Group{}, false
+}
+
+// SetGroupFile sets the file groups are saved to, must be called before Init.
+func (r *RulePersistence) SetGroupFile(file string) {
+	r.groupFile = file
+}
+
+// readGroups reads the group file, a missing file is no error.
+func (r *RulePersistence) readGroups() error {
+	if r.groupFile == "" {
+		return nil
+	}
+	f, err := os.Open(r.groupFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	// skip first line
+	br.ReadString('\n')
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		parts := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		if len(parts) != 3 {
+			continue
+		}
+		g := Group{Name: parts[0], Table: parts[2]}
+		if parts[1] != "" {
+			g.MACs = strings.Split(parts[1], ",")
+		}
+		r.groups[g.Name] = g
+	}
+	return nil
+}
+
+func (r *RulePersistence) saveGroups() error {
+	if r.store != nil {
+		return updateStore("groups", r.store, r.putGroups)
+	}
+	if r.groupFile == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Group\tMAC\tTable\n")
+	for _, g := range r.sortedGroups() {
+		buf.WriteString(g.Name)
+		buf.WriteString("\t")
+		buf.WriteString(strings.Join(g.MACs, ","))
+		buf.WriteString("\t")
+		buf.WriteString(g.Table)
+		buf.WriteString("\n")
+	}
+	return writeFile("groups", r.groupFile, buf.Bytes())
+}
+
+func (r *RulePersistence) sortedGroups() []Group {
+	groups := make([]Group, 0, len(r.groups))
+	for _, g := range r.groups {
+		groups = append(groups, g)
+	}
+	sort.Sort(groupsByName(groups))
+	return groups
+}
+
+type groupsByName []Group
+
+func (a groupsByName) Len() int           { return len(a) }
+func (a groupsByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a groupsByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// Groups returns all groups sorted by name.
+func (r *RulePersistence) Groups() []Group {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	groups := r.sortedGroups()
+	for i, g := range groups {
+		groups[i].Exceptions = r.groupExceptions[g.Name]
+	}
+	return groups
+}
+
+func (r *RulePersistence) SetGroup(g Group) error {
+	g, err := normalizeGroup(g)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, mac := range g.MACs {
+		if other, found := groupByMAC(r.groups, mac); found && other.Name != g.Name {
+			return ErrGroupMember
+		}
+	}
+	if g.Table == "" {
+		g.Table = r.groups[g.Name].Table
+	}
+	if g.Table != "" {
+		if err := r.setMembersTable(g.MACs, g.Table); err != nil {
+			return err
+		}
+	}
+	g.Exceptions = nil
+	r.groups[g.Name] = g
+	if err := r.saveGroups(); err != nil {
+		return err
+	}
+	if g.Table != "" {
+		ruleChanges.Inc("group")
+	}
+	return r.applyMemberExceptions()
+}
+
+func (r *RulePersistence) DeleteGroup(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.groups[name]; !ok {
+		return ErrUnknownGroup
+	}
+	delete(r.groups, name)
+	if err := r.saveGroups(); err != nil {
+		return err
+	}
+	if _, ok := r.groupExceptions[name]; !ok {
+		return nil
+	}
+	delete(r.groupExceptions, name)
+	if err := r.saveExceptions(); err != nil {
+		return err
+	}
+	return r.applyMemberExceptions()
+}
+
+// applyMemberExceptions applies the exceptions after the members of a group changed.
+func (r *RulePersistence) applyMemberExceptions() error {
+	if r.exceptions == nil {
+		return nil
+	}
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	return r.applyExceptions(hosts)
+}
+
+func (r *RulePersistence) SetGroupTable(name string, table string) error {
+	return countRuleChange("group", r.setGroupTable(name, table))
+}
+
+func (r *RulePersistence) setGroupTable(name string, table string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	g, ok := r.groups[name]
+	if !ok {
+		return ErrUnknownGroup
+	}
+	if err := r.setMembersTable(g.MACs, table); err != nil {
+		return err
+	}
+	g.Table = table
+	r.groups[name] = g
+	return r.saveGroups()
+}
+
+// setMembersTable applies table to all online members in a single batch
+// and saves it for all members. An empty table deletes their rules.
+func (r *RulePersistence) setMembersTable(macs []string, table string) error {
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	var changes []Rule
+	for _, mac := range macs {
+		addrs := r.db[mac].IPs
+		if h, found := hostByMAC(hosts, mac); found && len(h.Addrs()) > 0 {
+			addrs = h.Addrs()
+			if table == "" {
+				addrs = appendMissing(addrs, r.db[mac].IPs...)
+			}
+		}
+		for _, addr := range addrs {
+			changes = append(changes, Rule{IP: addr, Table: table})
+		}
+	}
+	if err := SetBatch(r.base, changes); err != nil {
+		return err
+	}
+	for _, mac := range macs {
+		if table == "" {
+			delete(r.db, mac)
+			continue
+		}
+		rule := r.db[mac]
+		if h, found := hostByMAC(hosts, mac); found && len(h.Addrs()) > 0 {
+			rule.IPs = h.Addrs()
+		}
+		rule.Table = table
+		rule.Expires, rule.Prev = time.Time{}, ""
+		if len(rule.IPs) > 0 {
+			r.db[mac] = rule
+		}
+	}
+	return r.saveRulesToDB()
+}
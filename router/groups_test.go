@@ -0,0 +1,81 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGroups(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "db.txt")
+	groupFile := filepath.Join(dir, "groups.txt")
+	ioutil.WriteFile(dbFile, []byte("MAC\tIP\tTable\n"), 0644)
+
+	const macA, macB, macC = "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03"
+	hosts := mockHostProvider{
+		{IP: "1", MAC: macA},
+		{IP: "2", MAC: macB},
+	}
+	kernel := make(DummyRuleProvider)
+	rp := NewRulePersistence(kernel, hosts, dbFile)
+	rp.SetGroupFile(groupFile)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+
+	assert.Equal(ErrInvalidGroup, rp.SetGroup(Group{Name: "a b"}))
+	assert.Equal(ErrInvalidGroup, rp.SetGroup(Group{Name: "kids", MACs: []string{"nomac"}}))
+
+	assert.Nil(rp.SetGroup(Group{Name: "kids", MACs: []string{macC, "AA:BB:CC:DD:EE:01"}}))
+	assert.Equal([]Group{{Name: "kids", MACs: []string{macA, macC}}}, rp.Groups())
+	assert.Equal(DummyRuleProvider{}, kernel, "No table yet")
+
+	assert.Equal(ErrUnknownGroup, rp.SetGroupTable("tv", "vpn"))
+	assert.Nil(rp.SetGroupTable("kids", "vpn"))
+	assert.Equal(DummyRuleProvider{"1": "vpn"}, kernel)
+	assert.Equal(map[string]string{macA: "vpn"}, rp.Policy())
+	assert.Equal("vpn", rp.snapshot()[macC].Table, "Offline members are part of the policy")
+
+	// New members inherit the table
+	assert.Nil(rp.SetGroup(Group{Name: "kids", MACs: []string{macA, macB, macC}}))
+	assert.Equal(DummyRuleProvider{"1": "vpn", "2": "vpn"}, kernel)
+	assert.Equal(ErrGroupMember, rp.SetGroup(Group{Name: "tv", MACs: []string{macB}}))
+
+	// Offline member shows up
+	rec := NewReconciler(append(hosts, Host{IP: "3", MAC: macC}), rp, kernel)
+	res := rec.Reconcile()
+	assert.Nil(res.Err)
+	assert.Equal([]Rule{{IP: "3", Table: "vpn"}}, res.Added)
+	assert.Equal("vpn", rp.Policy()[macC])
+
+	// Members fall back to the group table
+	assert.Nil(rp.Set("2", "defgw"))
+	assert.Equal("defgw", kernel["2"])
+	assert.Nil(rp.Delete("2"))
+	assert.Equal("vpn", kernel["2"])
+
+	// Reload from files
+	rp2 := NewRulePersistence(make(DummyRuleProvider), hosts, dbFile)
+	rp2.SetGroupFile(groupFile)
+	if err := rp2.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	assert.Equal(rp.Groups(), rp2.Groups())
+
+	assert.Nil(rp.SetGroupTable("kids", ""))
+	assert.Equal(DummyRuleProvider{}, kernel)
+	assert.Equal(map[string]string{}, rp.Policy())
+
+	assert.Nil(rp.DeleteGroup("kids"))
+	assert.Equal(ErrUnknownGroup, rp.DeleteGroup("kids"))
+	assert.Equal([]Group{}, rp.Groups())
+}
@@ -0,0 +1,304 @@
+package router
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Check probes the connectivity of a routing table.
+type Check interface {
+	// Probe returns nil if the table is usable
+	Probe(timeout time.Duration) error
+}
+
+// LinkCheck requires the interface of a table to be up and running,
+// e.g. the tun device of a VPN tunnel.
+type LinkCheck struct {
+	Interface string
+}
+
+func (c LinkCheck) Probe(timeout time.Duration) error {
+	iface, err := net.InterfaceByName(c.Interface)
+	if err != nil {
+		return err
+	}
+	if iface.Flags&net.FlagUp == 0 {
+		return fmt.Errorf("link %s is down", c.Interface)
+	}
+	if iface.Flags&net.FlagRunning == 0 {
+		return fmt.Errorf("link %s has no carrier", c.Interface)
+	}
+	return nil
+}
+
+// TCPCheck connects to Addr, bound to Interface if given.
+type TCPCheck struct {
+	Addr      string
+	Interface string
+}
+
+func (c TCPCheck) Probe(timeout time.Duration) error {
+	d := net.Dialer{
+		Timeout: timeout,
+		Control: bindControl(c.Interface),
+	}
+	conn, err := d.Dial("tcp", c.Addr)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// PingCheck sends an ICMP echo request to Addr, bound to Interface if given.
+// Needs a raw socket and therefore root.
+type PingCheck struct {
+	Addr      string
+	Interface string
+}
+
+var pingSeq uint32
+
+// ICMP echo types and protocol numbers
+const (
+	icmpEcho      = 8
+	icmpEchoReply = 0
+	icmp6Echo     = 128
+	icmp6Reply    = 129
+)
+
+func (c PingCheck) Probe(timeout time.Duration) error {
+	ip := net.ParseIP(c.Addr)
+	if ip == nil {
+		return fmt.Errorf("invalid ping address %s", c.Addr)
+	}
+	network, echo, reply := "ip4:icmp", byte(icmpEcho), byte(icmpEchoReply)
+	if ip.To4() == nil {
+		network, echo, reply = "ip6:ipv6-icmp", icmp6Echo, icmp6Reply
+	}
+	lc := net.ListenConfig{Control: bindControl(c.Interface)}
+	conn, err := lc.ListenPacket(context.Background(), network, "")
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(os.Getpid())
+	seq := uint16(atomic.AddUint32(&pingSeq, 1))
+	msg := []byte{echo, 0, 0, 0, 0, 0, 0, 0, 'v', 'p', 'n', 'r'}
+	binary.BigEndian.PutUint16(msg[4:6], id)
+	binary.BigEndian.PutUint16(msg[6:8], seq)
+	if echo == icmpEcho {
+		// The kernel computes the checksum of ICMPv6
+		binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+	}
+	if _, err := conn.WriteTo(msg, &net.IPAddr{IP: ip}); err != nil {
+		return err
+	}
+	buf := make([]byte, 1500)
+	for {
+		n, from, err := conn.ReadFrom(buf)
+		if err != nil {
+			return err
+		}
+		if n < 8 || buf[0] != reply || !from.(*net.IPAddr).IP.Equal(ip) {
+			continue
+		}
+		if binary.BigEndian.Uint16(buf[4:6]) == id && binary.BigEndian.Uint16(buf[6:8]) == seq {
+			return nil
+		}
+	}
+}
+
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// TableCheck describes the checks of a table and the table used while they fail.
+type TableCheck struct {
+	Table    string
+	Fallback string
+	Checks   []Check
+}
+
+// TableHealth is the health state of a table.
+type TableHealth struct {
+	Table    string
+	Fallback string
+	Healthy  bool
+	// Time of the last state change, zero if the table was always healthy
+	Since time.Time
+	// Error of the last failed probe
+	Err string
+}
+
+type tableState struct {
+	TableCheck
+	health TableHealth
+	// consecutive probes contradicting the current state
+	count int
+}
+
+// HealthMonitor probes tables periodically. A table is down after Failures
+// consecutive failed probes and up again after as many successful ones.
+type HealthMonitor struct {
+	Failures int
+	Timeout  time.Duration
+
+	mu       sync.Mutex
+	tables   map[string]*tableState
+	onChange []func()
+	events   *EventBus
+}
+
+// NewHealthMonitor monitors the given tables, all of them start healthy.
+func NewHealthMonitor(checks []TableCheck) *HealthMonitor {
+	m := &HealthMonitor{
+		Failures: 3,
+		Timeout:  2 * time.Second,
+		tables:   make(map[string]*tableState),
+	}
+	for _, c := range checks {
+		m.tables[c.Table] = &tableState{
+			TableCheck: c,
+			health:     TableHealth{Table: c.Table, Fallback: c.Fallback, Healthy: true},
+		}
+	}
+	return m
+}
+
+// OnChange registers fn to be called after the health of any table changed.
+func (m *HealthMonitor) OnChange(fn func()) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.onChange = append(m.onChange, fn)
+}
+
+// SetEventBus publishes every change of the health of a table.
+func (m *HealthMonitor) SetEventBus(events *EventBus) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.events = events
+}
+
+// Health returns the state of a table, false if it is not monitored.
+func (m *HealthMonitor) Health(table string) (TableHealth, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s, ok := m.tables[table]
+	if !ok {
+		return TableHealth{}, false
+	}
+	return s.health, true
+}
+
+// Active returns the table used instead of table: the first healthy table
+// following the fallbacks, table itself if none of them is healthy.
+func (m *HealthMonitor) Active(table string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	seen := make(map[string]bool)
+	for t := table; t != "" && !seen[t]; {
+		s, ok := m.tables[t]
+		if !ok || s.health.Healthy {
+			return t
+		}
+		seen[t] = true
+		t = s.Fallback
+	}
+	return table
+}
+
+// Probe runs the checks of all tables in parallel and updates their state.
+func (m *HealthMonitor) Probe() {
+	m.mu.Lock()
+	states := make([]*tableState, 0, len(m.tables))
+	for _, s := range m.tables {
+		states = append(states, s)
+	}
+	m.mu.Unlock()
+
+	errs := make([]error, len(states))
+	var wg sync.WaitGroup
+	for i, s := range states {
+		wg.Add(1)
+		go func(i int, checks []Check) {
+			defer wg.Done()
+			for _, c := range checks {
+				if err := c.Probe(m.Timeout); err != nil {
+					errs[i] = err
+					return
+				}
+			}
+		}(i, s.Checks)
+	}
+	wg.Wait()
+
+	now := time.Now()
+	var changed []TableHealth
+	m.mu.Lock()
+	for i, s := range states {
+		if errs[i] != nil {
+			s.health.Err = errs[i].Error()
+		}
+		if (errs[i] == nil) == s.health.Healthy {
+			s.count = 0
+			continue
+		}
+		if s.count++; s.count < m.Failures {
+			continue
+		}
+		s.count = 0
+		s.health.Healthy = !s.health.Healthy
+		s.health.Since = now
+		changed = append(changed, s.health)
+		if s.health.Healthy {
+			log.Printf("Health: Table %s recovered", s.Table)
+		} else {
+			log.Printf("Health: Table %s is down: %s", s.Table, s.health.Err)
+		}
+	}
+	fns := m.onChange
+	events := m.events
+	m.mu.Unlock()
+	if len(changed) == 0 {
+		return
+	}
+	for _, fn := range fns {
+		fn()
+	}
+	for i := range changed {
+		events.Publish(Event{Type: EventHealthChanged, Health: &changed[i]})
+	}
+}
+
+// Run probes every interval until stop is closed.
+func (m *HealthMonitor) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		m.Probe()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
@@ -0,0 +1,19 @@
+package router
+
+import "syscall"
+
+// bindControl returns a socket control function binding to iface, nil if iface is empty.
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		if cerr := c.Control(func(fd uintptr) {
+			err = syscall.BindToDevice(int(fd), iface)
+		}); cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
@@ -0,0 +1,28 @@
+package router
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthChecksNetNS(t *testing.T) {
+	inNetNS(t, func() {
+		assert := assert.New(t)
+		// Loopback is down in a new namespace
+		assert.NotNil(LinkCheck{Interface: "lo"}.Probe(time.Second))
+		assert.NotNil(PingCheck{Addr: "127.0.0.1"}.Probe(100 * time.Millisecond))
+
+		if out, err := exec.Command("ip", "link", "set", "lo", "up").CombinedOutput(); err != nil {
+			t.Skipf("Could not set up loopback: %s %s", err, out)
+		}
+		assert.Nil(LinkCheck{Interface: "lo"}.Probe(time.Second))
+		assert.Nil(PingCheck{Addr: "127.0.0.1"}.Probe(time.Second))
+		assert.Nil(PingCheck{Addr: "::1"}.Probe(time.Second))
+		assert.Nil(PingCheck{Addr: "127.0.0.1", Interface: "lo"}.Probe(time.Second))
+		assert.NotNil(PingCheck{Addr: "127.0.0.1", Interface: "missing0"}.Probe(time.Second))
+		assert.NotNil(PingCheck{Addr: "invalid"}.Probe(time.Second))
+	})
+}
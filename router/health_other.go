@@ -0,0 +1,18 @@
+//go:build !linux
+// +build !linux
+
+package router
+
+import (
+	"errors"
+	"syscall"
+)
+
+func bindControl(iface string) func(network, address string, c syscall.RawConn) error {
+	if iface == "" {
+		return nil
+	}
+	return func(network, address string, c syscall.RawConn) error {
+		return errors.New("binding to an interface is not supported on this platform")
+	}
+}
@@ -0,0 +1,98 @@
+package router
+
+import (
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// probeResult is a check returning its current value
+type probeResult struct {
+	err error
+}
+
+func (p *probeResult) Probe(timeout time.Duration) error {
+	return p.err
+}
+
+func TestHealthMonitor(t *testing.T) {
+	assert := assert.New(t)
+	vpn := &probeResult{}
+	vpn2 := &probeResult{}
+	m := NewHealthMonitor([]TableCheck{
+		{Table: "vpn", Fallback: "vpn2", Checks: []Check{vpn}},
+		{Table: "vpn2", Fallback: "defgw", Checks: []Check{vpn2}},
+		// Loops are ignored
+		{Table: "a", Fallback: "b", Checks: []Check{vpn}},
+		{Table: "b", Fallback: "a", Checks: []Check{vpn}},
+	})
+	m.Failures = 2
+	changes := 0
+	m.OnChange(func() { changes++ })
+
+	m.Probe()
+	assert.Equal("vpn", m.Active("vpn"))
+	assert.Equal("null", m.Active("null"))
+
+	vpn.err = errors.New("timeout")
+	m.Probe()
+	h, ok := m.Health("vpn")
+	assert.True(ok)
+	assert.True(h.Healthy, "Healthy until failures are reached")
+	assert.Equal("timeout", h.Err)
+	assert.Equal(0, changes)
+
+	m.Probe()
+	h, _ = m.Health("vpn")
+	assert.False(h.Healthy)
+	assert.False(h.Since.IsZero())
+	assert.Equal(1, changes)
+	assert.Equal("vpn2", m.Active("vpn"))
+	assert.Equal("a", m.Active("a"), "No healthy table in loop")
+
+	vpn2.err = errors.New("down")
+	m.Probe()
+	m.Probe()
+	assert.Equal("defgw", m.Active("vpn"))
+	assert.Equal(2, changes)
+
+	// A single success does not recover
+	vpn.err = nil
+	m.Probe()
+	vpn.err = errors.New("timeout")
+	m.Probe()
+	vpn.err = nil
+	m.Probe()
+	assert.Equal("defgw", m.Active("vpn"))
+	m.Probe()
+	assert.Equal("vpn", m.Active("vpn"))
+	assert.Equal(3, changes)
+
+	_, ok = m.Health("null")
+	assert.False(ok, "Unmonitored table")
+}
+
+func TestTCPCheck(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	addr := l.Addr().String()
+	assert.Nil(t, TCPCheck{Addr: addr}.Probe(time.Second))
+	l.Close()
+	assert.NotNil(t, TCPCheck{Addr: addr}.Probe(time.Second))
+}
+
+func TestLinkCheck(t *testing.T) {
+	assert.NotNil(t, LinkCheck{Interface: "vpnrouter-missing0"}.Probe(time.Second))
+}
+
+func TestICMPChecksum(t *testing.T) {
+	msg := []byte{8, 0, 0, 0, 0, 1, 0, 1}
+	assert.Equal(t, uint16(0xf7fd), icmpChecksum(msg))
+	msg[2], msg[3] = 0xf7, 0xfd
+	assert.Equal(t, uint16(0), icmpChecksum(msg))
+}
@@ -9,6 +9,9 @@ type HostMerger struct {
 
 	// Static names are used if found
 	StaticName HostProvider
+
+	// Optional IPv6 neighbours, attached to the hosts by MAC
+	Neighbors HostProvider
 }
 
 func (h HostMerger) Hosts() ([]Host, error) {
@@ -16,6 +19,13 @@ func (h HostMerger) Hosts() ([]Host, error) {
 	if err != nil {
 		return nil, err
 	}
+	if h.Neighbors != nil {
+		neighbors, err := h.Neighbors.Hosts()
+		if err != nil {
+			return nil, err
+		}
+		hosts1 = append(hosts1, neighbors...)
+	}
 	hosts2, err := h.Backup.Hosts()
 	if err != nil {
 		return nil, err
@@ -27,8 +37,22 @@ func (h HostMerger) Hosts() ([]Host, error) {
 	return mergeHosts(hosts1, hosts2, hosts3), nil
 }
 
+// splitIP6Only separates hosts only known by IPv6 addresses.
+func splitIP6Only(hosts []Host) (v4 []Host, v6 []Host) {
+	for _, h := range hosts {
+		if h.IP == "" {
+			v6 = append(v6, h)
+		} else {
+			v4 = append(v4, h)
+		}
+	}
+	return v4, v6
+}
+
 func mergeHosts(hosts1, hosts2, hosts3 []Host) []Host {
 	var hosts []Host
+	hosts1, v6hosts1 := splitIP6Only(hosts1)
+	hosts2, v6hosts2 := splitIP6Only(hosts2)
 	staticNameM := make(map[string]string) // MAC to Name
 	for _, sn := range hosts3 {
 		staticNameM[sn.MAC] = sn.Name
@@ -54,5 +78,55 @@ func mergeHosts(hosts1, hosts2, hosts3 []Host) []Host {
 		}
 		hosts = append(hosts, h2)
 	}
+
+	// Attach IPv6 addresses by MAC, or by name if the MAC is unknown
+	for _, h6 := range append(v6hosts1, v6hosts2...) {
+		i := indexOfHost(hosts, h6)
+		if i < 0 {
+			if sname, ok := staticNameM[h6.MAC]; ok && h6.MAC != "" {
+				h6.Name = sname
+			}
+			h6.IP6 = appendMissing(nil, h6.IP6...)
+			hosts = append(hosts, h6)
+			continue
+		}
+		hosts[i].IP6 = appendMissing(hosts[i].IP6, h6.IP6...)
+		if hosts[i].Name == "" {
+			hosts[i].Name = h6.Name
+		}
+	}
 	return hosts
 }
+
+func indexOfHost(hosts []Host, h Host) int {
+	for i, host := range hosts {
+		if h.MAC != "" && host.MAC == h.MAC {
+			return i
+		}
+	}
+	if h.MAC != "" || h.Name == "" {
+		return -1
+	}
+	for i, host := range hosts {
+		if host.Name == h.Name {
+			return i
+		}
+	}
+	return -1
+}
+
+func appendMissing(s []string, vs ...string) []string {
+	for _, v := range vs {
+		found := false
+		for _, e := range s {
+			if e == v {
+				found = true
+				break
+			}
+		}
+		if !found {
+			s = append(s, v)
+		}
+	}
+	return s
+}
@@ -30,3 +30,32 @@ func TestHostMerger(t *testing.T) {
 		t.Fatalf("Merge failed, got: %s", m)
 	}
 }
+
+func TestHostMergerIP6(t *testing.T) {
+	h1 := []Host{
+		{IP: "0.0.0.1", MAC: "1"},
+		{IP6: []string{"2001:db8::1"}, MAC: "1"},
+		{IP6: []string{"2001:db8::5"}, MAC: "5"},
+	}
+
+	h2 := []Host{
+		{IP: "0.0.0.1", MAC: "1", Name: "name1"},
+		{IP6: []string{"2001:db8::1"}, MAC: "1", Name: "name1"},
+		{IP6: []string{"2001:db8::11"}, Name: "name1"},
+		{IP6: []string{"2001:db8::6"}, Name: "name6"},
+	}
+
+	h3 := []Host{
+		{MAC: "5", Name: "staticname"},
+	}
+
+	// IPv6 addresses are attached by MAC or name
+	exp := []Host{
+		{IP: "0.0.0.1", IP6: []string{"2001:db8::1", "2001:db8::11"}, MAC: "1", Name: "name1"},
+		{IP6: []string{"2001:db8::5"}, MAC: "5", Name: "staticname"},
+		{IP6: []string{"2001:db8::6"}, Name: "name6"},
+	}
+	if m := mergeHosts(h1, h2, h3); !reflect.DeepEqual(m, exp) {
+		t.Fatalf("Merge failed, got: %v", m)
+	}
+}
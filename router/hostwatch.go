@@ -0,0 +1,63 @@
+package router
+
+import "sync"
+
+// HostWatcher publishes hosts appearing and disappearing between two calls of Hosts.
+// The hosts of the first call are taken as known without publishing them.
+type HostWatcher struct {
+	hp     HostProvider
+	events *EventBus
+
+	mu    sync.Mutex
+	last  []Host
+	known map[string]bool // MAC or the address of hosts without MAC
+}
+
+// NewHostWatcher wraps hp and publishes its changes to events.
+func NewHostWatcher(hp HostProvider, events *EventBus) *HostWatcher {
+	return &HostWatcher{
+		hp:     hp,
+		events: events,
+	}
+}
+
+func hostKey(h Host) string {
+	if h.MAC != "" {
+		return h.MAC
+	}
+	if addrs := h.Addrs(); len(addrs) > 0 {
+		return addrs[0]
+	}
+	return ""
+}
+
+func (w *HostWatcher) Hosts() ([]Host, error) {
+	hosts, err := w.hp.Hosts()
+	if err != nil {
+		return nil, err
+	}
+	current := make(map[string]bool)
+	for _, h := range hosts {
+		current[hostKey(h)] = true
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.known != nil {
+		for _, h := range hosts {
+			if !w.known[hostKey(h)] {
+				h := h
+				w.events.Publish(Event{Type: EventHostAdded, Host: &h})
+			}
+		}
+		for _, h := range w.last {
+			if !current[hostKey(h)] {
+				h := h
+				w.events.Publish(Event{Type: EventHostRemoved, Host: &h})
+			}
+		}
+	}
+	w.last = hosts
+	w.known = current
+	return hosts, nil
+}
@@ -0,0 +1,40 @@
+package router
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHostWatcher(t *testing.T) {
+	assert := assert.New(t)
+	hosts := &mock{leases: []Host{
+		{MAC: "a", IP: "1", Name: "pc1"},
+		{IP6: []string{"2001:db8::1"}},
+	}}
+	b := NewEventBus()
+	ch, cancel := b.Subscribe(10)
+	defer cancel()
+	w := NewHostWatcher(hosts, b)
+
+	hs, err := w.Hosts()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(hosts.leases, hs)
+	assert.Empty(drain(ch), "First hosts are known")
+
+	// New IP of a known host
+	hosts.leases = []Host{
+		{MAC: "a", IP: "3", Name: "pc1"},
+		{MAC: "b", IP: "4", Name: "pc2"},
+	}
+	if _, err := w.Hosts(); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	es := drain(ch)
+	if assert.Len(es, 2) {
+		assert.Equal(Event{Type: EventHostAdded, Time: es[0].Time, Host: &Host{MAC: "b", IP: "4", Name: "pc2"}}, es[0])
+		assert.Equal(Event{Type: EventHostRemoved, Time: es[1].Time, Host: &Host{IP6: []string{"2001:db8::1"}}}, es[1])
+	}
+}
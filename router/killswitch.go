@@ -0,0 +1,241 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// killSwitchMetric is the highest metric, every other default route of a table wins
+const killSwitchMetric = "4294967295"
+
+// KillSwitchState describes the kill switch of a table.
+type KillSwitchState struct {
+	Installed bool
+	// Blocking is set if the table has no other routes, so its hosts are cut off
+	Blocking bool
+}
+
+// KillSwitchProvider blocks the traffic of a table without routes, instead of letting
+// the kernel fall through to the main table.
+type KillSwitchProvider interface {
+	// InstallKillSwitch adds an unreachable default route with the highest metric to table
+	InstallKillSwitch(table string) error
+	KillSwitch(table string) (KillSwitchState, error)
+}
+
+// StrictRuleProvider installs the kill switch of a strict table before
+// the first rule pointing to it is added.
+type StrictRuleProvider struct {
+	base       RuleProvider
+	ks         KillSwitchProvider
+	strict     map[string]bool
+	exceptions ExceptionRuleProvider
+
+	mu        sync.Mutex
+	installed map[string]bool
+}
+
+func NewStrictRuleProvider(base RuleProvider, ks KillSwitchProvider, strict []string) *StrictRuleProvider {
+	s := &StrictRuleProvider{
+		base:      base,
+		ks:        ks,
+		strict:    make(map[string]bool),
+		installed: make(map[string]bool),
+	}
+	for _, t := range strict {
+		s.strict[t] = true
+	}
+	return s
+}
+
+// ensure installs the kill switch of table if it is strict and not installed yet.
+func (s *StrictRuleProvider) ensure(table string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.strict[table] || s.installed[table] {
+		return nil
+	}
+	if err := s.ks.InstallKillSwitch(table); err != nil {
+		return err
+	}
+	s.installed[table] = true
+	return nil
+}
+
+func (s *StrictRuleProvider) Rules() ([]Rule, error) {
+	return s.base.Rules()
+}
+
+func (s *StrictRuleProvider) Set(ip string, table string) error {
+	if err := s.ensure(table); err != nil {
+		return err
+	}
+	return s.base.Set(ip, table)
+}
+
+func (s *StrictRuleProvider) Delete(ip string) error {
+	return s.base.Delete(ip)
+}
+
+func (s *StrictRuleProvider) SetBatch(changes []Rule) error {
+	for i, c := range changes {
+		if err := s.ensure(c.Table); err != nil {
+			return &BatchError{Index: i, Err: err}
+		}
+	}
+	return SetBatch(s.base, changes)
+}
+
+// SetExceptionProvider passes exceptions to ep, the kill switch of a strict
+// table is installed before the first exception pointing to it as well.
+func (s *StrictRuleProvider) SetExceptionProvider(ep ExceptionRuleProvider) {
+	s.exceptions = ep
+}
+
+func (s *StrictRuleProvider) Exceptions() ([]Rule, error) {
+	if s.exceptions == nil {
+		return nil, ErrNoExceptions
+	}
+	return s.exceptions.Exceptions()
+}
+
+func (s *StrictRuleProvider) SetException(r Rule) error {
+	if s.exceptions == nil {
+		return ErrNoExceptions
+	}
+	if err := s.ensure(r.Table); err != nil {
+		return err
+	}
+	return s.exceptions.SetException(r)
+}
+
+func (s *StrictRuleProvider) DeleteException(r Rule) error {
+	if s.exceptions == nil {
+		return ErrNoExceptions
+	}
+	return s.exceptions.DeleteException(r)
+}
+
+// Strict returns true if table has a kill switch.
+func (s *StrictRuleProvider) Strict(table string) bool {
+	return s.strict[table]
+}
+
+// KillSwitch returns the state of the kill switch of table, false if the table is not strict.
+func (s *StrictRuleProvider) KillSwitch(table string) (KillSwitchState, bool, error) {
+	if !s.strict[table] {
+		return KillSwitchState{}, false, nil
+	}
+	state, err := s.ks.KillSwitch(table)
+	return state, true, err
+}
+
+// Verify installs the missing kill switches of all strict tables,
+// e.g. after a table was flushed, and returns the restored tables.
+func (s *StrictRuleProvider) Verify() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var restored []string
+	for _, table := range sortedKeys(s.strict) {
+		state, err := s.ks.KillSwitch(table)
+		if err != nil {
+			return restored, err
+		}
+		if state.Installed {
+			s.installed[table] = true
+			continue
+		}
+		if err := s.ks.InstallKillSwitch(table); err != nil {
+			return restored, err
+		}
+		s.installed[table] = true
+		restored = append(restored, table)
+	}
+	return restored, nil
+}
+
+// parseKillSwitch returns the kill switch state from the output of ip route show table.
+func parseKillSwitch(out string) KillSwitchState {
+	var state KillSwitchState
+	others := 0
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) >= 2 && fields[0] == "unreachable" && fields[1] == "default" && hasMetric(fields, killSwitchMetric) {
+			state.Installed = true
+			continue
+		}
+		others++
+	}
+	state.Blocking = state.Installed && others == 0
+	return state
+}
+
+func hasMetric(fields []string, metric string) bool {
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "metric" && fields[i+1] == metric {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *IPRoute2RuleProvider) families() []string {
+	if p.IPv6 {
+		return []string{"0.0.0.0", "::"}
+	}
+	return []string{"0.0.0.0"}
+}
+
+func (p *IPRoute2RuleProvider) InstallKillSwitch(table string) error {
+	for _, family := range p.families() {
+		cmd := ipCmd(family, "route", "replace", "unreachable", "default", "metric", killSwitchMetric, "table", table)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			return fmt.Errorf("kill switch of table %s: %s: %s", table, err, strings.TrimSpace(string(out)))
+		}
+	}
+	return nil
+}
+
+func (p *IPRoute2RuleProvider) KillSwitch(table string) (KillSwitchState, error) {
+	state := KillSwitchState{Installed: true}
+	for _, family := range p.families() {
+		out, err := ipCmd(family, "route", "show", "table", table).CombinedOutput()
+		// The kernel creates tables with their first route
+		if err != nil && strings.Contains(string(out), "table does not exist") {
+			out, err = nil, nil
+		}
+		if err != nil {
+			return KillSwitchState{}, fmt.Errorf("kill switch of table %s: %s: %s", table, err, strings.TrimSpace(string(out)))
+		}
+		s := parseKillSwitch(string(out))
+		state.Installed = state.Installed && s.Installed
+		state.Blocking = state.Blocking || s.Blocking
+	}
+	return state, nil
+}
+
+// DummyKillSwitch remembers the tables with a kill switch.
+type DummyKillSwitch map[string]bool
+
+func (d DummyKillSwitch) InstallKillSwitch(table string) error {
+	d[table] = true
+	return nil
+}
+
+func (d DummyKillSwitch) KillSwitch(table string) (KillSwitchState, error) {
+	return KillSwitchState{Installed: d[table]}, nil
+}
+
+func sortedKeys(m map[string]bool) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,56 @@
+package router
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseKillSwitch(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(KillSwitchState{}, parseKillSwitch(""))
+	assert.Equal(KillSwitchState{Installed: true, Blocking: true}, parseKillSwitch("unreachable default metric 4294967295 \n"))
+	assert.Equal(KillSwitchState{Installed: true, Blocking: true}, parseKillSwitch("unreachable default dev lo metric 4294967295 pref medium\n"))
+	assert.Equal(KillSwitchState{Installed: true}, parseKillSwitch("default dev tun0 scope link \nunreachable default metric 4294967295 \n"))
+	assert.Equal(KillSwitchState{}, parseKillSwitch("unreachable default metric 10 \n"), "Foreign unreachable route")
+}
+
+// failingKillSwitch fails to install any kill switch
+type failingKillSwitch struct {
+	DummyKillSwitch
+}
+
+func (f failingKillSwitch) InstallKillSwitch(table string) error {
+	return errors.New("no such table")
+}
+
+func TestStrictRuleProvider(t *testing.T) {
+	assert := assert.New(t)
+	kernel := DummyRuleProvider{}
+	ks := DummyKillSwitch{}
+	s := NewStrictRuleProvider(kernel, ks, []string{"vpn"})
+
+	assert.Nil(s.Set("1", "defgw"))
+	assert.Equal(DummyKillSwitch{}, ks, "Table not strict")
+	assert.Nil(s.SetBatch([]Rule{{IP: "1", Table: "vpn"}, {IP: "2", Table: ""}}))
+	assert.Equal(DummyKillSwitch{"vpn": true}, ks)
+	assert.Equal(DummyRuleProvider{"1": "vpn"}, kernel)
+
+	state, strict, err := s.KillSwitch("vpn")
+	assert.Nil(err)
+	assert.True(strict)
+	assert.True(state.Installed)
+	_, strict, _ = s.KillSwitch("defgw")
+	assert.False(strict)
+
+	// No rule without kill switch
+	kernel = DummyRuleProvider{}
+	s = NewStrictRuleProvider(kernel, failingKillSwitch{DummyKillSwitch{}}, []string{"vpn"})
+	assert.NotNil(s.Set("1", "vpn"))
+	err = s.SetBatch([]Rule{{IP: "1", Table: "defgw"}, {IP: "2", Table: "vpn"}})
+	if be, ok := err.(*BatchError); !ok || be.Index != 1 {
+		t.Errorf("Expected error of change 2, got %v", err)
+	}
+	assert.Equal(DummyRuleProvider{}, kernel)
+}
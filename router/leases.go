@@ -5,14 +5,35 @@ import (
 	"os"
 	"sort"
 	"strings"
+	"sync"
 )
 
 type Host struct {
 	MAC  string
 	IP   string
+	IP6  []string
 	Name string
 }
 
+// Addrs returns all IPv4 and IPv6 addresses of the host.
+func (h Host) Addrs() []string {
+	var addrs []string
+	if h.IP != "" {
+		addrs = append(addrs, h.IP)
+	}
+	return append(addrs, h.IP6...)
+}
+
+// HasAddr returns true if ip is one of the addresses of the host.
+func (h Host) HasAddr(ip string) bool {
+	for _, addr := range h.Addrs() {
+		if addr == ip {
+			return true
+		}
+	}
+	return false
+}
+
 type ByHostname []Host
 
 func (a ByHostname) Len() int           { return len(a) }
@@ -23,8 +44,13 @@ type HostProvider interface {
 	Hosts() ([]Host, error)
 }
 
+// DNSMasqLeaseProvider reads DHCP and DHCPv6 leases of dnsmasq.
 type DNSMasqLeaseProvider struct {
 	leaseFile string
+	events    *EventBus
+
+	mu       sync.Mutex
+	expiries map[string]string // MAC or DUID and address to expiry
 }
 
 func NewDNSMasqLeaseProvider(leaseFile string) *DNSMasqLeaseProvider {
@@ -33,6 +59,13 @@ func NewDNSMasqLeaseProvider(leaseFile string) *DNSMasqLeaseProvider {
 	}
 }
 
+// SetEventBus publishes renewed leases, noticed by comparing their expiry between reads.
+func (p *DNSMasqLeaseProvider) SetEventBus(events *EventBus) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.events = events
+}
+
 func (p *DNSMasqLeaseProvider) Hosts() ([]Host, error) {
 	f, err := os.Open(p.leaseFile)
 	if err != nil {
@@ -41,20 +74,54 @@ func (p *DNSMasqLeaseProvider) Hosts() ([]Host, error) {
 	defer f.Close()
 	var leases []Host
 
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
 	hostMap := make(map[string][]Host)
+	expiries := make(map[string]string)
+	var renewed []Host
 
+	// DHCPv6 leases follow the duid line of the server
+	v6 := false
 	sc := bufio.NewScanner(f)
 	for sc.Scan() {
 		parts := strings.Split(sc.Text(), " ")
+		if len(parts) == 2 && parts[0] == "duid" {
+			v6 = true
+			continue
+		}
 		if len(parts) != 5 {
 			continue
 		}
-		hostMap[parts[1]] = append(hostMap[parts[1]], Host{
-			MAC:  parts[1],
-			IP:   parts[2],
-			Name: parts[3],
-		})
+		var key string
+		var h Host
+		if v6 {
+			// expiry iaid ip hostname duid
+			key = parts[4]
+			h = Host{
+				MAC:  macFromDUID(parts[4]),
+				IP6:  []string{parts[2]},
+				Name: parts[3],
+			}
+		} else {
+			key = parts[1]
+			h = Host{
+				MAC:  parts[1],
+				IP:   parts[2],
+				Name: parts[3],
+			}
+		}
+		hostMap[key] = append(hostMap[key], h)
+		lease := key + " " + parts[2]
+		expiries[lease] = parts[0]
+		if prev, ok := p.expiries[lease]; ok && prev != parts[0] {
+			renewed = append(renewed, h)
+		}
 	}
+	for i := range renewed {
+		p.events.Publish(Event{Type: EventLeaseRenewed, Host: &renewed[i]})
+	}
+	p.expiries = expiries
 
 	// Save last x-last leases
 	x := 2
@@ -67,3 +134,20 @@ func (p *DNSMasqLeaseProvider) Hosts() ([]Host, error) {
 	return leases, nil
 
 }
+
+// macFromDUID extracts the MAC of link-layer based DUIDs of ethernet interfaces.
+func macFromDUID(duid string) string {
+	parts := strings.Split(strings.ToLower(duid), ":")
+	if len(parts) < 4 || parts[2] != "00" || parts[3] != "01" {
+		return ""
+	}
+	switch {
+	// DUID-LLT: type, hardware type, time, MAC
+	case parts[0] == "00" && parts[1] == "01" && len(parts) == 14:
+		return strings.Join(parts[8:], ":")
+	// DUID-LL: type, hardware type, MAC
+	case parts[0] == "00" && parts[1] == "03" && len(parts) == 10:
+		return strings.Join(parts[4:], ":")
+	}
+	return ""
+}
@@ -2,6 +2,7 @@ package router
 
 import "github.com/stretchr/testify/assert"
 import "io/ioutil"
+import "os"
 import "testing"
 
 const fixture_leases = `
@@ -45,3 +46,60 @@ func TestDNSMasqLeases(t *testing.T) {
 		Name: "pc2",
 	}, ls[1], "Invalid lease")
 }
+
+const fixture_leases6 = `0 00:11:22:33:44:55 192.168.0.1 pc1 01:00:11:22:33:44:55
+duid 00:01:00:01:1c:d3:ee:ce:00:27:13:69:93:b7
+0 1234 2001:db8::1 pc2 00:01:00:01:1f:2e:3d:4c:00:11:22:33:44:55
+0 5678 2001:db8::2 pc3 00:03:00:01:00:11:22:33:44:77
+0 9012 2001:db8::3 pc4 00:02:00:00:ab:11:04:2f:88:c8:b3:5e:6f:b7
+`
+
+func TestDNSMasqLeases6(t *testing.T) {
+	assert := assert.New(t)
+	name, err := writeTempFile(fixture_leases6)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	var p HostProvider = NewDNSMasqLeaseProvider(name)
+	ls, err := p.Hosts()
+	if err != nil {
+		t.Fatalf("Error getting leases: %s", err)
+	}
+	assert.Equal([]Host{
+		{MAC: "00:11:22:33:44:55", IP: "192.168.0.1", Name: "pc1"},
+		{MAC: "00:11:22:33:44:55", IP6: []string{"2001:db8::1"}, Name: "pc2"},
+		{MAC: "00:11:22:33:44:77", IP6: []string{"2001:db8::2"}, Name: "pc3"},
+		{IP6: []string{"2001:db8::3"}, Name: "pc4"},
+	}, ls)
+}
+
+func TestDNSMasqLeaseRenewal(t *testing.T) {
+	assert := assert.New(t)
+	name, err := writeTempFile("1000 00:11:22:33:44:55 192.168.0.1 pc1 *\n1000 00:11:22:33:44:66 192.168.0.2 pc2 *\n")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.Remove(name)
+	b := NewEventBus()
+	ch, cancel := b.Subscribe(10)
+	defer cancel()
+	p := NewDNSMasqLeaseProvider(name)
+	p.SetEventBus(b)
+	if _, err := p.Hosts(); err != nil {
+		t.Fatalf("Error getting leases: %s", err)
+	}
+	assert.Empty(drain(ch), "New leases are no renewals")
+
+	err = ioutil.WriteFile(name, []byte("1000 00:11:22:33:44:55 192.168.0.1 pc1 *\n2000 00:11:22:33:44:66 192.168.0.2 pc2 *\n"), 0666)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if _, err := p.Hosts(); err != nil {
+		t.Fatalf("Error getting leases: %s", err)
+	}
+	es := drain(ch)
+	if assert.Len(es, 1) {
+		assert.Equal(EventLeaseRenewed, es[0].Type)
+		assert.Equal(&Host{MAC: "00:11:22:33:44:66", IP: "192.168.0.2", Name: "pc2"}, es[0].Host)
+	}
+}
@@ -0,0 +1,44 @@
+package router
+
+import (
+	"io/ioutil"
+	"time"
+
+	"github.com/blang/vpnrouter/metrics"
+)
+
+var (
+	ipRuleDuration = metrics.Default.NewHistogram("vpnrouter_ip_rule_duration_seconds",
+		"Duration of the ip rule commands run by the iproute2 rule provider.", metrics.DurationBuckets, "op")
+	ipRuleErrors = metrics.Default.NewCounter("vpnrouter_ip_rule_errors_total",
+		"Failed ip rule commands run by the iproute2 rule provider.", "op")
+	persistenceWriteFailures = metrics.Default.NewCounter("vpnrouter_persistence_write_failures_total",
+		"Failed writes of the files of the persistence layer.", "file")
+	ruleChanges = metrics.Default.NewCounter("vpnrouter_rule_changes_total",
+		"Changes of the tables of hosts applied by the providers by source.", "source")
+)
+
+// countRuleChange counts a change of rules by source unless it failed, err is returned as is.
+func countRuleChange(source string, err error) error {
+	if err == nil {
+		ruleChanges.Inc(source)
+	}
+	return err
+}
+
+// observeIPRule records the duration and outcome of an ip rule command started at start.
+func observeIPRule(op string, start time.Time, err error) {
+	ipRuleDuration.Observe(time.Since(start).Seconds(), op)
+	if err != nil {
+		ipRuleErrors.Inc(op)
+	}
+}
+
+// writeFile writes a file of the persistence layer, failures are counted by kind.
+func writeFile(kind, file string, data []byte) error {
+	err := ioutil.WriteFile(file, data, 0644)
+	if err != nil {
+		persistenceWriteFailures.Inc(kind)
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPersistenceWriteFailures(t *testing.T) {
+	assert := assert.New(t)
+	hosts := mockHostProvider{{IP: "1", MAC: "a"}}
+	kernel := DummyRuleProvider{}
+	rp := NewRulePersistence(kernel, hosts, "/nonexistent/db.txt")
+	failures := persistenceWriteFailures.Value("rules")
+
+	assert.Error(rp.Set("1", "vpn"), "Failed write reported")
+	assert.Equal("vpn", kernel["1"])
+	assert.Equal(failures+1, persistenceWriteFailures.Value("rules"))
+}
+
+func TestObserveIPRule(t *testing.T) {
+	assert := assert.New(t)
+	count := ipRuleDuration.Count("test")
+	errs := ipRuleErrors.Value("test")
+	observeIPRule("test", time.Now(), nil)
+	observeIPRule("test", time.Now(), errors.New("exit status 2"))
+	assert.Equal(count+2, ipRuleDuration.Count("test"))
+	assert.Equal(errs+1, ipRuleErrors.Value("test"))
+}
+
+func TestRuleChanges(t *testing.T) {
+	assert := assert.New(t)
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	const macA, macB = "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02"
+	hosts := mockHostProvider{{IP: "1", MAC: macA}, {IP: "2", MAC: macB}}
+	kernel := DummyRuleProvider{}
+	m := NewHealthMonitor([]TableCheck{{Table: "vpn", Fallback: "defgw", Checks: []Check{&probeResult{err: errors.New("down")}}}})
+	m.Failures = 1
+	f := NewFailoverRuleProvider(kernel, m)
+	m.OnChange(f.Update)
+	rp := NewRulePersistence(f, hosts, "")
+	rp.SetStore(store)
+	assert.NoError(rp.SetGroup(Group{Name: "kids", MACs: []string{macB}}), "Groups without table change no rules")
+	s := NewScheduler(rp, hosts)
+	s.now = func() time.Time { return time.Date(2026, 10, 19, 10, 0, 0, 0, time.UTC) }
+	sources := []string{"set", "temporary", "delete", "batch", "group", "schedule", "failover"}
+	before := make(map[string]float64)
+	for _, source := range sources {
+		before[source] = ruleChanges.Value(source)
+	}
+
+	assert.NoError(rp.Set("1", "vpn"))
+	assert.NoError(rp.SetUntil("1", "null", time.Now().Add(time.Hour)))
+	assert.NoError(rp.Delete("1"))
+	assert.NoError(rp.SetBatch([]Rule{{IP: "1", Table: "vpn"}}))
+	assert.NoError(rp.SetGroupTable("kids", "null"))
+	m.Probe()
+	assert.Error(rp.Set("3", "vpn"), "Failed changes are not counted")
+	assert.NoError(rp.SetSchedule(Schedule{Name: "day", MAC: macA, Start: 8 * 60, End: 12 * 60, Table: "defgw"}))
+	s.Apply()
+	for _, source := range sources {
+		assert.Equal(before[source]+1, ruleChanges.Value(source), source)
+	}
+}
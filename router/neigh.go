@@ -0,0 +1,68 @@
+package router
+
+import (
+	"net"
+	"os/exec"
+	"strings"
+)
+
+// IPv6NeighProvider reads the IPv6 neighbours of the selected devices
+// using the ip command.
+type IPv6NeighProvider struct {
+	devs *deviceSet
+}
+
+func NewIPv6NeighProvider(devices []string) *IPv6NeighProvider {
+	return &IPv6NeighProvider{
+		devs: newDeviceSet(devices),
+	}
+}
+
+// SetDevices replaces the devices to get neighbours from.
+func (p *IPv6NeighProvider) SetDevices(devices []string) {
+	p.devs.Set(devices)
+}
+
+func (p *IPv6NeighProvider) Hosts() ([]Host, error) {
+	b, err := exec.Command("ip", "-6", "neigh", "show").Output()
+	if err != nil {
+		return nil, err
+	}
+	return parseNeighbors(string(b), p.devs), nil
+}
+
+// parseNeighbors parses lines like
+// 2001:db8::2 dev eth0 lladdr 00:11:22:33:44:55 REACHABLE
+func parseNeighbors(s string, devs *deviceSet) []Host {
+	var hosts []Host
+	for _, line := range strings.Split(s, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 5 {
+			continue
+		}
+		// Link local addresses are not routed
+		if ip := net.ParseIP(parts[0]); ip == nil || !ip.IsGlobalUnicast() {
+			continue
+		}
+		var dev, mac string
+		for i := 1; i < len(parts)-1; i++ {
+			switch parts[i] {
+			case "dev":
+				dev = parts[i+1]
+			case "lladdr":
+				mac = parts[i+1]
+			}
+		}
+		if mac == "" {
+			continue
+		}
+		if !devs.Contains(dev) {
+			continue
+		}
+		hosts = append(hosts, Host{
+			MAC: mac,
+			IP6: []string{parts[0]},
+		})
+	}
+	return hosts
+}
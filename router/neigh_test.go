@@ -0,0 +1,24 @@
+package router
+
+import (
+	"reflect"
+	"testing"
+)
+
+const fixture_neighbors = `fe80::1 dev br0 lladdr 00:01:02:03:04:01 router STALE
+2001:db8::5 dev br0 lladdr 00:01:02:03:04:05 REACHABLE
+2001:db8::6 dev br1 lladdr 00:01:02:03:04:06 REACHABLE
+2001:db8::7 dev br0  FAILED
+2001:db8::8 dev br0 lladdr 00:01:02:03:04:08 router DELAY
+`
+
+func TestParseNeighbors(t *testing.T) {
+	hs := parseNeighbors(fixture_neighbors, newDeviceSet([]string{"br0"}))
+	exp := []Host{
+		{MAC: "00:01:02:03:04:05", IP6: []string{"2001:db8::5"}},
+		{MAC: "00:01:02:03:04:08", IP6: []string{"2001:db8::8"}},
+	}
+	if !reflect.DeepEqual(exp, hs) {
+		t.Errorf("Expected:\n%v\nGot:\n%v", exp, hs)
+	}
+}
@@ -0,0 +1,731 @@
+package router
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// NetlinkError is returned if a rule operation fails.
+type NetlinkError struct {
+	Op    string // show, add, del, killswitch or route
+	IP    string
+	Table string
+	Err   error
+}
+
+func (e *NetlinkError) Error() string {
+	if e.IP == "" && e.Table != "" {
+		return fmt.Sprintf("netlink %s of table %s: %s", e.Op, e.Table, e.Err)
+	}
+	if e.IP == "" {
+		return fmt.Sprintf("netlink rule %s: %s", e.Op, e.Err)
+	}
+	return fmt.Sprintf("netlink rule %s from %s table %s: %s", e.Op, e.IP, e.Table, e.Err)
+}
+
+// Attributes and actions of fib rules, see linux/fib_rules.h
+const (
+	fraDst      = 1
+	fraSrc      = 2
+	fraIifname  = 3
+	fraGoto     = 4
+	fraPriority = 6
+	fraFwmark   = 10
+	fraTable    = 15
+	fraOifname  = 17
+	fraProtocol = 21
+	fraIPProto  = 22
+	fraSport    = 23
+	fraDport    = 24
+
+	frActToTbl       = 1
+	frActGoto        = 2
+	frActNop         = 3
+	frActBlackhole   = 6
+	frActUnreachable = 7
+	frActProhibit    = 8
+
+	sizeofFibRuleHdr = 12
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+// NetlinkRuleProvider manages rules directly over a netlink socket
+// instead of using the ip command.
+type NetlinkRuleProvider struct {
+	sync.Mutex
+	tables *RouteTables
+	seq    uint32
+
+	// IPv6 also installs kill switches for IPv6
+	IPv6 bool
+	// Only rules in this range tagged with Protocol are read and changed.
+	// Protocol 0 relies on the range alone.
+	Priorities PriorityRange
+	Protocol   uint8
+}
+
+// NewNetlinkRuleProvider uses tables to translate table names into kernel table ids.
+func NewNetlinkRuleProvider(tables *RouteTables) *NetlinkRuleProvider {
+	return &NetlinkRuleProvider{
+		tables:     tables,
+		Priorities: DefaultPriorities,
+		Protocol:   DefaultRuleProtocol,
+	}
+}
+
+type fibRule struct {
+	Family uint8
+	Src    net.IP
+	// Destination prefix of exceptions
+	Dst      net.IP
+	DstLen   uint8
+	IPProto  uint8
+	DPort    uint16
+	Table    uint32
+	Priority uint32
+	Action   uint8
+	Protocol uint8
+	// Other is set if the rule matches more than the source address and
+	// the destination of exceptions
+	Other bool
+}
+
+func (r fibRule) encode() []byte {
+	b := make([]byte, sizeofFibRuleHdr)
+	b[0] = r.Family
+	b[1] = r.DstLen
+	b[2] = uint8(len(r.Src) * 8)
+	if r.Table < 256 {
+		b[4] = uint8(r.Table)
+	}
+	b[7] = r.Action
+	if r.Src != nil {
+		b = appendAttr(b, fraSrc, r.Src)
+	}
+	if r.Dst != nil {
+		b = appendAttr(b, fraDst, r.Dst)
+	}
+	if r.IPProto != 0 {
+		b = appendAttr(b, fraIPProto, []byte{r.IPProto})
+	}
+	if r.DPort != 0 {
+		// A range of a single port
+		port := make([]byte, 4)
+		nativeEndian.PutUint16(port[0:2], r.DPort)
+		nativeEndian.PutUint16(port[2:4], r.DPort)
+		b = appendAttr(b, fraDport, port)
+	}
+	if r.Table != 0 {
+		b = appendAttr(b, fraTable, uint32Bytes(r.Table))
+	}
+	if r.Priority != 0 {
+		b = appendAttr(b, fraPriority, uint32Bytes(r.Priority))
+	}
+	if r.Protocol != 0 {
+		b = appendAttr(b, fraProtocol, []byte{r.Protocol})
+	}
+	return b
+}
+
+func parseFibRule(b []byte) (fibRule, bool) {
+	if len(b) < sizeofFibRuleHdr || (b[0] != syscall.AF_INET && b[0] != syscall.AF_INET6) {
+		return fibRule{}, false
+	}
+	r := fibRule{
+		Family: b[0],
+		Table:  uint32(b[4]),
+		Action: b[7],
+	}
+	srcLen := b[2]
+	attrs := parseAttrs(b[sizeofFibRuleHdr:])
+	// Only rules matching a single address
+	if src, ok := attrs[fraSrc]; ok && int(srcLen) == len(src)*8 {
+		r.Src = net.IP(src)
+	}
+	if t, ok := attrs[fraTable]; ok && len(t) == 4 {
+		r.Table = nativeEndian.Uint32(t)
+	}
+	if p, ok := attrs[fraPriority]; ok && len(p) == 4 {
+		r.Priority = nativeEndian.Uint32(p)
+	}
+	if p, ok := attrs[fraProtocol]; ok && len(p) == 1 {
+		r.Protocol = p[0]
+	}
+	if dst, ok := attrs[fraDst]; ok && (len(dst) == 4 || len(dst) == 16) {
+		r.Dst, r.DstLen = net.IP(dst), b[1]
+	}
+	if p, ok := attrs[fraIPProto]; ok && len(p) == 1 {
+		r.IPProto = p[0]
+	}
+	if port, ok := attrs[fraDport]; ok && len(port) == 4 {
+		r.DPort = nativeEndian.Uint16(port[0:2])
+		if r.DPort != nativeEndian.Uint16(port[2:4]) {
+			r.Other = true
+		}
+	}
+	for _, a := range []uint16{fraIifname, fraOifname, fraFwmark, fraSport} {
+		if _, ok := attrs[a]; ok {
+			r.Other = true
+		}
+	}
+	if _, ok := attrs[fraSrc]; ok && r.Src == nil {
+		r.Other = true
+	}
+	return r, true
+}
+
+// owns returns true if the rule is a host rule or exception of vpnrouter.
+func (p *NetlinkRuleProvider) owns(r fibRule) bool {
+	_, known := ipProtoNames[r.IPProto]
+	return r.Src != nil && !r.Other && r.Action == frActToTbl &&
+		p.Priorities.Contains(r.Priority) && r.Protocol == p.Protocol &&
+		(r.Dst != nil || (r.IPProto == 0 && r.DPort == 0)) && known
+}
+
+// Protocols of exceptions, by number and name as printed by ip
+var ipProtoNames = map[uint8]string{0: "", syscall.IPPROTO_TCP: "tcp", syscall.IPPROTO_UDP: "udp"}
+
+func ipProtoNumber(name string) (uint8, bool) {
+	for n, s := range ipProtoNames {
+		if s == name {
+			return n, true
+		}
+	}
+	return 0, false
+}
+
+// rule returns the host rule or exception of an owned fib rule.
+func (p *NetlinkRuleProvider) rule(fr fibRule) Rule {
+	r := Rule{
+		IP:    fr.Src.String(),
+		Table: p.tables.Name(fr.Table),
+	}
+	if fr.Dst != nil {
+		r.To = fmt.Sprintf("%s/%d", fr.Dst, fr.DstLen)
+		r.Proto = ipProtoNames[fr.IPProto]
+		r.Port = fr.DPort
+	}
+	return r
+}
+
+// ruleSpec formats a rule message like ip rule show.
+func (p *NetlinkRuleProvider) ruleSpec(b []byte) string {
+	attrs := parseAttrs(b[sizeofFibRuleHdr:])
+	prefix := func(ip []byte, l uint8) string {
+		s := net.IP(ip).String()
+		if int(l) != len(ip)*8 {
+			s = fmt.Sprintf("%s/%d", s, l)
+		}
+		return s
+	}
+	spec := "from all"
+	if src, ok := attrs[fraSrc]; ok {
+		spec = "from " + prefix(src, b[2])
+	}
+	if dst, ok := attrs[fraDst]; ok {
+		spec += " to " + prefix(dst, b[1])
+	}
+	if mark, ok := attrs[fraFwmark]; ok && len(mark) == 4 {
+		spec += fmt.Sprintf(" fwmark %#x", nativeEndian.Uint32(mark))
+	}
+	if iif, ok := attrs[fraIifname]; ok {
+		spec += " iif " + strings.TrimRight(string(iif), "\x00")
+	}
+	if oif, ok := attrs[fraOifname]; ok {
+		spec += " oif " + strings.TrimRight(string(oif), "\x00")
+	}
+	if proto, ok := attrs[fraIPProto]; ok && len(proto) == 1 {
+		if name := ipProtoNames[proto[0]]; name != "" {
+			spec += " ipproto " + name
+		} else {
+			spec += fmt.Sprintf(" ipproto %d", proto[0])
+		}
+	}
+	for _, port := range []struct {
+		attr uint16
+		name string
+	}{{fraSport, "sport"}, {fraDport, "dport"}} {
+		if r, ok := attrs[port.attr]; ok && len(r) == 4 {
+			start, end := nativeEndian.Uint16(r[0:2]), nativeEndian.Uint16(r[2:4])
+			if start == end {
+				spec += fmt.Sprintf(" %s %d", port.name, start)
+			} else {
+				spec += fmt.Sprintf(" %s %d-%d", port.name, start, end)
+			}
+		}
+	}
+	switch b[7] {
+	case frActToTbl:
+		table := uint32(b[4])
+		if t, ok := attrs[fraTable]; ok && len(t) == 4 {
+			table = nativeEndian.Uint32(t)
+		}
+		spec += " lookup " + p.tables.Name(table)
+	case frActGoto:
+		if g, ok := attrs[fraGoto]; ok && len(g) == 4 {
+			spec += fmt.Sprintf(" goto %d", nativeEndian.Uint32(g))
+		}
+	case frActNop:
+		spec += " nop"
+	case frActBlackhole:
+		spec += " blackhole"
+	case frActUnreachable:
+		spec += " unreachable"
+	case frActProhibit:
+		spec += " prohibit"
+	}
+	// ip hides the protocol of the default rules of the kernel
+	if proto, ok := attrs[fraProtocol]; ok && len(proto) == 1 && proto[0] != 0 && proto[0] != syscall.RTPROT_KERNEL {
+		spec += fmt.Sprintf(" proto %d", proto[0])
+	}
+	return spec
+}
+
+func uint32Bytes(v uint32) []byte {
+	b := make([]byte, 4)
+	nativeEndian.PutUint32(b, v)
+	return b
+}
+
+func rtaAlign(l int) int {
+	return (l + syscall.RTA_ALIGNTO - 1) &^ (syscall.RTA_ALIGNTO - 1)
+}
+
+func appendAttr(b []byte, typ uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	attr := make([]byte, rtaAlign(l))
+	nativeEndian.PutUint16(attr[0:2], uint16(l))
+	nativeEndian.PutUint16(attr[2:4], typ)
+	copy(attr[syscall.SizeofRtAttr:], data)
+	return append(b, attr...)
+}
+
+func parseAttrs(b []byte) map[uint16][]byte {
+	attrs := make(map[uint16][]byte)
+	for len(b) >= syscall.SizeofRtAttr {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < syscall.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs[nativeEndian.Uint16(b[2:4])] = b[syscall.SizeofRtAttr:l]
+		l = rtaAlign(l)
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs
+}
+
+func (p *NetlinkRuleProvider) request(typ uint16, flags uint16, data []byte) ([]syscall.NetlinkMessage, error) {
+	return netlinkRequest(&p.seq, typ, flags, data)
+}
+
+// netlinkRequest sends a single rtnetlink message and collects the answers until
+// the request is acknowledged or the dump is done.
+func netlinkRequest(seqp *uint32, typ uint16, flags uint16, data []byte) ([]syscall.NetlinkMessage, error) {
+	return netlinkProtoRequest(syscall.NETLINK_ROUTE, seqp, typ, flags, data)
+}
+
+// netlinkProtoRequest is netlinkRequest for any netlink protocol.
+func netlinkProtoRequest(proto int, seqp *uint32, typ uint16, flags uint16, data []byte) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, proto)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+	sa := &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}
+	if err := syscall.Bind(fd, sa); err != nil {
+		return nil, err
+	}
+
+	seq := atomic.AddUint32(seqp, 1)
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(data))
+	nativeEndian.PutUint32(b[0:4], uint32(syscall.NLMSG_HDRLEN+len(data)))
+	nativeEndian.PutUint16(b[4:6], typ)
+	nativeEndian.PutUint16(b[6:8], flags|syscall.NLM_F_REQUEST)
+	nativeEndian.PutUint32(b[8:12], seq)
+	b = append(b, data...)
+	if err := syscall.Sendto(fd, b, 0, sa); err != nil {
+		return nil, err
+	}
+
+	var msgs []syscall.NetlinkMessage
+	for {
+		// Collected messages point into buf, it must not be reused
+		buf := make([]byte, 32*1024)
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		ms, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range ms {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_DONE:
+				return msgs, nil
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, syscall.EINVAL
+				}
+				if errno := int32(nativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return msgs, nil
+			}
+			msgs = append(msgs, m)
+			if m.Header.Flags&syscall.NLM_F_MULTI == 0 {
+				return msgs, nil
+			}
+		}
+	}
+}
+
+// list returns the owned IPv4 and IPv6 host rules and all other rules.
+func (p *NetlinkRuleProvider) list() ([]Rule, []ForeignRule, error) {
+	msgs, err := p.request(syscall.RTM_GETRULE, syscall.NLM_F_DUMP, fibRule{}.encode())
+	if err != nil {
+		return nil, nil, &NetlinkError{Op: "show", Err: err}
+	}
+	var rules []Rule
+	var foreign []ForeignRule
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWRULE {
+			continue
+		}
+		fr, ok := parseFibRule(m.Data)
+		if !ok {
+			continue
+		}
+		if !p.owns(fr) {
+			foreign = append(foreign, ForeignRule{
+				Priority: fr.Priority,
+				Spec:     p.ruleSpec(m.Data),
+				IPv6:     fr.Family == syscall.AF_INET6,
+			})
+			continue
+		}
+		rules = append(rules, p.rule(fr))
+	}
+	return rules, foreign, nil
+}
+
+// Rules returns the host rules in the managed range.
+func (p *NetlinkRuleProvider) Rules() ([]Rule, error) {
+	rules, _, err := p.list()
+	hosts, _ := splitExceptions(rules)
+	return hosts, err
+}
+
+func (p *NetlinkRuleProvider) Exceptions() ([]Rule, error) {
+	rules, _, err := p.list()
+	_, exceptions := splitExceptions(rules)
+	return exceptions, err
+}
+
+func (p *NetlinkRuleProvider) SetException(r Rule) error {
+	current, err := p.Exceptions()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	if old, ok := findException(current, r); ok {
+		if old.Table == r.Table {
+			return nil
+		}
+		if err := p.changeRule(syscall.RTM_DELRULE, "del", old); err != nil {
+			return err
+		}
+	}
+	return p.changeRule(syscall.RTM_NEWRULE, "add", r)
+}
+
+func (p *NetlinkRuleProvider) DeleteException(r Rule) error {
+	current, err := p.Exceptions()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	old, ok := findException(current, r)
+	if !ok {
+		return nil
+	}
+	return p.changeRule(syscall.RTM_DELRULE, "del", old)
+}
+
+func (p *NetlinkRuleProvider) ForeignRules() ([]ForeignRule, error) {
+	_, foreign, err := p.list()
+	return foreign, err
+}
+
+func (p *NetlinkRuleProvider) Set(ip string, table string) error {
+	oldRules, err := p.Rules()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	oldRule, found := findByIP(oldRules, ip)
+	// Old Rule exists, delete
+	if found {
+		err = p.changeRule(syscall.RTM_DELRULE, "del", oldRule)
+		if err != nil {
+			return err
+		}
+	}
+	return p.changeRule(syscall.RTM_NEWRULE, "add", Rule{IP: ip, Table: table})
+}
+
+func (p *NetlinkRuleProvider) Delete(ip string) error {
+	oldRules, err := p.Rules()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	oldRule, found := findByIP(oldRules, ip)
+	if !found {
+		return nil
+	}
+	return p.changeRule(syscall.RTM_DELRULE, "del", oldRule)
+}
+
+// DeleteLegacyRule deletes an untagged host rule of an older version.
+func (p *NetlinkRuleProvider) DeleteLegacyRule(prio uint32, r Rule) error {
+	src := net.ParseIP(r.IP)
+	if src == nil {
+		return &NetlinkError{Op: "del", IP: r.IP, Table: r.Table, Err: syscall.EINVAL}
+	}
+	id, ok := p.tables.ID(r.Table)
+	if !ok {
+		return &NetlinkError{Op: "del", IP: r.IP, Table: r.Table, Err: ErrUnknownTable}
+	}
+	fr := fibRule{Family: syscall.AF_INET6, Src: src, Table: id, Priority: prio, Action: frActToTbl}
+	if src4 := src.To4(); src4 != nil {
+		fr.Family, fr.Src = syscall.AF_INET, src4
+	}
+	p.Lock()
+	defer p.Unlock()
+	if _, err := p.request(syscall.RTM_DELRULE, syscall.NLM_F_ACK, fr.encode()); err != nil {
+		return &NetlinkError{Op: "del", IP: r.IP, Table: r.Table, Err: err}
+	}
+	return nil
+}
+
+// SetBatch applies the changes in order and reverts them if one fails.
+func (p *NetlinkRuleProvider) SetBatch(changes []Rule) error {
+	oldRules, err := p.Rules()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return applyOps(planBatch(oldRules, changes), func(op ruleOp) error {
+		if op.del {
+			return p.changeRule(syscall.RTM_DELRULE, "del", Rule{IP: op.ip, Table: op.table})
+		}
+		return p.changeRule(syscall.RTM_NEWRULE, "add", Rule{IP: op.ip, Table: op.table})
+	})
+}
+
+// changeRule adds or deletes the host rule or exception r.
+func (p *NetlinkRuleProvider) changeRule(typ uint16, op string, r Rule) error {
+	src := net.ParseIP(r.IP)
+	if src == nil {
+		return &NetlinkError{Op: op, IP: r.IP, Table: r.Table, Err: syscall.EINVAL}
+	}
+	family := uint8(syscall.AF_INET6)
+	if src4 := src.To4(); src4 != nil {
+		family = syscall.AF_INET
+		src = src4
+	}
+	id, ok := p.tables.ID(r.Table)
+	if !ok {
+		return &NetlinkError{Op: op, IP: r.IP, Table: r.Table, Err: ErrUnknownTable}
+	}
+	fr := fibRule{
+		Family:   family,
+		Src:      src,
+		Table:    id,
+		Priority: p.Priorities.Host(),
+		Action:   frActToTbl,
+		Protocol: p.Protocol,
+	}
+	if r.To != "" {
+		_, dst, err := net.ParseCIDR(r.To)
+		proto, known := ipProtoNumber(r.Proto)
+		if err != nil || !known || (dst.IP.To4() != nil) != (family == syscall.AF_INET) {
+			return &NetlinkError{Op: op, IP: r.IP, Table: r.Table, Err: ErrInvalidException}
+		}
+		ones, _ := dst.Mask.Size()
+		fr.Dst, fr.DstLen = dst.IP, uint8(ones)
+		fr.IPProto, fr.DPort = proto, r.Port
+		fr.Priority = p.Priorities.Exception()
+	}
+	flags := uint16(syscall.NLM_F_ACK)
+	if typ == syscall.RTM_NEWRULE {
+		flags |= syscall.NLM_F_CREATE | syscall.NLM_F_EXCL
+	}
+	if _, err := p.request(typ, flags, fr.encode()); err != nil {
+		return &NetlinkError{Op: op, IP: r.IP, Table: r.Table, Err: err}
+	}
+	return nil
+}
+
+// route is a route without destination, like the default routes of
+// managed tables or the unreachable route of kill switches
+type route struct {
+	Family   uint8
+	DstLen   uint8
+	Table    uint32
+	Protocol uint8
+	Scope    uint8
+	Type     uint8
+	Flags    uint32
+	Priority uint32
+	Gateway  string
+	OIF      uint32
+}
+
+func (r route) encode() []byte {
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[0] = r.Family
+	b[1] = r.DstLen
+	if r.Table < 256 {
+		b[4] = uint8(r.Table)
+	}
+	b[5] = r.Protocol
+	b[6] = r.Scope
+	b[7] = r.Type
+	if r.Table != 0 {
+		b = appendAttr(b, syscall.RTA_TABLE, uint32Bytes(r.Table))
+	}
+	if r.Priority != 0 {
+		b = appendAttr(b, syscall.RTA_PRIORITY, uint32Bytes(r.Priority))
+	}
+	if gw := net.ParseIP(r.Gateway); gw != nil {
+		if r.Family == syscall.AF_INET {
+			gw = gw.To4()
+		}
+		b = appendAttr(b, syscall.RTA_GATEWAY, gw)
+	}
+	if r.OIF != 0 {
+		b = appendAttr(b, syscall.RTA_OIF, uint32Bytes(r.OIF))
+	}
+	return b
+}
+
+func parseRoute(b []byte) (route, bool) {
+	if len(b) < syscall.SizeofRtMsg {
+		return route{}, false
+	}
+	r := route{
+		Family:   b[0],
+		DstLen:   b[1],
+		Table:    uint32(b[4]),
+		Protocol: b[5],
+		Scope:    b[6],
+		Type:     b[7],
+		Flags:    nativeEndian.Uint32(b[8:12]),
+	}
+	attrs := parseAttrs(b[syscall.SizeofRtMsg:])
+	if t, ok := attrs[syscall.RTA_TABLE]; ok && len(t) == 4 {
+		r.Table = nativeEndian.Uint32(t)
+	}
+	if p, ok := attrs[syscall.RTA_PRIORITY]; ok && len(p) == 4 {
+		r.Priority = nativeEndian.Uint32(p)
+	}
+	if gw, ok := attrs[syscall.RTA_GATEWAY]; ok && (len(gw) == 4 || len(gw) == 16) {
+		r.Gateway = net.IP(gw).String()
+	}
+	if oif, ok := attrs[syscall.RTA_OIF]; ok && len(oif) == 4 {
+		r.OIF = nativeEndian.Uint32(oif)
+	}
+	return r, true
+}
+
+func (p *NetlinkRuleProvider) families() []uint8 {
+	if p.IPv6 {
+		return []uint8{syscall.AF_INET, syscall.AF_INET6}
+	}
+	return []uint8{syscall.AF_INET}
+}
+
+func killSwitchRoute(family uint8, table uint32) route {
+	return route{
+		Family:   family,
+		Table:    table,
+		Protocol: syscall.RTPROT_STATIC,
+		Type:     syscall.RTN_UNREACHABLE,
+		Priority: math.MaxUint32,
+	}
+}
+
+// isKillSwitch ignores the device, the kernel reports lo for IPv6 unreachable routes.
+func (r route) isKillSwitch() bool {
+	return r.DstLen == 0 && r.Type == syscall.RTN_UNREACHABLE && r.Priority == math.MaxUint32
+}
+
+func (p *NetlinkRuleProvider) InstallKillSwitch(table string) error {
+	id, ok := p.tables.ID(table)
+	if !ok {
+		return &NetlinkError{Op: "killswitch", Table: table, Err: ErrUnknownTable}
+	}
+	for _, family := range p.families() {
+		flags := uint16(syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+		if _, err := p.request(syscall.RTM_NEWROUTE, flags, killSwitchRoute(family, id).encode()); err != nil {
+			return &NetlinkError{Op: "killswitch", Table: table, Err: err}
+		}
+	}
+	return nil
+}
+
+func (p *NetlinkRuleProvider) KillSwitch(table string) (KillSwitchState, error) {
+	id, ok := p.tables.ID(table)
+	if !ok {
+		return KillSwitchState{}, &NetlinkError{Op: "killswitch", Table: table, Err: ErrUnknownTable}
+	}
+	state := KillSwitchState{Installed: true}
+	for _, family := range p.families() {
+		msgs, err := p.request(syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, route{Family: family}.encode())
+		if err != nil {
+			return KillSwitchState{}, &NetlinkError{Op: "killswitch", Table: table, Err: err}
+		}
+		installed, others := false, 0
+		for _, m := range msgs {
+			r, ok := parseRoute(m.Data)
+			if m.Header.Type != syscall.RTM_NEWROUTE || !ok || r.Table != id {
+				continue
+			}
+			if r.isKillSwitch() {
+				installed = true
+			} else {
+				others++
+			}
+		}
+		state.Installed = state.Installed && installed
+		state.Blocking = state.Blocking || (installed && others == 0)
+	}
+	return state, nil
+}
@@ -0,0 +1,321 @@
+package router
+
+import (
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strings"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// inNetNS runs fn on a locked thread inside a new network namespace.
+// The thread is never unlocked, so it is discarded afterwards.
+func inNetNS(t *testing.T, fn func()) {
+	if os.Geteuid() != 0 {
+		t.Skip("Network namespaces require root")
+	}
+	errc := make(chan error)
+	go func() {
+		runtime.LockOSThread()
+		if err := syscall.Unshare(syscall.CLONE_NEWNET); err != nil {
+			errc <- err
+			return
+		}
+		fn()
+		errc <- nil
+	}()
+	if err := <-errc; err != nil {
+		t.Skipf("Could not create network namespace: %s", err)
+	}
+}
+
+func TestNetlinkRuleProvider(t *testing.T) {
+	tables := NewRouteTables()
+	tables.Add("vpn", 100)
+	tables.Add("defgw", 101)
+
+	inNetNS(t, func() {
+		assert := assert.New(t)
+		var p RuleProvider = NewNetlinkRuleProvider(tables)
+		rs, err := p.Rules()
+		assert.Nil(err)
+		assert.Equal(0, len(rs), "Default rules have no source")
+
+		assert.Nil(p.Set("10.10.10.1", "vpn"))
+		assert.Nil(p.Set("10.10.10.2", "defgw"))
+		rs, err = p.Rules()
+		assert.Nil(err)
+		assert.Equal(2, len(rs))
+		r, found := findByIP(rs, "10.10.10.1")
+		assert.True(found)
+		assert.Equal(Rule{IP: "10.10.10.1", Table: "vpn"}, r)
+
+		// Move to another table
+		assert.Nil(p.Set("10.10.10.1", "defgw"))
+		rs, err = p.Rules()
+		assert.Nil(err)
+		assert.Equal(2, len(rs))
+		r, _ = findByIP(rs, "10.10.10.1")
+		assert.Equal("defgw", r.Table)
+
+		// IPv6
+		assert.Nil(p.Set("2001:db8::1", "vpn"))
+		rs, _ = p.Rules()
+		r, found = findByIP(rs, "2001:db8::1")
+		assert.True(found)
+		assert.Equal("vpn", r.Table)
+		assert.Nil(p.Set("2001:db8::1", "defgw"))
+		rs, _ = p.Rules()
+		assert.Equal(3, len(rs))
+
+		// Delete
+		assert.Nil(p.Delete("2001:db8::1"))
+		assert.Nil(p.Delete("2001:db8::1"), "Deleting a missing rule is no error")
+		rs, _ = p.Rules()
+		_, found = findByIP(rs, "2001:db8::1")
+		assert.False(found)
+
+		// Numeric table without name
+		assert.Nil(p.Set("10.10.10.3", "200"))
+		rs, _ = p.Rules()
+		r, _ = findByIP(rs, "10.10.10.3")
+		assert.Equal("200", r.Table)
+
+		err = p.Set("10.10.10.4", "unknown")
+		if nerr, ok := err.(*NetlinkError); assert.True(ok, "Structured error expected") {
+			assert.Equal("add", nerr.Op)
+			assert.Equal(ErrUnknownTable, nerr.Err)
+		}
+
+		err = p.Set("invalid", "vpn")
+		if nerr, ok := err.(*NetlinkError); assert.True(ok, "Structured error expected") {
+			assert.Equal(syscall.EINVAL, nerr.Err)
+		}
+	})
+}
+
+func TestFibRuleEncoding(t *testing.T) {
+	assert := assert.New(t)
+	fr := fibRule{
+		Family:   syscall.AF_INET,
+		Src:      []byte{10, 10, 10, 1},
+		Table:    1000,
+		Priority: 100,
+		Action:   frActToTbl,
+	}
+	parsed, ok := parseFibRule(fr.encode())
+	assert.True(ok)
+	assert.Equal(fr, parsed)
+
+	fr.Family = syscall.AF_INET6
+	fr.Src = net.ParseIP("2001:db8::1")
+	parsed, ok = parseFibRule(fr.encode())
+	assert.True(ok)
+	assert.Equal(fr, parsed)
+
+	// Exception
+	fr.Dst, fr.DstLen, fr.IPProto, fr.DPort = net.ParseIP("2001:db8:1::"), 48, syscall.IPPROTO_TCP, 443
+	parsed, ok = parseFibRule(fr.encode())
+	assert.True(ok)
+	assert.Equal(fr, parsed)
+}
+
+func TestNetlinkExceptions(t *testing.T) {
+	tables := NewRouteTables()
+	tables.Add("vpn", 100)
+	tables.Add("defgw", 101)
+
+	inNetNS(t, func() {
+		assert := assert.New(t)
+		p := NewNetlinkRuleProvider(tables)
+		assert.Nil(p.Set("10.10.10.1", "vpn"))
+		assert.Nil(p.SetException(Rule{IP: "10.10.10.1", To: "10.0.0.0/8", Table: "defgw"}))
+		assert.Nil(p.SetException(Rule{IP: "10.10.10.1", To: "192.168.1.0/24", Proto: "udp", Port: 53, Table: "defgw"}))
+		assert.Nil(p.SetException(Rule{IP: "10.10.10.1", To: "10.0.0.0/8", Table: "vpn"}), "Move")
+		err := p.SetException(Rule{IP: "10.10.10.1", To: "2001:db8::/32", Table: "vpn"})
+		if nerr, ok := err.(*NetlinkError); assert.True(ok, "Structured error expected") {
+			assert.Equal(ErrInvalidException, nerr.Err, "Mixed families")
+		}
+
+		rs, err := p.Rules()
+		assert.Nil(err)
+		assert.Equal([]Rule{{IP: "10.10.10.1", Table: "vpn"}}, rs, "Exceptions are no host rules")
+		exceptions, err := p.Exceptions()
+		assert.Nil(err)
+		assert.Equal([]Rule{
+			{IP: "10.10.10.1", To: "10.0.0.0/8", Table: "vpn"},
+			{IP: "10.10.10.1", To: "192.168.1.0/24", Proto: "udp", Port: 53, Table: "defgw"},
+		}, exceptions)
+
+		assert.Nil(p.DeleteException(Rule{IP: "10.10.10.1", To: "10.0.0.0/8"}))
+		assert.Nil(p.DeleteException(Rule{IP: "10.10.10.1", To: "10.0.0.0/8"}), "Deleting a missing exception is no error")
+		exceptions, _ = p.Exceptions()
+		assert.Equal(1, len(exceptions))
+		foreign, err := p.ForeignRules()
+		assert.Nil(err)
+		for _, f := range foreign {
+			assert.NotContains(f.Spec, "10.10.10.1")
+		}
+	})
+}
+
+func TestSetBatch(t *testing.T) {
+	providers := map[string]func() RuleProvider{
+		"netlink": func() RuleProvider { return NewNetlinkRuleProvider(NewRouteTables()) },
+		"iproute2": func() RuleProvider {
+			p := NewIPRoute2RuleProvider()
+			p.IPv6 = true
+			return p
+		},
+	}
+	for name, newProvider := range providers {
+		inNetNS(t, func() {
+			assert := assert.New(t)
+			p := newProvider()
+			err := SetBatch(p, []Rule{
+				{IP: "10.0.0.1", Table: "100"},
+				{IP: "2001:db8::1", Table: "100"},
+				{IP: "10.0.0.2", Table: "101"},
+			})
+			assert.Nil(err, name)
+			rs, _ := p.Rules()
+			before := sortedRules(rs)
+			assert.Equal([]Rule{{IP: "10.0.0.1", Table: "100"}, {IP: "10.0.0.2", Table: "101"}, {IP: "2001:db8::1", Table: "100"}}, before, name)
+
+			// Invalid table rolls back the whole batch
+			err = SetBatch(p, []Rule{
+				{IP: "10.0.0.1", Table: "101"},
+				{IP: "2001:db8::1", Table: ""},
+				{IP: "10.0.0.3", Table: "nosuch"},
+			})
+			if be, ok := err.(*BatchError); assert.True(ok, name) {
+				assert.Equal(2, be.Index, name)
+			}
+			rs, _ = p.Rules()
+			assert.Equal(before, sortedRules(rs), name)
+
+			// Failing IPv6 change after IPv4 changes
+			err = SetBatch(p, []Rule{
+				{IP: "10.0.0.1", Table: ""},
+				{IP: "2001:db8::2", Table: "nosuch"},
+			})
+			if be, ok := err.(*BatchError); assert.True(ok, name) {
+				assert.Equal(1, be.Index, name)
+			}
+			rs, _ = p.Rules()
+			assert.Equal(before, sortedRules(rs), name)
+		})
+	}
+}
+
+func TestKillSwitch(t *testing.T) {
+	providers := map[string]func() KillSwitchProvider{
+		"netlink": func() KillSwitchProvider {
+			p := NewNetlinkRuleProvider(NewRouteTables())
+			p.IPv6 = true
+			return p
+		},
+		"iproute2": func() KillSwitchProvider {
+			p := NewIPRoute2RuleProvider()
+			p.IPv6 = true
+			return p
+		},
+	}
+	ip := func(args ...string) bool {
+		out, err := exec.Command("ip", args...).CombinedOutput()
+		if err != nil {
+			t.Errorf("ip %v: %s %s", args, err, out)
+		}
+		return err == nil
+	}
+	for name, newProvider := range providers {
+		inNetNS(t, func() {
+			assert := assert.New(t)
+			p := newProvider()
+			state, err := p.KillSwitch("100")
+			assert.Nil(err, name)
+			assert.Equal(KillSwitchState{}, state, name)
+
+			// Tunnel up, loopback stands in for the tunnel device
+			if !ip("link", "set", "lo", "up") || !ip("route", "add", "default", "dev", "lo", "table", "100") {
+				return
+			}
+			assert.Nil(p.InstallKillSwitch("100"), name)
+			assert.Nil(p.InstallKillSwitch("100"), name+": installing twice")
+			state, err = p.KillSwitch("100")
+			assert.Nil(err, name)
+			assert.Equal(KillSwitchState{Installed: true, Blocking: true}, state, name+": only IPv6 blocked")
+			if !ip("-6", "route", "add", "default", "dev", "lo", "table", "100") {
+				return
+			}
+			state, err = p.KillSwitch("100")
+			assert.Nil(err, name)
+			assert.Equal(KillSwitchState{Installed: true}, state, name)
+
+			// Tunnel gone
+			ip("route", "del", "default", "dev", "lo", "table", "100")
+			state, err = p.KillSwitch("100")
+			assert.Nil(err, name)
+			assert.Equal(KillSwitchState{Installed: true, Blocking: true}, state, name)
+		})
+	}
+}
+
+func TestForeignRules(t *testing.T) {
+	providers := map[string]func() RuleProvider{
+		"netlink": func() RuleProvider {
+			tables := NewRouteTables()
+			tables.Add("main", 254)
+			tables.Add("local", 255)
+			tables.Add("default", 253)
+			return NewNetlinkRuleProvider(tables)
+		},
+		"iproute2": func() RuleProvider { return NewIPRoute2RuleProvider() },
+	}
+	for name, newProvider := range providers {
+		inNetNS(t, func() {
+			assert := assert.New(t)
+			p := newProvider()
+			for _, args := range [][]string{
+				{"rule", "add", "from", "10.0.0.1", "table", "100", "pref", "10999"},
+				{"rule", "add", "fwmark", "1", "table", "100", "pref", "10999", "protocol", "86"},
+				{"rule", "add", "from", "10.0.0.0/24", "table", "100", "pref", "100"},
+			} {
+				if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+					t.Errorf("ip %v: %s %s", args, err, out)
+					return
+				}
+			}
+			assert.Nil(p.Set("10.0.0.2", "100"), name)
+			rs, err := p.Rules()
+			assert.Nil(err, name)
+			assert.Equal([]Rule{{IP: "10.0.0.2", Table: "100"}}, rs, name)
+
+			// Untagged rules are never deleted
+			assert.Nil(p.Delete("10.0.0.1"), name)
+			all, err := p.(ForeignRuleProvider).ForeignRules()
+			assert.Nil(err, name)
+			var foreign []ForeignRule
+			for _, r := range all {
+				if !r.IPv6 {
+					foreign = append(foreign, r)
+				}
+			}
+			assert.Equal([]ForeignRule{
+				{Priority: 0, Spec: "from all lookup local"},
+				{Priority: 100, Spec: "from 10.0.0.0/24 lookup 100"},
+				{Priority: 10999, Spec: "from 10.0.0.1 lookup 100"},
+				{Priority: 10999, Spec: "from all fwmark 0x1 lookup 100 proto 86"},
+				{Priority: 32766, Spec: "from all lookup main"},
+				{Priority: 32767, Spec: "from all lookup default"},
+			}, foreign, name)
+
+			out, _ := exec.Command("ip", "rule", "show", "from", "10.0.0.2").CombinedOutput()
+			assert.Equal("10999:\tfrom 10.0.0.2 lookup 100 proto 86", strings.TrimSpace(string(out)), name)
+		})
+	}
+}
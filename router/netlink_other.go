@@ -0,0 +1,62 @@
+//go:build !linux
+// +build !linux
+
+package router
+
+import "errors"
+
+var errNetlinkUnsupported = errors.New("netlink is not supported on this platform")
+
+// NetlinkRuleProvider is only available on Linux, all operations fail.
+type NetlinkRuleProvider struct {
+	IPv6       bool
+	Priorities PriorityRange
+	Protocol   uint8
+}
+
+func NewNetlinkRuleProvider(tables *RouteTables) *NetlinkRuleProvider {
+	return &NetlinkRuleProvider{
+		Priorities: DefaultPriorities,
+		Protocol:   DefaultRuleProtocol,
+	}
+}
+
+func (p *NetlinkRuleProvider) Rules() ([]Rule, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) Set(ip string, table string) error {
+	return errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) Delete(ip string) error {
+	return errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) Exceptions() ([]Rule, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) SetException(r Rule) error {
+	return errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) DeleteException(r Rule) error {
+	return errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) ForeignRules() ([]ForeignRule, error) {
+	return nil, errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) DeleteLegacyRule(prio uint32, r Rule) error {
+	return errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) InstallKillSwitch(table string) error {
+	return errNetlinkUnsupported
+}
+
+func (p *NetlinkRuleProvider) KillSwitch(table string) (KillSwitchState, error) {
+	return KillSwitchState{}, errNetlinkUnsupported
+}
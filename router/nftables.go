@@ -0,0 +1,457 @@
+package router
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// DefaultNFTTable is the nftables table of the inet family owned by vpnrouter.
+const DefaultNFTTable = "vpnrouter"
+
+// Maps of the nftables table from source address or MAC to the mark of a table
+const (
+	nftHosts4 = "hosts4"
+	nftHosts6 = "hosts6"
+	nftMACs   = "macs"
+)
+
+// NFTRuleProvider routes hosts by marking their traffic with nftables instead
+// of adding an ip rule per host. The mark of a table is its id and a single
+// rule "fwmark <id> lookup <id>" per table routes the marked traffic, so
+// moving a host is an atomic update of a map element. Exceptions are still
+// ip rules, preceding the fwmark rules.
+type NFTRuleProvider struct {
+	sync.Mutex
+
+	// IPv6 also lists the IPv6 hosts and installs the fwmark rules of ip -6
+	IPv6 bool
+	// The fwmark rules get the priority of host rules and are tagged with Protocol
+	Priorities PriorityRange
+	Protocol   uint8
+	// Table of the inet family holding the maps and the marking chain
+	Table string
+
+	tables *RouteTables
+	// Hosts are matched by MAC if set
+	hosts HostProvider
+	// Tables whose fwmark rules are installed
+	marked map[uint32]bool
+	// run executes a command with stdin and returns its output, replaced by tests
+	run func(stdin string, name string, args ...string) (string, error)
+}
+
+func NewNFTRuleProvider(tables *RouteTables) *NFTRuleProvider {
+	return &NFTRuleProvider{
+		Priorities: DefaultPriorities,
+		Protocol:   DefaultRuleProtocol,
+		Table:      DefaultNFTTable,
+		tables:     tables,
+		marked:     make(map[uint32]bool),
+		run:        runCmd,
+	}
+}
+
+// SetHostProvider matches hosts by the MAC of their addresses, so all
+// addresses of a host are routed alike. Only hosts on a segment directly
+// attached to the router have their MAC seen.
+func (p *NFTRuleProvider) SetHostProvider(hp HostProvider) {
+	p.Lock()
+	defer p.Unlock()
+	p.hosts = hp
+}
+
+func runCmd(stdin string, name string, args ...string) (string, error) {
+	cmd := exec.Command(name, args...)
+	if stdin != "" {
+		cmd.Stdin = strings.NewReader(stdin)
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return string(out), nil
+}
+
+// Init creates the table with its maps and chain, elements are kept.
+func (p *NFTRuleProvider) Init() error {
+	p.Lock()
+	defer p.Unlock()
+	_, err := p.run(p.setupScript(), "nft", "-f", "-")
+	return err
+}
+
+// setupScript declares the table, its maps and the marking chain.
+// Declaring existing objects is no error and the chain is recreated, so the
+// script is prepended to every change in case the ruleset was flushed.
+func (p *NFTRuleProvider) setupScript() string {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "add table inet %s\n", p.Table)
+	fmt.Fprintf(&buf, "add map inet %s %s { type ipv4_addr : mark; }\n", p.Table, nftHosts4)
+	fmt.Fprintf(&buf, "add map inet %s %s { type ipv6_addr : mark; }\n", p.Table, nftHosts6)
+	fmt.Fprintf(&buf, "add map inet %s %s { type ether_addr : mark; }\n", p.Table, nftMACs)
+	fmt.Fprintf(&buf, "add chain inet %s prerouting { type filter hook prerouting priority mangle; policy accept; }\n", p.Table)
+	fmt.Fprintf(&buf, "flush chain inet %s prerouting\n", p.Table)
+	// A lookup without element ends the rule, leaving the mark alone
+	if p.hosts != nil {
+		fmt.Fprintf(&buf, "add rule inet %s prerouting meta mark set ether saddr map @%s\n", p.Table, nftMACs)
+	} else {
+		fmt.Fprintf(&buf, "add rule inet %s prerouting meta mark set ip saddr map @%s\n", p.Table, nftHosts4)
+		fmt.Fprintf(&buf, "add rule inet %s prerouting meta mark set ip6 saddr map @%s\n", p.Table, nftHosts6)
+	}
+	return buf.String()
+}
+
+// nftElement is an element of a map of the table.
+type nftElement struct {
+	Map  string
+	Key  string
+	Mark uint32
+}
+
+// parseNFTElements returns the elements of all maps in the output of nft list table.
+func parseNFTElements(s string) []nftElement {
+	var elems []nftElement
+	name := ""
+	inElements := false
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(line, "map "):
+			name = strings.Fields(line)[1]
+			continue
+		case strings.HasPrefix(line, "elements = {"):
+			inElements = true
+			line = strings.TrimPrefix(line, "elements = {")
+		case !inElements:
+			continue
+		}
+		if i := strings.Index(line, "}"); i >= 0 {
+			line = line[:i]
+			inElements = false
+		}
+		for _, e := range strings.Split(line, ",") {
+			kv := strings.Split(e, " : ")
+			if len(kv) != 2 {
+				continue
+			}
+			mark, err := strconv.ParseUint(strings.TrimSpace(kv[1]), 0, 32)
+			if err != nil {
+				continue
+			}
+			elems = append(elems, nftElement{Map: name, Key: strings.TrimSpace(kv[0]), Mark: uint32(mark)})
+		}
+	}
+	return elems
+}
+
+// elements returns the mark of every key of the maps in use.
+func (p *NFTRuleProvider) elements() (map[string]uint32, error) {
+	out, err := p.run("", "nft", "list", "table", "inet", p.Table)
+	if err != nil {
+		return nil, err
+	}
+	marks := make(map[string]uint32)
+	for _, e := range parseNFTElements(out) {
+		if e.Map == p.mapOf(e.Key) {
+			marks[e.Key] = e.Mark
+		}
+	}
+	return marks, nil
+}
+
+// mapOf returns the map holding key.
+func (p *NFTRuleProvider) mapOf(key string) string {
+	switch {
+	case p.hosts != nil:
+		return nftMACs
+	case strings.Contains(key, ":"):
+		return nftHosts6
+	default:
+		return nftHosts4
+	}
+}
+
+// key returns the map key of ip, false if its host is unknown.
+func (p *NFTRuleProvider) key(ip string, hosts []Host) (string, bool) {
+	if p.hosts == nil {
+		return ip, true
+	}
+	h, ok := hostByIP(hosts, ip)
+	if !ok || h.MAC == "" {
+		return "", false
+	}
+	return strings.ToLower(h.MAC), true
+}
+
+func (p *NFTRuleProvider) currentHosts() ([]Host, error) {
+	if p.hosts == nil {
+		return nil, nil
+	}
+	return p.hosts.Hosts()
+}
+
+func (p *NFTRuleProvider) Rules() ([]Rule, error) {
+	p.Lock()
+	defer p.Unlock()
+	marks, err := p.elements()
+	if err != nil {
+		return nil, err
+	}
+	hosts, err := p.currentHosts()
+	if err != nil {
+		return nil, err
+	}
+	var rules []Rule
+	add := func(ip string, mark uint32) {
+		if p.IPv6 || !strings.Contains(ip, ":") {
+			rules = append(rules, Rule{IP: ip, Table: p.tables.Name(mark)})
+		}
+	}
+	if p.hosts == nil {
+		ips := make([]string, 0, len(marks))
+		for ip := range marks {
+			ips = append(ips, ip)
+		}
+		sort.Strings(ips)
+		for _, ip := range ips {
+			add(ip, marks[ip])
+		}
+		return rules, nil
+	}
+	for _, h := range hosts {
+		if mark, ok := marks[strings.ToLower(h.MAC)]; ok {
+			for _, ip := range h.Addrs() {
+				add(ip, mark)
+			}
+		}
+	}
+	return rules, nil
+}
+
+func (p *NFTRuleProvider) Set(ip string, table string) error {
+	return unwrapBatchError(p.SetBatch([]Rule{{IP: ip, Table: table}}))
+}
+
+// Delete removes the element of ip, or of its MAC.
+func (p *NFTRuleProvider) Delete(ip string) error {
+	return unwrapBatchError(p.SetBatch([]Rule{{IP: ip}}))
+}
+
+func unwrapBatchError(err error) error {
+	if be, ok := err.(*BatchError); ok {
+		return be.Err
+	}
+	return err
+}
+
+// SetBatch applies the changes in a single nftables transaction.
+func (p *NFTRuleProvider) SetBatch(changes []Rule) error {
+	p.Lock()
+	defer p.Unlock()
+	marks, err := p.elements()
+	if err != nil {
+		return err
+	}
+	hosts, err := p.currentHosts()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	buf.WriteString(p.setupScript())
+	// Change of each line of the script after the setup
+	offset := strings.Count(buf.String(), "\n")
+	var lines []int
+	var ids []uint32
+	for i, c := range changes {
+		key, ok := p.key(c.IP, hosts)
+		if !ok {
+			if c.Table == "" {
+				continue
+			}
+			return &BatchError{Index: i, Err: ErrUnknownHost}
+		}
+		var id uint32
+		if c.Table != "" {
+			id, ok = p.tables.ID(c.Table)
+			if !ok || id == 0 {
+				return &BatchError{Index: i, Err: ErrUnknownTable}
+			}
+			ids = append(ids, id)
+		}
+		old, found := marks[key]
+		if found && old == id {
+			continue
+		}
+		m := p.mapOf(key)
+		if found {
+			fmt.Fprintf(&buf, "delete element inet %s %s { %s }\n", p.Table, m, key)
+			lines = append(lines, i)
+			delete(marks, key)
+		}
+		if c.Table != "" {
+			fmt.Fprintf(&buf, "add element inet %s %s { %s : %d }\n", p.Table, m, key, id)
+			lines = append(lines, i)
+			marks[key] = id
+		}
+	}
+	if err := p.ensureMarkRules(ids); err != nil {
+		return err
+	}
+	if len(lines) == 0 {
+		return nil
+	}
+	if _, err := p.run(buf.String(), "nft", "-f", "-"); err != nil {
+		if line := nftFailedLine(err.Error()) - offset; line >= 1 && line <= len(lines) {
+			return &BatchError{Index: lines[line-1], Err: err}
+		}
+		return err
+	}
+	return nil
+}
+
+var nftErrorRe = regexp.MustCompile(`:(\d+):[\d-]+: Error:`)
+
+// nftFailedLine returns the line of the first error reported by nft -f, 0 if none.
+func nftFailedLine(out string) int {
+	m := nftErrorRe.FindStringSubmatch(out)
+	if m == nil {
+		return 0
+	}
+	line, _ := strconv.Atoi(m[1])
+	return line
+}
+
+func (p *NFTRuleProvider) families() []string {
+	if p.IPv6 {
+		return []string{"-4", "-6"}
+	}
+	return []string{"-4"}
+}
+
+// ipRules returns the owned rules of family and all others.
+func (p *NFTRuleProvider) ipRules(family string) ([]Rule, []ForeignRule, error) {
+	out, err := p.run("", "ip", family, "rule", "show")
+	if err != nil {
+		return nil, nil, err
+	}
+	rules, foreign := parseRuleLines(out, p.Priorities, p.Protocol, family == "-6")
+	return rules, foreign, nil
+}
+
+// markRule returns the mark of a fwmark rule of the provider.
+func (p *NFTRuleProvider) markRule(f ForeignRule) (uint32, bool) {
+	parts := strings.Fields(f.Spec)
+	tag := []string{}
+	if p.Protocol != 0 {
+		tag = []string{"proto", strconv.Itoa(int(p.Protocol))}
+	}
+	if f.Priority != p.Priorities.Host() || len(parts) != 6+len(tag) ||
+		parts[0] != "from" || parts[1] != "all" || parts[2] != "fwmark" || parts[4] != "lookup" ||
+		strings.Join(parts[6:], " ") != strings.Join(tag, " ") {
+		return 0, false
+	}
+	mark, err := strconv.ParseUint(parts[3], 0, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(mark), true
+}
+
+// ensureMarkRules installs the missing fwmark rules of the tables ids.
+func (p *NFTRuleProvider) ensureMarkRules(ids []uint32) error {
+	var missing []uint32
+	for _, id := range ids {
+		if !p.marked[id] {
+			missing = append(missing, id)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	for _, family := range p.families() {
+		_, foreign, err := p.ipRules(family)
+		if err != nil {
+			return err
+		}
+		installed := make(map[uint32]bool)
+		for _, f := range foreign {
+			if mark, ok := p.markRule(f); ok {
+				installed[mark] = true
+			}
+		}
+		for _, id := range missing {
+			if installed[id] {
+				continue
+			}
+			installed[id] = true
+			mark := strconv.FormatUint(uint64(id), 10)
+			args := append([]string{family, "rule", "add", "fwmark", mark, "table", mark}, ruleTag(p.Priorities.Host(), p.Protocol)...)
+			if _, err := p.run("", "ip", args...); err != nil {
+				return err
+			}
+		}
+	}
+	for _, id := range missing {
+		p.marked[id] = true
+	}
+	return nil
+}
+
+// ForeignRules returns all rules but the fwmark rules of the provider.
+func (p *NFTRuleProvider) ForeignRules() ([]ForeignRule, error) {
+	var rules []ForeignRule
+	for _, family := range p.families() {
+		_, foreign, err := p.ipRules(family)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range foreign {
+			if _, ok := p.markRule(f); !ok {
+				rules = append(rules, f)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// Exceptions returns the exceptions of all families, which are ip rules.
+func (p *NFTRuleProvider) Exceptions() ([]Rule, error) {
+	var exceptions []Rule
+	for _, family := range p.families() {
+		rules, _, err := p.ipRules(family)
+		if err != nil {
+			return nil, err
+		}
+		_, e := splitExceptions(rules)
+		exceptions = append(exceptions, e...)
+	}
+	return exceptions, nil
+}
+
+func (p *NFTRuleProvider) SetException(r Rule) error {
+	current, err := p.Exceptions()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return setIPException(p.run, current, r, ruleTag(p.Priorities.Exception(), p.Protocol))
+}
+
+func (p *NFTRuleProvider) DeleteException(r Rule) error {
+	current, err := p.Exceptions()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return deleteIPException(p.run, current, r, ruleTag(p.Priorities.Exception(), p.Protocol))
+}
@@ -0,0 +1,195 @@
+package router
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fixture_nft = `table inet vpnrouter {
+	map hosts4 {
+		type ipv4_addr : mark
+		elements = { 10.0.0.1 : 0x00000064, 10.0.0.2 : 0x00000065,
+			     10.0.0.3 : 0x00000064 }
+	}
+
+	map hosts6 {
+		type ipv6_addr : mark
+		elements = { 2001:db8::1 : 0x00000065 }
+	}
+
+	map macs {
+		type ether_addr : mark
+		elements = { 02:00:00:00:00:01 : 0x00000065 }
+	}
+
+	chain prerouting {
+		type filter hook prerouting priority mangle; policy accept;
+		meta mark set ip saddr map @hosts4
+		meta mark set ip6 saddr map @hosts6
+	}
+}
+`
+
+const fixture_fwmark_rules = `
+0:	from all lookup local
+10998:	from 10.0.0.1 to 10.0.0.0/8 lookup defgw proto 86
+10999:	from all fwmark 0x64 lookup vpn proto 86
+10999:	from all fwmark 0x66 lookup 102
+32766:	from all lookup main
+`
+
+// fakeCmds records the commands run by a provider and answers listings with fixtures.
+type fakeCmds struct {
+	nft     string
+	rules   string
+	scripts []string
+	ipCmds  []string
+	nftErr  error
+}
+
+func (f *fakeCmds) run(stdin string, name string, args ...string) (string, error) {
+	cmd := strings.Join(args, " ")
+	switch {
+	case name == "nft" && strings.HasPrefix(cmd, "list"):
+		return f.nft, nil
+	case name == "nft":
+		f.scripts = append(f.scripts, stdin)
+		return "", f.nftErr
+	case strings.HasSuffix(cmd, "rule show"):
+		return f.rules, nil
+	default:
+		f.ipCmds = append(f.ipCmds, cmd)
+		return "", nil
+	}
+}
+
+func newTestNFTRuleProvider(f *fakeCmds) *NFTRuleProvider {
+	rt := NewRouteTables()
+	rt.Add("vpn", 100)
+	rt.Add("defgw", 101)
+	p := NewNFTRuleProvider(rt)
+	p.run = f.run
+	return p
+}
+
+func TestParseNFTElements(t *testing.T) {
+	assert.Equal(t, []nftElement{
+		{Map: "hosts4", Key: "10.0.0.1", Mark: 100},
+		{Map: "hosts4", Key: "10.0.0.2", Mark: 101},
+		{Map: "hosts4", Key: "10.0.0.3", Mark: 100},
+		{Map: "hosts6", Key: "2001:db8::1", Mark: 101},
+		{Map: "macs", Key: "02:00:00:00:00:01", Mark: 101},
+	}, parseNFTElements(fixture_nft))
+}
+
+func TestNFTRules(t *testing.T) {
+	assert := assert.New(t)
+	p := newTestNFTRuleProvider(&fakeCmds{nft: fixture_nft})
+	rules, err := p.Rules()
+	assert.Nil(err)
+	assert.Equal([]Rule{{IP: "10.0.0.1", Table: "vpn"}, {IP: "10.0.0.2", Table: "defgw"}, {IP: "10.0.0.3", Table: "vpn"}}, rules)
+
+	p.IPv6 = true
+	rules, err = p.Rules()
+	assert.Nil(err)
+	assert.Equal(4, len(rules))
+
+	// By MAC
+	p.SetHostProvider(mockHostProvider{{MAC: "02:00:00:00:00:01", IP: "10.0.0.5", IP6: []string{"2001:db8::5"}}})
+	rules, err = p.Rules()
+	assert.Nil(err)
+	assert.Equal([]Rule{{IP: "10.0.0.5", Table: "defgw"}, {IP: "2001:db8::5", Table: "defgw"}}, rules)
+}
+
+func TestNFTSetBatch(t *testing.T) {
+	assert := assert.New(t)
+	f := &fakeCmds{nft: fixture_nft, rules: fixture_fwmark_rules}
+	p := newTestNFTRuleProvider(f)
+	setup := p.setupScript()
+
+	assert.Nil(p.SetBatch([]Rule{
+		{IP: "10.0.0.1", Table: "defgw"},
+		{IP: "10.0.0.2"},
+		{IP: "10.0.0.3", Table: "vpn"},
+		{IP: "10.0.0.4", Table: "vpn"},
+	}))
+	assert.Equal([]string{setup +
+		"delete element inet vpnrouter hosts4 { 10.0.0.1 }\n" +
+		"add element inet vpnrouter hosts4 { 10.0.0.1 : 101 }\n" +
+		"delete element inet vpnrouter hosts4 { 10.0.0.2 }\n" +
+		"add element inet vpnrouter hosts4 { 10.0.0.4 : 100 }\n",
+	}, f.scripts)
+	// The rule of vpn exists, the one of mark 0x66 is not tagged
+	assert.Equal([]string{"-4 rule add fwmark 101 table 101 pref 10999 protocol 86"}, f.ipCmds)
+
+	// Rules are only installed once
+	f.scripts, f.ipCmds = nil, nil
+	assert.Nil(p.Set("10.0.0.5", "defgw"))
+	assert.Nil(f.ipCmds)
+	assert.Equal(1, len(f.scripts))
+
+	// Nothing to change
+	f.scripts = nil
+	assert.Nil(p.Set("10.0.0.1", "vpn"))
+	assert.Nil(p.Delete("10.0.0.9"))
+	assert.Nil(f.scripts)
+
+	assert.Equal(&BatchError{Index: 1, Err: ErrUnknownTable}, p.SetBatch([]Rule{{IP: "10.0.0.4", Table: "vpn"}, {IP: "10.0.0.5", Table: "x"}}))
+	assert.Equal(ErrUnknownTable, p.Set("10.0.0.5", "x"))
+
+	// Errors are mapped to the change of their line
+	lines := strings.Count(setup, "\n")
+	f.nftErr = fmt.Errorf("exit status 1: /dev/stdin:%d:1-45: Error: Could not process rule: No such file or directory", lines+2)
+	err := p.SetBatch([]Rule{{IP: "10.0.0.4", Table: "vpn"}, {IP: "10.0.0.2", Table: "vpn"}})
+	if be, ok := err.(*BatchError); assert.True(ok) {
+		assert.Equal(1, be.Index)
+	}
+}
+
+func TestNFTSetBatchMAC(t *testing.T) {
+	assert := assert.New(t)
+	f := &fakeCmds{nft: fixture_nft, rules: fixture_fwmark_rules}
+	p := newTestNFTRuleProvider(f)
+	p.SetHostProvider(mockHostProvider{{MAC: "02:00:00:00:00:01", IP: "10.0.0.5"}, {MAC: "02:00:00:00:00:02", IP: "10.0.0.6"}})
+
+	assert.Nil(p.Set("10.0.0.6", "vpn"))
+	assert.Nil(p.Delete("10.0.0.5"))
+	assert.Nil(p.Delete("10.0.0.7"), "Unknown host has no element")
+	assert.Equal(ErrUnknownHost, p.Set("10.0.0.7", "vpn"))
+	setup := p.setupScript()
+	assert.Contains(setup, "meta mark set ether saddr map @macs")
+	assert.Equal([]string{
+		setup + "add element inet vpnrouter macs { 02:00:00:00:00:02 : 100 }\n",
+		setup + "delete element inet vpnrouter macs { 02:00:00:00:00:01 }\n",
+	}, f.scripts)
+}
+
+func TestNFTForeignRules(t *testing.T) {
+	p := newTestNFTRuleProvider(&fakeCmds{rules: fixture_fwmark_rules})
+	foreign, err := p.ForeignRules()
+	assert.Nil(t, err)
+	assert.Equal(t, []ForeignRule{
+		{Priority: 0, Spec: "from all lookup local"},
+		{Priority: 10999, Spec: "from all fwmark 0x66 lookup 102"},
+		{Priority: 32766, Spec: "from all lookup main"},
+	}, foreign)
+}
+
+func TestNFTExceptions(t *testing.T) {
+	assert := assert.New(t)
+	f := &fakeCmds{rules: fixture_fwmark_rules}
+	p := newTestNFTRuleProvider(f)
+	exceptions, err := p.Exceptions()
+	assert.Nil(err)
+	assert.Equal([]Rule{{IP: "10.0.0.1", To: "10.0.0.0/8", Table: "defgw"}}, exceptions)
+
+	assert.Nil(p.SetException(Rule{IP: "10.0.0.1", To: "10.0.0.0/8", Table: "vpn"}))
+	assert.Nil(p.DeleteException(Rule{IP: "10.0.0.1", To: "192.168.0.0/16"}))
+	assert.Equal([]string{
+		"-4 rule del from 10.0.0.1 to 10.0.0.0/8 table defgw pref 10998 protocol 86",
+		"-4 rule add from 10.0.0.1 to 10.0.0.0/8 table vpn pref 10998 protocol 86",
+	}, f.ipCmds)
+}
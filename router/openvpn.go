@@ -0,0 +1,292 @@
+package router
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// ErrNoOpenVPN is returned for tables without OpenVPN tunnel.
+	ErrNoOpenVPN = errors.New("table has no openvpn tunnel")
+	// ErrOpenVPNUnknown is returned for tunnels which were not polled yet.
+	ErrOpenVPNUnknown = errors.New("openvpn: state not polled yet")
+)
+
+// OpenVPNState is the connection state of an OpenVPN client.
+type OpenVPNState struct {
+	// State like CONNECTED, RECONNECTING or EXITING
+	State string
+	Since time.Time
+	// Tunnel IP assigned by the server
+	LocalIP string
+	// Address of the server
+	RemoteIP string
+	// Bytes read and written on the link
+	RxBytes uint64
+	TxBytes uint64
+}
+
+// OpenVPNManagement talks to the management interface of an OpenVPN instance.
+// It connects for every request, as the interface only serves one client at a time.
+type OpenVPNManagement struct {
+	// host:port or the path of a unix socket
+	Addr     string
+	Password string
+	Timeout  time.Duration
+}
+
+func NewOpenVPNManagement(addr, password string) *OpenVPNManagement {
+	return &OpenVPNManagement{
+		Addr:     addr,
+		Password: password,
+		Timeout:  2 * time.Second,
+	}
+}
+
+type openVPNConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (m *OpenVPNManagement) dial() (*openVPNConn, error) {
+	network := "tcp"
+	if strings.HasPrefix(m.Addr, "/") {
+		network = "unix"
+	}
+	conn, err := net.DialTimeout(network, m.Addr, m.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(m.Timeout))
+	c := &openVPNConn{Conn: conn, r: bufio.NewReader(conn)}
+	if m.Password != "" {
+		if _, err := c.command(m.Password, false); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// command sends cmd and returns the lines of a multi line response up to END,
+// or the single SUCCESS line. Real-time notifications like the greeting are skipped.
+func (c *openVPNConn) command(cmd string, multi bool) ([]string, error) {
+	if _, err := fmt.Fprintf(c, "%s\n", cmd); err != nil {
+		return nil, err
+	}
+	var lines []string
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		// The password prompt has no line break
+		line = strings.TrimPrefix(strings.TrimRight(line, "\r\n"), "ENTER PASSWORD:")
+		switch {
+		case strings.HasPrefix(line, ">"):
+		case strings.HasPrefix(line, "ERROR:"):
+			return nil, fmt.Errorf("openvpn: %s", strings.TrimSpace(strings.TrimPrefix(line, "ERROR:")))
+		case !multi && strings.HasPrefix(line, "SUCCESS:"):
+			return []string{line}, nil
+		case multi && line == "END":
+			return lines, nil
+		case multi:
+			lines = append(lines, line)
+		}
+	}
+}
+
+// State returns the connection state and transfer of the instance.
+func (m *OpenVPNManagement) State() (OpenVPNState, error) {
+	c, err := m.dial()
+	if err != nil {
+		return OpenVPNState{}, err
+	}
+	defer c.Close()
+	lines, err := c.command("state", true)
+	if err != nil {
+		return OpenVPNState{}, err
+	}
+	if len(lines) == 0 {
+		return OpenVPNState{}, errors.New("openvpn: empty state")
+	}
+	state := parseOpenVPNState(lines[len(lines)-1])
+	lines, err = c.command("status", true)
+	if err != nil {
+		return OpenVPNState{}, err
+	}
+	state.RxBytes, state.TxBytes = parseOpenVPNBytes(lines)
+	return state, nil
+}
+
+// parseOpenVPNState parses a state line like
+// "1760788800,CONNECTED,SUCCESS,10.8.0.6,192.0.2.1,1194,,".
+func parseOpenVPNState(line string) OpenVPNState {
+	fields := strings.Split(line, ",")
+	var s OpenVPNState
+	if sec, err := strconv.ParseInt(fields[0], 10, 64); err == nil && sec > 0 {
+		s.Since = time.Unix(sec, 0)
+	}
+	if len(fields) > 1 {
+		s.State = fields[1]
+	}
+	if len(fields) > 3 {
+		s.LocalIP = fields[3]
+	}
+	if len(fields) > 4 {
+		s.RemoteIP = fields[4]
+	}
+	return s
+}
+
+// parseOpenVPNBytes returns the link transfer of the status report of a client.
+func parseOpenVPNBytes(lines []string) (rx uint64, tx uint64) {
+	for _, line := range lines {
+		kv := strings.SplitN(line, ",", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		n, err := strconv.ParseUint(kv[1], 10, 64)
+		if err != nil {
+			continue
+		}
+		switch kv[0] {
+		case "TCP/UDP read bytes":
+			rx = n
+		case "TCP/UDP write bytes":
+			tx = n
+		}
+	}
+	return rx, tx
+}
+
+// Restart makes the instance reconnect by sending SIGUSR1.
+func (m *OpenVPNManagement) Restart() error {
+	c, err := m.dial()
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	_, err = c.command("signal SIGUSR1", false)
+	return err
+}
+
+// OpenVPNTunnels maps tables to the management interfaces of their OpenVPN instances.
+type OpenVPNTunnels map[string]*OpenVPNManagement
+
+// OpenVPNState returns the state of the tunnel of table, false if it has none.
+func (t OpenVPNTunnels) OpenVPNState(table string) (OpenVPNState, bool, error) {
+	m, ok := t[table]
+	if !ok {
+		return OpenVPNState{}, false, nil
+	}
+	state, err := m.State()
+	return state, true, err
+}
+
+// RestartOpenVPN restarts the tunnel of table.
+func (t OpenVPNTunnels) RestartOpenVPN(table string) error {
+	m, ok := t[table]
+	if !ok {
+		return ErrNoOpenVPN
+	}
+	return m.Restart()
+}
+
+type openVPNResult struct {
+	state OpenVPNState
+	err   error
+}
+
+// OpenVPNMonitor polls the state of the OpenVPN tunnels in the background and
+// reports the last one, so readers never wait for a management interface.
+type OpenVPNMonitor struct {
+	mu      sync.Mutex
+	tunnels OpenVPNTunnels
+	states  map[string]openVPNResult
+}
+
+func NewOpenVPNMonitor(tunnels OpenVPNTunnels) *OpenVPNMonitor {
+	return &OpenVPNMonitor{
+		tunnels: tunnels,
+		states:  make(map[string]openVPNResult),
+	}
+}
+
+// SetTunnels replaces the tunnels, their state is known after the next Poll.
+func (m *OpenVPNMonitor) SetTunnels(tunnels OpenVPNTunnels) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.tunnels = tunnels
+	m.states = make(map[string]openVPNResult)
+}
+
+// Poll queries the state of all tunnels in parallel.
+func (m *OpenVPNMonitor) Poll() {
+	m.mu.Lock()
+	tunnels := m.tunnels
+	m.mu.Unlock()
+	states := make(map[string]openVPNResult)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for table, t := range tunnels {
+		wg.Add(1)
+		go func(table string, t *OpenVPNManagement) {
+			defer wg.Done()
+			state, err := t.State()
+			mu.Lock()
+			states[table] = openVPNResult{state: state, err: err}
+			mu.Unlock()
+		}(table, t)
+	}
+	wg.Wait()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	// Tunnels replaced in the meantime are polled next time
+	if reflect.DeepEqual(tunnels, m.tunnels) {
+		m.states = states
+	}
+}
+
+// Run polls the tunnels every interval until stop is closed.
+func (m *OpenVPNMonitor) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		m.Poll()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+	}
+}
+
+// OpenVPNState returns the last polled state of the tunnel of table, false if it has none.
+func (m *OpenVPNMonitor) OpenVPNState(table string) (OpenVPNState, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.tunnels[table]; !ok {
+		return OpenVPNState{}, false, nil
+	}
+	res, ok := m.states[table]
+	if !ok {
+		return OpenVPNState{}, true, ErrOpenVPNUnknown
+	}
+	return res.state, true, res.err
+}
+
+// RestartOpenVPN restarts the tunnel of table.
+func (m *OpenVPNMonitor) RestartOpenVPN(table string) error {
+	m.mu.Lock()
+	tunnels := m.tunnels
+	m.mu.Unlock()
+	return tunnels.RestartOpenVPN(table)
+}
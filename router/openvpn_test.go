@@ -0,0 +1,153 @@
+package router
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeOpenVPN serves the management interface of a connected client
+// and records the received commands.
+type fakeOpenVPN struct {
+	l        net.Listener
+	password string
+	commands chan string
+}
+
+func newFakeOpenVPN(t *testing.T, password string) *fakeOpenVPN {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	f := &fakeOpenVPN{l: l, password: password, commands: make(chan string, 10)}
+	go f.serve()
+	return f
+}
+
+func (f *fakeOpenVPN) serve() {
+	for {
+		conn, err := f.l.Accept()
+		if err != nil {
+			return
+		}
+		go f.handle(conn)
+	}
+}
+
+func (f *fakeOpenVPN) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if f.password != "" {
+		fmt.Fprint(conn, "ENTER PASSWORD:")
+		line, _ := r.ReadString('\n')
+		if strings.TrimSpace(line) != f.password {
+			fmt.Fprint(conn, "ERROR: bad password\r\n")
+			return
+		}
+		fmt.Fprint(conn, "SUCCESS: password is correct\r\n")
+	}
+	fmt.Fprint(conn, ">INFO:OpenVPN Management Interface Version 3 -- type 'help' for more info\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		cmd := strings.TrimSpace(line)
+		f.commands <- cmd
+		switch cmd {
+		case "state":
+			fmt.Fprint(conn, "1760788800,CONNECTED,SUCCESS,10.8.0.6,192.0.2.1,1194,,\r\nEND\r\n")
+		case "status":
+			fmt.Fprint(conn, "OpenVPN STATISTICS\r\nUpdated,2026-10-18 12:00:00\r\n"+
+				"TUN/TAP read bytes,100\r\nTUN/TAP write bytes,200\r\n"+
+				">BYTECOUNT:1,2\r\n"+
+				"TCP/UDP read bytes,3000\r\nTCP/UDP write bytes,4000\r\nAuth read bytes,0\r\nEND\r\n")
+		case "signal SIGUSR1":
+			fmt.Fprint(conn, "SUCCESS: signal SIGUSR1 thrown\r\n")
+		default:
+			fmt.Fprint(conn, "ERROR: unknown command, enter 'help' for more options\r\n")
+		}
+	}
+}
+
+func TestOpenVPNManagement(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeOpenVPN(t, "secret")
+	defer f.l.Close()
+
+	tunnels := OpenVPNTunnels{"vpn": NewOpenVPNManagement(f.l.Addr().String(), "secret")}
+	state, ok, err := tunnels.OpenVPNState("vpn")
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Equal(OpenVPNState{
+		State:    "CONNECTED",
+		Since:    time.Unix(1760788800, 0),
+		LocalIP:  "10.8.0.6",
+		RemoteIP: "192.0.2.1",
+		RxBytes:  3000,
+		TxBytes:  4000,
+	}, state)
+	assert.Equal("state", <-f.commands)
+	assert.Equal("status", <-f.commands)
+
+	assert.Nil(tunnels.RestartOpenVPN("vpn"))
+	assert.Equal("signal SIGUSR1", <-f.commands)
+
+	_, ok, err = tunnels.OpenVPNState("defgw")
+	assert.False(ok)
+	assert.Nil(err)
+	assert.Equal(ErrNoOpenVPN, tunnels.RestartOpenVPN("defgw"))
+
+	bad := NewOpenVPNManagement(f.l.Addr().String(), "wrong")
+	_, err = bad.State()
+	assert.EqualError(err, "openvpn: bad password")
+}
+
+func TestOpenVPNMonitor(t *testing.T) {
+	assert := assert.New(t)
+	f := newFakeOpenVPN(t, "")
+	defer f.l.Close()
+	dead, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	dead.Close()
+
+	m := NewOpenVPNMonitor(OpenVPNTunnels{
+		"vpn":  NewOpenVPNManagement(f.l.Addr().String(), ""),
+		"vpn2": NewOpenVPNManagement(dead.Addr().String(), ""),
+	})
+	_, ok, err := m.OpenVPNState("vpn")
+	assert.True(ok)
+	assert.Equal(ErrOpenVPNUnknown, err, "Not polled yet")
+
+	m.Poll()
+	state, ok, err := m.OpenVPNState("vpn")
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Equal("CONNECTED", state.State)
+	_, ok, err = m.OpenVPNState("vpn2")
+	assert.True(ok)
+	assert.NotNil(err, "Unreachable tunnel")
+	_, ok, _ = m.OpenVPNState("defgw")
+	assert.False(ok)
+	assert.Nil(m.RestartOpenVPN("vpn"))
+
+	m.SetTunnels(OpenVPNTunnels{"vpn2": NewOpenVPNManagement(f.l.Addr().String(), "")})
+	_, ok, _ = m.OpenVPNState("vpn")
+	assert.False(ok, "Removed by reload")
+	_, _, err = m.OpenVPNState("vpn2")
+	assert.Equal(ErrOpenVPNUnknown, err)
+}
+
+func TestParseOpenVPNState(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(OpenVPNState{State: "RECONNECTING", Since: time.Unix(1760788800, 0)},
+		parseOpenVPNState("1760788800,RECONNECTING,ping-restart,,,,,"))
+	assert.Equal(OpenVPNState{}, parseOpenVPNState(""))
+}
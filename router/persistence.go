@@ -4,50 +4,187 @@ import (
 	"bufio"
 	"bytes"
 	"io"
-	"io/ioutil"
+	"log"
 	"os"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 )
 
+// RulePersistence saves the table of each host by MAC, so a host keeps
+// its table if it gets a new IP.
 type RulePersistence struct {
-	base RuleProvider
-	file string
-	db   map[string]string
-	mu   *sync.Mutex
+	base      RuleProvider
+	hosts     HostProvider
+	file      string
+	db        map[string]persRule // MAC to last known IPs and table
+	groupFile string
+	groups    map[string]Group
+
+	scheduleFile string
+	schedules    map[string]Schedule
+	// Schedule name to the table last applied by the Scheduler
+	scheduleApplied map[string]string
+
+	exceptionFile   string
+	exceptions      ExceptionRuleProvider
+	hostExceptions  map[string][]Rule // MAC to exceptions without IP
+	groupExceptions map[string][]Rule // Group to exceptions without IP
+
+	// Replaces the files if set
+	store Store
+
+	legacy       LegacyRuleProvider
+	legacyTables []string
+
+	events *EventBus
+	// Records the changes of the scheduler, expiry and reconciler
+	audit AuditRecorder
+
+	mu *sync.Mutex
 }
 
-func NewRulePersistence(base RuleProvider, file string) *RulePersistence {
+func NewRulePersistence(base RuleProvider, hosts HostProvider, file string) *RulePersistence {
 	return &RulePersistence{
-		base: base,
-		file: file,
-		db:   make(map[string]string),
-		mu:   &sync.Mutex{},
+		base:      base,
+		hosts:     hosts,
+		file:      file,
+		db:        make(map[string]persRule),
+		groups:    make(map[string]Group),
+		schedules: make(map[string]Schedule),
+
+		scheduleApplied: make(map[string]string),
+
+		hostExceptions:  make(map[string][]Rule),
+		groupExceptions: make(map[string][]Rule),
+		mu:              &sync.Mutex{},
 	}
 }
 
 type persRule struct {
-	IP    string
+	IPs   []string
 	Table string
+	// Temporary rules are reverted to Prev after Expires
+	Expires time.Time
+	Prev    string
+}
+
+// SetEventBus publishes the reverts of expired temporary rules.
+func (r *RulePersistence) SetEventBus(events *EventBus) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = events
+}
+
+// SetAuditLog records the changes of schedules, expired temporary rules
+// and reconcilers, must be called before they run.
+func (r *RulePersistence) SetAuditLog(a AuditRecorder) {
+	r.audit = a
 }
 
-// Init applies all saved rules
+// Init applies all saved rules. IP based entries of older databases
+// are migrated using the current hosts.
 func (r *RulePersistence) Init() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	err := r.readFromFile()
+	hosts, err := r.hosts.Hosts()
 	if err != nil {
 		return err
 	}
-	r.applyRulesInDB()
+	load := r.readFiles
+	if r.store != nil {
+		load = r.loadStore
+	}
+	if err := load(hosts); err != nil {
+		return err
+	}
+	r.applyRulesInDB(hosts)
+	// After the tagged rules are in place, so hosts are never left without one
+	if err := r.migrateLegacyRules(); err != nil {
+		log.Printf("Persistence/Error: %s", err)
+	}
+	if err := r.applyExceptions(hosts); err != nil {
+		log.Printf("Persistence/Error: %s", err)
+	}
 	return nil
 }
 
-func (r *RulePersistence) readFromFile() error {
-	f, err := os.Open(r.file)
+// SetLegacyRuleProvider has Init delete the untagged host rules of older
+// versions pointing to one of tables, must be called before Init.
+// The saved tables are applied with tagged rules instead.
+func (r *RulePersistence) SetLegacyRuleProvider(p LegacyRuleProvider, tables []string) {
+	r.legacy = p
+	r.legacyTables = tables
+}
+
+// migrateLegacyRules deletes the host rules of older versions, once per store.
+func (r *RulePersistence) migrateLegacyRules() error {
+	if r.legacy == nil {
+		return nil
+	}
+	if r.store != nil {
+		done, err := imported(r.store, "rules")
+		if err != nil || done {
+			return err
+		}
+	}
+	foreign, err := r.legacy.ForeignRules()
+	if err != nil {
+		return err
+	}
+	tables := make(map[string]struct{})
+	for _, t := range r.legacyTables {
+		tables[t] = struct{}{}
+	}
+	for _, f := range foreign {
+		rule, ok := legacyRule(f, tables)
+		if !ok {
+			continue
+		}
+		if err := r.legacy.DeleteLegacyRule(f.Priority, rule); err != nil {
+			return err
+		}
+		log.Printf("Persistence: Removed rule %d: %s of an older version", f.Priority, f.Spec)
+	}
+	if r.store == nil {
+		return nil
+	}
+	return updateStore("import", r.store, func(tx StoreTx) error {
+		return markImported(tx, "rules")
+	})
+}
+
+// readFiles reads all files, legacy entries are migrated using hosts.
+func (r *RulePersistence) readFiles(hosts []Host) error {
+	if err := r.readGroups(); err != nil {
+		return err
+	}
+	if err := r.readSchedules(); err != nil {
+		return err
+	}
+	if err := r.readExceptions(); err != nil {
+		return err
+	}
+	legacy, err := r.readFromFile()
 	if err != nil {
 		return err
 	}
+	if len(legacy) > 0 {
+		r.migrate(legacy, hosts)
+		return r.saveRulesToDB()
+	}
+	return nil
+}
+
+// readFromFile reads the database and returns legacy IP to table entries separately.
+func (r *RulePersistence) readFromFile() (map[string]string, error) {
+	f, err := os.Open(r.file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	legacy := make(map[string]string)
 	br := bufio.NewReader(f)
 	// skip first line
 	br.ReadString('\n')
@@ -55,37 +192,258 @@ func (r *RulePersistence) readFromFile() error {
 		line, err := br.ReadString('\n')
 		if err != nil {
 			if err != io.EOF {
-				return err
+				return nil, err
 			}
 			break
 		}
 		parts := strings.Fields(line)
-		if len(parts) != 2 {
+		switch len(parts) {
+		case 2:
+			legacy[parts[0]] = parts[1]
+		case 3, 5:
+			rule := persRule{
+				IPs:   strings.Split(parts[1], ","),
+				Table: parts[2],
+			}
+			if len(parts) == 5 {
+				if rule.Expires, err = time.Parse(time.RFC3339, parts[3]); err != nil {
+					log.Printf("Persistence: Invalid expiry of %s: %s", parts[0], err)
+					continue
+				}
+				if parts[4] != noTable {
+					rule.Prev = parts[4]
+				}
+			}
+			r.db[parts[0]] = rule
+		}
+	}
+	return legacy, nil
+}
+
+func (r *RulePersistence) migrate(legacy map[string]string, hosts []Host) {
+	for ip, table := range legacy {
+		h, found := hostByIP(hosts, ip)
+		if !found || h.MAC == "" {
+			log.Printf("Persistence: Drop rule for unknown host %s (table %s)", ip, table)
 			continue
 		}
-		ip := strings.TrimSpace(parts[0])
-		table := strings.TrimSpace(parts[1])
-		r.db[ip] = table
+		r.db[h.MAC] = persRule{
+			IPs:   h.Addrs(),
+			Table: table,
+		}
 	}
-	return nil
 }
 
-func (r *RulePersistence) applyRulesInDB() {
-	for ip, table := range r.db {
-		r.base.Set(ip, table)
+// applyRulesInDB applies the rules to the current IPs of the hosts.
+// Saved IPs are left untouched, so rules of old IPs can be found by the Reconciler.
+func (r *RulePersistence) applyRulesInDB(hosts []Host) {
+	for mac, rule := range r.db {
+		ips := rule.IPs
+		if h, found := hostByMAC(hosts, mac); found && len(h.Addrs()) > 0 {
+			ips = h.Addrs()
+		}
+		for _, ip := range ips {
+			r.base.Set(ip, rule.Table)
+		}
 	}
 }
 
 func (r *RulePersistence) saveRulesToDB() error {
+	if r.store != nil {
+		return updateStore("rules", r.store, r.putRules)
+	}
+	macs := make([]string, 0, len(r.db))
+	for mac := range r.db {
+		macs = append(macs, mac)
+	}
+	sort.Strings(macs)
+
 	var buf bytes.Buffer
-	buf.WriteString("IP\tTable\n")
-	for ip, table := range r.db {
-		buf.WriteString(ip)
+	buf.WriteString("MAC\tIP\tTable\tExpires\tPrevious\n")
+	for _, mac := range macs {
+		rule := r.db[mac]
+		buf.WriteString(mac)
+		buf.WriteString("\t")
+		buf.WriteString(strings.Join(rule.IPs, ","))
 		buf.WriteString("\t")
-		buf.WriteString(table)
+		buf.WriteString(rule.Table)
+		if !rule.Expires.IsZero() {
+			prev := rule.Prev
+			if prev == "" {
+				prev = noTable
+			}
+			buf.WriteString("\t")
+			buf.WriteString(rule.Expires.Format(time.RFC3339))
+			buf.WriteString("\t")
+			buf.WriteString(prev)
+		}
 		buf.WriteString("\n")
 	}
-	return ioutil.WriteFile(r.file, buf.Bytes(), 0644)
+	return writeFile("rules", r.file, buf.Bytes())
+}
+
+// Policy returns the saved table of each MAC.
+func (r *RulePersistence) Policy() map[string]string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := make(map[string]string)
+	for mac, rule := range r.db {
+		m[mac] = rule.Table
+	}
+	return m
+}
+
+// snapshot returns the saved rules including group members
+// which were never seen with a table. The caller holds r.mu.
+func (r *RulePersistence) snapshot() map[string]persRule {
+	m := make(map[string]persRule)
+	for mac, rule := range r.db {
+		m[mac] = rule
+	}
+	for _, g := range r.groups {
+		if g.Table == "" {
+			continue
+		}
+		for _, mac := range g.MACs {
+			if _, ok := m[mac]; !ok {
+				m[mac] = persRule{Table: g.Table}
+			}
+		}
+	}
+	return m
+}
+
+// updateIPs saves the current IPs of MACs. The caller holds r.mu.
+func (r *RulePersistence) updateIPs(ips map[string][]string) error {
+	changed := false
+	for mac, ip := range ips {
+		rule, ok := r.db[mac]
+		if ok && strings.Join(rule.IPs, ",") != strings.Join(ip, ",") {
+			rule.IPs = ip
+			r.db[mac] = rule
+			changed = true
+		} else if g, member := groupByMAC(r.groups, mac); !ok && member && g.Table != "" {
+			r.db[mac] = persRule{IPs: ip, Table: g.Table}
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return r.saveRulesToDB()
+}
+
+// SetBatch applies the changes to all addresses of the hosts and saves them once.
+// A change with an empty table deletes the saved table of the host.
+func (r *RulePersistence) SetBatch(changes []Rule) error {
+	return countRuleChange("batch", r.setBatch(changes))
+}
+
+func (r *RulePersistence) setBatch(changes []Rule) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	var expanded []Rule
+	var index []int // change of each expanded rule
+	resolved := make([]Host, len(changes))
+	for i, c := range changes {
+		h, found := hostByIP(hosts, c.IP)
+		if !found || h.MAC == "" {
+			return &BatchError{Index: i, Err: ErrUnknownHost}
+		}
+		addrs := h.Addrs()
+		if c.Table == "" {
+			addrs = appendMissing(addrs, r.db[h.MAC].IPs...)
+		}
+		for _, addr := range addrs {
+			expanded = append(expanded, Rule{IP: addr, Table: c.Table})
+			index = append(index, i)
+		}
+		resolved[i] = h
+	}
+	if err := SetBatch(r.base, expanded); err != nil {
+		if be, ok := err.(*BatchError); ok {
+			return &BatchError{Index: index[be.Index], Err: be.Err}
+		}
+		return err
+	}
+	for i, c := range changes {
+		h := resolved[i]
+		if c.Table == "" {
+			delete(r.db, h.MAC)
+			continue
+		}
+		r.db[h.MAC] = persRule{
+			IPs:   h.Addrs(),
+			Table: c.Table,
+		}
+	}
+	return r.saveRulesToDB()
+}
+
+// Delete removes the saved table of the host currently using ip
+// and the rules of all its addresses.
+func (r *RulePersistence) Delete(ip string) error {
+	return countRuleChange("delete", r.deleteRule(ip))
+}
+
+func (r *RulePersistence) deleteRule(ip string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	addrs := []string{ip}
+	var macs []string
+	if h, found := hostByIP(hosts, ip); found {
+		addrs = appendMissing(addrs, h.Addrs()...)
+		if _, ok := r.db[h.MAC]; ok && h.MAC != "" {
+			addrs = appendMissing(addrs, r.db[h.MAC].IPs...)
+			macs = append(macs, h.MAC)
+		}
+	}
+	// Entries of hosts which used ip before
+	for mac, rule := range r.db {
+		for _, addr := range rule.IPs {
+			if addr == ip {
+				addrs = appendMissing(addrs, rule.IPs...)
+				macs = append(macs, mac)
+				break
+			}
+		}
+	}
+	var changes []Rule
+	for _, addr := range addrs {
+		changes = append(changes, Rule{IP: addr})
+	}
+	if err := r.apply(changes); err != nil {
+		return err
+	}
+	for _, mac := range macs {
+		delete(r.db, mac)
+	}
+	// Members fall back to the table of their group
+	if h, found := hostByIP(hosts, ip); found {
+		if g, member := groupByMAC(r.groups, h.MAC); member && g.Table != "" {
+			return r.setMembersTable([]string{h.MAC}, g.Table)
+		}
+	}
+	return r.saveRulesToDB()
+}
+
+// apply sets the rules of all addresses of a host or none of them.
+func (r *RulePersistence) apply(changes []Rule) error {
+	if err := SetBatch(r.base, changes); err != nil {
+		if be, ok := err.(*BatchError); ok {
+			return be.Err
+		}
+		return err
+	}
+	return nil
 }
 
 // Wrap base
@@ -93,10 +451,48 @@ func (r *RulePersistence) Rules() ([]Rule, error) {
 	return r.base.Rules()
 }
 
+// Set saves the table for the host currently using ip and applies it
+// to all IPv4 and IPv6 addresses of the host.
 func (r *RulePersistence) Set(ip string, table string) error {
+	return countRuleChange("set", r.setUntil(ip, table, time.Time{}))
+}
+
+// SetUntil sets the table of the host until the given time, the previous table is
+// restored by Expire afterwards. A zero time sets the table permanently.
+func (r *RulePersistence) SetUntil(ip string, table string, until time.Time) error {
+	return countRuleChange("temporary", r.setUntil(ip, table, until))
+}
+
+func (r *RulePersistence) setUntil(ip string, table string, until time.Time) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
-	r.db[ip] = table
-	r.saveRulesToDB()
-	return r.base.Set(ip, table)
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	h, found := hostByIP(hosts, ip)
+	if !found || h.MAC == "" {
+		return ErrUnknownHost
+	}
+	rule := persRule{
+		IPs:   h.Addrs(),
+		Table: table,
+	}
+	if !until.IsZero() {
+		rule.Expires = until
+		rule.Prev = r.db[h.MAC].Table
+		// Keep the table of the first override
+		if !r.db[h.MAC].Expires.IsZero() {
+			rule.Prev = r.db[h.MAC].Prev
+		}
+	}
+	var changes []Rule
+	for _, addr := range h.Addrs() {
+		changes = append(changes, Rule{IP: addr, Table: table})
+	}
+	if err := r.apply(changes); err != nil {
+		return err
+	}
+	r.db[h.MAC] = rule
+	return r.saveRulesToDB()
 }
@@ -0,0 +1,246 @@
+package router
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// SetStore saves the rules, groups, schedules and exceptions to s instead of
+// the files, must be called before Init. The files are imported once into a
+// store which has never seen them and are left untouched afterwards.
+func (r *RulePersistence) SetStore(s Store) {
+	r.store = s
+}
+
+type ruleRecord struct {
+	IPs     []string   `json:"ips"`
+	Table   string     `json:"table"`
+	Expires *time.Time `json:"expires,omitempty"`
+	Prev    string     `json:"prev,omitempty"`
+}
+
+type groupRecord struct {
+	MACs  []string `json:"macs"`
+	Table string   `json:"table,omitempty"`
+}
+
+type scheduleRecord struct {
+	MAC   string   `json:"mac,omitempty"`
+	Group string   `json:"group,omitempty"`
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Table string   `json:"table"`
+	Else  string   `json:"else,omitempty"`
+	// Table last applied by the Scheduler, nil if never applied
+	Applied *string `json:"applied,omitempty"`
+}
+
+type exceptionRecord struct {
+	To    string `json:"to"`
+	Proto string `json:"proto,omitempty"`
+	Port  uint16 `json:"port,omitempty"`
+	Table string `json:"table"`
+}
+
+// loadStore reads the store, the files are imported if the store never saw them.
+func (r *RulePersistence) loadStore(hosts []Host) error {
+	done, err := imported(r.store, "persistence")
+	if err != nil {
+		return err
+	}
+	if !done {
+		return r.importFiles(hosts)
+	}
+	return r.store.View(func(tx StoreTx) error {
+		for _, load := range []func(tx StoreTx) error{r.loadRules, r.loadGroups, r.loadSchedules, r.loadExceptions} {
+			if err := load(tx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// importFiles reads the files of an older version and saves them to the store.
+func (r *RulePersistence) importFiles(hosts []Host) error {
+	if err := r.readGroups(); err != nil {
+		return err
+	}
+	if err := r.readSchedules(); err != nil {
+		return err
+	}
+	if err := r.readExceptions(); err != nil {
+		return err
+	}
+	legacy, err := r.readFromFile()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	r.migrate(legacy, hosts)
+	var files []string
+	for _, f := range []string{r.file, r.groupFile, r.scheduleFile, r.exceptionFile} {
+		if f != "" {
+			files = append(files, f)
+		}
+	}
+	return updateStore("import", r.store, func(tx StoreTx) error {
+		for _, put := range []func(tx StoreTx) error{r.putRules, r.putGroups, r.putSchedules, r.putExceptions} {
+			if err := put(tx); err != nil {
+				return err
+			}
+		}
+		return markImported(tx, "persistence", files...)
+	})
+}
+
+func (r *RulePersistence) loadRules(tx StoreTx) error {
+	return tx.ForEach(storeRules, func(mac string, data []byte) error {
+		var rec ruleRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		rule := persRule{IPs: rec.IPs, Table: rec.Table, Prev: rec.Prev}
+		if rec.Expires != nil {
+			rule.Expires = *rec.Expires
+		}
+		r.db[mac] = rule
+		return nil
+	})
+}
+
+func (r *RulePersistence) putRules(tx StoreTx) error {
+	if err := tx.Clear(storeRules); err != nil {
+		return err
+	}
+	for mac, rule := range r.db {
+		rec := ruleRecord{IPs: rule.IPs, Table: rule.Table, Prev: rule.Prev}
+		if !rule.Expires.IsZero() {
+			expires := rule.Expires
+			rec.Expires = &expires
+		}
+		if err := tx.Put(storeRules, mac, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RulePersistence) loadGroups(tx StoreTx) error {
+	return tx.ForEach(storeGroups, func(name string, data []byte) error {
+		var rec groupRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		r.groups[name] = Group{Name: name, MACs: rec.MACs, Table: rec.Table}
+		return nil
+	})
+}
+
+func (r *RulePersistence) putGroups(tx StoreTx) error {
+	if err := tx.Clear(storeGroups); err != nil {
+		return err
+	}
+	for _, g := range r.groups {
+		if err := tx.Put(storeGroups, g.Name, groupRecord{MACs: g.MACs, Table: g.Table}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *RulePersistence) loadSchedules(tx StoreTx) error {
+	return tx.ForEach(storeSchedules, func(name string, data []byte) error {
+		var rec scheduleRecord
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return err
+		}
+		s, err := parseSchedule([]string{name, rec.MAC, rec.Group, strings.Join(rec.Days, ","), rec.Start, rec.End, rec.Table, rec.Else})
+		if err != nil {
+			log.Printf("Persistence: Drop invalid schedule %s: %s", name, err)
+			return nil
+		}
+		r.schedules[s.Name] = s
+		if rec.Applied != nil {
+			r.scheduleApplied[s.Name] = *rec.Applied
+		}
+		return nil
+	})
+}
+
+func (r *RulePersistence) putSchedules(tx StoreTx) error {
+	if err := tx.Clear(storeSchedules); err != nil {
+		return err
+	}
+	for _, s := range r.schedules {
+		rec := scheduleRecord{
+			MAC:   s.MAC,
+			Group: s.Group,
+			Start: s.Start.String(),
+			End:   s.End.String(),
+			Table: s.Table,
+			Else:  s.Else,
+		}
+		for _, d := range s.Days {
+			rec.Days = append(rec.Days, WeekdayName(d))
+		}
+		if applied, ok := r.scheduleApplied[s.Name]; ok {
+			rec.Applied = &applied
+		}
+		if err := tx.Put(storeSchedules, s.Name, rec); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Exceptions are saved by "host/<MAC>" or "group/<name>"
+func (r *RulePersistence) loadExceptions(tx StoreTx) error {
+	return tx.ForEach(storeExceptions, func(key string, data []byte) error {
+		var recs []exceptionRecord
+		if err := json.Unmarshal(data, &recs); err != nil {
+			return err
+		}
+		parts := strings.SplitN(key, "/", 2)
+		if len(parts) != 2 {
+			return nil
+		}
+		m := r.hostExceptions
+		if parts[0] == "group" {
+			m = r.groupExceptions
+		}
+		for _, rec := range recs {
+			e, err := NormalizeException(Rule{To: rec.To, Proto: rec.Proto, Port: rec.Port, Table: rec.Table})
+			if err != nil {
+				log.Printf("Persistence: Drop invalid exception of %s: %s", parts[1], err)
+				continue
+			}
+			m[parts[1]] = append(m[parts[1]], e)
+		}
+		return nil
+	})
+}
+
+func (r *RulePersistence) putExceptions(tx StoreTx) error {
+	if err := tx.Clear(storeExceptions); err != nil {
+		return err
+	}
+	for typ, m := range map[string]map[string][]Rule{"host": r.hostExceptions, "group": r.groupExceptions} {
+		for owner, es := range m {
+			if len(es) == 0 {
+				continue
+			}
+			recs := make([]exceptionRecord, 0, len(es))
+			for _, e := range es {
+				recs = append(recs, exceptionRecord{To: e.To, Proto: e.Proto, Port: e.Port, Table: e.Table})
+			}
+			if err := tx.Put(storeExceptions, typ+"/"+owner, recs); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,151 @@
+package router
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRulePersistenceStore(t *testing.T) {
+	assert := assert.New(t)
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	const macA, macB, macC = "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03"
+	expires := time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC)
+	files := map[string]string{
+		"db.txt": "MAC\tIP\tTable\tExpires\tPrevious\n" +
+			macA + "\t10.0.0.1\tvpn\n" +
+			macB + "\t10.0.0.2\tnull\t" + expires.Format(time.RFC3339) + "\t-\n" +
+			// Entry of the IP based format
+			"10.0.0.3\tdefgw\n",
+		"groups.txt":     "Group\tMAC\tTable\nkids\t" + macB + "\tnull\n",
+		"schedules.txt":  "Name\tMAC\tGroup\tDays\tStart\tEnd\tTable\tElse\nnight\t\tkids\tmon,tue\t22:00\t07:00\tnull\tdefgw\n",
+		"exceptions.txt": "Type\tOwner\tTo\tProto\tPort\tTable\nhost\t" + macA + "\t10.0.0.0/8\ttcp\t443\tdefgw\n",
+	}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatalf("Error: %s", err)
+		}
+	}
+	hosts := mockHostProvider{
+		{IP: "10.0.0.1", MAC: macA},
+		{IP: "10.0.0.2", MAC: macB},
+		{IP: "10.0.0.3", MAC: macC},
+	}
+	newPersistence := func(kernel DummyRuleProvider) *RulePersistence {
+		rp := NewRulePersistence(kernel, hosts, filepath.Join(dir, "db.txt"))
+		rp.SetStore(store)
+		rp.SetGroupFile(filepath.Join(dir, "groups.txt"))
+		rp.SetScheduleFile(filepath.Join(dir, "schedules.txt"))
+		rp.SetExceptionFile(filepath.Join(dir, "exceptions.txt"))
+		rp.SetExceptionProvider(make(DummyExceptions))
+		if err := rp.Init(); err != nil {
+			t.Fatalf("Error on init: %s", err)
+		}
+		return rp
+	}
+
+	kernel := make(DummyRuleProvider)
+	rp := newPersistence(kernel)
+	assert.Equal(DummyRuleProvider{"10.0.0.1": "vpn", "10.0.0.2": "null", "10.0.0.3": "defgw"}, kernel, "Files imported")
+	assert.Equal(map[string]persRule{
+		macA: {IPs: []string{"10.0.0.1"}, Table: "vpn"},
+		macB: {IPs: []string{"10.0.0.2"}, Table: "null", Expires: expires},
+		macC: {IPs: []string{"10.0.0.3"}, Table: "defgw"},
+	}, rp.db)
+	imported := rp.Groups()
+	assert.Equal([]Group{{Name: "kids", MACs: []string{macB}, Table: "null"}}, imported)
+
+	// Changes go to the store only
+	assert.Nil(rp.Set("10.0.0.3", "vpn"))
+	assert.Nil(rp.SetSchedule(Schedule{Name: "day", MAC: macA, Start: 8 * 60, End: 12 * 60, Table: "defgw"}))
+	assert.Nil(rp.setAppliedTable("day", ""))
+	for name, content := range files {
+		data, _ := ioutil.ReadFile(filepath.Join(dir, name))
+		assert.Equal(content, string(data), "%s untouched", name)
+	}
+
+	// The files are imported only once
+	os.Remove(filepath.Join(dir, "groups.txt"))
+	kernel2 := make(DummyRuleProvider)
+	rp2 := newPersistence(kernel2)
+	assert.Equal(DummyRuleProvider{"10.0.0.1": "vpn", "10.0.0.2": "null", "10.0.0.3": "vpn"}, kernel2)
+	assert.Equal(rp.db, rp2.db)
+	assert.Equal(imported, rp2.Groups())
+	assert.Equal(rp.Schedules(), rp2.Schedules())
+	assert.Len(rp2.Schedules(), 2)
+	assert.Equal(map[string]string{"day": ""}, rp2.scheduleApplied)
+	own, _ := rp2.HostExceptions(macA)
+	assert.Equal([]Rule{{To: "10.0.0.0/8", Proto: "tcp", Port: 443, Table: "defgw"}}, own)
+}
+
+type mockLegacyRules struct {
+	foreign []ForeignRule
+	deleted []string
+}
+
+func (m *mockLegacyRules) ForeignRules() ([]ForeignRule, error) {
+	return m.foreign, nil
+}
+
+func (m *mockLegacyRules) DeleteLegacyRule(prio uint32, r Rule) error {
+	m.deleted = append(m.deleted, fmt.Sprintf("%d %s %s", prio, r.IP, r.Table))
+	return nil
+}
+
+func TestRulePersistenceLegacyRules(t *testing.T) {
+	assert := assert.New(t)
+	store, _, cleanup := tempStore(t)
+	defer cleanup()
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "db.txt")
+	ioutil.WriteFile(dbFile, []byte("MAC\tIP\tTable\naa:bb:cc:dd:ee:01\t10.0.0.1\tvpn\n"), 0644)
+	hosts := mockHostProvider{{IP: "10.0.0.1", MAC: "aa:bb:cc:dd:ee:01"}}
+	legacy := &mockLegacyRules{foreign: []ForeignRule{
+		{Priority: 0, Spec: "from all lookup local"},
+		{Priority: 32764, Spec: "from 10.0.0.2 lookup null"},
+		{Priority: 32765, Spec: "from 10.0.0.1 lookup vpn"},
+		{Priority: 32765, Spec: "from 10.0.0.3 lookup other"},
+		{Priority: 32765, Spec: "from 10.0.0.0/24 lookup vpn"},
+		{Priority: 32765, Spec: "from 10.0.0.4 iif eth0 lookup vpn"},
+		{Priority: 32765, Spec: "from fd00::1 lookup vpn", IPv6: true},
+		{Priority: 32766, Spec: "from all lookup main"},
+	}}
+
+	init := func(s Store) DummyRuleProvider {
+		kernel := make(DummyRuleProvider)
+		rp := NewRulePersistence(kernel, hosts, dbFile)
+		if s != nil {
+			rp.SetStore(s)
+		}
+		rp.SetLegacyRuleProvider(legacy, []string{"null", "defgw", "vpn"})
+		if err := rp.Init(); err != nil {
+			t.Fatalf("Error on init: %s", err)
+		}
+		return kernel
+	}
+	assert.Equal(DummyRuleProvider{"10.0.0.1": "vpn"}, init(nil), "Saved tables applied with tagged rules")
+	assert.Equal([]string{"32764 10.0.0.2 null", "32765 10.0.0.1 vpn", "32765 fd00::1 vpn"}, legacy.deleted)
+
+	legacy.deleted = nil
+	init(store)
+	assert.Len(legacy.deleted, 3)
+	legacy.deleted = nil
+	init(store)
+	assert.Nil(legacy.deleted, "Migrated once per store")
+}
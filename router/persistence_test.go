@@ -1,9 +1,11 @@
 package router
 
 import (
+	"errors"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"sort"
 	"strings"
 	"testing"
 )
@@ -11,6 +13,7 @@ import (
 type mockRuleProvider struct {
 	getFn func() ([]Rule, error)
 	setFn func(ip, table string) error
+	delFn func(ip string) error
 }
 
 func (m *mockRuleProvider) Rules() ([]Rule, error) {
@@ -21,18 +24,68 @@ func (m *mockRuleProvider) Set(ip, table string) error {
 	return m.setFn(ip, table)
 }
 
-func TestRulePersistence(t *testing.T) {
+func (m *mockRuleProvider) Delete(ip string) error {
+	return m.delFn(ip)
+}
+
+type rulesByIP []Rule
+
+func (a rulesByIP) Len() int           { return len(a) }
+func (a rulesByIP) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a rulesByIP) Less(i, j int) bool { return a[i].IP < a[j].IP }
+
+func sortedRules(rs []Rule) []Rule {
+	sorted := append([]Rule(nil), rs...)
+	sort.Sort(rulesByIP(sorted))
+	return sorted
+}
+
+type mockHostProvider []Host
+
+func (m mockHostProvider) Hosts() ([]Host, error) {
+	return m, nil
+}
+
+// recordingRuleProvider returns a mock which appends all set rules to setrules
+func recordingRuleProvider(rules []Rule, setrules *[]Rule) *mockRuleProvider {
+	return &mockRuleProvider{
+		getFn: func() ([]Rule, error) {
+			return rules, nil
+		},
+		setFn: func(ip, table string) error {
+			*setrules = append(*setrules, Rule{
+				IP:    ip,
+				Table: table,
+			})
+			return nil
+		},
+	}
+}
+
+func tempDB(t *testing.T, content string) string {
 	f, err := ioutil.TempFile("", "")
 	if err != nil {
 		t.Fatalf("Error: %s", err)
 	}
 	f.Close()
-	defer os.Remove(f.Name())
+	if err := ioutil.WriteFile(f.Name(), []byte(content), 0666); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	return f.Name()
+}
+
+func TestRulePersistence(t *testing.T) {
+	file := tempDB(t, "")
+	defer os.Remove(file)
 
 	rules := []Rule{
 		{IP: "1", Table: "1"},
 		{IP: "2", Table: "2"},
 	}
+	hosts := mockHostProvider{
+		{IP: "3", MAC: "c"},
+		{IP: "4", MAC: "d"},
+	}
 
 	expRules := []Rule{
 		{IP: "3", Table: "3"},
@@ -42,24 +95,13 @@ func TestRulePersistence(t *testing.T) {
 	//save set rules
 	setrules := []Rule{}
 
-	mock := &mockRuleProvider{
-		getFn: func() ([]Rule, error) {
-			return rules, nil
-		},
-		setFn: func(ip, table string) error {
-			setrules = append(setrules, Rule{
-				IP:    ip,
-				Table: table,
-			})
-			return nil
-		},
-	}
-	rp := NewRulePersistence(mock, f.Name())
+	mock := recordingRuleProvider(rules, &setrules)
+	rp := NewRulePersistence(mock, hosts, file)
 	if err := rp.Init(); err != nil {
 		t.Fatalf("Error on init: %s", err)
 	}
 	if rs, err := rp.Rules(); err != nil || !reflect.DeepEqual(rs, rules) {
-		t.Errorf("Wrong rules (error: %s):  %s", err, rs)
+		t.Errorf("Wrong rules (error: %v):  %v", err, rs)
 	}
 
 	if err := rp.Set("3", "3"); err != nil {
@@ -68,32 +110,226 @@ func TestRulePersistence(t *testing.T) {
 	if err := rp.Set("4", "4"); err != nil {
 		t.Errorf("Error on set: %s", err)
 	}
+	if err := rp.Set("5", "5"); err != ErrUnknownHost {
+		t.Errorf("Expected unknown host, got: %s", err)
+	}
 
 	if !reflect.DeepEqual(setrules, expRules) {
-		t.Errorf("Invalid tables saved: %s", setrules)
+		t.Errorf("Invalid tables saved: %v", setrules)
 	}
 
-	bs, err := ioutil.ReadFile(f.Name())
+	bs, err := ioutil.ReadFile(file)
 	if err != nil {
 		t.Fatalf("Error reading file: %s", err)
 	}
 
 	str := string(bs)
 	indexSecondLine := strings.Index(str, "\n") + 1
-	if str[indexSecondLine:] != "3\t3\n4\t4\n" {
+	if str[indexSecondLine:] != "c\t3\t3\nd\t4\t4\n" {
 		t.Errorf("Invalid file contents: %s", str)
 	}
 
 	// Reset set rules
 	setrules = []Rule{}
-	// Create new RP
-	rp = NewRulePersistence(mock, f.Name())
+	// Create new RP, host c got a new IP in the meantime
+	hosts[0].IP = "5"
+	rp = NewRulePersistence(mock, hosts, file)
 	if err := rp.Init(); err != nil {
 		t.Errorf("Error on second init: %s", err)
 	}
 
-	if !reflect.DeepEqual(setrules, expRules) {
-		t.Errorf("Invalid tables imported: %s", setrules)
+	expRules = []Rule{
+		{IP: "5", Table: "3"},
+		{IP: "4", Table: "4"},
+	}
+	if !reflect.DeepEqual(sortedRules(setrules), sortedRules(expRules)) {
+		t.Errorf("Invalid tables imported: %v", setrules)
+	}
+}
+
+func TestRulePersistenceMigration(t *testing.T) {
+	file := tempDB(t, "IP\tTable\n1\tvpn\n2\tdefgw\n")
+	defer os.Remove(file)
+
+	hosts := mockHostProvider{
+		{IP: "1", MAC: "a"},
+	}
+	setrules := []Rule{}
+	rp := NewRulePersistence(recordingRuleProvider(nil, &setrules), hosts, file)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	// Rule for unknown host 2 is dropped
+	if exp := []Rule{{IP: "1", Table: "vpn"}}; !reflect.DeepEqual(setrules, exp) {
+		t.Errorf("Invalid tables imported: %v", setrules)
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	if str := string(bs); str != "MAC\tIP\tTable\tExpires\tPrevious\na\t1\tvpn\n" {
+		t.Errorf("Invalid file contents: %s", str)
+	}
+}
+
+func TestRulePersistenceIP6(t *testing.T) {
+	file := tempDB(t, "")
+	defer os.Remove(file)
+
+	hosts := mockHostProvider{
+		{IP: "1", IP6: []string{"2001:db8::1"}, MAC: "a"},
+	}
+	setrules := []Rule{}
+	rp := NewRulePersistence(recordingRuleProvider(nil, &setrules), hosts, file)
+	rp.Init()
+
+	// Both families are routed to the same table
+	if err := rp.Set("2001:db8::1", "vpn"); err != nil {
+		t.Fatalf("Error on set: %s", err)
+	}
+	if exp := []Rule{{IP: "1", Table: "vpn"}, {IP: "2001:db8::1", Table: "vpn"}}; !reflect.DeepEqual(setrules, exp) {
+		t.Errorf("Invalid rules set: %v", setrules)
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	if str := string(bs); str != "MAC\tIP\tTable\tExpires\tPrevious\na\t1,2001:db8::1\tvpn\n" {
+		t.Errorf("Invalid file contents: %s", str)
+	}
+}
+
+// failingAddrProvider fails to change the rule of a single address
+type failingAddrProvider struct {
+	DummyRuleProvider
+	ip string
+}
+
+func (p failingAddrProvider) Set(ip, table string) error {
+	if ip == p.ip {
+		return errors.New("failed")
+	}
+	return p.DummyRuleProvider.Set(ip, table)
+}
+
+func (p failingAddrProvider) Delete(ip string) error {
+	if ip == p.ip {
+		return errors.New("failed")
+	}
+	return p.DummyRuleProvider.Delete(ip)
+}
+
+func TestRulePersistenceKernelFailure(t *testing.T) {
+	file := tempDB(t, "MAC\tIP\tTable\na\t1,2001:db8::1\tvpn\n")
+	defer os.Remove(file)
+
+	hosts := mockHostProvider{
+		{IP: "1", IP6: []string{"2001:db8::1"}, MAC: "a"},
+	}
+	kernel := DummyRuleProvider{}
+	rp := NewRulePersistence(kernel, hosts, file)
+	rp.Init()
+	p := failingAddrProvider{kernel, "2001:db8::1"}
+	rp.base = p
+
+	if err := rp.Set("1", "null"); err == nil {
+		t.Error("Expected error on set")
+	}
+	if err := rp.Delete("1"); err == nil {
+		t.Error("Expected error on delete")
+	}
+	if exp := (DummyRuleProvider{"1": "vpn", "2001:db8::1": "vpn"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Host half applied: %v", kernel)
+	}
+	if exp := (map[string]string{"a": "vpn"}); !reflect.DeepEqual(rp.Policy(), exp) {
+		t.Errorf("Saved table changed: %v", rp.Policy())
+	}
+}
+
+func TestRulePersistenceDelete(t *testing.T) {
+	file := tempDB(t, "MAC\tIP\tTable\na\t1,2001:db8::1\tvpn\nb\t2\tdefgw\n")
+	defer os.Remove(file)
+
+	hosts := mockHostProvider{
+		{IP: "1", IP6: []string{"2001:db8::1"}, MAC: "a"},
+		{IP: "2", MAC: "b"},
+	}
+	deleted := []string{}
+	mock := &mockRuleProvider{
+		getFn: func() ([]Rule, error) { return nil, nil },
+		setFn: func(ip, table string) error { return nil },
+		delFn: func(ip string) error {
+			deleted = append(deleted, ip)
+			return nil
+		},
+	}
+	rp := NewRulePersistence(mock, hosts, file)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+
+	if err := rp.Delete("1"); err != nil {
+		t.Fatalf("Error on delete: %s", err)
+	}
+	if exp := []string{"1", "2001:db8::1"}; !reflect.DeepEqual(deleted, exp) {
+		t.Errorf("Invalid rules deleted: %s", deleted)
 	}
+	if exp := map[string]string{"b": "defgw"}; !reflect.DeepEqual(rp.Policy(), exp) {
+		t.Errorf("Invalid policy: %v", rp.Policy())
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	if str := string(bs); str != "MAC\tIP\tTable\tExpires\tPrevious\nb\t2\tdefgw\n" {
+		t.Errorf("Invalid file contents: %s", str)
+	}
+}
+
+func TestRulePersistenceSetBatch(t *testing.T) {
+	file := tempDB(t, "MAC\tIP\tTable\nb\t2\tdefgw\n")
+	defer os.Remove(file)
 
+	hosts := mockHostProvider{
+		{IP: "1", IP6: []string{"2001:db8::1"}, MAC: "a"},
+		{IP: "2", MAC: "b"},
+		{IP: "3", MAC: "c"},
+	}
+	kernel := failingRuleProvider{DummyRuleProvider{"2": "defgw"}}
+	rp := NewRulePersistence(kernel, hosts, file)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	readDB := func() string {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			t.Fatalf("Error reading file: %s", err)
+		}
+		return string(bs)
+	}
+
+	err := rp.SetBatch([]Rule{{IP: "1", Table: "vpn"}, {IP: "3", Table: "fail"}})
+	if be, ok := err.(*BatchError); !ok || be.Index != 1 {
+		t.Errorf("Expected error of change 2, got %v", err)
+	}
+	err = rp.SetBatch([]Rule{{IP: "1", Table: "vpn"}, {IP: "4", Table: "vpn"}})
+	if be, ok := err.(*BatchError); !ok || be.Index != 1 || be.Err != ErrUnknownHost {
+		t.Errorf("Expected unknown host error of change 2, got %v", err)
+	}
+	if exp := (DummyRuleProvider{"2": "defgw"}); !reflect.DeepEqual(kernel.DummyRuleProvider, exp) {
+		t.Errorf("Failed batch applied: %v", kernel.DummyRuleProvider)
+	}
+	if str := readDB(); str != "MAC\tIP\tTable\nb\t2\tdefgw\n" {
+		t.Errorf("Failed batch saved: %s", str)
+	}
+
+	if err := rp.SetBatch([]Rule{{IP: "2001:db8::1", Table: "vpn"}, {IP: "2", Table: ""}, {IP: "3", Table: "defgw"}}); err != nil {
+		t.Fatalf("Error on batch: %s", err)
+	}
+	if exp := (DummyRuleProvider{"1": "vpn", "2001:db8::1": "vpn", "3": "defgw"}); !reflect.DeepEqual(kernel.DummyRuleProvider, exp) {
+		t.Errorf("Invalid rules: %v", kernel.DummyRuleProvider)
+	}
+	if str := readDB(); str != "MAC\tIP\tTable\tExpires\tPrevious\na\t1,2001:db8::1\tvpn\nc\t3\tdefgw\n" {
+		t.Errorf("Invalid file contents: %s", str)
+	}
 }
@@ -0,0 +1,167 @@
+package router
+
+import (
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PriorityRange is the range of rule priorities owned by vpnrouter.
+type PriorityRange struct {
+	Min, Max uint32
+}
+
+// DefaultPriorities leaves room for other tools below and the main table above.
+var DefaultPriorities = PriorityRange{Min: 10000, Max: 10999}
+
+// DefaultRuleProtocol tags the rules of vpnrouter. It is not named in the
+// rt_protos of iproute2, so ip prints it as number.
+const DefaultRuleProtocol = 86
+
+func (r PriorityRange) Contains(prio uint32) bool {
+	return prio >= r.Min && prio <= r.Max
+}
+
+// Host returns the priority of host rules. It is the last of the range,
+// so more specific rules of vpnrouter can precede them.
+func (r PriorityRange) Host() uint32 {
+	return r.Max
+}
+
+// Exception returns the priority of exceptions, right before the host rules.
+// A range of a single priority has exceptions and host rules share it.
+func (r PriorityRange) Exception() uint32 {
+	if r.Max > r.Min {
+		return r.Max - 1
+	}
+	return r.Max
+}
+
+// Domain returns the priority of the fwmark rules of domain policies, right
+// before the exceptions. Small ranges have them share the first priority.
+func (r PriorityRange) Domain() uint32 {
+	if r.Max-r.Min >= 2 {
+		return r.Max - 2
+	}
+	return r.Min
+}
+
+// ForeignRule is a rule not managed by vpnrouter, like the default rules of
+// the kernel or those of other tools.
+type ForeignRule struct {
+	Priority uint32
+	// Rule as printed by ip rule, like "from all lookup main"
+	Spec string
+	IPv6 bool
+}
+
+// ForeignRuleProvider lists the rules outside of the managed range or without its tag.
+type ForeignRuleProvider interface {
+	ForeignRules() ([]ForeignRule, error)
+}
+
+// LegacyRuleProvider deletes the host rules of older versions, which were
+// installed without tag at the priority picked by the kernel.
+type LegacyRuleProvider interface {
+	ForeignRuleProvider
+	// DeleteLegacyRule deletes the untagged host rule r at prio
+	DeleteLegacyRule(prio uint32, r Rule) error
+}
+
+// legacyRule returns the host rule of an older version, like
+// "from 10.0.0.1 lookup vpn" before the main table, if f is one
+// pointing to one of tables.
+func legacyRule(f ForeignRule, tables map[string]struct{}) (Rule, bool) {
+	parts := strings.Fields(f.Spec)
+	// 32766 is the rule of the main table
+	if len(parts) != 4 || parts[0] != "from" || parts[2] != "lookup" || f.Priority == 0 || f.Priority >= 32766 {
+		return Rule{}, false
+	}
+	if _, ok := tables[parts[3]]; !ok || net.ParseIP(parts[1]) == nil {
+		return Rule{}, false
+	}
+	return Rule{IP: parts[1], Table: parts[3]}, true
+}
+
+// parseRuleLines splits the output of ip rule show into the host rules and
+// exceptions owned by vpnrouter and all other rules. A rule is owned if its
+// priority is in prios, it is tagged with proto and matches nothing but its
+// source address and the destination of an exception.
+func parseRuleLines(s string, prios PriorityRange, proto uint8, ipv6 bool) ([]Rule, []ForeignRule) {
+	var rules []Rule
+	var foreign []ForeignRule
+	for _, line := range strings.Split(s, "\n") {
+		parts := strings.Fields(line)
+		if len(parts) < 2 || !strings.HasSuffix(parts[0], ":") {
+			continue
+		}
+		prio, err := strconv.ParseUint(strings.TrimSuffix(parts[0], ":"), 10, 32)
+		if err != nil {
+			continue
+		}
+		tag := ""
+		if proto != 0 {
+			tag = strconv.Itoa(int(proto))
+		}
+		if rule, ok := parseOwnedRule(parts[1:], tag); ok && prios.Contains(uint32(prio)) {
+			rules = append(rules, rule)
+			continue
+		}
+		foreign = append(foreign, ForeignRule{
+			Priority: uint32(prio),
+			Spec:     strings.Join(parts[1:], " "),
+			IPv6:     ipv6,
+		})
+	}
+	return rules, foreign
+}
+
+// parseOwnedRule parses a rule of vpnrouter as printed by ip rule show, like
+// "from 10.0.0.1 to 10.0.0.0/8 ipproto tcp dport 443 lookup vpn proto 86".
+func parseOwnedRule(parts []string, tag string) (Rule, bool) {
+	if tag != "" {
+		if len(parts) < 2 || parts[len(parts)-2] != "proto" || parts[len(parts)-1] != tag {
+			return Rule{}, false
+		}
+		parts = parts[:len(parts)-2]
+	}
+	if len(parts) < 4 || parts[0] != "from" || parts[1] == "all" || parts[len(parts)-2] != "lookup" {
+		return Rule{}, false
+	}
+	r := Rule{IP: parts[1], Table: parts[len(parts)-1]}
+	for opts := parts[2 : len(parts)-2]; len(opts) > 0; opts = opts[2:] {
+		if len(opts) < 2 {
+			return Rule{}, false
+		}
+		switch opts[0] {
+		case "to":
+			r.To = hostPrefix(opts[1])
+		case "ipproto":
+			r.Proto = opts[1]
+		case "dport":
+			port, err := strconv.ParseUint(opts[1], 10, 16)
+			if err != nil {
+				return Rule{}, false
+			}
+			r.Port = uint16(port)
+		default:
+			return Rule{}, false
+		}
+	}
+	if r.To == "" && (r.Proto != "" || r.Port != 0) {
+		return Rule{}, false
+	}
+	return r, true
+}
+
+// hostPrefix adds the length of a single address to prefixes without one,
+// ip omits it when printing rules.
+func hostPrefix(s string) string {
+	if strings.Contains(s, "/") {
+		return s
+	}
+	if strings.Contains(s, ":") {
+		return s + "/128"
+	}
+	return s + "/32"
+}
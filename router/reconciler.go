@@ -0,0 +1,222 @@
+package router
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ReconcileResult describes a single reconcile run and the drift it fixed.
+type ReconcileResult struct {
+	Time    time.Time
+	Added   []Rule
+	Moved   []Rule
+	Removed []Rule
+	// Strict tables whose kill switch had to be restored
+	KillSwitches []string
+	Err          error
+}
+
+// Drift returns true if any rule had to be changed.
+func (r ReconcileResult) Drift() bool {
+	return len(r.Added) > 0 || len(r.Moved) > 0 || len(r.Removed) > 0 || len(r.KillSwitches) > 0
+}
+
+// Reconciler keeps the rules of the kernel in sync with the saved policy
+// of each host, e.g. if a host gets a new IP by DHCP.
+type Reconciler struct {
+	hosts   HostProvider
+	policy  *RulePersistence
+	rules   RuleProvider
+	strict  *StrictRuleProvider
+	events  *EventBus
+	trigger chan struct{}
+
+	mu   sync.Mutex
+	last ReconcileResult
+}
+
+// NewReconciler compares the hosts with the policy and applies the differences to rules.
+// The rules should not be wrapped by the policy itself.
+func NewReconciler(hosts HostProvider, policy *RulePersistence, rules RuleProvider) *Reconciler {
+	return &Reconciler{
+		hosts:   hosts,
+		policy:  policy,
+		rules:   rules,
+		trigger: make(chan struct{}, 1),
+	}
+}
+
+// SetStrict lets every reconcile verify the kill switches of strict tables.
+func (r *Reconciler) SetStrict(s *StrictRuleProvider) {
+	r.strict = s
+}
+
+// SetEventBus publishes the result of every reconcile run.
+func (r *Reconciler) SetEventBus(events *EventBus) {
+	r.events = events
+}
+
+// Watch triggers a reconcile whenever one of the files changes.
+func (r *Reconciler) Watch(files ...string) error {
+	return watchFiles(files, r.Trigger)
+}
+
+// Trigger requests a reconcile without waiting for the next interval.
+func (r *Reconciler) Trigger() {
+	select {
+	case r.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run reconciles every interval and on every trigger until stop is closed.
+func (r *Reconciler) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-r.trigger:
+		}
+		res := r.Reconcile()
+		if res.Err != nil {
+			log.Printf("Reconcile/Error: %s", res.Err)
+		} else if res.Drift() {
+			log.Printf("Reconcile: added %v, moved %v, removed %v, restored kill switches %v", res.Added, res.Moved, res.Removed, res.KillSwitches)
+		}
+	}
+}
+
+// LastResult returns the result of the last reconcile run.
+func (r *Reconciler) LastResult() ReconcileResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.last
+}
+
+// Reconcile adds rules for hosts with a saved table, moves rules pointing
+// to the wrong table and deletes rules of IPs without a saved table.
+// Exceptions are synced with the saved exceptions the same way.
+func (r *Reconciler) Reconcile() ReconcileResult {
+	res := ReconcileResult{Time: time.Now()}
+	res.Err = r.reconcile(&res)
+	r.mu.Lock()
+	r.last = res
+	r.mu.Unlock()
+	recordSystem(r.policy.audit, "reconcile", nil, reconcileAudit(res)...)
+	r.events.Publish(Event{Type: EventReconciled, Time: res.Time, Reconcile: &res})
+	return res
+}
+
+// reconcileAudit returns the entries of the host rules repaired by res.
+func reconcileAudit(res ReconcileResult) []AuditEntry {
+	var entries []AuditEntry
+	for _, rules := range [][]Rule{res.Added, res.Moved} {
+		for _, rule := range rules {
+			if rule.To == "" {
+				entries = append(entries, AuditEntry{Action: "reconcile", IP: rule.IP, NewTable: rule.Table})
+			}
+		}
+	}
+	for _, rule := range res.Removed {
+		if rule.To == "" {
+			entries = append(entries, AuditEntry{Action: "reconcile", IP: rule.IP, OldTable: rule.Table})
+		}
+	}
+	return entries
+}
+
+func (r *Reconciler) reconcile(res *ReconcileResult) error {
+	if r.strict != nil {
+		restored, err := r.strict.Verify()
+		res.KillSwitches = restored
+		if err != nil {
+			return err
+		}
+	}
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	// Changes of the policy during the repair would be reverted
+	r.policy.mu.Lock()
+	defer r.policy.mu.Unlock()
+	rules, err := r.rules.Rules()
+	if err != nil {
+		return err
+	}
+	current := ruleMap(rules)
+	db := r.policy.snapshot()
+
+	desired := make(map[string]string) // IP to table
+	ips := make(map[string][]string)   // MAC to current IPs
+	for mac, rule := range db {
+		h, found := hostByMAC(hosts, mac)
+		if !found || len(h.Addrs()) == 0 {
+			continue
+		}
+		for _, addr := range h.Addrs() {
+			desired[addr] = rule.Table
+		}
+		ips[mac] = h.Addrs()
+	}
+
+	// IPs left by moved hosts and hosts without a saved table
+	var stale []string
+	for mac, rule := range db {
+		if _, ok := ips[mac]; ok {
+			stale = append(stale, rule.IPs...)
+		}
+	}
+	for _, h := range hosts {
+		stale = append(stale, h.Addrs()...)
+	}
+	sort.Strings(stale)
+	for _, ip := range stale {
+		if _, ok := desired[ip]; ok {
+			continue
+		}
+		rule, ok := current[ip]
+		if !ok {
+			continue
+		}
+		if err := r.rules.Delete(ip); err != nil {
+			return err
+		}
+		delete(current, ip)
+		res.Removed = append(res.Removed, rule)
+	}
+
+	desiredIPs := make([]string, 0, len(desired))
+	for ip := range desired {
+		desiredIPs = append(desiredIPs, ip)
+	}
+	sort.Strings(desiredIPs)
+	for _, ip := range desiredIPs {
+		table := desired[ip]
+		rule, ok := current[ip]
+		if ok && rule.Table == table {
+			continue
+		}
+		if err := r.rules.Set(ip, table); err != nil {
+			return err
+		}
+		if ok {
+			res.Moved = append(res.Moved, Rule{IP: ip, Table: table})
+		} else {
+			res.Added = append(res.Added, Rule{IP: ip, Table: table})
+		}
+	}
+	added, moved, removed, err := r.policy.syncExceptions(hosts)
+	res.Added = append(res.Added, added...)
+	res.Moved = append(res.Moved, moved...)
+	res.Removed = append(res.Removed, removed...)
+	if err != nil {
+		return err
+	}
+	return r.policy.updateIPs(ips)
+}
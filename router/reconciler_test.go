@@ -0,0 +1,106 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReconcile(t *testing.T) {
+	assert := assert.New(t)
+	file := tempDB(t, "MAC\tIP\tTable\na\t1\tvpn\nb\t2\tdefgw\n")
+	defer os.Remove(file)
+
+	// a moved to a new IP, b took the old IP of a, c has no saved table
+	hosts := mockHostProvider{
+		{IP: "3", MAC: "a"},
+		{IP: "1", MAC: "b"},
+		{IP: "4", MAC: "c"},
+	}
+	kernel := DummyRuleProvider{
+		"1":   "vpn",
+		"2":   "defgw",
+		"4":   "vpn",
+		"all": "main",
+	}
+	policy := NewRulePersistence(make(DummyRuleProvider), hosts, file)
+	if err := policy.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+
+	rec := NewReconciler(hosts, policy, kernel)
+	res := rec.Reconcile()
+	assert.Nil(res.Err)
+	assert.True(res.Drift())
+	assert.Equal([]Rule{{IP: "3", Table: "vpn"}}, res.Added)
+	assert.Equal([]Rule{{IP: "1", Table: "defgw"}}, res.Moved)
+	assert.Equal([]Rule{{IP: "2", Table: "defgw"}, {IP: "4", Table: "vpn"}}, res.Removed)
+	assert.Equal(res, rec.LastResult())
+
+	assert.Equal(DummyRuleProvider{
+		"1":   "defgw",
+		"3":   "vpn",
+		"all": "main",
+	}, kernel)
+
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	assert.Equal("MAC\tIP\tTable\tExpires\tPrevious\na\t3\tvpn\nb\t1\tdefgw\n", string(bs), "Current IPs saved")
+
+	res = rec.Reconcile()
+	assert.Nil(res.Err)
+	assert.False(res.Drift())
+}
+
+func TestReconcileKillSwitch(t *testing.T) {
+	assert := assert.New(t)
+	file := tempDB(t, "MAC\tIP\tTable\n")
+	defer os.Remove(file)
+
+	policy := NewRulePersistence(make(DummyRuleProvider), mockHostProvider{}, file)
+	if err := policy.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	ks := DummyKillSwitch{"vpn": true}
+	rec := NewReconciler(mockHostProvider{}, policy, make(DummyRuleProvider))
+	rec.SetStrict(NewStrictRuleProvider(make(DummyRuleProvider), ks, []string{"vpn", "vpn2"}))
+	res := rec.Reconcile()
+	assert.Nil(res.Err)
+	assert.True(res.Drift())
+	assert.Equal([]string{"vpn2"}, res.KillSwitches)
+	assert.Equal(DummyKillSwitch{"vpn": true, "vpn2": true}, ks)
+
+	res = rec.Reconcile()
+	assert.False(res.Drift())
+}
+
+func TestReconcilerWatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "leases")
+
+	rec := NewReconciler(mockHostProvider{}, nil, make(DummyRuleProvider))
+	if err := rec.Watch(file); err != nil {
+		t.Fatalf("Error on watch: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("x"), 0666); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	if err := ioutil.WriteFile(file, []byte("x"), 0666); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	select {
+	case <-rec.trigger:
+	case <-time.After(time.Second):
+		t.Fatal("No reconcile triggered")
+	}
+}
@@ -1,28 +1,119 @@
 package router
 
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+// DefaultTable is reported for hosts without a rule. No rule is installed
+// for it, the kernel routes such hosts by its main table.
+const DefaultTable = "null"
+
+// ErrUnknownHost is returned if no host is known for an IP.
+var ErrUnknownHost = errors.New("unknown host")
+
 type Route struct {
 	IP    string
 	Table string
 	Lease Host
+	// Group of the host, if any
+	Group string
+	// Next scheduled change, if any
+	Next *ScheduledChange
+	// Expiry of a temporary table, zero if permanent
+	Expires time.Time
+	// Exceptions of the host and of its group, without IP
+	Exceptions      []Rule
+	GroupExceptions []Rule
 }
 
 type Router interface {
 	Routes() ([]Route, error)
 	SetRoute(ip string, table string) error
+	// SetTemporaryRoute sets the table until the given time, the previous table is restored afterwards
+	SetTemporaryRoute(ip string, table string, until time.Time) error
+	// DeleteRoute removes the rules of the host, the kernel routes it by the main table
+	DeleteRoute(ip string) error
+	// SetRoutes applies all changes or none, an empty table deletes the route
+	SetRoutes(changes []Rule) error
+
+	Groups() ([]Group, error)
+	SetGroup(g Group) error
+	DeleteGroup(name string) error
+	// SetGroupRoute sets the table of all members of a group
+	SetGroupRoute(name string, table string) error
+
+	Schedules() ([]Schedule, error)
+	SetSchedule(s Schedule) error
+	DeleteSchedule(name string) error
+
+	// SetExceptions replaces the exceptions of the host currently using ip
+	SetExceptions(ip string, exceptions []Rule) error
+	// SetGroupExceptions replaces the exceptions of all members of a group
+	SetGroupExceptions(name string, exceptions []Rule) error
 }
 
 type VPNRouter struct {
-	lp HostProvider
-	rp RuleProvider
+	lp           HostProvider
+	rp           RuleProvider
+	gp           GroupProvider
+	scheduler    *Scheduler
+	ep           ExceptionPolicy
+	displayTable string
+	expiry       chan struct{}
+	events       *EventBus
+	// Who makes the changes, see As
+	actor string
 }
 
 func NewVPNRouter(lp HostProvider, rp RuleProvider) *VPNRouter {
 	return &VPNRouter{
-		lp: lp,
-		rp: rp,
+		lp:           lp,
+		rp:           rp,
+		displayTable: DefaultTable,
+		expiry:       make(chan struct{}, 1),
 	}
 }
 
+// SetGroupProvider enables groups of hosts.
+func (r *VPNRouter) SetGroupProvider(gp GroupProvider) {
+	r.gp = gp
+}
+
+// SetScheduler enables schedules.
+func (r *VPNRouter) SetScheduler(s *Scheduler) {
+	r.scheduler = s
+}
+
+// SetExceptionPolicy enables exceptions of hosts and groups.
+func (r *VPNRouter) SetExceptionPolicy(ep ExceptionPolicy) {
+	r.ep = ep
+}
+
+// SetEventBus publishes the route changes made through the router.
+func (r *VPNRouter) SetEventBus(events *EventBus) {
+	r.events = events
+}
+
+// As returns a router attributing its route changes to actor, e.g. a client of the API.
+func (r *VPNRouter) As(actor string) Router {
+	c := *r
+	c.actor = actor
+	return &c
+}
+
+func (r *VPNRouter) publishRoute(change RouteChange) {
+	change.By = r.actor
+	r.events.Publish(Event{Type: EventRouteChanged, Route: &change})
+}
+
+// SetDisplayTable sets the table reported for hosts without a rule,
+// it is for display only and not routed to.
+func (r *VPNRouter) SetDisplayTable(table string) {
+	r.displayTable = table
+}
+
 func (r *VPNRouter) Routes() ([]Route, error) {
 	ls, err := r.lp.Hosts()
 	if err != nil {
@@ -33,19 +124,47 @@ func (r *VPNRouter) Routes() ([]Route, error) {
 		return nil, err
 	}
 	rsMap := ruleMap(rs)
+	groups := make(map[string]string) // MAC to group
+	if r.gp != nil {
+		for _, g := range r.gp.Groups() {
+			for _, mac := range g.MACs {
+				groups[mac] = g.Name
+			}
+		}
+	}
 
 	var routes []Route
 	var table string
 	for _, l := range ls {
-		table = "null"
-		if rule, ok := rsMap[l.IP]; ok {
-			table = rule.Table
+		addrs := l.Addrs()
+		if len(addrs) == 0 {
+			continue
+		}
+		table = r.displayTable
+		for _, addr := range addrs {
+			if rule, ok := rsMap[addr]; ok {
+				table = rule.Table
+				break
+			}
 		}
-		routes = append(routes, Route{
-			IP:    l.IP,
+		route := Route{
+			IP:    addrs[0],
 			Table: table,
 			Lease: l,
-		})
+			Group: groups[l.MAC],
+		}
+		if tp, ok := r.rp.(TemporaryRuleProvider); ok {
+			route.Expires = tp.Expiry(l.MAC)
+		}
+		if r.scheduler != nil {
+			if next, ok := r.scheduler.Next(l.MAC, route.Group); ok {
+				route.Next = &next
+			}
+		}
+		if r.ep != nil && l.MAC != "" {
+			route.Exceptions, route.GroupExceptions = r.ep.HostExceptions(l.MAC)
+		}
+		routes = append(routes, route)
 	}
 	return routes, nil
 }
@@ -58,6 +177,206 @@ func ruleMap(rs []Rule) map[string]Rule {
 	return m
 }
 
+func hostByIP(hosts []Host, ip string) (Host, bool) {
+	for _, h := range hosts {
+		if h.HasAddr(ip) {
+			return h, true
+		}
+	}
+	return Host{}, false
+}
+
+func hostByMAC(hosts []Host, mac string) (Host, bool) {
+	for _, h := range hosts {
+		if h.MAC == mac {
+			return h, true
+		}
+	}
+	return Host{}, false
+}
+
+// SetRoute routes the host currently using ip through table.
 func (r *VPNRouter) SetRoute(ip string, table string) error {
-	return r.rp.Set(ip, table)
+	ls, err := r.lp.Hosts()
+	if err != nil {
+		return err
+	}
+	h, found := hostByIP(ls, ip)
+	if !found {
+		return ErrUnknownHost
+	}
+	if err := r.rp.Set(ip, table); err != nil {
+		return err
+	}
+	r.publishRoute(RouteChange{IP: ip, MAC: h.MAC, Table: table})
+	return nil
+}
+
+// DeleteRoute removes the rules of the host currently using ip.
+func (r *VPNRouter) DeleteRoute(ip string) error {
+	ls, err := r.lp.Hosts()
+	if err != nil {
+		return err
+	}
+	h, found := hostByIP(ls, ip)
+	if !found {
+		return ErrUnknownHost
+	}
+	if err := r.rp.Delete(ip); err != nil {
+		return err
+	}
+	r.publishRoute(RouteChange{IP: ip, MAC: h.MAC})
+	return nil
+}
+
+// SetRoutes applies all changes or none of them, see SetBatch.
+func (r *VPNRouter) SetRoutes(changes []Rule) error {
+	ls, err := r.lp.Hosts()
+	if err != nil {
+		return err
+	}
+	macs := make([]string, len(changes))
+	for i, c := range changes {
+		h, found := hostByIP(ls, c.IP)
+		if !found {
+			return &BatchError{Index: i, Err: ErrUnknownHost}
+		}
+		macs[i] = h.MAC
+	}
+	if err := SetBatch(r.rp, changes); err != nil {
+		return err
+	}
+	for i, c := range changes {
+		r.publishRoute(RouteChange{IP: c.IP, MAC: macs[i], Table: c.Table})
+	}
+	return nil
+}
+
+func (r *VPNRouter) Groups() ([]Group, error) {
+	if r.gp == nil {
+		return nil, ErrNoGroups
+	}
+	return r.gp.Groups(), nil
+}
+
+func (r *VPNRouter) SetGroup(g Group) error {
+	if r.gp == nil {
+		return ErrNoGroups
+	}
+	if err := r.gp.SetGroup(g); err != nil {
+		return err
+	}
+	if g.Table != "" {
+		r.publishRoute(RouteChange{Group: g.Name, Table: g.Table})
+	}
+	return nil
+}
+
+func (r *VPNRouter) DeleteGroup(name string) error {
+	if r.gp == nil {
+		return ErrNoGroups
+	}
+	return r.gp.DeleteGroup(name)
+}
+
+func (r *VPNRouter) SetGroupRoute(name string, table string) error {
+	if r.gp == nil {
+		return ErrNoGroups
+	}
+	if err := r.gp.SetGroupTable(name, table); err != nil {
+		return err
+	}
+	r.publishRoute(RouteChange{Group: name, Table: table})
+	return nil
+}
+
+func (r *VPNRouter) Schedules() ([]Schedule, error) {
+	if r.scheduler == nil {
+		return nil, ErrNoSchedules
+	}
+	return r.scheduler.Schedules(), nil
+}
+
+func (r *VPNRouter) SetSchedule(s Schedule) error {
+	if r.scheduler == nil {
+		return ErrNoSchedules
+	}
+	return r.scheduler.SetSchedule(s)
+}
+
+func (r *VPNRouter) DeleteSchedule(name string) error {
+	if r.scheduler == nil {
+		return ErrNoSchedules
+	}
+	return r.scheduler.DeleteSchedule(name)
+}
+
+func (r *VPNRouter) SetExceptions(ip string, exceptions []Rule) error {
+	if r.ep == nil {
+		return ErrNoExceptions
+	}
+	ls, err := r.lp.Hosts()
+	if err != nil {
+		return err
+	}
+	if _, found := hostByIP(ls, ip); !found {
+		return ErrUnknownHost
+	}
+	return r.ep.SetHostExceptions(ip, exceptions)
+}
+
+func (r *VPNRouter) SetGroupExceptions(name string, exceptions []Rule) error {
+	if r.ep == nil {
+		return ErrNoExceptions
+	}
+	return r.ep.SetGroupExceptions(name, exceptions)
+}
+
+func (r *VPNRouter) SetTemporaryRoute(ip string, table string, until time.Time) error {
+	tp, ok := r.rp.(TemporaryRuleProvider)
+	if !ok {
+		return ErrNoTemporary
+	}
+	ls, err := r.lp.Hosts()
+	if err != nil {
+		return err
+	}
+	h, found := hostByIP(ls, ip)
+	if !found {
+		return ErrUnknownHost
+	}
+	if err := tp.SetUntil(ip, table, until); err != nil {
+		return err
+	}
+	r.publishRoute(RouteChange{IP: ip, MAC: h.MAC, Table: table, Until: until})
+	// Wake up RunExpiry to wait for the new expiry
+	select {
+	case r.expiry <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// RunExpiry reverts temporary routes when they expire until stop is closed.
+// Expiries are checked at least every minute, so changes of the clock are caught up.
+func (r *VPNRouter) RunExpiry(stop <-chan struct{}) {
+	tp, ok := r.rp.(TemporaryRuleProvider)
+	if !ok {
+		return
+	}
+	for {
+		wait := time.Minute
+		next, err := tp.Expire(time.Now())
+		if err != nil {
+			log.Printf("Expiry/Error: %s", err)
+		} else if d := next.Sub(time.Now()); !next.IsZero() && d < wait {
+			wait = d
+		}
+		select {
+		case <-stop:
+			return
+		case <-time.After(wait):
+		case <-r.expiry:
+		}
+	}
 }
@@ -1,7 +1,9 @@
 package router
 
 import (
+	"os"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -28,6 +30,16 @@ func (m mock) Set(ip string, table string) error {
 	return nil
 }
 
+func (m *mock) Delete(ip string) error {
+	for i, r := range m.rules {
+		if r.IP == ip {
+			m.rules = append(m.rules[:i], m.rules[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
 func TestRoutes(t *testing.T) {
 	m := mock{
 		rules: []Rule{
@@ -39,7 +51,7 @@ func TestRoutes(t *testing.T) {
 			{MAC: "def", IP: "127.0.0.2", Name: "pc2"},
 		},
 	}
-	var r Router = NewVPNRouter(m, m)
+	var r Router = NewVPNRouter(m, &m)
 	rs, err := r.Routes()
 	if err != nil {
 		t.Fatalf("Error: %s", err)
@@ -67,7 +79,7 @@ func TestSetRoute(t *testing.T) {
 			{MAC: "abc", IP: "127.0.0.1", Name: "pc1"},
 		},
 	}
-	var r Router = NewVPNRouter(m, m)
+	var r Router = NewVPNRouter(m, &m)
 	err := r.SetRoute("127.0.0.1", "table3")
 	if err != nil {
 		t.Fatalf("Error: %s", err)
@@ -85,3 +97,115 @@ func TestSetRoute(t *testing.T) {
 	}, rs[0])
 
 }
+
+func TestDeleteRoute(t *testing.T) {
+	m := &mock{
+		rules: []Rule{
+			{IP: "127.0.0.1", Table: "table1"},
+		},
+		leases: []Host{
+			{MAC: "abc", IP: "127.0.0.1", Name: "pc1"},
+		},
+	}
+	r := NewVPNRouter(m, m)
+	r.SetDisplayTable("defgw")
+	assert := assert.New(t)
+	assert.Equal(ErrUnknownHost, r.DeleteRoute("127.0.0.2"))
+	if err := r.DeleteRoute("127.0.0.1"); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	rs, err := r.Routes()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal([]Route{{
+		IP:    "127.0.0.1",
+		Table: "defgw",
+		Lease: m.leases[0],
+	}}, rs)
+}
+
+func TestSetRoutes(t *testing.T) {
+	m := mock{
+		leases: []Host{
+			{MAC: "abc", IP: "127.0.0.1", Name: "pc1"},
+		},
+	}
+	kernel := DummyRuleProvider{}
+	r := NewVPNRouter(m, kernel)
+	assert := assert.New(t)
+	err := r.SetRoutes([]Rule{{IP: "127.0.0.1", Table: "vpn"}, {IP: "127.0.0.2", Table: "vpn"}})
+	assert.Equal(&BatchError{Index: 1, Err: ErrUnknownHost}, err)
+	assert.Equal(DummyRuleProvider{}, kernel)
+
+	assert.Nil(r.SetRoutes([]Rule{{IP: "127.0.0.1", Table: "vpn"}}))
+	assert.Equal(DummyRuleProvider{"127.0.0.1": "vpn"}, kernel)
+}
+
+func TestRoutesGroup(t *testing.T) {
+	m := mock{
+		leases: []Host{
+			{MAC: "aa:bb:cc:dd:ee:01", IP: "127.0.0.1", Name: "pc1"},
+			{MAC: "aa:bb:cc:dd:ee:02", IP: "127.0.0.2", Name: "pc2"},
+		},
+	}
+	gp := NewRulePersistence(make(DummyRuleProvider), m, "")
+	if err := gp.SetGroup(Group{Name: "kids", MACs: []string{"aa:bb:cc:dd:ee:02"}}); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	r := NewVPNRouter(m, &m)
+	r.SetGroupProvider(gp)
+	rs, err := r.Routes()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert := assert.New(t)
+	assert.Equal("", rs[0].Group)
+	assert.Equal("kids", rs[1].Group)
+}
+
+func TestSetTemporaryRoute(t *testing.T) {
+	assert := assert.New(t)
+	m := mock{
+		leases: []Host{{MAC: "aa:bb:cc:dd:ee:01", IP: "127.0.0.1", Name: "pc1"}},
+	}
+	r := NewVPNRouter(m, &m)
+	assert.Equal(ErrNoTemporary, r.SetTemporaryRoute("127.0.0.1", "vpn", time.Now().Add(time.Hour)))
+
+	file := tempDB(t, "MAC\tIP\tTable\n")
+	defer os.Remove(file)
+	kernel := make(DummyRuleProvider)
+	rp := NewRulePersistence(kernel, m, file)
+	r = NewVPNRouter(m, rp)
+	until := time.Now().Add(time.Hour)
+	assert.Equal(ErrUnknownHost, r.SetTemporaryRoute("127.0.0.2", "vpn", until))
+	if err := r.SetTemporaryRoute("127.0.0.1", "vpn", until); err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	rs, err := r.Routes()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal("vpn", rs[0].Table)
+	assert.True(until.Equal(rs[0].Expires), "Expiry reported")
+
+	// RunExpiry reverts routes which expired while it was not running
+	rp.db["aa:bb:cc:dd:ee:01"] = persRule{IPs: []string{"127.0.0.1"}, Table: "vpn", Expires: time.Now().Add(-time.Minute)}
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		r.RunExpiry(stop)
+		close(done)
+	}()
+	for i := 0; i < 100 && !rp.Expiry("aa:bb:cc:dd:ee:01").IsZero(); i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	close(stop)
+	<-done
+	rs, err = r.Routes()
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(DefaultTable, rs[0].Table)
+	assert.True(rs[0].Expires.IsZero(), "Route still temporary")
+}
@@ -0,0 +1,149 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// ErrUnknownTable is returned if a table name can not be mapped to a kernel table id.
+var ErrUnknownTable = errors.New("unknown routing table")
+
+// RouteTables maps routing table names to kernel table ids,
+// like /etc/iproute2/rt_tables does for the ip command.
+type RouteTables struct {
+	ids   map[string]uint32
+	names map[uint32]string
+}
+
+// NewRouteTables returns a mapping which only knows the builtin tables.
+func NewRouteTables() *RouteTables {
+	t := &RouteTables{
+		ids:   make(map[string]uint32),
+		names: make(map[uint32]string),
+	}
+	t.Add("local", 255)
+	t.Add("main", 254)
+	t.Add("default", 253)
+	t.Add("unspec", 0)
+	return t
+}
+
+// ReadRouteTables reads a rt_tables file.
+func ReadRouteTables(file string) (*RouteTables, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseRouteTables(f)
+}
+
+// ParseRouteTables parses rt_tables formatted lines of "id name".
+func ParseRouteTables(r io.Reader) (*RouteTables, error) {
+	t := NewRouteTables()
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		parts := strings.Fields(line)
+		if len(parts) != 2 {
+			continue
+		}
+		id, err := strconv.ParseUint(parts[0], 0, 32)
+		if err != nil {
+			continue
+		}
+		t.Add(parts[1], uint32(id))
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Add registers a table name for id.
+func (t *RouteTables) Add(name string, id uint32) {
+	t.ids[name] = id
+	t.names[id] = name
+}
+
+// ID returns the table id for name. Numeric names are accepted as ids.
+func (t *RouteTables) ID(name string) (uint32, bool) {
+	if id, ok := t.ids[name]; ok {
+		return id, true
+	}
+	id, err := strconv.ParseUint(name, 10, 32)
+	if err != nil {
+		return 0, false
+	}
+	return uint32(id), true
+}
+
+// Name returns the table name for id, or the id itself if it has no name.
+func (t *RouteTables) Name(id uint32) string {
+	if name, ok := t.names[id]; ok {
+		return name
+	}
+	return strconv.FormatUint(uint64(id), 10)
+}
+
+// First id given to tables without one, lower ids are usually assigned by hand
+const firstTableID = 100
+
+// AddRouteTable makes sure file maps name to a table id, so the ip command
+// knows the table. A table without id gets the first free id from 100 on,
+// the file is created if missing. Returns the id of the table.
+func AddRouteTable(file string, name string, id uint32) (uint32, error) {
+	if n, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(n), nil
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	t, err := ParseRouteTables(bytes.NewReader(bs))
+	if err != nil {
+		return 0, err
+	}
+	if cur, ok := t.ids[name]; ok {
+		if id != 0 && cur != id {
+			return 0, fmt.Errorf("table %s has id %d in %s, not %d", name, cur, file, id)
+		}
+		return cur, nil
+	}
+	if id == 0 {
+		for i := uint32(firstTableID); i < 253 && id == 0; i++ {
+			if _, used := t.names[i]; !used {
+				id = i
+			}
+		}
+		if id == 0 {
+			return 0, fmt.Errorf("no free table id for %s in %s", name, file)
+		}
+	} else if other, used := t.names[id]; used {
+		return 0, fmt.Errorf("table id %d of %s is used by %s in %s", id, name, other, file)
+	}
+
+	line := fmt.Sprintf("%d\t%s\n", id, name)
+	if len(bs) > 0 && bs[len(bs)-1] != '\n' {
+		line = "\n" + line
+	}
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.WriteString(line); err != nil {
+		f.Close()
+		return 0, err
+	}
+	return id, f.Close()
+}
@@ -0,0 +1,85 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fixture_rttables = `
+#
+# reserved values
+#
+255	local
+254	main
+253	default
+0	unspec
+#
+# local
+#
+100	vpn
+101 defgw # comment
+`
+
+func TestParseRouteTables(t *testing.T) {
+	assert := assert.New(t)
+	rt, err := ParseRouteTables(strings.NewReader(fixture_rttables))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	id, ok := rt.ID("vpn")
+	assert.True(ok)
+	assert.Equal(uint32(100), id)
+	id, ok = rt.ID("defgw")
+	assert.True(ok)
+	assert.Equal(uint32(101), id)
+	id, ok = rt.ID("200")
+	assert.True(ok)
+	assert.Equal(uint32(200), id)
+	_, ok = rt.ID("unknown")
+	assert.False(ok)
+
+	assert.Equal("main", rt.Name(254))
+	assert.Equal("vpn", rt.Name(100))
+	assert.Equal("200", rt.Name(200))
+}
+
+func TestAddRouteTable(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	file := dir + "/rt_tables"
+	ioutil.WriteFile(file, []byte("100\tvpn\n101\tdefgw"), 0644)
+
+	id, err := AddRouteTable(file, "vpn", 0)
+	assert.Nil(err)
+	assert.Equal(uint32(100), id)
+	id, err = AddRouteTable(file, "wg", 0)
+	assert.Nil(err)
+	assert.Equal(uint32(102), id, "First free id")
+	id, err = AddRouteTable(file, "lte", 200)
+	assert.Nil(err)
+	assert.Equal(uint32(200), id)
+	id, err = AddRouteTable(file, "42", 0)
+	assert.Nil(err)
+	assert.Equal(uint32(42), id, "Numeric tables are not added")
+
+	_, err = AddRouteTable(file, "vpn", 105)
+	assert.NotNil(err, "Different id")
+	_, err = AddRouteTable(file, "other", 101)
+	assert.NotNil(err, "Id taken")
+
+	bs, _ := ioutil.ReadFile(file)
+	assert.Equal("100\tvpn\n101\tdefgw\n102\twg\n200\tlte\n", string(bs))
+
+	// Missing files are created
+	id, err = AddRouteTable(dir+"/new", "vpn", 0)
+	assert.Nil(err)
+	assert.Equal(uint32(100), id)
+}
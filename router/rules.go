@@ -1,54 +1,125 @@
 package router
 
 import (
+	"bytes"
+	"fmt"
+	"log"
 	"os/exec"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 )
 
 type Rule struct {
 	IP    string
 	Table string
+	// Exceptions only match the traffic to a prefix like "10.0.0.0/8",
+	// optionally of a protocol and destination port. They precede the
+	// host rule of their IP, which has none of these.
+	To    string
+	Proto string
+	Port  uint16
 }
 
 type RuleProvider interface {
 	Rules() ([]Rule, error)
 	Set(ip string, table string) error
+	// Delete removes the rule of ip, if any
+	Delete(ip string) error
 }
 
 type IPRoute2RuleProvider struct {
 	sync.Mutex
+
+	// IPv6 also lists the rules of ip -6
+	IPv6 bool
+	// Only rules in this range tagged with Protocol are read and changed.
+	// Protocol 0 relies on the range alone.
+	Priorities PriorityRange
+	Protocol   uint8
 }
 
 func NewIPRoute2RuleProvider() *IPRoute2RuleProvider {
-	return &IPRoute2RuleProvider{}
+	return &IPRoute2RuleProvider{
+		Priorities: DefaultPriorities,
+		Protocol:   DefaultRuleProtocol,
+	}
 }
 
-func (p *IPRoute2RuleProvider) Rules() ([]Rule, error) {
+// list returns the owned and the foreign rules.
+func (p *IPRoute2RuleProvider) list() ([]Rule, []ForeignRule, error) {
+	start := time.Now()
 	b, err := exec.Command("ip", "rule", "show").Output()
+	observeIPRule("show", start, err)
 	if err != nil {
-		return nil, err
+		return nil, nil, err
+	}
+	rules, foreign := parseRuleLines(string(b), p.Priorities, p.Protocol, false)
+	if p.IPv6 {
+		start := time.Now()
+		b, err := exec.Command("ip", "-6", "rule", "show").Output()
+		observeIPRule("show", start, err)
+		if err != nil {
+			return nil, nil, err
+		}
+		rules6, foreign6 := parseRuleLines(string(b), p.Priorities, p.Protocol, true)
+		rules = append(rules, rules6...)
+		foreign = append(foreign, foreign6...)
 	}
-	return parseRules(string(b)), nil
+	return rules, foreign, nil
 }
 
-func parseRules(s string) []Rule {
-	lines := strings.Split(s, "\n")
-	var rules []Rule
-	for _, line := range lines {
-		if len(strings.TrimSpace(line)) == 0 {
-			continue
-		}
-		parts := strings.Fields(line)
-		if len(parts) < 5 {
-			continue
-		}
-		rules = append(rules, Rule{
-			IP:    parts[2],
-			Table: parts[4],
-		})
+// Rules returns the host rules in the managed range.
+func (p *IPRoute2RuleProvider) Rules() ([]Rule, error) {
+	rules, _, err := p.list()
+	hosts, _ := splitExceptions(rules)
+	return hosts, err
+}
+
+func (p *IPRoute2RuleProvider) Exceptions() ([]Rule, error) {
+	rules, _, err := p.list()
+	_, exceptions := splitExceptions(rules)
+	return exceptions, err
+}
+
+func (p *IPRoute2RuleProvider) SetException(r Rule) error {
+	current, err := p.Exceptions()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return setIPException(timedRun("exception"), current, r, ruleTag(p.Priorities.Exception(), p.Protocol))
+}
+
+func (p *IPRoute2RuleProvider) DeleteException(r Rule) error {
+	current, err := p.Exceptions()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	return deleteIPException(timedRun("exception"), current, r, ruleTag(p.Priorities.Exception(), p.Protocol))
+}
+
+func (p *IPRoute2RuleProvider) ForeignRules() ([]ForeignRule, error) {
+	_, foreign, err := p.list()
+	return foreign, err
+}
+
+// ruleArgs returns the priority and tag of all host rules.
+func (p *IPRoute2RuleProvider) ruleArgs() []string {
+	return ruleTag(p.Priorities.Host(), p.Protocol)
+}
+
+// ipCmd returns the ip command for the address family of addr.
+func ipCmd(addr string, args ...string) *exec.Cmd {
+	if strings.Contains(addr, ":") {
+		args = append([]string{"-6"}, args...)
 	}
-	return rules
+	return exec.Command("ip", args...)
 }
 
 func findByIP(rules []Rule, ip string) (Rule, bool) {
@@ -82,12 +153,182 @@ func (p *IPRoute2RuleProvider) Set(ip string, table string) error {
 	return nil
 }
 
+func (p *IPRoute2RuleProvider) Delete(ip string) error {
+	oldRules, err := p.Rules()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	oldRule, found := findByIP(oldRules, ip)
+	if !found {
+		return nil
+	}
+	return p.delRoute(ip, oldRule.Table)
+}
+
+// DeleteLegacyRule deletes an untagged host rule of an older version.
+func (p *IPRoute2RuleProvider) DeleteLegacyRule(prio uint32, r Rule) error {
+	p.Lock()
+	defer p.Unlock()
+	start := time.Now()
+	err := ipCmd(r.IP, "rule", "del", "priority", strconv.FormatUint(uint64(prio), 10), "from", r.IP, "table", r.Table).Run()
+	observeIPRule("del", start, err)
+	return err
+}
+
 func (p *IPRoute2RuleProvider) delRoute(ip string, table string) error {
-	return exec.Command("ip", "rule", "del", "from", ip, "table", table).Run()
+	start := time.Now()
+	err := ipCmd(ip, append([]string{"rule", "del", "from", ip, "table", table}, p.ruleArgs()...)...).Run()
+	observeIPRule("del", start, err)
+	return err
 }
 
 func (p *IPRoute2RuleProvider) addRoute(ip string, table string) error {
-	return exec.Command("ip", "rule", "add", "from", ip, "table", table).Run()
+	start := time.Now()
+	err := ipCmd(ip, append([]string{"rule", "add", "from", ip, "table", table}, p.ruleArgs()...)...).Run()
+	observeIPRule("add", start, err)
+	return err
+}
+
+// timedRun returns runCmd recording its commands as op.
+func timedRun(op string) func(stdin string, name string, args ...string) (string, error) {
+	return func(stdin string, name string, args ...string) (string, error) {
+		start := time.Now()
+		out, err := runCmd(stdin, name, args...)
+		observeIPRule(op, start, err)
+		return out, err
+	}
+}
+
+// SetBatch applies the changes with a single ip -batch per address family.
+func (p *IPRoute2RuleProvider) SetBatch(changes []Rule) error {
+	oldRules, err := p.Rules()
+	if err != nil {
+		return err
+	}
+	p.Lock()
+	defer p.Unlock()
+	var applied []ruleOp
+	for _, family := range splitFamilies(planBatch(oldRules, changes)) {
+		n, err := runBatch(family, false, p.ruleArgs())
+		if err != nil && n < 0 {
+			// ip exits on invalid arguments without naming the line
+			rules, rerr := p.Rules()
+			if rerr != nil {
+				log.Printf("SetBatch/Error: %s", rerr)
+			}
+			n = appliedOps(oldRules, family, rules)
+		}
+		applied = append(applied, family[:n]...)
+		if err != nil {
+			var reverted []ruleOp
+			for i := len(applied) - 1; i >= 0; i-- {
+				reverted = append(reverted, applied[i].inverse())
+			}
+			for _, family := range splitFamilies(reverted) {
+				if _, err := runBatch(family, true, p.ruleArgs()); err != nil {
+					log.Printf("SetBatch/Error: Could not roll back: %s", err)
+				}
+			}
+			return &BatchError{Index: family[n].change, Err: err}
+		}
+	}
+	return nil
+}
+
+// splitFamilies splits ops into IPv4 and IPv6 ops, omitting empty lists.
+func splitFamilies(ops []ruleOp) [][]ruleOp {
+	var v4, v6 []ruleOp
+	for _, op := range ops {
+		if strings.Contains(op.ip, ":") {
+			v6 = append(v6, op)
+		} else {
+			v4 = append(v4, op)
+		}
+	}
+	var families [][]ruleOp
+	for _, f := range [][]ruleOp{v4, v6} {
+		if len(f) > 0 {
+			families = append(families, f)
+		}
+	}
+	return families
+}
+
+// runBatch runs ops of the same address family and returns the number of applied ops,
+// or -1 if unknown. If force is set, failed ops are skipped. The args are appended to all rules.
+func runBatch(ops []ruleOp, force bool, args []string) (int, error) {
+	ipArgs := []string{"-batch", "-"}
+	if force {
+		ipArgs = append([]string{"-force"}, ipArgs...)
+	}
+	cmd := ipCmd(ops[0].ip, ipArgs...)
+	cmd.Stdin = strings.NewReader(batchScript(ops, args))
+	start := time.Now()
+	out, err := cmd.CombinedOutput()
+	observeIPRule("batch", start, err)
+	if err != nil {
+		return failedOp(string(out), len(ops)), fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	return len(ops), nil
+}
+
+func batchScript(ops []ruleOp, args []string) string {
+	suffix := ""
+	if len(args) > 0 {
+		suffix = " " + strings.Join(args, " ")
+	}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		cmd := "add"
+		if op.del {
+			cmd = "del"
+		}
+		fmt.Fprintf(&buf, "rule %s from %s table %s%s\n", cmd, op.ip, op.table, suffix)
+	}
+	return buf.String()
+}
+
+var batchFailedRe = regexp.MustCompile(`Command failed -:(\d+)`)
+
+// failedOp returns the index of the failed op from the output of ip -batch or -1.
+func failedOp(out string, n int) int {
+	m := batchFailedRe.FindStringSubmatch(out)
+	if m == nil {
+		return -1
+	}
+	line, err := strconv.Atoi(m[1])
+	if err != nil || line < 1 || line > n {
+		return -1
+	}
+	return line - 1
+}
+
+// appliedOps returns the number of ops applied to old leading to current.
+func appliedOps(old []Rule, ops []ruleOp, current []Rule) int {
+	state := ruleMap(old)
+	cur := ruleMap(current)
+	matches := func() bool {
+		for _, op := range ops {
+			if state[op.ip] != cur[op.ip] {
+				return false
+			}
+		}
+		return true
+	}
+	n := 0
+	for i, op := range ops[:len(ops)-1] {
+		if op.del {
+			delete(state, op.ip)
+		} else {
+			state[op.ip] = Rule{IP: op.ip, Table: op.table}
+		}
+		if matches() {
+			n = i + 1
+		}
+	}
+	return n
 }
 
 type DummyRuleProvider map[string]string
@@ -107,3 +348,8 @@ func (p DummyRuleProvider) Set(ip string, table string) error {
 	p[ip] = table
 	return nil
 }
+
+func (p DummyRuleProvider) Delete(ip string) error {
+	delete(p, ip)
+	return nil
+}
@@ -7,14 +7,71 @@ import (
 )
 
 const fixture_rules = `
-32745:  from 10.10.10.1 lookup vpn 
-32747:  from 10.10.10.2 lookup defgw 
+0:	from all lookup local
+10998:	from 10.10.10.3 lookup vpn
+10999:	from 10.10.10.1 lookup vpn proto 86
+10999:	from 10.10.10.2 lookup defgw proto 86
+10999:	from all fwmark 0x1 lookup defgw proto 86
+10999:	from 10.10.10.4 lookup vpn proto static
+32745:	from 10.10.10.5 lookup vpn
+32766:	from all lookup main
 `
 
 func TestParseRules(t *testing.T) {
-	rs := parseRules(fixture_rules)
+	rs, foreign := parseRuleLines(fixture_rules, DefaultPriorities, DefaultRuleProtocol, false)
 	assert := assert.New(t)
-	assert.Equal(2, len(rs))
-	assert.Equal(Rule{IP: "10.10.10.1", Table: "vpn"}, rs[0])
-	assert.Equal(Rule{IP: "10.10.10.2", Table: "defgw"}, rs[1])
+	assert.Equal([]Rule{{IP: "10.10.10.1", Table: "vpn"}, {IP: "10.10.10.2", Table: "defgw"}}, rs)
+	assert.Equal([]ForeignRule{
+		{Priority: 0, Spec: "from all lookup local"},
+		{Priority: 10998, Spec: "from 10.10.10.3 lookup vpn"},
+		{Priority: 10999, Spec: "from all fwmark 0x1 lookup defgw proto 86"},
+		{Priority: 10999, Spec: "from 10.10.10.4 lookup vpn proto static"},
+		{Priority: 32745, Spec: "from 10.10.10.5 lookup vpn"},
+		{Priority: 32766, Spec: "from all lookup main"},
+	}, foreign)
+
+	// Range alone
+	rs, _ = parseRuleLines(fixture_rules, PriorityRange{10000, 19999}, 0, true)
+	assert.Equal([]Rule{{IP: "10.10.10.3", Table: "vpn"}}, rs)
+}
+
+func TestIPCmd(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal([]string{"ip", "rule", "add", "from", "10.0.0.1"}, ipCmd("10.0.0.1", "rule", "add", "from", "10.0.0.1").Args)
+	assert.Equal([]string{"ip", "-6", "rule", "add", "from", "2001:db8::1"}, ipCmd("2001:db8::1", "rule", "add", "from", "2001:db8::1").Args)
+}
+
+func TestBatchScript(t *testing.T) {
+	assert := assert.New(t)
+	ops := []ruleOp{
+		{del: true, ip: "10.0.0.1", table: "vpn"},
+		{ip: "10.0.0.1", table: "defgw"},
+	}
+	assert.Equal("rule del from 10.0.0.1 table vpn\nrule add from 10.0.0.1 table defgw\n", batchScript(ops, nil))
+	assert.Equal("rule del from 10.0.0.1 table vpn pref 10999 protocol 86\nrule add from 10.0.0.1 table defgw pref 10999 protocol 86\n",
+		batchScript(ops, NewIPRoute2RuleProvider().ruleArgs()))
+
+	assert.Equal(1, failedOp("Error: argument \"x\" is wrong: invalid table ID\nCommand failed -:2\n", 2))
+	assert.Equal(-1, failedOp("Command failed -:5\n", 2), "Out of range")
+	assert.Equal(-1, failedOp("Error: argument \"x\" is wrong: invalid table ID\n", 2))
+
+	old := []Rule{{IP: "10.0.0.1", Table: "vpn"}}
+	ops = append(ops, ruleOp{ip: "10.0.0.2", table: "x"})
+	assert.Equal(0, appliedOps(old, ops, old))
+	assert.Equal(2, appliedOps(old, ops, []Rule{{IP: "10.0.0.1", Table: "defgw"}}))
+}
+
+func TestParseExceptionRules(t *testing.T) {
+	const lines = `
+10998:	from 10.10.10.1 to 10.0.0.0/8 lookup defgw proto 86
+10998:	from 10.10.10.1 to 192.168.1.5 ipproto tcp dport 443 lookup defgw proto 86
+10999:	from 10.10.10.1 lookup vpn proto 86
+`
+	rs, foreign := parseRuleLines(lines, DefaultPriorities, DefaultRuleProtocol, false)
+	assert.Equal(t, []Rule{
+		{IP: "10.10.10.1", To: "10.0.0.0/8", Table: "defgw"},
+		{IP: "10.10.10.1", To: "192.168.1.5/32", Proto: "tcp", Port: 443, Table: "defgw"},
+		{IP: "10.10.10.1", Table: "vpn"},
+	}, rs)
+	assert.Nil(t, foreign)
 }
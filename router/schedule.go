@@ -0,0 +1,491 @@
+package router
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrUnknownSchedule = errors.New("unknown schedule")
+	ErrInvalidSchedule = errors.New("invalid schedule")
+	ErrNoSchedules     = errors.New("schedules not supported")
+)
+
+// Clock is a time of day in minutes after midnight.
+type Clock int
+
+// ParseClock parses times like "07:30".
+func ParseClock(s string) (Clock, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return Clock(t.Hour()*60 + t.Minute()), nil
+}
+
+func (c Clock) String() string {
+	return fmt.Sprintf("%02d:%02d", c/60, c%60)
+}
+
+func clockOf(t time.Time) Clock {
+	return Clock(t.Hour()*60 + t.Minute())
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// ParseWeekday parses the abbreviated weekday names sun to sat.
+func ParseWeekday(s string) (time.Weekday, error) {
+	for i, d := range weekdays {
+		if strings.EqualFold(s, d) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// WeekdayName returns the abbreviated name of d as accepted by ParseWeekday.
+func WeekdayName(d time.Weekday) string {
+	return weekdays[d]
+}
+
+// Schedule routes a host or group to Table during a weekly time window
+// and to Else outside of it.
+type Schedule struct {
+	Name string
+	// Either a host by MAC or a group
+	MAC   string
+	Group string
+	// Days the window starts, every day if empty
+	Days []time.Weekday
+	// The window ends the next day if End is not after Start
+	Start, End Clock
+	Table      string
+	// Table outside the window, the rule is deleted if empty
+	Else string
+}
+
+// ScheduledChange is the next transition of a schedule.
+type ScheduledChange struct {
+	Time  time.Time
+	Table string
+}
+
+func (s Schedule) startsOn(d time.Weekday) bool {
+	if len(s.Days) == 0 {
+		return true
+	}
+	for _, day := range s.Days {
+		if day == d {
+			return true
+		}
+	}
+	return false
+}
+
+// Active returns true if t is inside the window.
+func (s Schedule) Active(t time.Time) bool {
+	c := clockOf(t)
+	if s.End > s.Start {
+		return s.startsOn(t.Weekday()) && c >= s.Start && c < s.End
+	}
+	// Window spans midnight
+	if s.startsOn(t.Weekday()) && c >= s.Start {
+		return true
+	}
+	return s.startsOn(t.AddDate(0, 0, -1).Weekday()) && c < s.End
+}
+
+// TableAt returns the table of the schedule at t.
+func (s Schedule) TableAt(t time.Time) string {
+	if s.Active(t) {
+		return s.Table
+	}
+	return s.Else
+}
+
+// Next returns the first transition after t.
+func (s Schedule) Next(t time.Time) (ScheduledChange, bool) {
+	active := s.Active(t)
+	var candidates []time.Time
+	for d := -1; d <= 7; d++ {
+		for _, c := range []Clock{s.Start, s.End} {
+			// Days with a DST change are not 24 hours long
+			at := time.Date(t.Year(), t.Month(), t.Day()+d, int(c/60), int(c%60), 0, 0, t.Location())
+			if at.After(t) {
+				candidates = append(candidates, at)
+			}
+		}
+	}
+	sort.Sort(byTime(candidates))
+	for _, at := range candidates {
+		if s.Active(at) != active {
+			return ScheduledChange{Time: at, Table: s.TableAt(at)}, true
+		}
+	}
+	return ScheduledChange{}, false
+}
+
+type byTime []time.Time
+
+func (a byTime) Len() int           { return len(a) }
+func (a byTime) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a byTime) Less(i, j int) bool { return a[i].Before(a[j]) }
+
+// normalizeSchedule validates s and returns it with a lower case MAC.
+func normalizeSchedule(s Schedule) (Schedule, error) {
+	if !groupNameRe.MatchString(s.Name) || s.Table == "" ||
+		strings.ContainsAny(s.Table+s.Else, " \t") ||
+		s.Start < 0 || s.Start >= 24*60 || s.End < 0 || s.End >= 24*60 {
+		return s, ErrInvalidSchedule
+	}
+	switch {
+	case s.MAC != "" && s.Group == "":
+		hw, err := net.ParseMAC(s.MAC)
+		if err != nil {
+			return s, ErrInvalidSchedule
+		}
+		s.MAC = hw.String()
+	case s.MAC == "" && groupNameRe.MatchString(s.Group):
+	default:
+		return s, ErrInvalidSchedule
+	}
+	return s, nil
+}
+
+// SetScheduleFile sets the file schedules are saved to, must be called before Init.
+func (r *RulePersistence) SetScheduleFile(file string) {
+	r.scheduleFile = file
+}
+
+// readSchedules reads the schedule file, a missing file is no error.
+func (r *RulePersistence) readSchedules() error {
+	if r.scheduleFile == "" {
+		return nil
+	}
+	f, err := os.Open(r.scheduleFile)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	br := bufio.NewReader(f)
+	// skip first line
+	br.ReadString('\n')
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			if err != io.EOF {
+				return err
+			}
+			break
+		}
+		parts := strings.Split(strings.TrimRight(line, "\r\n"), "\t")
+		// Files of older versions have no applied table
+		if len(parts) != 8 && len(parts) != 9 {
+			continue
+		}
+		s, err := parseSchedule(parts[:8])
+		if err != nil {
+			log.Printf("Persistence: Drop invalid schedule %s: %s", parts[0], err)
+			continue
+		}
+		r.schedules[s.Name] = s
+		if len(parts) == 9 && parts[8] != "" {
+			r.scheduleApplied[s.Name] = strings.TrimPrefix(parts[8], "-")
+		}
+	}
+	return nil
+}
+
+func parseSchedule(parts []string) (Schedule, error) {
+	s := Schedule{
+		Name:  parts[0],
+		MAC:   parts[1],
+		Group: parts[2],
+		Table: parts[6],
+		Else:  parts[7],
+	}
+	if parts[3] != "" {
+		for _, d := range strings.Split(parts[3], ",") {
+			day, err := ParseWeekday(d)
+			if err != nil {
+				return s, err
+			}
+			s.Days = append(s.Days, day)
+		}
+	}
+	var err error
+	if s.Start, err = ParseClock(parts[4]); err != nil {
+		return s, err
+	}
+	if s.End, err = ParseClock(parts[5]); err != nil {
+		return s, err
+	}
+	return normalizeSchedule(s)
+}
+
+func (r *RulePersistence) saveSchedules() error {
+	if r.store != nil {
+		return updateStore("schedules", r.store, r.putSchedules)
+	}
+	if r.scheduleFile == "" {
+		return nil
+	}
+	var buf bytes.Buffer
+	buf.WriteString("Name\tMAC\tGroup\tDays\tStart\tEnd\tTable\tElse\tApplied\n")
+	for _, s := range r.sortedSchedules() {
+		days := make([]string, 0, len(s.Days))
+		for _, d := range s.Days {
+			days = append(days, WeekdayName(d))
+		}
+		// Empty if never applied, "-" for an applied empty table
+		applied, ok := r.scheduleApplied[s.Name]
+		if ok && applied == "" {
+			applied = "-"
+		}
+		fmt.Fprintf(&buf, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\n",
+			s.Name, s.MAC, s.Group, strings.Join(days, ","), s.Start, s.End, s.Table, s.Else, applied)
+	}
+	return writeFile("schedules", r.scheduleFile, buf.Bytes())
+}
+
+func (r *RulePersistence) sortedSchedules() []Schedule {
+	schedules := make([]Schedule, 0, len(r.schedules))
+	for _, s := range r.schedules {
+		schedules = append(schedules, s)
+	}
+	sort.Sort(schedulesByName(schedules))
+	return schedules
+}
+
+type schedulesByName []Schedule
+
+func (a schedulesByName) Len() int           { return len(a) }
+func (a schedulesByName) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a schedulesByName) Less(i, j int) bool { return a[i].Name < a[j].Name }
+
+// Schedules returns all schedules sorted by name.
+func (r *RulePersistence) Schedules() []Schedule {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sortedSchedules()
+}
+
+// SetSchedule creates or replaces a schedule, it is applied again by the Scheduler.
+func (r *RulePersistence) SetSchedule(s Schedule) error {
+	s, err := normalizeSchedule(s)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.schedules[s.Name] = s
+	delete(r.scheduleApplied, s.Name)
+	return r.saveSchedules()
+}
+
+func (r *RulePersistence) DeleteSchedule(name string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.schedules[name]; !ok {
+		return ErrUnknownSchedule
+	}
+	delete(r.schedules, name)
+	delete(r.scheduleApplied, name)
+	return r.saveSchedules()
+}
+
+// appliedTable returns the table last applied by the schedule name.
+func (r *RulePersistence) appliedTable(name string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	table, ok := r.scheduleApplied[name]
+	return table, ok
+}
+
+// setAppliedTable saves the table applied by the schedule name, so it is
+// not applied again after a restart, overwriting manual changes.
+func (r *RulePersistence) setAppliedTable(name string, table string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.schedules[name]; !ok {
+		return ErrUnknownSchedule
+	}
+	if applied, ok := r.scheduleApplied[name]; ok && applied == table {
+		return nil
+	}
+	r.scheduleApplied[name] = table
+	return r.saveSchedules()
+}
+
+// Scheduler applies the tables of the saved schedules at their transitions.
+// The applied tables are saved with the schedules.
+type Scheduler struct {
+	store   *RulePersistence
+	hosts   HostProvider
+	events  *EventBus
+	trigger chan struct{}
+	now     func() time.Time
+
+	mu   sync.Mutex
+	errs map[string]string // schedule name to last error
+}
+
+// NewScheduler applies the schedules saved in store to the hosts,
+// rules are set through the store so they are saved as well.
+func NewScheduler(store *RulePersistence, hosts HostProvider) *Scheduler {
+	return &Scheduler{
+		store:   store,
+		hosts:   hosts,
+		trigger: make(chan struct{}, 1),
+		now:     time.Now,
+		errs:    make(map[string]string),
+	}
+}
+
+// SetEventBus publishes the changes made by schedules.
+func (s *Scheduler) SetEventBus(events *EventBus) {
+	s.events = events
+}
+
+// Trigger requests an evaluation without waiting for the next interval.
+func (s *Scheduler) Trigger() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run evaluates the schedules every interval and on every trigger until stop is closed.
+func (s *Scheduler) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		s.Apply()
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-s.trigger:
+		}
+	}
+}
+
+// Apply sets the table of every schedule which changed since the last call.
+// Schedules are applied by name, so later schedules win on the same host.
+// Schedules of hosts which are offline are retried on the next call.
+func (s *Scheduler) Apply() {
+	now := s.now()
+	hosts, err := s.hosts.Hosts()
+	if err != nil {
+		log.Printf("Scheduler/Error: %s", err)
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, sched := range s.store.Schedules() {
+		table := sched.TableAt(now)
+		if last, ok := s.store.appliedTable(sched.Name); ok && last == table {
+			continue
+		}
+		entry := AuditEntry{Action: "schedule", MAC: sched.MAC, Group: sched.Group, OldTable: s.store.currentTable(sched), NewTable: table}
+		if err := countRuleChange("schedule", s.apply(sched, table, hosts)); err != nil {
+			// Log once, not on every retry
+			if s.errs[sched.Name] != err.Error() {
+				log.Printf("Scheduler/Error: Schedule %s: %s", sched.Name, err)
+				recordSystem(s.store.audit, "schedule:"+sched.Name, err, entry)
+				s.errs[sched.Name] = err.Error()
+			}
+			continue
+		}
+		recordSystem(s.store.audit, "schedule:"+sched.Name, nil, entry)
+		log.Printf("Scheduler: Schedule %s set table %q", sched.Name, table)
+		s.events.Publish(Event{Type: EventRouteChanged, Route: &RouteChange{
+			MAC:   sched.MAC,
+			Group: sched.Group,
+			Table: table,
+			By:    "schedule " + sched.Name,
+		}})
+		if err := s.store.setAppliedTable(sched.Name, table); err != nil {
+			log.Printf("Scheduler/Error: Schedule %s: %s", sched.Name, err)
+		}
+		delete(s.errs, sched.Name)
+	}
+}
+
+// currentTable returns the saved table of the host or group of sched.
+func (r *RulePersistence) currentTable(sched Schedule) string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if sched.Group != "" {
+		return r.groups[sched.Group].Table
+	}
+	return r.db[sched.MAC].Table
+}
+
+// apply sets the table of sched bypassing the counted methods of the store,
+// its changes are counted as schedule by Apply.
+func (s *Scheduler) apply(sched Schedule, table string, hosts []Host) error {
+	if sched.Group != "" {
+		return s.store.setGroupTable(sched.Group, table)
+	}
+	h, found := hostByMAC(hosts, sched.MAC)
+	if !found || len(h.Addrs()) == 0 {
+		return ErrUnknownHost
+	}
+	if table == "" {
+		return s.store.deleteRule(h.Addrs()[0])
+	}
+	return s.store.setUntil(h.Addrs()[0], table, time.Time{})
+}
+
+// Next returns the next scheduled change of the host with mac in group.
+func (s *Scheduler) Next(mac string, group string) (ScheduledChange, bool) {
+	now := s.now()
+	var next ScheduledChange
+	found := false
+	for _, sched := range s.store.Schedules() {
+		if (sched.MAC == "" || sched.MAC != mac) && (sched.Group == "" || sched.Group != group) {
+			continue
+		}
+		if c, ok := sched.Next(now); ok && (!found || c.Time.Before(next.Time)) {
+			next, found = c, true
+		}
+	}
+	return next, found
+}
+
+// Schedules returns all saved schedules.
+func (s *Scheduler) Schedules() []Schedule {
+	return s.store.Schedules()
+}
+
+// SetSchedule saves a schedule and applies it.
+func (s *Scheduler) SetSchedule(sched Schedule) error {
+	if err := s.store.SetSchedule(sched); err != nil {
+		return err
+	}
+	s.Trigger()
+	return nil
+}
+
+// DeleteSchedule removes a schedule, the hosts keep their current table.
+func (s *Scheduler) DeleteSchedule(name string) error {
+	if err := s.store.DeleteSchedule(name); err != nil {
+		return err
+	}
+	s.Trigger()
+	return nil
+}
@@ -0,0 +1,145 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Friday
+var scheduleBase = time.Date(2026, 10, 16, 0, 0, 0, 0, time.UTC)
+
+func at(day int, clock string) time.Time {
+	c, err := ParseClock(clock)
+	if err != nil {
+		panic(err)
+	}
+	return scheduleBase.AddDate(0, 0, day).Add(time.Duration(c) * time.Minute)
+}
+
+var schoolNights = []time.Weekday{time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday}
+
+func TestScheduleActive(t *testing.T) {
+	assert := assert.New(t)
+	s := Schedule{Days: schoolNights, Start: 22 * 60, End: 7 * 60, Table: "null", Else: "defgw"}
+
+	assert.True(s.Active(at(0, "06:59")), "Thursday night")
+	assert.False(s.Active(at(0, "07:00")))
+	assert.False(s.Active(at(0, "23:00")), "No school on Saturday")
+	assert.False(s.Active(at(1, "02:00")))
+	assert.True(s.Active(at(2, "22:00")), "Sunday night")
+	assert.True(s.Active(at(3, "06:00")))
+	assert.Equal("defgw", s.TableAt(at(1, "12:00")))
+
+	next, ok := s.Next(at(0, "12:00"))
+	assert.True(ok)
+	assert.Equal(ScheduledChange{Time: at(2, "22:00"), Table: "null"}, next)
+	next, _ = s.Next(at(2, "23:00"))
+	assert.Equal(ScheduledChange{Time: at(3, "07:00"), Table: "defgw"}, next)
+
+	daily := Schedule{Start: 8 * 60, End: 12 * 60, Table: "vpn"}
+	assert.True(daily.Active(at(1, "10:00")))
+	next, _ = daily.Next(at(1, "10:00"))
+	assert.Equal(ScheduledChange{Time: at(1, "12:00"), Table: ""}, next)
+
+	always := Schedule{Table: "vpn"}
+	assert.True(always.Active(at(1, "10:00")))
+	_, ok = always.Next(at(1, "10:00"))
+	assert.False(ok)
+
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skipf("No time zone data: %s", err)
+	}
+	// Clocks go forward at 02:00 on Sunday
+	next, _ = s.Next(time.Date(2026, 3, 29, 12, 0, 0, 0, berlin))
+	assert.Equal(time.Date(2026, 3, 29, 22, 0, 0, 0, berlin), next.Time)
+	next, _ = s.Next(time.Date(2026, 3, 29, 23, 0, 0, 0, berlin))
+	assert.Equal(time.Date(2026, 3, 30, 7, 0, 0, 0, berlin), next.Time)
+}
+
+func TestScheduler(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := filepath.Join(dir, "db.txt")
+	scheduleFile := filepath.Join(dir, "schedules.txt")
+	ioutil.WriteFile(dbFile, []byte("MAC\tIP\tTable\n"), 0644)
+
+	const macA, macC = "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:03"
+	hosts := mockHostProvider{{IP: "1", MAC: macA}}
+	kernel := make(DummyRuleProvider)
+	rp := NewRulePersistence(kernel, hosts, dbFile)
+	rp.SetScheduleFile(scheduleFile)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+
+	assert.Equal(ErrInvalidSchedule, rp.SetSchedule(Schedule{Name: "x", MAC: macA, Group: "kids", Table: "vpn"}))
+	assert.Equal(ErrInvalidSchedule, rp.SetSchedule(Schedule{Name: "x", MAC: macA}), "No table")
+	assert.Equal(ErrUnknownSchedule, rp.DeleteSchedule("x"))
+
+	sched := NewScheduler(rp, hosts)
+	now := at(0, "12:00")
+	sched.now = func() time.Time { return now }
+	assert.Nil(sched.SetSchedule(Schedule{Name: "bed", MAC: "AA:BB:CC:DD:EE:01", Days: schoolNights, Start: 22 * 60, End: 7 * 60, Table: "null", Else: "defgw"}))
+	assert.Nil(sched.SetSchedule(Schedule{Name: "offline", MAC: macC, Start: 8 * 60, End: 9 * 60, Table: "vpn"}))
+
+	sched.Apply()
+	assert.Equal(DummyRuleProvider{"1": "defgw"}, kernel)
+
+	now = at(2, "22:30")
+	sched.Apply()
+	assert.Equal(DummyRuleProvider{"1": "null"}, kernel)
+	assert.Equal("null", rp.Policy()[macA], "Scheduled tables are saved")
+
+	// Manual changes are kept until the next transition
+	assert.Nil(rp.Set("1", "vpn"))
+	now = at(2, "22:31")
+	sched.Apply()
+	assert.Equal(DummyRuleProvider{"1": "vpn"}, kernel)
+
+	next, ok := sched.Next(macA, "")
+	assert.True(ok)
+	assert.Equal(ScheduledChange{Time: at(3, "07:00"), Table: "defgw"}, next)
+	_, ok = sched.Next("aa:bb:cc:dd:ee:02", "")
+	assert.False(ok)
+
+	// Reload from file
+	kernel2 := make(DummyRuleProvider)
+	rp2 := NewRulePersistence(kernel2, hosts, dbFile)
+	rp2.SetScheduleFile(scheduleFile)
+	if err := rp2.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	assert.Equal(rp.Schedules(), rp2.Schedules())
+	assert.Equal(map[string]string{"bed": "null"}, rp2.scheduleApplied)
+
+	// Manual changes survive a restart too
+	sched2 := NewScheduler(rp2, hosts)
+	sched2.now = sched.now
+	sched2.Apply()
+	assert.Equal(DummyRuleProvider{"1": "vpn"}, kernel2)
+
+	// Changed schedules are applied again
+	assert.Nil(sched.SetSchedule(Schedule{Name: "bed", MAC: macA, Days: schoolNights, Start: 22 * 60, End: 7 * 60, Table: "null"}))
+	sched.Apply()
+	assert.Equal(DummyRuleProvider{"1": "null"}, kernel)
+
+	// Group schedules set the group table
+	assert.Nil(sched.DeleteSchedule("bed"))
+	assert.Nil(rp.SetGroup(Group{Name: "kids", MACs: []string{macA}}))
+	assert.Nil(sched.SetSchedule(Schedule{Name: "kids", Group: "kids", Table: "null"}))
+	sched.Apply()
+	assert.Equal([]Group{{Name: "kids", MACs: []string{macA}, Table: "null"}}, rp.Groups())
+	assert.Equal(DummyRuleProvider{"1": "null"}, kernel)
+	next, ok = sched.Next("aa:bb:cc:dd:ee:09", "kids")
+	assert.False(ok, "Schedule never ends")
+}
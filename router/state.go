@@ -0,0 +1,679 @@
+package router
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StateVersion is the version of the State documents written by this version.
+const StateVersion = 1
+
+// State is the routing state of an installation, exported to back it up
+// or move it to new hardware.
+type State struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	// Tables of the config, for reference only
+	Tables    []StateTable    `json:"tables"`
+	Names     []StateName     `json:"names"`
+	Routes    []StateRoute    `json:"routes"`
+	Groups    []StateGroup    `json:"groups"`
+	Schedules []StateSchedule `json:"schedules"`
+	// Missing in documents of older versions, importing them leaves the
+	// current exceptions and domain policies untouched
+	Exceptions []StateException `json:"exceptions"`
+	Domains    []StateDomain    `json:"domains"`
+}
+
+type StateTable struct {
+	Name string `json:"name"`
+	Text string `json:"text,omitempty"`
+}
+
+// StateName is a static name of a device.
+type StateName struct {
+	MAC  string `json:"mac"`
+	Name string `json:"name"`
+}
+
+// StateRoute is the saved table of a device.
+type StateRoute struct {
+	MAC string `json:"mac"`
+	// Last known addresses
+	IPs   []string `json:"ips,omitempty"`
+	Table string   `json:"table"`
+	// Temporary tables are reverted to Previous after Expires
+	Expires  *time.Time `json:"expires,omitempty"`
+	Previous string     `json:"previous,omitempty"`
+}
+
+type StateGroup struct {
+	Name  string   `json:"name"`
+	MACs  []string `json:"macs"`
+	Table string   `json:"table,omitempty"`
+}
+
+type StateSchedule struct {
+	Name  string   `json:"name"`
+	MAC   string   `json:"mac,omitempty"`
+	Group string   `json:"group,omitempty"`
+	Days  []string `json:"days,omitempty"`
+	Start string   `json:"start"`
+	End   string   `json:"end"`
+	Table string   `json:"table"`
+	Else  string   `json:"else,omitempty"`
+}
+
+// StateException is a split tunnelling exception of a device or a group.
+type StateException struct {
+	MAC   string `json:"mac,omitempty"`
+	Group string `json:"group,omitempty"`
+	To    string `json:"to"`
+	Proto string `json:"proto,omitempty"`
+	Port  uint16 `json:"port,omitempty"`
+	Table string `json:"table"`
+}
+
+// StateDomain is a domain policy.
+type StateDomain struct {
+	Domain string `json:"domain"`
+	Table  string `json:"table"`
+}
+
+// InvalidStateError is returned for states which can not be imported.
+type InvalidStateError struct {
+	Reason string
+}
+
+func (e *InvalidStateError) Error() string {
+	return "invalid state: " + e.Reason
+}
+
+func invalidState(format string, args ...interface{}) error {
+	return &InvalidStateError{Reason: fmt.Sprintf(format, args...)}
+}
+
+// NormalizeState validates s and returns it with lower case MACs, sorted like an export.
+func NormalizeState(s State) (State, error) {
+	if s.Version != StateVersion {
+		return s, invalidState("unsupported version %d", s.Version)
+	}
+	names := make([]StateName, 0, len(s.Names))
+	seen := make(map[string]bool)
+	for _, n := range s.Names {
+		hw, err := net.ParseMAC(n.MAC)
+		if err != nil || n.Name == "" || strings.ContainsAny(n.Name, " \t\n") {
+			return s, invalidState("name %q of %q", n.Name, n.MAC)
+		}
+		if seen[hw.String()] {
+			return s, invalidState("duplicate name of %s", hw)
+		}
+		seen[hw.String()] = true
+		names = append(names, StateName{MAC: hw.String(), Name: n.Name})
+	}
+	sort.Sort(namesByMAC(names))
+
+	routes := make([]StateRoute, 0, len(s.Routes))
+	seen = make(map[string]bool)
+	for _, rt := range s.Routes {
+		hw, err := net.ParseMAC(rt.MAC)
+		if err != nil || rt.Table == "" || strings.ContainsAny(rt.Table+rt.Previous, " \t\n") {
+			return s, invalidState("route of %q", rt.MAC)
+		}
+		for _, ip := range rt.IPs {
+			if net.ParseIP(ip) == nil {
+				return s, invalidState("address %q of %s", ip, hw)
+			}
+		}
+		if seen[hw.String()] {
+			return s, invalidState("duplicate route of %s", hw)
+		}
+		seen[hw.String()] = true
+		rt.MAC = hw.String()
+		if rt.Expires == nil {
+			rt.Previous = ""
+		}
+		routes = append(routes, rt)
+	}
+	sort.Sort(routesByMAC(routes))
+
+	groups := make(map[string]Group)
+	for _, sg := range s.Groups {
+		g, err := normalizeGroup(Group{Name: sg.Name, MACs: sg.MACs, Table: sg.Table})
+		if err != nil {
+			return s, invalidState("group %q", sg.Name)
+		}
+		if _, ok := groups[g.Name]; ok {
+			return s, invalidState("duplicate group %s", g.Name)
+		}
+		for _, mac := range g.MACs {
+			if other, found := groupByMAC(groups, mac); found {
+				return s, invalidState("%s is member of %s and %s", mac, other.Name, g.Name)
+			}
+		}
+		groups[g.Name] = g
+	}
+
+	schedules := make(map[string]Schedule)
+	for _, ss := range s.Schedules {
+		sched, err := parseSchedule([]string{ss.Name, ss.MAC, ss.Group, strings.Join(ss.Days, ","), ss.Start, ss.End, ss.Table, ss.Else})
+		if err != nil {
+			return s, invalidState("schedule %q", ss.Name)
+		}
+		if _, ok := schedules[sched.Name]; ok {
+			return s, invalidState("duplicate schedule %s", sched.Name)
+		}
+		if _, ok := groups[sched.Group]; sched.Group != "" && !ok {
+			return s, invalidState("schedule %s of unknown group %s", sched.Name, sched.Group)
+		}
+		schedules[sched.Name] = sched
+	}
+
+	if s.Exceptions != nil {
+		hostExceptions := make(map[string][]Rule)
+		groupExceptions := make(map[string][]Rule)
+		for _, se := range s.Exceptions {
+			e := Rule{To: se.To, Proto: se.Proto, Port: se.Port, Table: se.Table}
+			switch {
+			case se.MAC != "" && se.Group == "":
+				hw, err := net.ParseMAC(se.MAC)
+				if err != nil {
+					return s, invalidState("exception of %q", se.MAC)
+				}
+				hostExceptions[hw.String()] = append(hostExceptions[hw.String()], e)
+			case se.Group != "" && se.MAC == "":
+				if _, ok := groups[se.Group]; !ok {
+					return s, invalidState("exception of unknown group %s", se.Group)
+				}
+				groupExceptions[se.Group] = append(groupExceptions[se.Group], e)
+			default:
+				return s, invalidState("exception to %q without device or group", se.To)
+			}
+		}
+		for _, m := range []map[string][]Rule{hostExceptions, groupExceptions} {
+			for owner, es := range m {
+				es, err := normalizeExceptions(es)
+				if err != nil {
+					return s, invalidState("exception of %s", owner)
+				}
+				m[owner] = es
+			}
+		}
+		s.Exceptions = stateExceptions(hostExceptions, groupExceptions)
+	}
+
+	if s.Domains != nil {
+		policies := make(map[string]DomainPolicy)
+		for _, sd := range s.Domains {
+			p, err := normalizeDomainPolicy(DomainPolicy{Domain: sd.Domain, Table: sd.Table})
+			if err != nil {
+				return s, invalidState("domain policy of %q", sd.Domain)
+			}
+			if _, ok := policies[p.Domain]; ok {
+				return s, invalidState("duplicate domain policy of %s", p.Domain)
+			}
+			policies[p.Domain] = p
+		}
+		s.Domains = stateDomains(policies)
+	}
+
+	s.Names = names
+	s.Routes = routes
+	s.Groups = stateGroups(groups)
+	s.Schedules = stateSchedules(schedules)
+	return s, nil
+}
+
+type namesByMAC []StateName
+
+func (a namesByMAC) Len() int           { return len(a) }
+func (a namesByMAC) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a namesByMAC) Less(i, j int) bool { return a[i].MAC < a[j].MAC }
+
+type routesByMAC []StateRoute
+
+func (a routesByMAC) Len() int           { return len(a) }
+func (a routesByMAC) Swap(i, j int)      { a[i], a[j] = a[j], a[i] }
+func (a routesByMAC) Less(i, j int) bool { return a[i].MAC < a[j].MAC }
+
+// UsedTables returns the tables referenced by the routes, groups, schedules,
+// exceptions and domain policies.
+func (s State) UsedTables() []string {
+	var tables []string
+	for _, rt := range s.Routes {
+		tables = appendMissing(tables, rt.Table)
+		if rt.Previous != "" {
+			tables = appendMissing(tables, rt.Previous)
+		}
+	}
+	for _, g := range s.Groups {
+		if g.Table != "" {
+			tables = appendMissing(tables, g.Table)
+		}
+	}
+	for _, sched := range s.Schedules {
+		tables = appendMissing(tables, sched.Table)
+		if sched.Else != "" {
+			tables = appendMissing(tables, sched.Else)
+		}
+	}
+	for _, e := range s.Exceptions {
+		tables = appendMissing(tables, e.Table)
+	}
+	for _, d := range s.Domains {
+		tables = appendMissing(tables, d.Table)
+	}
+	sort.Strings(tables)
+	return tables
+}
+
+func stateGroups(groups map[string]Group) []StateGroup {
+	sorted := make([]Group, 0, len(groups))
+	for _, g := range groups {
+		sorted = append(sorted, g)
+	}
+	sort.Sort(groupsByName(sorted))
+	sgs := make([]StateGroup, 0, len(sorted))
+	for _, g := range sorted {
+		macs := g.MACs
+		if macs == nil {
+			macs = []string{}
+		}
+		sgs = append(sgs, StateGroup{Name: g.Name, MACs: macs, Table: g.Table})
+	}
+	return sgs
+}
+
+func stateSchedules(schedules map[string]Schedule) []StateSchedule {
+	sorted := make([]Schedule, 0, len(schedules))
+	for _, s := range schedules {
+		sorted = append(sorted, s)
+	}
+	sort.Sort(schedulesByName(sorted))
+	sss := make([]StateSchedule, 0, len(sorted))
+	for _, s := range sorted {
+		ss := StateSchedule{
+			Name:  s.Name,
+			MAC:   s.MAC,
+			Group: s.Group,
+			Start: s.Start.String(),
+			End:   s.End.String(),
+			Table: s.Table,
+			Else:  s.Else,
+		}
+		for _, d := range s.Days {
+			ss.Days = append(ss.Days, WeekdayName(d))
+		}
+		sss = append(sss, ss)
+	}
+	return sss
+}
+
+// stateExceptions returns the exceptions of hosts and groups, the hosts first.
+func stateExceptions(hostExceptions, groupExceptions map[string][]Rule) []StateException {
+	ses := []StateException{}
+	for _, owners := range []struct {
+		m     map[string][]Rule
+		group bool
+	}{{hostExceptions, false}, {groupExceptions, true}} {
+		var keys []string
+		for k := range owners.m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			for _, e := range owners.m[k] {
+				se := StateException{MAC: k, To: e.To, Proto: e.Proto, Port: e.Port, Table: e.Table}
+				if owners.group {
+					se.MAC, se.Group = "", k
+				}
+				ses = append(ses, se)
+			}
+		}
+	}
+	return ses
+}
+
+func stateDomains(policies map[string]DomainPolicy) []StateDomain {
+	sorted := make([]DomainPolicy, 0, len(policies))
+	for _, p := range policies {
+		sorted = append(sorted, p)
+	}
+	sort.Sort(policiesByDomain(sorted))
+	sds := make([]StateDomain, 0, len(sorted))
+	for _, p := range sorted {
+		sds = append(sds, StateDomain{Domain: p.Domain, Table: p.Table})
+	}
+	return sds
+}
+
+// StateManager exports and restores the state saved by a RulePersistence
+// together with the static names and the domain policies.
+type StateManager struct {
+	persistence *RulePersistence
+	names       *StaticNameProvider
+	domains     *DomainRouter
+}
+
+func NewStateManager(persistence *RulePersistence, names *StaticNameProvider) *StateManager {
+	return &StateManager{
+		persistence: persistence,
+		names:       names,
+	}
+}
+
+// SetDomainRouter includes the domain policies of d in the state.
+func (m *StateManager) SetDomainRouter(d *DomainRouter) {
+	m.domains = d
+}
+
+// State returns the current state, its tables are left to the caller.
+func (m *StateManager) State() (State, error) {
+	s := State{
+		Version: StateVersion,
+		Time:    time.Now(),
+		Tables:  []StateTable{},
+	}
+	hosts, err := m.names.Hosts()
+	if err != nil && !os.IsNotExist(err) {
+		return s, err
+	}
+	for _, h := range hosts {
+		s.Names = append(s.Names, StateName{MAC: h.MAC, Name: h.Name})
+	}
+	s.Routes, s.Groups, s.Schedules, s.Exceptions = m.persistence.state()
+	s.Domains = []StateDomain{}
+	if m.domains != nil {
+		s.Domains = m.domains.state()
+	}
+	return NormalizeState(s)
+}
+
+// Restore replaces the static names, routes, groups, schedules, exceptions
+// and domain policies with those of s. The tables of s are ignored.
+func (m *StateManager) Restore(s State) error {
+	s, err := NormalizeState(s)
+	if err != nil {
+		return err
+	}
+	if m.domains != nil && s.Domains != nil {
+		if err := m.domains.restore(s.Domains); err != nil {
+			return err
+		}
+	} else if len(s.Domains) > 0 {
+		return invalidState("domain policies without domain routing")
+	}
+	if err := m.persistence.restore(s); err != nil {
+		return err
+	}
+	names := make([]Host, 0, len(s.Names))
+	for _, n := range s.Names {
+		names = append(names, Host{MAC: n.MAC, Name: n.Name})
+	}
+	return m.names.SetNames(names)
+}
+
+// StateChange is a difference of two states, Old is empty for added
+// entries and New for removed ones.
+type StateChange struct {
+	Kind string `json:"kind"`
+	Key  string `json:"key"`
+	Old  string `json:"old,omitempty"`
+	New  string `json:"new,omitempty"`
+}
+
+func (c StateChange) String() string {
+	switch {
+	case c.Old == "":
+		return fmt.Sprintf("+ %s %s: %s", c.Kind, c.Key, c.New)
+	case c.New == "":
+		return fmt.Sprintf("- %s %s: %s", c.Kind, c.Key, c.Old)
+	}
+	return fmt.Sprintf("~ %s %s: %s -> %s", c.Kind, c.Key, c.Old, c.New)
+}
+
+// DiffState returns the changes from old to s, both must be normalized.
+// Tables are left out as part of the config, so are the addresses of
+// routes which differ on new hardware.
+func DiffState(old, s State) []StateChange {
+	var changes []StateChange
+	diff := func(kind string, a, b map[string]string) {
+		var keys []string
+		for k := range a {
+			keys = append(keys, k)
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			if a[k] != b[k] {
+				changes = append(changes, StateChange{Kind: kind, Key: k, Old: a[k], New: b[k]})
+			}
+		}
+	}
+	diff("name", describeNames(old), describeNames(s))
+	diff("route", describeRoutes(old), describeRoutes(s))
+	diff("group", describeGroups(old), describeGroups(s))
+	diff("schedule", describeSchedules(old), describeSchedules(s))
+	// Sections missing in s are left untouched
+	if s.Exceptions != nil {
+		diff("exception", describeExceptions(old), describeExceptions(s))
+	}
+	if s.Domains != nil {
+		diff("domain", describeDomains(old), describeDomains(s))
+	}
+	return changes
+}
+
+func describeNames(s State) map[string]string {
+	m := make(map[string]string)
+	for _, n := range s.Names {
+		m[n.MAC] = n.Name
+	}
+	return m
+}
+
+func describeRoutes(s State) map[string]string {
+	m := make(map[string]string)
+	for _, rt := range s.Routes {
+		m[rt.MAC] = rt.Table
+		if rt.Expires != nil {
+			prev := rt.Previous
+			if prev == "" {
+				prev = noTable
+			}
+			m[rt.MAC] = fmt.Sprintf("%s until %s, then %s", rt.Table, rt.Expires.Format(time.RFC3339), prev)
+		}
+	}
+	return m
+}
+
+func describeGroups(s State) map[string]string {
+	m := make(map[string]string)
+	for _, g := range s.Groups {
+		table := g.Table
+		if table == "" {
+			table = noTable
+		}
+		m[g.Name] = fmt.Sprintf("%s [%s]", table, strings.Join(g.MACs, " "))
+	}
+	return m
+}
+
+func describeSchedules(s State) map[string]string {
+	m := make(map[string]string)
+	for _, sched := range s.Schedules {
+		target := sched.MAC
+		if sched.Group != "" {
+			target = "group " + sched.Group
+		}
+		days := "daily"
+		if len(sched.Days) > 0 {
+			days = strings.Join(sched.Days, ",")
+		}
+		d := fmt.Sprintf("%s %s %s-%s %s", target, days, sched.Start, sched.End, sched.Table)
+		if sched.Else != "" {
+			d += " else " + sched.Else
+		}
+		m[sched.Name] = d
+	}
+	return m
+}
+
+func describeExceptions(s State) map[string]string {
+	m := make(map[string]string)
+	for _, e := range s.Exceptions {
+		key := e.MAC
+		if e.Group != "" {
+			key = "group " + e.Group
+		}
+		d := e.To
+		if e.Proto != "" {
+			d += " " + e.Proto
+		}
+		if e.Port != 0 {
+			d += fmt.Sprintf(" %d", e.Port)
+		}
+		d += " via " + e.Table
+		if m[key] != "" {
+			d = m[key] + ", " + d
+		}
+		m[key] = d
+	}
+	return m
+}
+
+func describeDomains(s State) map[string]string {
+	m := make(map[string]string)
+	for _, d := range s.Domains {
+		m[d.Domain] = d.Table
+	}
+	return m
+}
+
+// state returns the saved routes, groups, schedules and exceptions.
+func (r *RulePersistence) state() ([]StateRoute, []StateGroup, []StateSchedule, []StateException) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	routes := make([]StateRoute, 0, len(r.db))
+	for mac, rule := range r.db {
+		rt := StateRoute{MAC: mac, IPs: rule.IPs, Table: rule.Table}
+		if !rule.Expires.IsZero() {
+			expires := rule.Expires
+			rt.Expires = &expires
+			rt.Previous = rule.Prev
+		}
+		routes = append(routes, rt)
+	}
+	return routes, stateGroups(r.groups), stateSchedules(r.schedules), stateExceptions(r.hostExceptions, r.groupExceptions)
+}
+
+// restore replaces the saved routes, groups, schedules and exceptions, if
+// given, with those of the normalized state s. The routes are applied to the current addresses of
+// known hosts, the others get their rules once they show up.
+func (r *RulePersistence) restore(s State) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return err
+	}
+	db := make(map[string]persRule)
+	var changes []Rule
+	for _, rt := range s.Routes {
+		rule := persRule{IPs: rt.IPs, Table: rt.Table, Prev: rt.Previous}
+		if rt.Expires != nil {
+			rule.Expires = *rt.Expires
+		}
+		if h, found := hostByMAC(hosts, rt.MAC); found && len(h.Addrs()) > 0 {
+			rule.IPs = h.Addrs()
+			for _, addr := range rule.IPs {
+				changes = append(changes, Rule{IP: addr, Table: rule.Table})
+			}
+		}
+		db[rt.MAC] = rule
+	}
+	// Rules of the hosts without a route in s are deleted
+	for mac, old := range r.db {
+		if _, ok := db[mac]; ok {
+			continue
+		}
+		addrs := old.IPs
+		if h, found := hostByMAC(hosts, mac); found {
+			addrs = appendMissing(h.Addrs(), old.IPs...)
+		}
+		for _, addr := range addrs {
+			changes = append(changes, Rule{IP: addr})
+		}
+	}
+	if err := SetBatch(r.base, changes); err != nil {
+		return err
+	}
+
+	r.db = db
+	r.groups = make(map[string]Group)
+	for _, sg := range s.Groups {
+		r.groups[sg.Name] = Group{Name: sg.Name, MACs: sg.MACs, Table: sg.Table}
+	}
+	old := r.schedules
+	r.schedules = make(map[string]Schedule)
+	for _, ss := range s.Schedules {
+		sched, _ := parseSchedule([]string{ss.Name, ss.MAC, ss.Group, strings.Join(ss.Days, ","), ss.Start, ss.End, ss.Table, ss.Else})
+		r.schedules[sched.Name] = sched
+	}
+	// Changed schedules are applied again
+	for name := range r.scheduleApplied {
+		if sched, ok := r.schedules[name]; !ok || !reflect.DeepEqual(sched, old[name]) {
+			delete(r.scheduleApplied, name)
+		}
+	}
+	if s.Exceptions != nil {
+		r.hostExceptions = make(map[string][]Rule)
+		r.groupExceptions = make(map[string][]Rule)
+		for _, se := range s.Exceptions {
+			e := Rule{To: se.To, Proto: se.Proto, Port: se.Port, Table: se.Table}
+			if se.Group != "" {
+				r.groupExceptions[se.Group] = append(r.groupExceptions[se.Group], e)
+			} else {
+				r.hostExceptions[se.MAC] = append(r.hostExceptions[se.MAC], e)
+			}
+		}
+	}
+	for name := range r.groupExceptions {
+		if _, ok := r.groups[name]; !ok {
+			delete(r.groupExceptions, name)
+		}
+	}
+
+	if r.store != nil {
+		err = updateStore("import", r.store, func(tx StoreTx) error {
+			for _, put := range []func(tx StoreTx) error{r.putRules, r.putGroups, r.putSchedules, r.putExceptions} {
+				if err := put(tx); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	} else {
+		for _, save := range []func() error{r.saveRulesToDB, r.saveGroups, r.saveSchedules, r.saveExceptions} {
+			if err = save(); err != nil {
+				break
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if r.exceptions == nil {
+		return nil
+	}
+	return r.applyExceptions(hosts)
+}
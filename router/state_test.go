@@ -0,0 +1,215 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNormalizeState(t *testing.T) {
+	assert := assert.New(t)
+	s, err := NormalizeState(State{
+		Version: StateVersion,
+		Names:   []StateName{{MAC: "AA:BB:CC:DD:EE:02", Name: "tv"}, {MAC: "aa:bb:cc:dd:ee:01", Name: "pc1"}},
+		Routes:  []StateRoute{{MAC: "AA:BB:CC:DD:EE:01", IPs: []string{"10.0.0.1"}, Table: "vpn", Previous: "null"}},
+		Groups:  []StateGroup{{Name: "kids", MACs: []string{"AA:BB:CC:DD:EE:02"}}},
+		Schedules: []StateSchedule{
+			{Name: "night", Group: "kids", Days: []string{"Mon"}, Start: "22:00", End: "07:00", Table: "null", Else: "defgw"},
+		},
+		Exceptions: []StateException{
+			{Group: "kids", To: "10.0.0.0/8", Table: "defgw"},
+			{MAC: "AA:BB:CC:DD:EE:01", To: "192.168.0.0/16", Proto: "tcp", Port: 443, Table: "null"},
+		},
+		Domains: []StateDomain{{Domain: "Example.COM.", Table: "tor"}},
+	})
+	assert.Nil(err)
+	assert.Equal([]StateName{{MAC: "aa:bb:cc:dd:ee:01", Name: "pc1"}, {MAC: "aa:bb:cc:dd:ee:02", Name: "tv"}}, s.Names)
+	assert.Equal([]StateRoute{{MAC: "aa:bb:cc:dd:ee:01", IPs: []string{"10.0.0.1"}, Table: "vpn"}}, s.Routes, "Previous only for temporary routes")
+	assert.Equal([]StateGroup{{Name: "kids", MACs: []string{"aa:bb:cc:dd:ee:02"}}}, s.Groups)
+	assert.Equal("mon", s.Schedules[0].Days[0])
+	assert.Equal([]StateException{
+		{MAC: "aa:bb:cc:dd:ee:01", To: "192.168.0.0/16", Proto: "tcp", Port: 443, Table: "null"},
+		{Group: "kids", To: "10.0.0.0/8", Table: "defgw"},
+	}, s.Exceptions, "Exceptions of hosts first")
+	assert.Equal([]StateDomain{{Domain: "example.com", Table: "tor"}}, s.Domains)
+	assert.Equal([]string{"defgw", "null", "tor", "vpn"}, s.UsedTables())
+
+	s, err = NormalizeState(State{Version: StateVersion})
+	assert.Nil(err)
+	assert.Nil(s.Exceptions, "Missing sections stay missing")
+	assert.Nil(s.Domains)
+
+	for _, invalid := range []State{
+		{Version: 2},
+		{Version: StateVersion, Names: []StateName{{MAC: "aa:bb:cc:dd:ee:01", Name: "my pc"}}},
+		{Version: StateVersion, Routes: []StateRoute{{MAC: "aa:bb:cc:dd:ee:01", IPs: []string{"x"}, Table: "vpn"}}},
+		{Version: StateVersion, Routes: []StateRoute{{MAC: "aa:bb:cc:dd:ee:01"}}},
+		{Version: StateVersion, Routes: []StateRoute{{MAC: "aa:bb:cc:dd:ee:01", Table: "vpn"}, {MAC: "AA:BB:CC:DD:EE:01", Table: "null"}}},
+		{Version: StateVersion, Groups: []StateGroup{{Name: "a", MACs: []string{"aa:bb:cc:dd:ee:01"}}, {Name: "b", MACs: []string{"aa:bb:cc:dd:ee:01"}}}},
+		{Version: StateVersion, Schedules: []StateSchedule{{Name: "night", Group: "kids", Start: "22:00", End: "07:00", Table: "null"}}},
+		{Version: StateVersion, Exceptions: []StateException{{Group: "kids", To: "10.0.0.0/8", Table: "defgw"}}},
+		{Version: StateVersion, Exceptions: []StateException{{To: "10.0.0.0/8", Table: "defgw"}}},
+		{Version: StateVersion, Exceptions: []StateException{{MAC: "aa:bb:cc:dd:ee:01", To: "x", Table: "defgw"}}},
+		{Version: StateVersion, Domains: []StateDomain{{Domain: "example..com", Table: "vpn"}}},
+		{Version: StateVersion, Domains: []StateDomain{{Domain: "example.com", Table: "vpn"}, {Domain: "EXAMPLE.com", Table: "null"}}},
+	} {
+		_, err := NormalizeState(invalid)
+		_, ok := err.(*InvalidStateError)
+		assert.True(ok, "%v: %v", invalid, err)
+	}
+}
+
+func TestDiffState(t *testing.T) {
+	assert := assert.New(t)
+	until := time.Date(2026, 10, 18, 20, 0, 0, 0, time.UTC)
+	old := State{
+		Tables: []StateTable{{Name: "vpn"}},
+		Names:  []StateName{{MAC: "a", Name: "pc1"}},
+		Routes: []StateRoute{{MAC: "a", IPs: []string{"10.0.0.1"}, Table: "vpn"}, {MAC: "b", Table: "null"}},
+		Groups: []StateGroup{{Name: "kids", MACs: []string{"b"}}},
+	}
+	s := State{
+		Names:     []StateName{{MAC: "a", Name: "pc2"}},
+		Routes:    []StateRoute{{MAC: "a", IPs: []string{"192.168.0.2"}, Table: "null", Expires: &until, Previous: "vpn"}},
+		Groups:    []StateGroup{{Name: "kids", MACs: []string{"b"}}},
+		Schedules: []StateSchedule{{Name: "night", MAC: "a", Start: "22:00", End: "07:00", Table: "null"}},
+	}
+	changes := DiffState(old, s)
+	assert.Equal([]StateChange{
+		{Kind: "name", Key: "a", Old: "pc1", New: "pc2"},
+		{Kind: "route", Key: "a", Old: "vpn", New: "null until 2026-10-18T20:00:00Z, then vpn"},
+		{Kind: "route", Key: "b", Old: "null"},
+		{Kind: "schedule", Key: "night", New: "a daily 22:00-07:00 null"},
+	}, changes)
+	assert.Equal("~ name a: pc1 -> pc2", changes[0].String())
+	assert.Equal("- route b: null", changes[2].String())
+	assert.Nil(DiffState(s, s))
+
+	old.Exceptions = []StateException{{MAC: "a", To: "10.0.0.0/8", Table: "defgw"}}
+	old.Domains = []StateDomain{{Domain: "example.com", Table: "vpn"}}
+	s = old
+	assert.Nil(DiffState(old, State{Names: old.Names, Routes: old.Routes, Groups: old.Groups}), "Missing sections left untouched")
+	s.Exceptions = []StateException{
+		{MAC: "a", To: "10.0.0.0/8", Table: "defgw"},
+		{MAC: "a", To: "192.168.0.0/16", Proto: "tcp", Port: 443, Table: "null"},
+		{Group: "kids", To: "10.0.0.0/8", Table: "vpn"},
+	}
+	s.Domains = []StateDomain{}
+	assert.Equal([]StateChange{
+		{Kind: "exception", Key: "a", Old: "10.0.0.0/8 via defgw", New: "10.0.0.0/8 via defgw, 192.168.0.0/16 tcp 443 via null"},
+		{Kind: "exception", Key: "group kids", New: "10.0.0.0/8 via vpn"},
+		{Kind: "domain", Key: "example.com", Old: "vpn"},
+	}, DiffState(old, s))
+}
+
+func TestStateManager(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	const macA, macB, macC = "aa:bb:cc:dd:ee:01", "aa:bb:cc:dd:ee:02", "aa:bb:cc:dd:ee:03"
+	dbFile := filepath.Join(dir, "db.txt")
+	nameFile := filepath.Join(dir, "names.txt")
+	ioutil.WriteFile(dbFile, []byte("MAC\tIP\tTable\n"+macA+"\t10.0.0.1\tvpn\n"+macB+"\t10.0.0.2\tdefgw\n"), 0644)
+	ioutil.WriteFile(nameFile, []byte("MAC\tName\n"+macA+"\tpc1\n"), 0644)
+	hosts := mockHostProvider{
+		{IP: "10.0.0.1", MAC: macA},
+		{IP: "10.0.0.2", MAC: macB},
+		{IP: "10.0.0.3", MAC: macC},
+	}
+	kernel := make(DummyRuleProvider)
+	exceptions := make(DummyExceptions)
+	rp := NewRulePersistence(kernel, hosts, dbFile)
+	rp.SetGroupFile(filepath.Join(dir, "groups.txt"))
+	rp.SetScheduleFile(filepath.Join(dir, "schedules.txt"))
+	rp.SetExceptionFile(filepath.Join(dir, "exceptions.txt"))
+	rp.SetExceptionProvider(exceptions)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	assert.Nil(rp.SetHostExceptions("10.0.0.2", []Rule{{To: "10.0.0.0/8", Table: "null"}}))
+	d, domainDir := newTestDomainRouter(t, &fakeCmds{})
+	defer os.RemoveAll(domainDir)
+	assert.Nil(d.SetDomainPolicy(DomainPolicy{Domain: "example.com", Table: "defgw"}))
+	m := NewStateManager(rp, NewStaticNameProvider(nameFile))
+	m.SetDomainRouter(d)
+
+	s, err := m.State()
+	assert.Nil(err)
+	assert.Equal(StateVersion, s.Version)
+	assert.Equal([]StateName{{MAC: macA, Name: "pc1"}}, s.Names)
+	assert.Equal([]StateRoute{
+		{MAC: macA, IPs: []string{"10.0.0.1"}, Table: "vpn"},
+		{MAC: macB, IPs: []string{"10.0.0.2"}, Table: "defgw"},
+	}, s.Routes)
+	assert.Equal([]StateGroup{}, s.Groups)
+	assert.Equal([]StateException{{MAC: macB, To: "10.0.0.0/8", Table: "null"}}, s.Exceptions)
+	assert.Equal([]StateDomain{{Domain: "example.com", Table: "defgw"}}, s.Domains)
+
+	// Restore a state of other hardware
+	s.Names = append(s.Names, StateName{MAC: macC, Name: "tv"})
+	s.Routes = []StateRoute{
+		{MAC: macA, IPs: []string{"192.168.0.1"}, Table: "null"},
+		{MAC: macC, IPs: []string{"192.168.0.3"}, Table: "vpn"},
+		// Offline host
+		{MAC: "aa:bb:cc:dd:ee:04", IPs: []string{"192.168.0.4"}, Table: "vpn"},
+	}
+	s.Groups = []StateGroup{{Name: "kids", MACs: []string{macC}, Table: "vpn"}}
+	s.Schedules = []StateSchedule{{Name: "night", Group: "kids", Start: "22:00", End: "07:00", Table: "null"}}
+	s.Exceptions = []StateException{{Group: "kids", To: "192.168.0.0/16", Table: "defgw"}}
+	s.Domains = []StateDomain{{Domain: "example.org", Table: "vpn"}}
+	assert.Nil(m.Restore(s))
+	assert.Equal(DummyExceptions{"10.0.0.3 192.168.0.0/16  0": {IP: "10.0.0.3", To: "192.168.0.0/16", Table: "defgw"}}, exceptions, "Exceptions replaced")
+	assert.Equal([]DomainPolicy{{Domain: "example.org", Table: "vpn"}}, d.DomainPolicies())
+	assert.Equal(DummyRuleProvider{"10.0.0.1": "null", "10.0.0.3": "vpn"}, kernel, "Rules of current addresses, the one of the removed route deleted")
+
+	restored, err := m.State()
+	assert.Nil(err)
+	assert.Equal([]StateName{{MAC: macA, Name: "pc1"}, {MAC: macC, Name: "tv"}}, restored.Names)
+	assert.Equal([]StateRoute{
+		{MAC: macA, IPs: []string{"10.0.0.1"}, Table: "null"},
+		{MAC: macC, IPs: []string{"10.0.0.3"}, Table: "vpn"},
+		{MAC: "aa:bb:cc:dd:ee:04", IPs: []string{"192.168.0.4"}, Table: "vpn"},
+	}, restored.Routes)
+	assert.Equal(s.Groups, restored.Groups)
+	assert.Len(restored.Schedules, 1)
+	assert.Equal(s.Exceptions, restored.Exceptions)
+	assert.Equal(s.Domains, restored.Domains)
+
+	// Documents without exceptions and domain policies keep them
+	assert.Nil(m.Restore(State{Version: StateVersion, Groups: s.Groups}))
+	kept, _ := m.State()
+	assert.Equal(s.Exceptions, kept.Exceptions)
+	assert.Equal(s.Domains, kept.Domains)
+	assert.Nil(m.Restore(restored))
+
+	// Saved to the files
+	rp2 := NewRulePersistence(make(DummyRuleProvider), hosts, dbFile)
+	rp2.SetGroupFile(filepath.Join(dir, "groups.txt"))
+	rp2.SetScheduleFile(filepath.Join(dir, "schedules.txt"))
+	rp2.SetExceptionFile(filepath.Join(dir, "exceptions.txt"))
+	if err := rp2.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	d2 := NewDomainRouter(d.tables, d.file)
+	d2.run = (&fakeCmds{}).run
+	if err := d2.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	m2 := NewStateManager(rp2, NewStaticNameProvider(nameFile))
+	m2.SetDomainRouter(d2)
+	again, _ := m2.State()
+	assert.Nil(DiffState(restored, again))
+
+	_, ok := NewStateManager(rp2, NewStaticNameProvider(nameFile)).Restore(restored).(*InvalidStateError)
+	assert.True(ok, "Domain policies without domain routing")
+
+	_, ok = m.Restore(State{Version: 2}).(*InvalidStateError)
+	assert.True(ok)
+}
@@ -2,6 +2,7 @@ package router
 
 import (
 	"bufio"
+	"bytes"
 	"io"
 	"os"
 	"strings"
@@ -45,3 +46,16 @@ func (s *StaticNameProvider) Hosts() ([]Host, error) {
 	}
 	return ls, nil
 }
+
+// SetNames replaces the names of the file by those of hosts.
+func (s *StaticNameProvider) SetNames(hosts []Host) error {
+	var buf bytes.Buffer
+	buf.WriteString("MAC\tName\n")
+	for _, h := range hosts {
+		buf.WriteString(h.MAC)
+		buf.WriteString("\t")
+		buf.WriteString(h.Name)
+		buf.WriteString("\n")
+	}
+	return writeFile("names", s.filename, buf.Bytes())
+}
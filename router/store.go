@@ -0,0 +1,114 @@
+package router
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// ErrStoreSchema is returned for stores written by a newer version.
+var ErrStoreSchema = errors.New("store schema not supported")
+
+// errStopIteration ends a ForEach early without an error.
+var errStopIteration = errors.New("stop iteration")
+
+// Store saves the state of the router. All changes made by one Update
+// are applied atomically.
+type Store interface {
+	View(fn func(tx StoreTx) error) error
+	Update(fn func(tx StoreTx) error) error
+	Close() error
+}
+
+// StoreTx reads and writes JSON encoded records in named buckets.
+// Buckets are created on first use.
+type StoreTx interface {
+	// Get decodes the record of key into v and returns false if it is missing
+	Get(bucket, key string, v interface{}) (bool, error)
+	Put(bucket, key string, v interface{}) error
+	Delete(bucket, key string) error
+	// ForEach calls fn for all records in the order of their keys,
+	// ForEachReverse in reverse order. Records must not be changed by fn.
+	ForEach(bucket string, fn func(key string, data []byte) error) error
+	ForEachReverse(bucket string, fn func(key string, data []byte) error) error
+	// Clear deletes all records of bucket
+	Clear(bucket string) error
+	// NextSequence returns an increasing number unique to bucket
+	NextSequence(bucket string) (uint64, error)
+}
+
+// Buckets of the store
+const (
+	storeMeta       = "meta"
+	storeRules      = "rules"
+	storeGroups     = "groups"
+	storeSchedules  = "schedules"
+	storeExceptions = "exceptions"
+	storeDomains    = "domains"
+	storeAudit      = "audit"
+)
+
+// storeSchema is the version of the records written by this version.
+const storeSchema = 1
+
+// storeMigrations[i] migrates the records of schema version i to i+1.
+var storeMigrations = []func(tx StoreTx) error{
+	// Empty store
+	func(tx StoreTx) error { return nil },
+}
+
+// MigrateStore upgrades the records of s to the current schema.
+func MigrateStore(s Store) error {
+	return s.Update(func(tx StoreTx) error {
+		var version int
+		if _, err := tx.Get(storeMeta, "schema", &version); err != nil {
+			return err
+		}
+		if version > storeSchema {
+			return fmt.Errorf("%s: version %d, supported %d", ErrStoreSchema, version, storeSchema)
+		}
+		if version == storeSchema {
+			return nil
+		}
+		for v := version; v < storeSchema; v++ {
+			if err := storeMigrations[v](tx); err != nil {
+				return fmt.Errorf("migrating store to version %d: %s", v+1, err)
+			}
+		}
+		log.Printf("Store: Migrated schema version %d to %d", version, storeSchema)
+		return tx.Put(storeMeta, "schema", storeSchema)
+	})
+}
+
+// storeImport records the import of the files of an older version.
+type storeImport struct {
+	Time  time.Time `json:"time"`
+	Files []string  `json:"files"`
+}
+
+// imported returns true if the files of name were imported into s before.
+func imported(s Store, name string) (bool, error) {
+	var found bool
+	err := s.View(func(tx StoreTx) error {
+		var err error
+		found, err = tx.Get(storeMeta, "import/"+name, &storeImport{})
+		return err
+	})
+	return found, err
+}
+
+// markImported records the import of files, so they are never imported again.
+func markImported(tx StoreTx, name string, files ...string) error {
+	log.Printf("Store: Imported %s from %v", name, files)
+	return tx.Put(storeMeta, "import/"+name, storeImport{Time: time.Now(), Files: files})
+}
+
+// updateStore runs fn in a transaction of s, failures are counted by kind.
+func updateStore(kind string, s Store, fn func(tx StoreTx) error) error {
+	err := s.Update(fn)
+	if err != nil {
+		persistenceWriteFailures.Inc(kind)
+	}
+	return err
+}
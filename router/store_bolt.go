@@ -0,0 +1,126 @@
+package router
+
+import (
+	"encoding/json"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// BoltStore is a Store in a single bolt database file.
+type BoltStore struct {
+	db *bolt.DB
+}
+
+// OpenBoltStore opens or creates the database file and migrates it to the current schema.
+func OpenBoltStore(file string) (*BoltStore, error) {
+	db, err := bolt.Open(file, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	s := &BoltStore{db: db}
+	if err := MigrateStore(s); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+func (s *BoltStore) View(fn func(tx StoreTx) error) error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *BoltStore) Update(fn func(tx StoreTx) error) error {
+	return s.db.Update(func(tx *bolt.Tx) error {
+		return fn(boltTx{tx})
+	})
+}
+
+func (s *BoltStore) Close() error {
+	return s.db.Close()
+}
+
+type boltTx struct {
+	tx *bolt.Tx
+}
+
+// bucket returns the bucket of name, nil if it is missing in a read-only transaction.
+func (t boltTx) bucket(name string) (*bolt.Bucket, error) {
+	if !t.tx.Writable() {
+		return t.tx.Bucket([]byte(name)), nil
+	}
+	return t.tx.CreateBucketIfNotExists([]byte(name))
+}
+
+func (t boltTx) Get(bucket, key string, v interface{}) (bool, error) {
+	b, err := t.bucket(bucket)
+	if b == nil || err != nil {
+		return false, err
+	}
+	data := b.Get([]byte(key))
+	if data == nil {
+		return false, nil
+	}
+	return true, json.Unmarshal(data, v)
+}
+
+func (t boltTx) Put(bucket, key string, v interface{}) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return b.Put([]byte(key), data)
+}
+
+func (t boltTx) Delete(bucket, key string) error {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return err
+	}
+	return b.Delete([]byte(key))
+}
+
+func (t boltTx) ForEach(bucket string, fn func(key string, data []byte) error) error {
+	b, err := t.bucket(bucket)
+	if b == nil || err != nil {
+		return err
+	}
+	return b.ForEach(func(k, v []byte) error {
+		return fn(string(k), v)
+	})
+}
+
+func (t boltTx) ForEachReverse(bucket string, fn func(key string, data []byte) error) error {
+	b, err := t.bucket(bucket)
+	if b == nil || err != nil {
+		return err
+	}
+	c := b.Cursor()
+	for k, v := c.Last(); k != nil; k, v = c.Prev() {
+		if err := fn(string(k), v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (t boltTx) Clear(bucket string) error {
+	if t.tx.Bucket([]byte(bucket)) == nil {
+		return nil
+	}
+	return t.tx.DeleteBucket([]byte(bucket))
+}
+
+func (t boltTx) NextSequence(bucket string) (uint64, error) {
+	b, err := t.bucket(bucket)
+	if err != nil {
+		return 0, err
+	}
+	return b.NextSequence()
+}
@@ -0,0 +1,104 @@
+package router
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tempStore opens a BoltStore in a new directory, removed by the returned func.
+func tempStore(t *testing.T) (*BoltStore, string, func()) {
+	dir, err := ioutil.TempDir("", "store")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	file := filepath.Join(dir, "vpnrouter.db")
+	s, err := OpenBoltStore(file)
+	if err != nil {
+		os.RemoveAll(dir)
+		t.Fatalf("Error: %s", err)
+	}
+	return s, file, func() {
+		s.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	assert := assert.New(t)
+	s, file, cleanup := tempStore(t)
+	defer cleanup()
+
+	// Reading missing buckets is no error
+	err := s.View(func(tx StoreTx) error {
+		var v string
+		found, err := tx.Get("b", "x", &v)
+		assert.False(found)
+		return err
+	})
+	assert.Nil(err)
+
+	err = s.Update(func(tx StoreTx) error {
+		for _, k := range []string{"b", "a", "c"} {
+			if err := tx.Put("b", k, ruleRecord{Table: k}); err != nil {
+				return err
+			}
+		}
+		seq, err := tx.NextSequence("b")
+		assert.Equal(uint64(1), seq)
+		return err
+	})
+	assert.Nil(err)
+
+	// Failed updates change nothing
+	err = s.Update(func(tx StoreTx) error {
+		tx.Delete("b", "a")
+		tx.Put("b", "d", ruleRecord{})
+		return errors.New("failed")
+	})
+	assert.EqualError(err, "failed")
+
+	var keys, reverse []string
+	err = s.View(func(tx StoreTx) error {
+		var rec ruleRecord
+		found, err := tx.Get("b", "b", &rec)
+		assert.True(found)
+		assert.Equal("b", rec.Table)
+		tx.ForEach("b", func(key string, data []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+		tx.ForEachReverse("b", func(key string, data []byte) error {
+			reverse = append(reverse, key)
+			return errStopIteration
+		})
+		return err
+	})
+	assert.Nil(err)
+	assert.Equal([]string{"a", "b", "c"}, keys)
+	assert.Equal([]string{"c"}, reverse)
+
+	assert.Nil(s.Update(func(tx StoreTx) error {
+		return tx.Clear("b")
+	}))
+	keys = nil
+	s.View(func(tx StoreTx) error {
+		return tx.ForEach("b", func(key string, data []byte) error {
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	assert.Nil(keys)
+
+	// Stores of newer versions are refused
+	assert.Nil(s.Update(func(tx StoreTx) error {
+		return tx.Put(storeMeta, "schema", storeSchema+1)
+	}))
+	s.Close()
+	_, err = OpenBoltStore(file)
+	assert.Error(err)
+}
@@ -0,0 +1,21 @@
+package router
+
+// TableRoute is the default route of a table managed by vpnrouter.
+type TableRoute struct {
+	Table string
+	// Next hop, without one the route points to the device, e.g. of a WireGuard tunnel
+	Gateway string
+	Device  string
+}
+
+// TableStatus describes the routes found in a table.
+type TableStatus struct {
+	// The table has routes besides its kill switch
+	Populated bool
+	// The table has a default route over an interface which is up
+	Usable bool
+	// The default route is installed by vpnrouter
+	Managed bool
+	// Error of the last attempt to install the default route
+	Err string
+}
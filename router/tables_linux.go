@@ -0,0 +1,297 @@
+package router
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Metric of the default routes of managed tables, the kernel uses it for
+// IPv6 routes without metric anyway
+const tableRouteMetric = 1024
+
+// Route flag and multicast groups of rtnetlink, see linux/rtnetlink.h
+const (
+	rtnhFLinkdown = 0x10
+
+	rtmgrpLink       = 0x1
+	rtmgrpIPv4Ifaddr = 0x10
+	rtmgrpIPv6Ifaddr = 0x100
+)
+
+// TableManager installs the default routes of managed tables via netlink.
+// The kernel removes routes whose interface goes down or is deleted, so
+// they are restored on every sync.
+type TableManager struct {
+	IPv6 bool
+
+	tables  *RouteTables
+	routes  []TableRoute
+	seq     uint32
+	trigger chan struct{}
+
+	mu sync.Mutex
+	// Last sync error of each managed table
+	errs map[string]error
+}
+
+func NewTableManager(tables *RouteTables, routes []TableRoute) *TableManager {
+	return &TableManager{
+		tables:  tables,
+		routes:  routes,
+		trigger: make(chan struct{}, 1),
+		errs:    make(map[string]error),
+	}
+}
+
+func (m *TableManager) families() []uint8 {
+	if m.IPv6 {
+		return []uint8{syscall.AF_INET, syscall.AF_INET6}
+	}
+	return []uint8{syscall.AF_INET}
+}
+
+// desired returns the default routes of tr, one per family without gateway.
+func (m *TableManager) desired(tr TableRoute) ([]route, error) {
+	id, ok := m.tables.ID(tr.Table)
+	if !ok {
+		return nil, ErrUnknownTable
+	}
+	var oif uint32
+	if tr.Device != "" {
+		iface, err := net.InterfaceByName(tr.Device)
+		if err != nil {
+			return nil, err
+		}
+		oif = uint32(iface.Index)
+	}
+	r := route{
+		Table:    id,
+		Protocol: syscall.RTPROT_STATIC,
+		Type:     syscall.RTN_UNICAST,
+		Priority: tableRouteMetric,
+		OIF:      oif,
+	}
+	if tr.Gateway != "" {
+		gw := net.ParseIP(tr.Gateway)
+		if gw == nil {
+			return nil, fmt.Errorf("invalid gateway %s", tr.Gateway)
+		}
+		r.Family, r.Gateway = syscall.AF_INET6, gw.String()
+		if gw.To4() != nil {
+			r.Family = syscall.AF_INET
+		}
+		return []route{r}, nil
+	}
+	var rs []route
+	for _, family := range m.families() {
+		r.Family, r.Scope = family, syscall.RT_SCOPE_UNIVERSE
+		if family == syscall.AF_INET {
+			// Like ip does for routes without gateway, IPv6 has no scopes
+			r.Scope = syscall.RT_SCOPE_LINK
+		}
+		rs = append(rs, r)
+	}
+	return rs, nil
+}
+
+// matches compares the attributes of a route set by TableManager, except its
+// protocol. The kernel fills in the device of routes over a gateway.
+func (r route) matches(want route) bool {
+	return r.Family == want.Family && r.DstLen == 0 && r.Table == want.Table && r.Scope == want.Scope &&
+		r.Type == want.Type && r.Priority == want.Priority && r.Gateway == want.Gateway &&
+		(want.OIF == 0 || r.OIF == want.OIF)
+}
+
+// dump returns the routes of table id in the given families.
+func (m *TableManager) dump(id uint32, families []uint8) ([]route, error) {
+	var rs []route
+	for _, family := range families {
+		msgs, err := netlinkRequest(&m.seq, syscall.RTM_GETROUTE, syscall.NLM_F_DUMP, route{Family: family}.encode())
+		if err != nil {
+			return nil, err
+		}
+		for _, msg := range msgs {
+			r, ok := parseRoute(msg.Data)
+			if msg.Header.Type == syscall.RTM_NEWROUTE && ok && r.Table == id {
+				rs = append(rs, r)
+			}
+		}
+	}
+	return rs, nil
+}
+
+// sync installs the default routes of tr and removes all other default routes
+// of their families but the kill switch. Returns true if anything changed.
+func (m *TableManager) sync(tr TableRoute) (bool, error) {
+	want, err := m.desired(tr)
+	if err != nil {
+		return false, &NetlinkError{Op: "route", Table: tr.Table, Err: err}
+	}
+	var families []uint8
+	for _, w := range want {
+		families = append(families, w.Family)
+	}
+	current, err := m.dump(want[0].Table, families)
+	if err != nil {
+		return false, &NetlinkError{Op: "route", Table: tr.Table, Err: err}
+	}
+	changed := false
+	installed := make([]bool, len(want))
+	for _, r := range current {
+		if r.DstLen != 0 || r.isKillSwitch() {
+			continue
+		}
+		if i := matchIndex(r, want); i >= 0 {
+			installed[i] = true
+			continue
+		}
+		if _, err := netlinkRequest(&m.seq, syscall.RTM_DELROUTE, syscall.NLM_F_ACK, r.encode()); err != nil {
+			return changed, &NetlinkError{Op: "route", Table: tr.Table, Err: err}
+		}
+		changed = true
+	}
+	for i, w := range want {
+		if installed[i] {
+			continue
+		}
+		flags := uint16(syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+		if _, err := netlinkRequest(&m.seq, syscall.RTM_NEWROUTE, flags, w.encode()); err != nil {
+			return changed, &NetlinkError{Op: "route", Table: tr.Table, Err: err}
+		}
+		changed = true
+	}
+	return changed, nil
+}
+
+// matchIndex returns the index of the first route of want matched by r, -1 if none.
+func matchIndex(r route, want []route) int {
+	for i, w := range want {
+		if r.matches(w) {
+			return i
+		}
+	}
+	return -1
+}
+
+// Sync installs the missing default routes of all managed tables.
+// All tables are synced, the first error is returned.
+func (m *TableManager) Sync() error {
+	var first error
+	for _, tr := range m.routes {
+		changed, err := m.sync(tr)
+		if changed {
+			log.Printf("Tables: Installed default route of table %s", tr.Table)
+		}
+		m.mu.Lock()
+		m.errs[tr.Table] = err
+		m.mu.Unlock()
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Watch triggers a sync whenever a link or address changes, to restore the
+// routes removed while an interface was down.
+func (m *TableManager) Watch() error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpLink | rtmgrpIPv4Ifaddr | rtmgrpIPv6Ifaddr,
+	}
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return err
+	}
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 32*1024)
+		for {
+			_, _, err := syscall.Recvfrom(fd, buf, 0)
+			if err == syscall.EINTR {
+				continue
+			}
+			// Missed notifications are caught by the next interval
+			if err != nil && err != syscall.ENOBUFS {
+				log.Printf("Tables/Error: %s", err)
+				return
+			}
+			m.Trigger()
+		}
+	}()
+	return nil
+}
+
+// Trigger requests a sync without waiting for the next interval.
+func (m *TableManager) Trigger() {
+	select {
+	case m.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Run syncs every interval and on every trigger until stop is closed.
+func (m *TableManager) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		case <-m.trigger:
+		}
+		if err := m.Sync(); err != nil {
+			log.Printf("Tables/Error: %s", err)
+		}
+	}
+}
+
+// TableStatus inspects the routes of any table, managed or not.
+func (m *TableManager) TableStatus(table string) (TableStatus, error) {
+	id, ok := m.tables.ID(table)
+	if !ok {
+		return TableStatus{}, &NetlinkError{Op: "route", Table: table, Err: ErrUnknownTable}
+	}
+	rs, err := m.dump(id, m.families())
+	if err != nil {
+		return TableStatus{}, &NetlinkError{Op: "route", Table: table, Err: err}
+	}
+	var status TableStatus
+	for _, r := range rs {
+		if r.isKillSwitch() {
+			continue
+		}
+		status.Populated = true
+		if r.DstLen == 0 && r.Type == syscall.RTN_UNICAST && r.Flags&rtnhFLinkdown == 0 && linkUp(r.OIF) {
+			status.Usable = true
+		}
+	}
+	for _, tr := range m.routes {
+		status.Managed = status.Managed || tr.Table == table
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.errs[table]; err != nil {
+		status.Err = err.Error()
+	}
+	return status, nil
+}
+
+// linkUp returns true if interface index is up. Multipath routes have
+// no single interface and count as up.
+func linkUp(index uint32) bool {
+	if index == 0 {
+		return true
+	}
+	iface, err := net.InterfaceByIndex(int(index))
+	return err == nil && iface.Flags&net.FlagUp != 0
+}
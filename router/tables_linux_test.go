@@ -0,0 +1,74 @@
+package router
+
+import (
+	"os/exec"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTableManager(t *testing.T) {
+	tables := NewRouteTables()
+	tables.Add("uplink", 100)
+	tables.Add("tunnel", 101)
+	tables.Add("other", 102)
+
+	inNetNS(t, func() {
+		assert := assert.New(t)
+		for _, args := range [][]string{
+			{"link", "add", "v0", "type", "veth", "peer", "name", "v1"},
+			{"link", "set", "v0", "up"},
+			{"link", "set", "v1", "up"},
+			{"addr", "add", "10.1.0.1/24", "dev", "v0"},
+			{"route", "add", "default", "via", "10.1.0.3", "table", "100"},
+		} {
+			if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+				t.Errorf("Could not set up veth pair: %s: %s", err, out)
+				return
+			}
+		}
+		show := func(table string) string {
+			out, err := exec.Command("ip", "route", "show", "table", table).CombinedOutput()
+			if err != nil {
+				t.Errorf("Error: %s: %s", err, out)
+			}
+			return strings.TrimSpace(string(out))
+		}
+
+		m := NewTableManager(tables, []TableRoute{
+			{Table: "uplink", Gateway: "10.1.0.2"},
+			{Table: "tunnel", Device: "v1"},
+		})
+		assert.Nil(m.Sync())
+		assert.Equal("default via 10.1.0.2 dev v0 proto static metric 1024", show("100"), "Replaces other default route")
+		assert.Equal("default dev v1 proto static scope link metric 1024", show("101"))
+
+		status, err := m.TableStatus("uplink")
+		assert.Nil(err)
+		assert.Equal(TableStatus{Populated: true, Usable: true, Managed: true}, status)
+		status, err = m.TableStatus("other")
+		assert.Nil(err)
+		assert.Equal(TableStatus{}, status)
+
+		// The kernel flushes the routes of interfaces going down
+		exec.Command("ip", "link", "set", "v1", "down").Run()
+		assert.Equal("", show("101"))
+		assert.NotNil(m.Sync(), "Device is down")
+		status, _ = m.TableStatus("tunnel")
+		assert.False(status.Populated)
+		assert.Contains(status.Err, "netlink route of table tunnel")
+
+		exec.Command("ip", "link", "set", "v1", "up").Run()
+		assert.Nil(m.Sync())
+		assert.Equal("default dev v1 proto static scope link metric 1024", show("101"))
+		status, _ = m.TableStatus("tunnel")
+		assert.Equal(TableStatus{Populated: true, Usable: true, Managed: true}, status)
+
+		// Kill switches are kept
+		ks := NewNetlinkRuleProvider(tables)
+		assert.Nil(ks.InstallKillSwitch("tunnel"))
+		assert.Nil(m.Sync())
+		assert.Equal("default dev v1 proto static scope link metric 1024 \nunreachable default proto static metric 4294967295", show("101"))
+	})
+}
@@ -0,0 +1,33 @@
+//go:build !linux
+// +build !linux
+
+package router
+
+import "time"
+
+// TableManager is only available on Linux, routes are never installed.
+type TableManager struct {
+	IPv6 bool
+}
+
+func NewTableManager(tables *RouteTables, routes []TableRoute) *TableManager {
+	return &TableManager{}
+}
+
+func (m *TableManager) Sync() error {
+	return errNetlinkUnsupported
+}
+
+func (m *TableManager) Watch() error {
+	return errNetlinkUnsupported
+}
+
+func (m *TableManager) Trigger() {}
+
+func (m *TableManager) Run(interval time.Duration, stop <-chan struct{}) {
+	<-stop
+}
+
+func (m *TableManager) TableStatus(table string) (TableStatus, error) {
+	return TableStatus{}, errNetlinkUnsupported
+}
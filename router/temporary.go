@@ -0,0 +1,102 @@
+package router
+
+import (
+	"errors"
+	"log"
+	"time"
+)
+
+var ErrNoTemporary = errors.New("temporary routes not supported")
+
+// noTable marks a missing previous table in the database
+const noTable = "-"
+
+// TemporaryRuleProvider sets rules which are reverted after a while.
+type TemporaryRuleProvider interface {
+	// SetUntil sets the table of ip until the given time
+	SetUntil(ip string, table string, until time.Time) error
+	// Expire reverts all rules expired at now and returns the next expiry, zero if none
+	Expire(now time.Time) (time.Time, error)
+	// Expiry returns the expiry of the rule of mac, zero if the rule is permanent
+	Expiry(mac string) time.Time
+}
+
+// Expire reverts the hosts with expired temporary rules to their previous table.
+// Hosts without a previous table fall back to their group or have no rule.
+func (r *RulePersistence) Expire(now time.Time) (time.Time, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hosts, err := r.hosts.Hosts()
+	if err != nil {
+		return time.Time{}, err
+	}
+	var next time.Time
+	var firstErr error
+	changed := false
+	for mac, rule := range r.db {
+		if rule.Expires.IsZero() {
+			continue
+		}
+		if rule.Expires.After(now) {
+			if next.IsZero() || rule.Expires.Before(next) {
+				next = rule.Expires
+			}
+			continue
+		}
+		addrs := rule.IPs
+		if h, found := hostByMAC(hosts, mac); found && len(h.Addrs()) > 0 {
+			addrs = appendMissing(h.Addrs(), rule.IPs...)
+		}
+		var changes []Rule
+		for _, addr := range addrs {
+			changes = append(changes, Rule{IP: addr, Table: rule.Prev})
+		}
+		entry := AuditEntry{Action: "expiry", MAC: mac, OldTable: rule.Table, NewTable: rule.Prev}
+		if len(addrs) > 0 {
+			entry.IP = addrs[0]
+		}
+		if err := SetBatch(r.base, changes); err != nil {
+			recordSystem(r.audit, "expiry", err, entry)
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		log.Printf("Persistence: Temporary table %s of %s expired, reverted to %q", rule.Table, mac, rule.Prev)
+		changed = true
+		change := &RouteChange{MAC: mac, Table: rule.Prev, By: "expiry"}
+		if len(addrs) > 0 {
+			change.IP = addrs[0]
+		}
+		if rule.Prev != "" {
+			r.db[mac] = persRule{IPs: rule.IPs, Table: rule.Prev}
+			recordSystem(r.audit, "expiry", nil, entry)
+			r.events.Publish(Event{Type: EventRouteChanged, Route: change})
+			continue
+		}
+		delete(r.db, mac)
+		var groupErr error
+		if g, member := groupByMAC(r.groups, mac); member && g.Table != "" {
+			groupErr = r.setMembersTable([]string{mac}, g.Table)
+			if groupErr != nil && firstErr == nil {
+				firstErr = groupErr
+			}
+			change.Group, change.Table = g.Name, g.Table
+			entry.Group, entry.NewTable = g.Name, g.Table
+		}
+		recordSystem(r.audit, "expiry", groupErr, entry)
+		r.events.Publish(Event{Type: EventRouteChanged, Route: change})
+	}
+	if changed {
+		if err := r.saveRulesToDB(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return next, firstErr
+}
+
+func (r *RulePersistence) Expiry(mac string) time.Time {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.db[mac].Expires
+}
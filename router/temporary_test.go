@@ -0,0 +1,122 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRulePersistenceTemporary(t *testing.T) {
+	file := tempDB(t, "MAC\tIP\tTable\nb\t2\tdefgw\n")
+	defer os.Remove(file)
+
+	hosts := mockHostProvider{
+		{IP: "1", MAC: "a"},
+		{IP: "2", MAC: "b"},
+	}
+	kernel := DummyRuleProvider{"2": "defgw"}
+	rp := NewRulePersistence(kernel, hosts, file)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+
+	t1 := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	t2 := t1.Add(time.Hour)
+	if err := rp.SetUntil("1", "vpn", t1); err != nil {
+		t.Fatalf("Error on set: %s", err)
+	}
+	if err := rp.SetUntil("2", "vpn", t1); err != nil {
+		t.Fatalf("Error on set: %s", err)
+	}
+	// Extending an override keeps the original table
+	if err := rp.SetUntil("2", "vpn2", t2); err != nil {
+		t.Fatalf("Error on set: %s", err)
+	}
+	if exp := (DummyRuleProvider{"1": "vpn", "2": "vpn2"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules: %v", kernel)
+	}
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	if str, exp := string(bs), "MAC\tIP\tTable\tExpires\tPrevious\n"+
+		"a\t1\tvpn\t2026-10-16T20:00:00Z\t-\n"+
+		"b\t2\tvpn2\t2026-10-16T21:00:00Z\tdefgw\n"; str != exp {
+		t.Errorf("Invalid file contents: %s", str)
+	}
+
+	// Expiries survive a restart
+	rp = NewRulePersistence(kernel, hosts, file)
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	if exp := t2; !rp.Expiry("b").Equal(exp) {
+		t.Errorf("Invalid expiry: %s", rp.Expiry("b"))
+	}
+
+	next, err := rp.Expire(t1.Add(-time.Minute))
+	if err != nil || !next.Equal(t1) {
+		t.Errorf("Expected next expiry %s, got %s, %v", t1, next, err)
+	}
+	next, err = rp.Expire(t1)
+	if err != nil || !next.Equal(t2) {
+		t.Errorf("Expected next expiry %s, got %s, %v", t2, next, err)
+	}
+	if exp := (DummyRuleProvider{"2": "vpn2"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules after first expiry: %v", kernel)
+	}
+	next, err = rp.Expire(t2)
+	if err != nil || !next.IsZero() {
+		t.Errorf("Expected no further expiry, got %s, %v", next, err)
+	}
+	if exp := (DummyRuleProvider{"2": "defgw"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules after expiry: %v", kernel)
+	}
+	if !rp.Expiry("b").IsZero() {
+		t.Errorf("Rule still temporary: %s", rp.Expiry("b"))
+	}
+	bs, err = ioutil.ReadFile(file)
+	if err != nil {
+		t.Fatalf("Error reading file: %s", err)
+	}
+	if str := string(bs); str != "MAC\tIP\tTable\tExpires\tPrevious\nb\t2\tdefgw\n" {
+		t.Errorf("Invalid file contents: %s", str)
+	}
+}
+
+func TestRulePersistenceTemporaryGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	dbFile := dir + "/db.txt"
+	ioutil.WriteFile(dbFile, []byte("MAC\tIP\tTable\n"), 0644)
+
+	hosts := mockHostProvider{{IP: "1", MAC: "00:00:00:00:00:01"}}
+	kernel := DummyRuleProvider{}
+	rp := NewRulePersistence(kernel, hosts, dbFile)
+	rp.SetGroupFile(dir + "/groups.txt")
+	if err := rp.Init(); err != nil {
+		t.Fatalf("Error on init: %s", err)
+	}
+	if err := rp.SetGroup(Group{Name: "kids", MACs: []string{"00:00:00:00:00:01"}, Table: "defgw"}); err != nil {
+		t.Fatalf("Error on group: %s", err)
+	}
+	until := time.Date(2026, 10, 16, 20, 0, 0, 0, time.UTC)
+	if err := rp.SetUntil("1", "vpn", until); err != nil {
+		t.Fatalf("Error on set: %s", err)
+	}
+	// Group changes replace the override
+	if err := rp.SetGroupTable("kids", "null"); err != nil {
+		t.Fatalf("Error on group table: %s", err)
+	}
+	if !rp.Expiry("00:00:00:00:00:01").IsZero() {
+		t.Errorf("Override kept after group change")
+	}
+	if exp := (DummyRuleProvider{"1": "null"}); !reflect.DeepEqual(kernel, exp) {
+		t.Errorf("Invalid rules: %v", kernel)
+	}
+}
@@ -0,0 +1,67 @@
+package router
+
+import (
+	"log"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// watchFiles calls fn whenever one of files is written or replaced.
+// The directories are watched, so files replaced by a rename are noticed too.
+func watchFiles(files []string, fn func()) error {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC)
+	if err != nil {
+		return err
+	}
+	watched := make(map[int32]map[string]struct{}) // watch descriptor to file names
+	for _, file := range files {
+		dir, name := filepath.Split(filepath.Clean(file))
+		if dir == "" {
+			dir = "."
+		}
+		wd, err := syscall.InotifyAddWatch(fd, dir, syscall.IN_CLOSE_WRITE|syscall.IN_MODIFY|syscall.IN_MOVED_TO|syscall.IN_CREATE)
+		if err != nil {
+			syscall.Close(fd)
+			return err
+		}
+		if watched[int32(wd)] == nil {
+			watched[int32(wd)] = make(map[string]struct{})
+		}
+		watched[int32(wd)][name] = struct{}{}
+	}
+
+	go func() {
+		defer syscall.Close(fd)
+		buf := make([]byte, 4096)
+		for {
+			n, err := syscall.Read(fd, buf)
+			if err == syscall.EINTR {
+				continue
+			}
+			if err != nil {
+				log.Printf("Watch/Error: %s", err)
+				return
+			}
+			changed := false
+			for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+				ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+				off += syscall.SizeofInotifyEvent
+				end := off + int(ev.Len)
+				if end > n {
+					break
+				}
+				name := strings.TrimRight(string(buf[off:end]), "\x00")
+				off = end
+				if _, ok := watched[ev.Wd][name]; ok {
+					changed = true
+				}
+			}
+			if changed {
+				fn()
+			}
+		}
+	}()
+	return nil
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package router
+
+import "errors"
+
+func watchFiles(files []string, fn func()) error {
+	return errors.New("watching files is not supported on this platform")
+}
@@ -0,0 +1,350 @@
+package router
+
+import (
+	"bufio"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrNoWireGuardDevice is returned for the state of a missing interface.
+var ErrNoWireGuardDevice = errors.New("no such wireguard interface")
+
+// A peer is alive if its last handshake is younger than this, WireGuard
+// rejects sessions older than 180 seconds and rekeys before
+const wireGuardAliveAge = 180 * time.Second
+
+// WireGuardKey is a Curve25519 key.
+type WireGuardKey [32]byte
+
+// ParseWireGuardKey parses a base64 encoded key as used by wg.
+func ParseWireGuardKey(s string) (WireGuardKey, error) {
+	var k WireGuardKey
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil || len(b) != len(k) {
+		return k, fmt.Errorf("invalid key %q", s)
+	}
+	copy(k[:], b)
+	return k, nil
+}
+
+func (k WireGuardKey) String() string {
+	return base64.StdEncoding.EncodeToString(k[:])
+}
+
+// IsZero returns true if the key is not set.
+func (k WireGuardKey) IsZero() bool {
+	return k == WireGuardKey{}
+}
+
+// WireGuardConfig is the configuration of a tunnel in the format of wg-quick.
+type WireGuardConfig struct {
+	PrivateKey WireGuardKey
+	ListenPort int
+	FwMark     uint32
+	// Addresses of the interface like "10.8.0.2/32"
+	Addresses []string
+	Peers     []WireGuardPeer
+}
+
+// WireGuardPeer is a peer of a tunnel.
+type WireGuardPeer struct {
+	PublicKey    WireGuardKey
+	PresharedKey WireGuardKey
+	// host:port, resolved whenever the tunnel is configured
+	Endpoint   string
+	AllowedIPs []string
+	// Seconds, 0 disables keepalives
+	PersistentKeepalive int
+}
+
+// Keys of wg-quick not used by vpnrouter, routes are managed by the table instead
+var wgQuickKeys = map[string]bool{
+	"dns": true, "mtu": true, "table": true, "saveconfig": true,
+	"preup": true, "postup": true, "predown": true, "postdown": true,
+}
+
+// ReadWireGuardConfig reads a config file of wg or wg-quick.
+func ReadWireGuardConfig(file string) (*WireGuardConfig, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseWireGuardConfig(f)
+}
+
+// ParseWireGuardConfig parses the [Interface] and [Peer] sections of a config.
+func ParseWireGuardConfig(r io.Reader) (*WireGuardConfig, error) {
+	c := &WireGuardConfig{}
+	var peer *WireGuardPeer
+	section := ""
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		line := sc.Text()
+		if i := strings.Index(line, "#"); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.ToLower(strings.TrimSpace(line[1 : len(line)-1]))
+			switch section {
+			case "interface":
+			case "peer":
+				c.Peers = append(c.Peers, WireGuardPeer{})
+				peer = &c.Peers[len(c.Peers)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown section %s", n, line)
+			}
+			continue
+		}
+		kv := strings.SplitN(line, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("line %d: invalid line %q", n, line)
+		}
+		key, value := strings.ToLower(strings.TrimSpace(kv[0])), strings.TrimSpace(kv[1])
+		var err error
+		switch {
+		case section == "interface" && key == "privatekey":
+			c.PrivateKey, err = ParseWireGuardKey(value)
+		case section == "interface" && key == "listenport":
+			c.ListenPort, err = strconv.Atoi(value)
+		case section == "interface" && key == "fwmark":
+			if value != "off" {
+				var mark uint64
+				mark, err = strconv.ParseUint(value, 0, 32)
+				c.FwMark = uint32(mark)
+			}
+		case section == "interface" && key == "address":
+			c.Addresses, err = appendPrefixes(c.Addresses, value)
+		case section == "interface" && wgQuickKeys[key]:
+		case section == "peer" && key == "publickey":
+			peer.PublicKey, err = ParseWireGuardKey(value)
+		case section == "peer" && key == "presharedkey":
+			peer.PresharedKey, err = ParseWireGuardKey(value)
+		case section == "peer" && key == "endpoint":
+			if _, _, err = net.SplitHostPort(value); err == nil {
+				peer.Endpoint = value
+			}
+		case section == "peer" && key == "allowedips":
+			peer.AllowedIPs, err = appendPrefixes(peer.AllowedIPs, value)
+		case section == "peer" && key == "persistentkeepalive":
+			if value != "off" {
+				peer.PersistentKeepalive, err = strconv.Atoi(value)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: unknown key %s", n, kv[0])
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", n, err)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return nil, err
+	}
+	if c.PrivateKey.IsZero() {
+		return nil, errors.New("no private key")
+	}
+	for i, p := range c.Peers {
+		if p.PublicKey.IsZero() {
+			return nil, fmt.Errorf("peer %d: no public key", i+1)
+		}
+	}
+	return c, nil
+}
+
+// appendPrefixes appends the comma separated prefixes of value, addresses
+// without length get the length of a single address.
+func appendPrefixes(prefixes []string, value string) ([]string, error) {
+	for _, s := range strings.Split(value, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %s", s)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			s = fmt.Sprintf("%s/%d", s, bits)
+		}
+		if _, _, err := net.ParseCIDR(s); err != nil {
+			return nil, err
+		}
+		prefixes = append(prefixes, s)
+	}
+	return prefixes, nil
+}
+
+// WireGuardDevice is the state of a WireGuard interface.
+type WireGuardDevice struct {
+	PublicKey  WireGuardKey
+	ListenPort int
+	Peers      []WireGuardPeerState
+}
+
+// WireGuardPeerState is the state of a peer of an interface.
+type WireGuardPeerState struct {
+	PublicKey WireGuardKey
+	Endpoint  string
+	// Zero if there was no handshake yet
+	LastHandshake time.Time
+	RxBytes       uint64
+	TxBytes       uint64
+}
+
+// Alive returns true if the peer had a recent handshake at now.
+func (p WireGuardPeerState) Alive(now time.Time) bool {
+	return !p.LastHandshake.IsZero() && now.Sub(p.LastHandshake) < wireGuardAliveAge
+}
+
+// WireGuardClient configures the WireGuard interfaces of the kernel.
+type WireGuardClient interface {
+	// Configure creates the interface if missing, replaces its configuration
+	// and peers and brings it up
+	Configure(iface string, c *WireGuardConfig) error
+	Device(iface string) (WireGuardDevice, error)
+}
+
+// WireGuardTunnel binds a WireGuard interface configured by a file to a table.
+type WireGuardTunnel struct {
+	Table      string
+	Interface  string
+	ConfigFile string
+}
+
+// WireGuardTunnelState is the state of a tunnel.
+type WireGuardTunnelState struct {
+	WireGuardTunnel
+	Device WireGuardDevice
+	// Error of the last configuration or state query
+	Err string
+}
+
+// WireGuardManager configures the interfaces of tunnels from their config files.
+// An interface is only reconfigured if it vanished or its file changed, as
+// replacing the peers of a running tunnel drops its sessions.
+type WireGuardManager struct {
+	client  WireGuardClient
+	tunnels []WireGuardTunnel
+
+	mu      sync.Mutex
+	applied map[string]*WireGuardConfig
+	errs    map[string]error
+}
+
+func NewWireGuardManager(client WireGuardClient, tunnels []WireGuardTunnel) *WireGuardManager {
+	return &WireGuardManager{
+		client:  client,
+		tunnels: tunnels,
+		applied: make(map[string]*WireGuardConfig),
+		errs:    make(map[string]error),
+	}
+}
+
+// Sync configures all tunnels which are missing or changed.
+// All tunnels are synced, the first error is returned.
+func (m *WireGuardManager) Sync() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var first error
+	for _, t := range m.tunnels {
+		err := m.sync(t)
+		m.errs[t.Interface] = err
+		if err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+func (m *WireGuardManager) sync(t WireGuardTunnel) error {
+	c, err := ReadWireGuardConfig(t.ConfigFile)
+	if err != nil {
+		return fmt.Errorf("wireguard %s: %s", t.Interface, err)
+	}
+	_, err = m.client.Device(t.Interface)
+	if err == nil && reflect.DeepEqual(c, m.applied[t.Interface]) {
+		return nil
+	}
+	if err := m.client.Configure(t.Interface, c); err != nil {
+		delete(m.applied, t.Interface)
+		return fmt.Errorf("wireguard %s: %s", t.Interface, err)
+	}
+	m.applied[t.Interface] = c
+	log.Printf("WireGuard: Configured %s of table %s", t.Interface, t.Table)
+	return nil
+}
+
+// Run syncs every interval until stop is closed.
+func (m *WireGuardManager) Run(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-t.C:
+		}
+		if err := m.Sync(); err != nil {
+			log.Printf("WireGuard/Error: %s", err)
+		}
+	}
+}
+
+// Tunnels returns the state of all tunnels.
+func (m *WireGuardManager) Tunnels() []WireGuardTunnelState {
+	states := make([]WireGuardTunnelState, len(m.tunnels))
+	for i, t := range m.tunnels {
+		states[i].WireGuardTunnel = t
+		dev, err := m.client.Device(t.Interface)
+		if err == nil {
+			states[i].Device = dev
+		}
+		m.mu.Lock()
+		if syncErr := m.errs[t.Interface]; syncErr != nil {
+			err = syncErr
+		}
+		m.mu.Unlock()
+		if err != nil {
+			states[i].Err = err.Error()
+		}
+	}
+	return states
+}
+
+// DummyWireGuard remembers the configured interfaces without any handshakes.
+type DummyWireGuard map[string]WireGuardDevice
+
+func (d DummyWireGuard) Configure(iface string, c *WireGuardConfig) error {
+	dev := WireGuardDevice{ListenPort: c.ListenPort}
+	for _, p := range c.Peers {
+		dev.Peers = append(dev.Peers, WireGuardPeerState{PublicKey: p.PublicKey, Endpoint: p.Endpoint})
+	}
+	d[iface] = dev
+	return nil
+}
+
+func (d DummyWireGuard) Device(iface string) (WireGuardDevice, error) {
+	dev, ok := d[iface]
+	if !ok {
+		return WireGuardDevice{}, ErrNoWireGuardDevice
+	}
+	return dev, nil
+}
@@ -0,0 +1,394 @@
+package router
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Generic netlink and WireGuard constants, see linux/genetlink.h and linux/wireguard.h
+const (
+	genlIDCtrl         = 0x10
+	ctrlCmdGetFamily   = 3
+	ctrlAttrFamilyID   = 1
+	ctrlAttrFamilyName = 2
+	sizeofGenlMsghdr   = 4
+
+	nlaFNested  = 0x8000
+	nlaTypeMask = 0x3fff
+
+	iflaInfoKind = 1
+
+	wgGenlName     = "wireguard"
+	wgGenlVersion  = 1
+	wgCmdGetDevice = 0
+	wgCmdSetDevice = 1
+
+	wgDeviceAIfname       = 2
+	wgDeviceAPrivateKey   = 3
+	wgDeviceAPublicKey    = 4
+	wgDeviceAFlags        = 5
+	wgDeviceAListenPort   = 6
+	wgDeviceAFwmark       = 7
+	wgDeviceAPeers        = 8
+	wgDeviceFReplacePeers = 1
+
+	wgPeerAPublicKey           = 1
+	wgPeerAPresharedKey        = 2
+	wgPeerAFlags               = 3
+	wgPeerAEndpoint            = 4
+	wgPeerAPersistentKeepalive = 5
+	wgPeerALastHandshakeTime   = 6
+	wgPeerARxBytes             = 7
+	wgPeerATxBytes             = 8
+	wgPeerAAllowedIPs          = 9
+	wgPeerFReplaceAllowedIPs   = 2
+
+	wgAllowedIPAFamily   = 1
+	wgAllowedIPAIPAddr   = 2
+	wgAllowedIPACidrMask = 3
+)
+
+// NetlinkWireGuard configures the WireGuard interfaces of the kernel via
+// generic netlink, like the wg tool does.
+type NetlinkWireGuard struct {
+	seq uint32
+
+	mu     sync.Mutex
+	family uint16
+}
+
+func NewNetlinkWireGuard() *NetlinkWireGuard {
+	return &NetlinkWireGuard{}
+}
+
+type nlAttr struct {
+	Type uint16
+	Data []byte
+}
+
+// parseAttrList returns the attributes of b in order, without the nested flag.
+// Unlike parseAttrs it keeps repeated types, as used by nested lists.
+func parseAttrList(b []byte) []nlAttr {
+	var attrs []nlAttr
+	for len(b) >= syscall.SizeofRtAttr {
+		l := int(nativeEndian.Uint16(b[0:2]))
+		if l < syscall.SizeofRtAttr || l > len(b) {
+			break
+		}
+		attrs = append(attrs, nlAttr{Type: nativeEndian.Uint16(b[2:4]) & nlaTypeMask, Data: b[syscall.SizeofRtAttr:l]})
+		l = rtaAlign(l)
+		if l > len(b) {
+			break
+		}
+		b = b[l:]
+	}
+	return attrs
+}
+
+func genlHeader(cmd uint8, version uint8) []byte {
+	return []byte{cmd, version, 0, 0}
+}
+
+func uint16Bytes(v uint16) []byte {
+	b := make([]byte, 2)
+	nativeEndian.PutUint16(b, v)
+	return b
+}
+
+// familyID resolves the generic netlink family of WireGuard once.
+func (w *NetlinkWireGuard) familyID() (uint16, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.family != 0 {
+		return w.family, nil
+	}
+	data := appendAttr(genlHeader(ctrlCmdGetFamily, 1), ctrlAttrFamilyName, []byte(wgGenlName+"\x00"))
+	msgs, err := netlinkProtoRequest(syscall.NETLINK_GENERIC, &w.seq, genlIDCtrl, 0, data)
+	if err == syscall.ENOENT {
+		return 0, errors.New("wireguard is not supported by the kernel")
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, m := range msgs {
+		if len(m.Data) < sizeofGenlMsghdr {
+			continue
+		}
+		for _, a := range parseAttrList(m.Data[sizeofGenlMsghdr:]) {
+			if a.Type == ctrlAttrFamilyID && len(a.Data) >= 2 {
+				w.family = nativeEndian.Uint16(a.Data)
+				return w.family, nil
+			}
+		}
+	}
+	return 0, errors.New("no wireguard family id")
+}
+
+func (w *NetlinkWireGuard) Configure(iface string, c *WireGuardConfig) error {
+	if err := w.createLink(iface); err != nil {
+		return fmt.Errorf("create link: %s", err)
+	}
+	data, err := encodeWireGuardDevice(iface, c)
+	if err != nil {
+		return err
+	}
+	family, err := w.familyID()
+	if err != nil {
+		return err
+	}
+	if _, err := netlinkProtoRequest(syscall.NETLINK_GENERIC, &w.seq, family, syscall.NLM_F_ACK, data); err != nil {
+		return fmt.Errorf("set device: %s", err)
+	}
+	link, err := net.InterfaceByName(iface)
+	if err != nil {
+		return err
+	}
+	current, err := link.Addrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range staleAddresses(current, c.Addresses) {
+		if err := w.changeAddress(syscall.RTM_DELADDR, syscall.NLM_F_ACK, link.Index, addr); err != nil {
+			return fmt.Errorf("delete address %s: %s", addr, err)
+		}
+	}
+	for _, addr := range c.Addresses {
+		flags := uint16(syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_REPLACE)
+		if err := w.changeAddress(syscall.RTM_NEWADDR, flags, link.Index, addr); err != nil {
+			return fmt.Errorf("add address %s: %s", addr, err)
+		}
+	}
+	if err := w.setUp(link.Index); err != nil {
+		return fmt.Errorf("set link up: %s", err)
+	}
+	return nil
+}
+
+func (w *NetlinkWireGuard) createLink(iface string) error {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b = appendAttr(b, syscall.IFLA_IFNAME, []byte(iface+"\x00"))
+	b = appendAttr(b, syscall.IFLA_LINKINFO|nlaFNested, appendAttr(nil, iflaInfoKind, []byte(wgGenlName)))
+	flags := uint16(syscall.NLM_F_ACK | syscall.NLM_F_CREATE | syscall.NLM_F_EXCL)
+	_, err := netlinkRequest(&w.seq, syscall.RTM_NEWLINK, flags, b)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	if err == syscall.EOPNOTSUPP {
+		return errors.New("wireguard is not supported by the kernel")
+	}
+	return err
+}
+
+func (w *NetlinkWireGuard) setUp(index int) error {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	nativeEndian.PutUint32(b[8:12], syscall.IFF_UP)
+	nativeEndian.PutUint32(b[12:16], syscall.IFF_UP)
+	_, err := netlinkRequest(&w.seq, syscall.RTM_NEWLINK, syscall.NLM_F_ACK, b)
+	return err
+}
+
+// staleAddresses returns the prefixes of the addresses of an interface which
+// are not in want, link-local addresses are kept.
+func staleAddresses(current []net.Addr, want []string) []string {
+	keep := make(map[string]bool, len(want))
+	for _, prefix := range want {
+		if ip, ipnet, err := net.ParseCIDR(prefix); err == nil {
+			ones, _ := ipnet.Mask.Size()
+			keep[fmt.Sprintf("%s/%d", ip, ones)] = true
+		}
+	}
+	var stale []string
+	for _, a := range current {
+		ipnet, ok := a.(*net.IPNet)
+		if !ok || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		ones, _ := ipnet.Mask.Size()
+		if prefix := fmt.Sprintf("%s/%d", ipnet.IP, ones); !keep[prefix] {
+			stale = append(stale, prefix)
+		}
+	}
+	return stale
+}
+
+// changeAddress adds or deletes the address prefix of the interface index.
+func (w *NetlinkWireGuard) changeAddress(msgType, flags uint16, index int, prefix string) error {
+	ip, ipnet, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return err
+	}
+	ones, _ := ipnet.Mask.Size()
+	family := uint8(syscall.AF_INET6)
+	if ip4 := ip.To4(); ip4 != nil {
+		family, ip = syscall.AF_INET, ip4
+	}
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = family
+	b[1] = uint8(ones)
+	nativeEndian.PutUint32(b[4:8], uint32(index))
+	b = appendAttr(b, syscall.IFA_LOCAL, ip)
+	b = appendAttr(b, syscall.IFA_ADDRESS, ip)
+	_, err = netlinkRequest(&w.seq, msgType, flags, b)
+	return err
+}
+
+// encodeWireGuardDevice returns the set device request for c, replacing all peers.
+// Endpoints are resolved.
+func encodeWireGuardDevice(iface string, c *WireGuardConfig) ([]byte, error) {
+	b := genlHeader(wgCmdSetDevice, wgGenlVersion)
+	b = appendAttr(b, wgDeviceAIfname, []byte(iface+"\x00"))
+	b = appendAttr(b, wgDeviceAPrivateKey, c.PrivateKey[:])
+	b = appendAttr(b, wgDeviceAFlags, uint32Bytes(wgDeviceFReplacePeers))
+	b = appendAttr(b, wgDeviceAListenPort, uint16Bytes(uint16(c.ListenPort)))
+	b = appendAttr(b, wgDeviceAFwmark, uint32Bytes(c.FwMark))
+	var peers []byte
+	for i, p := range c.Peers {
+		peer := appendAttr(nil, wgPeerAPublicKey, p.PublicKey[:])
+		peer = appendAttr(peer, wgPeerAPresharedKey, p.PresharedKey[:])
+		peer = appendAttr(peer, wgPeerAFlags, uint32Bytes(wgPeerFReplaceAllowedIPs))
+		if p.Endpoint != "" {
+			addr, err := net.ResolveUDPAddr("udp", p.Endpoint)
+			if err != nil {
+				return nil, err
+			}
+			peer = appendAttr(peer, wgPeerAEndpoint, encodeSockaddr(addr))
+		}
+		peer = appendAttr(peer, wgPeerAPersistentKeepalive, uint16Bytes(uint16(p.PersistentKeepalive)))
+		var allowed []byte
+		for j, prefix := range p.AllowedIPs {
+			ip, ipnet, err := net.ParseCIDR(prefix)
+			if err != nil {
+				return nil, err
+			}
+			ones, _ := ipnet.Mask.Size()
+			family := uint16(syscall.AF_INET6)
+			if ip4 := ip.To4(); ip4 != nil {
+				family, ip = syscall.AF_INET, ip4
+			}
+			a := appendAttr(nil, wgAllowedIPAFamily, uint16Bytes(family))
+			a = appendAttr(a, wgAllowedIPAIPAddr, ip)
+			a = appendAttr(a, wgAllowedIPACidrMask, []byte{uint8(ones)})
+			allowed = appendAttr(allowed, uint16(j)|nlaFNested, a)
+		}
+		peer = appendAttr(peer, wgPeerAAllowedIPs|nlaFNested, allowed)
+		peers = appendAttr(peers, uint16(i)|nlaFNested, peer)
+	}
+	return appendAttr(b, wgDeviceAPeers|nlaFNested, peers), nil
+}
+
+// encodeSockaddr returns addr as sockaddr_in or sockaddr_in6.
+func encodeSockaddr(addr *net.UDPAddr) []byte {
+	if ip4 := addr.IP.To4(); ip4 != nil {
+		b := make([]byte, syscall.SizeofSockaddrInet4)
+		nativeEndian.PutUint16(b[0:2], syscall.AF_INET)
+		binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+		copy(b[4:8], ip4)
+		return b
+	}
+	b := make([]byte, syscall.SizeofSockaddrInet6)
+	nativeEndian.PutUint16(b[0:2], syscall.AF_INET6)
+	binary.BigEndian.PutUint16(b[2:4], uint16(addr.Port))
+	copy(b[8:24], addr.IP.To16())
+	return b
+}
+
+func parseSockaddr(b []byte) string {
+	if len(b) < 4 {
+		return ""
+	}
+	port := int(binary.BigEndian.Uint16(b[2:4]))
+	switch nativeEndian.Uint16(b[0:2]) {
+	case syscall.AF_INET:
+		if len(b) >= 8 {
+			return net.JoinHostPort(net.IP(b[4:8]).String(), fmt.Sprint(port))
+		}
+	case syscall.AF_INET6:
+		if len(b) >= 24 {
+			return net.JoinHostPort(net.IP(b[8:24]).String(), fmt.Sprint(port))
+		}
+	}
+	return ""
+}
+
+func (w *NetlinkWireGuard) Device(iface string) (WireGuardDevice, error) {
+	family, err := w.familyID()
+	if err != nil {
+		return WireGuardDevice{}, err
+	}
+	data := appendAttr(genlHeader(wgCmdGetDevice, wgGenlVersion), wgDeviceAIfname, []byte(iface+"\x00"))
+	msgs, err := netlinkProtoRequest(syscall.NETLINK_GENERIC, &w.seq, family, syscall.NLM_F_DUMP, data)
+	if err == syscall.ENODEV {
+		return WireGuardDevice{}, ErrNoWireGuardDevice
+	}
+	if err != nil {
+		return WireGuardDevice{}, err
+	}
+	var parts [][]byte
+	for _, m := range msgs {
+		if len(m.Data) >= sizeofGenlMsghdr {
+			parts = append(parts, m.Data[sizeofGenlMsghdr:])
+		}
+	}
+	return parseWireGuardDevice(parts), nil
+}
+
+// parseWireGuardDevice parses the attributes of a device dump. The kernel splits
+// large devices into several messages, repeating a peer continued in the next one.
+func parseWireGuardDevice(parts [][]byte) WireGuardDevice {
+	var dev WireGuardDevice
+	for _, part := range parts {
+		for _, a := range parseAttrList(part) {
+			switch a.Type {
+			case wgDeviceAPublicKey:
+				copy(dev.PublicKey[:], a.Data)
+			case wgDeviceAListenPort:
+				if len(a.Data) >= 2 {
+					dev.ListenPort = int(nativeEndian.Uint16(a.Data))
+				}
+			case wgDeviceAPeers:
+				for _, p := range parseAttrList(a.Data) {
+					peer := parseWireGuardPeer(p.Data)
+					if n := len(dev.Peers); n > 0 && dev.Peers[n-1].PublicKey == peer.PublicKey {
+						continue
+					}
+					dev.Peers = append(dev.Peers, peer)
+				}
+			}
+		}
+	}
+	return dev
+}
+
+func parseWireGuardPeer(b []byte) WireGuardPeerState {
+	var p WireGuardPeerState
+	for _, a := range parseAttrList(b) {
+		switch a.Type {
+		case wgPeerAPublicKey:
+			copy(p.PublicKey[:], a.Data)
+		case wgPeerAEndpoint:
+			p.Endpoint = parseSockaddr(a.Data)
+		case wgPeerALastHandshakeTime:
+			if len(a.Data) >= 16 {
+				sec, nsec := int64(nativeEndian.Uint64(a.Data[0:8])), int64(nativeEndian.Uint64(a.Data[8:16]))
+				if sec != 0 || nsec != 0 {
+					p.LastHandshake = time.Unix(sec, nsec)
+				}
+			}
+		case wgPeerARxBytes:
+			if len(a.Data) >= 8 {
+				p.RxBytes = nativeEndian.Uint64(a.Data)
+			}
+		case wgPeerATxBytes:
+			if len(a.Data) >= 8 {
+				p.TxBytes = nativeEndian.Uint64(a.Data)
+			}
+		}
+	}
+	return p
+}
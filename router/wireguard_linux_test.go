@@ -0,0 +1,90 @@
+package router
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEncodeWireGuardDevice(t *testing.T) {
+	assert := assert.New(t)
+	c := &WireGuardConfig{
+		PrivateKey: mustKey(t, "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="),
+		ListenPort: 51820,
+		Peers: []WireGuardPeer{{
+			PublicKey:  mustKey(t, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="),
+			Endpoint:   "[2001:db8::1]:51820",
+			AllowedIPs: []string{"0.0.0.0/0", "fd00::/64"},
+		}},
+	}
+	b, err := encodeWireGuardDevice("wg0", c)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal([]byte{wgCmdSetDevice, wgGenlVersion, 0, 0}, b[:sizeofGenlMsghdr])
+	attrs := parseAttrList(b[sizeofGenlMsghdr:])
+	assert.Equal(6, len(attrs))
+	assert.Equal(nlAttr{Type: wgDeviceAIfname, Data: []byte("wg0\x00")}, attrs[0])
+	assert.Equal(c.PrivateKey[:], attrs[1].Data)
+	assert.Equal(uint32Bytes(wgDeviceFReplacePeers), attrs[2].Data)
+	assert.Equal(uint16Bytes(51820), attrs[3].Data)
+
+	// The peer list is read like a device dump, which shares the peer attributes
+	dev := parseWireGuardDevice([][]byte{b[sizeofGenlMsghdr:]})
+	assert.Equal(51820, dev.ListenPort)
+	assert.Equal([]WireGuardPeerState{{PublicKey: c.Peers[0].PublicKey, Endpoint: "[2001:db8::1]:51820"}}, dev.Peers)
+
+	peer := parseAttrList(parseAttrList(attrs[5].Data)[0].Data)
+	allowed := parseAttrList(peer[len(peer)-1].Data)
+	assert.Equal(2, len(allowed))
+	ip := parseAttrList(allowed[1].Data)
+	assert.Equal(uint16Bytes(syscall.AF_INET6), ip[0].Data)
+	assert.Equal([]byte{64}, ip[2].Data)
+}
+
+func TestParseWireGuardDevice(t *testing.T) {
+	assert := assert.New(t)
+	key := mustKey(t, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=")
+	handshake := make([]byte, 16)
+	nativeEndian.PutUint64(handshake[0:8], 1760788800)
+	rx := make([]byte, 8)
+	nativeEndian.PutUint64(rx, 4096)
+
+	peer := appendAttr(nil, wgPeerAPublicKey, key[:])
+	peer = appendAttr(peer, wgPeerAEndpoint, []byte{2, 0, 0xca, 0x6c, 192, 0, 2, 1, 0, 0, 0, 0, 0, 0, 0, 0})
+	peer = appendAttr(peer, wgPeerALastHandshakeTime, handshake)
+	peer = appendAttr(peer, wgPeerARxBytes, rx)
+	first := appendAttr(nil, wgDeviceAListenPort, uint16Bytes(51820))
+	first = appendAttr(first, wgDeviceAPeers|nlaFNested, appendAttr(nil, nlaFNested, peer))
+	// Continuation of the same peer with further allowed IPs
+	second := appendAttr(nil, wgDeviceAPeers|nlaFNested, appendAttr(nil, nlaFNested, appendAttr(nil, wgPeerAPublicKey, key[:])))
+
+	if nativeEndian.Uint16([]byte{2, 0}) != syscall.AF_INET {
+		t.Skip("Fixture is little endian")
+	}
+	dev := parseWireGuardDevice([][]byte{first, second})
+	assert.Equal(WireGuardDevice{
+		ListenPort: 51820,
+		Peers: []WireGuardPeerState{{
+			PublicKey:     key,
+			Endpoint:      "192.0.2.1:51820",
+			LastHandshake: time.Unix(1760788800, 0),
+			RxBytes:       4096,
+		}},
+	}, dev)
+}
+
+func TestStaleAddresses(t *testing.T) {
+	current := []net.Addr{
+		&net.IPNet{IP: net.ParseIP("10.0.0.2").To4(), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("10.0.1.2").To4(), Mask: net.CIDRMask(24, 32)},
+		&net.IPNet{IP: net.ParseIP("fd00::2"), Mask: net.CIDRMask(64, 128)},
+		&net.IPNet{IP: net.ParseIP("fe80::1"), Mask: net.CIDRMask(64, 128)},
+	}
+	stale := staleAddresses(current, []string{"10.0.0.2/24", "fd00::2/128"})
+	assert.Equal(t, []string{"10.0.1.2/24", "fd00::2/64"}, stale)
+	assert.Empty(t, staleAddresses(current[:1], []string{"10.0.0.2/24"}))
+}
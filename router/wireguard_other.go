@@ -0,0 +1,19 @@
+//go:build !linux
+// +build !linux
+
+package router
+
+// NetlinkWireGuard is only available on Linux, all operations fail.
+type NetlinkWireGuard struct{}
+
+func NewNetlinkWireGuard() *NetlinkWireGuard {
+	return &NetlinkWireGuard{}
+}
+
+func (w *NetlinkWireGuard) Configure(iface string, c *WireGuardConfig) error {
+	return errNetlinkUnsupported
+}
+
+func (w *NetlinkWireGuard) Device(iface string) (WireGuardDevice, error) {
+	return WireGuardDevice{}, errNetlinkUnsupported
+}
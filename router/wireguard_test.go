@@ -0,0 +1,122 @@
+package router
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const fixture_wireguard = `
+[Interface]
+# wg-quick settings are ignored
+PrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=
+ListenPort = 51820
+Address = 10.8.0.2/32, fd00::2
+DNS = 10.8.0.1
+PostUp = iptables -A FORWARD -i %i -j ACCEPT
+
+[Peer]
+PublicKey = xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=
+PresharedKey = gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA=
+Endpoint = 192.0.2.1:51820
+AllowedIPs = 0.0.0.0/0, ::/0
+PersistentKeepalive = 25
+
+[Peer]
+PublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=
+AllowedIPs = 10.9.0.0/24
+`
+
+func mustKey(t *testing.T, s string) WireGuardKey {
+	k, err := ParseWireGuardKey(s)
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	return k
+}
+
+func TestParseWireGuardConfig(t *testing.T) {
+	assert := assert.New(t)
+	c, err := ParseWireGuardConfig(strings.NewReader(fixture_wireguard))
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	assert.Equal(&WireGuardConfig{
+		PrivateKey: mustKey(t, "yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk="),
+		ListenPort: 51820,
+		Addresses:  []string{"10.8.0.2/32", "fd00::2/128"},
+		Peers: []WireGuardPeer{
+			{
+				PublicKey:           mustKey(t, "xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg="),
+				PresharedKey:        mustKey(t, "gN65BkIKy1eCE9pP1wdc8ROUtkHLF2PfAqYdyYBz6EA="),
+				Endpoint:            "192.0.2.1:51820",
+				AllowedIPs:          []string{"0.0.0.0/0", "::/0"},
+				PersistentKeepalive: 25,
+			},
+			{
+				PublicKey:  mustKey(t, "TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0="),
+				AllowedIPs: []string{"10.9.0.0/24"},
+			},
+		},
+	}, c)
+	assert.Equal("xTIBA5rboUvnH4htodjb6e697QjLERt1NAB4mZqp8Dg=", c.Peers[0].PublicKey.String())
+
+	for _, invalid := range []string{
+		"[Interface]\nListenPort = 1\n",
+		"[Interface]\nPrivateKey = abc\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n[Peer]\nAllowedIPs = 10.0.0.0/8\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\nUnknown = 1\n",
+		"[Interface]\nPrivateKey = yAnz5TF+lXXJte14tji3zlMNq+hd2rYUIgJBgB3fBmk=\n[Peer]\nPublicKey = TrMvSoP4jYQlY6RIzBgbssQqY3vxI2Pi+y71lOWWXX0=\nEndpoint = 192.0.2.1\n",
+	} {
+		_, err := ParseWireGuardConfig(strings.NewReader(invalid))
+		assert.NotNil(err, invalid)
+	}
+}
+
+func TestWireGuardManager(t *testing.T) {
+	assert := assert.New(t)
+	dir, err := ioutil.TempDir("", "")
+	if err != nil {
+		t.Fatalf("Error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	ioutil.WriteFile(dir+"/wg0.conf", []byte(fixture_wireguard), 0600)
+
+	client := DummyWireGuard{}
+	m := NewWireGuardManager(client, []WireGuardTunnel{
+		{Table: "vpn", Interface: "wg0", ConfigFile: dir + "/wg0.conf"},
+		{Table: "vpn2", Interface: "wg1", ConfigFile: dir + "/missing.conf"},
+	})
+	assert.NotNil(m.Sync(), "Missing config")
+	assert.Equal(2, len(client["wg0"].Peers))
+
+	// Running tunnels are kept
+	handshake := time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	client["wg0"].Peers[0].LastHandshake = handshake
+	client["wg0"].Peers[0].RxBytes = 1024
+	m.Sync()
+	assert.Equal(handshake, client["wg0"].Peers[0].LastHandshake)
+
+	states := m.Tunnels()
+	assert.Equal(2, len(states))
+	assert.Equal(WireGuardTunnel{Table: "vpn", Interface: "wg0", ConfigFile: dir + "/wg0.conf"}, states[0].WireGuardTunnel)
+	assert.Equal("", states[0].Err)
+	assert.Equal(uint64(1024), states[0].Device.Peers[0].RxBytes)
+	assert.Equal("192.0.2.1:51820", states[0].Device.Peers[0].Endpoint)
+	assert.True(states[0].Device.Peers[0].Alive(handshake.Add(time.Minute)))
+	assert.False(states[0].Device.Peers[0].Alive(handshake.Add(3*time.Minute)), "Handshake too old")
+	assert.False(states[0].Device.Peers[1].Alive(handshake), "No handshake")
+	assert.Contains(states[1].Err, "wireguard wg1")
+
+	// Vanished interfaces and changed configs are configured again
+	delete(client, "wg0")
+	m.Sync()
+	assert.Equal(2, len(client["wg0"].Peers))
+	ioutil.WriteFile(dir+"/wg0.conf", []byte(strings.SplitN(fixture_wireguard, "\n[Peer]", 3)[0]+"\n"), 0600)
+	m.Sync()
+	assert.Equal(0, len(client["wg0"].Peers))
+}
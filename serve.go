@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/blang/vpnrouter/api"
+	"github.com/blang/vpnrouter/config"
+	"github.com/zenazn/goji/graceful"
+)
+
+// shutdownTimeout bounds the wait for open requests on shutdown.
+const shutdownTimeout = 10 * time.Second
+
+// serve serves handler on all configured listeners until SIGINT or SIGTERM
+// and waits for open requests to finish, at most shutdownTimeout.
+func serve(cfg *config.Config, handler http.Handler) error {
+	l, err := net.Listen("tcp", cfg.Listen)
+	if err != nil {
+		return err
+	}
+	listeners := []net.Listener{l}
+	handlers := []http.Handler{handler}
+
+	if cfg.TLS.Enabled() {
+		tlsConfig, err := tlsConfig(cfg.TLS)
+		if err != nil {
+			return err
+		}
+		listeners[0] = tls.NewListener(l, tlsConfig)
+		if cfg.TLS.Redirect != "" {
+			rl, err := net.Listen("tcp", cfg.TLS.Redirect)
+			if err != nil {
+				return err
+			}
+			listeners = append(listeners, rl)
+			handlers = append(handlers, redirectHandler(cfg.Listen))
+		}
+	}
+
+	if cfg.Socket != "" {
+		// Remove the socket of a previous run
+		if fi, err := os.Stat(cfg.Socket); err == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(cfg.Socket)
+		}
+		ul, err := net.Listen("unix", cfg.Socket)
+		if err != nil {
+			return err
+		}
+		if err := os.Chmod(cfg.Socket, 0660); err != nil {
+			return err
+		}
+		listeners = append(listeners, ul)
+		handlers = append(handlers, api.LocalHandler(handler))
+	}
+
+	graceful.HandleSignals()
+	graceful.AddSignal(syscall.SIGTERM)
+	graceful.Timeout(shutdownTimeout)
+	graceful.PreHook(func() { log.Printf("Received signal, gracefully stopping") })
+	graceful.PostHook(func() { log.Printf("Stopped") })
+
+	errc := make(chan error, len(listeners))
+	for i, l := range listeners {
+		log.Printf("Listening on %s", l.Addr())
+		go func(l net.Listener, h http.Handler) {
+			errc <- graceful.Serve(l, h)
+		}(l, handlers[i])
+	}
+	// Servers return after their listener is closed on shutdown
+	for range listeners {
+		if err := <-errc; err != nil {
+			return err
+		}
+	}
+	graceful.Wait()
+	return nil
+}
+
+// redirectHandler redirects all requests to HTTPS on the port of listen.
+func redirectHandler(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+		if port != "" && port != "443" {
+			host = net.JoinHostPort(host, port)
+		} else if strings.Contains(host, ":") {
+			host = "[" + host + "]"
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+func tlsConfig(c config.TLS) (*tls.Config, error) {
+	var cert tls.Certificate
+	var err error
+	if c.SelfSigned {
+		cert, err = selfSignedCert(c.CertFile, c.KeyFile)
+	} else {
+		cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+// selfSignedCert loads the certificate from certFile and keyFile if they exist.
+// Otherwise a new certificate is generated and saved to the files if given.
+func selfSignedCert(certFile, keyFile string) (tls.Certificate, error) {
+	if certFile != "" {
+		if cert, err := tls.LoadX509KeyPair(certFile, keyFile); err == nil {
+			return cert, nil
+		} else if !os.IsNotExist(err) {
+			return tls.Certificate{}, err
+		}
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "vpnrouter"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(5 * 365 * 24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		DNSNames:              []string{"localhost"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+	}
+	if hostname, err := os.Hostname(); err == nil {
+		template.DNSNames = append(template.DNSNames, hostname)
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+
+	if certFile != "" {
+		log.Printf("Saving self-signed certificate to %s", certFile)
+		if err := ioutil.WriteFile(keyFile, keyPEM, 0600); err != nil {
+			return tls.Certificate{}, err
+		}
+		if err := ioutil.WriteFile(certFile, certPEM, 0644); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.X509KeyPair(certPEM, keyPEM)
+}
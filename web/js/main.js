@@ -89,6 +89,8 @@ angular.module('vpnrApp', ["ngFlash"])
     routeList.myRoute = null;
     routeList.routes = [];
     routeList.tables = [];
+    // Audit entries by MAC of the hosts with their history shown
+    routeList.history = {};
     var init = function() {
         var encoded = Base64.encode($location.hash());
         $http.defaults.headers.common['Authorization'] = 'Bearer ' + encoded;
@@ -101,6 +103,12 @@ angular.module('vpnrApp', ["ngFlash"])
         $http.get(endpoint+"/routes").success(function(data){
             preprocessData(data); 
         });
+        for (var key in routeList.history) {
+            loadHistory(key);
+        }
+    };
+    var isRequestHost = function(route, ip) {
+        return route.ip == ip || (route.ip6 && route.ip6.indexOf(ip) >= 0);
     };
     var preprocessData = function(data) {
         if (!data.data) {
@@ -109,7 +117,7 @@ angular.module('vpnrApp', ["ngFlash"])
         var ip = data["request-ip"];
         routeList.routes = new Array();
         for (i=0;i<data.data.length; i++) {
-            if (data.data[i].ip == ip) {
+            if (isRequestHost(data.data[i], ip)) {
                 routeList.myRoute = data.data[i]; 
             }else{
                 routeList.routes.push(data.data[i]);
@@ -117,6 +125,21 @@ angular.module('vpnrApp', ["ngFlash"])
         }
     };
     load();
+    // Reload on changes made elsewhere, reconcile runs only matter if they fixed something
+    if (window.EventSource) {
+        var events = new EventSource(endpoint+"/events?types=host-added,host-removed,route-changed,health-changed,reconciled");
+        var reload = function(e) {
+            var data = JSON.parse(e.data);
+            var r = data.reconcile;
+            if (r && !r.added && !r.moved && !r.removed && !r.killswitches) {
+                return;
+            }
+            $scope.$apply(load);
+        };
+        ["host-added", "host-removed", "route-changed", "health-changed", "reconciled"].forEach(function(t) {
+            events.addEventListener(t, reload);
+        });
+    }
     routeList.setRoute = function(ip, table) {
         $http.post(endpoint+"/routes", {data:{ip: ip, table: table}}).success(function(data){
             load();
@@ -126,6 +149,85 @@ angular.module('vpnrApp', ["ngFlash"])
         });
 
     };
+    routeList.exceptionText = function(e) {
+        var text = e.to;
+        if (e.proto) {
+            text += " " + e.proto;
+        }
+        if (e.port) {
+            text += ":" + e.port;
+        }
+        return text;
+    };
+    var ownExceptions = function(route) {
+        var exceptions = new Array();
+        var all = route.exceptions || [];
+        for (i=0; i<all.length; i++) {
+            if (!all[i].group) {
+                exceptions.push(all[i]);
+            }
+        }
+        return exceptions;
+    };
+    var setExceptions = function(ip, exceptions) {
+        $http.put(endpoint+"/routes/"+ip+"/exceptions", {data: exceptions}).success(function(data){
+            load();
+
+        }).error(function(data, status){
+            var msg = "<strong>Permission denied</strong>";
+            if (status == 400) {
+                msg = "<strong>Invalid exception</strong>";
+            }
+            Flash.create('danger', msg, 2000, {class: 'alert alert-danger navbar-alert', id:'navbar-alert'}, false); 
+        });
+    };
+    routeList.addException = function(route) {
+        var e = route.newException;
+        if (!e || !e.to || !e.table) {
+            return;
+        }
+        var exceptions = ownExceptions(route);
+        exceptions.push({to: e.to, proto: e.proto || "", port: (e.proto && e.port) || 0, table: e.table});
+        setExceptions(route.ip, exceptions);
+    };
+    routeList.removeException = function(route, e) {
+        var exceptions = ownExceptions(route);
+        exceptions.splice(exceptions.indexOf(e), 1);
+        setExceptions(route.ip, exceptions);
+    };
+    var hostKey = function(route) {
+        return route.mac || route.ip;
+    };
+    var loadHistory = function(key) {
+        $http.get(endpoint+"/audit", {params: {host: key, limit: 20}}).success(function(data){
+            if (routeList.history[key]) {
+                routeList.history[key] = data.data;
+            }
+        }).error(function(data, status){
+            delete routeList.history[key];
+            if (status != 401) {
+                Flash.create('danger', "<strong>Verlauf nicht verfügbar</strong>", 2000, {class: 'alert alert-danger navbar-alert', id:'navbar-alert'}, false); 
+            }
+        });
+    };
+    routeList.toggleHistory = function(route) {
+        var key = hostKey(route);
+        if (routeList.history[key]) {
+            delete routeList.history[key];
+            return;
+        }
+        routeList.history[key] = [];
+        loadHistory(key);
+    };
+    routeList.historyOf = function(route) {
+        return routeList.history[hostKey(route)];
+    };
+    routeList.auditBy = function(e) {
+        if (e.auth == "self") {
+            return e.client_ip;
+        }
+        return e.user || e.auth + " " + e.client_ip;
+    };
     routeList.tableClasses = [
         "btn-default",
         "btn-primary",
@@ -151,6 +253,9 @@ angular.module('vpnrApp', ["ngFlash"])
         }
         return routeList.tableClasses[0];
     };
+    routeList.labelClass = function(name) {
+        return routeList.tableClass(name).replace("btn-", "label-");
+    };
 
     routeList.missingTables = function(name) {
         tables = new Array(); 